@@ -0,0 +1,70 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+)
+
+// Declared returns true if the account (or, when parent is true, any
+// account beneath it) has been declared so far.
+func (this *TxScanner) Declared(account string, parent bool) bool {
+	account = strings.Trim(account, "[]()")
+	if this.account[account] {
+		return true
+	}
+	if parent {
+		for declared := range this.account {
+			if strings.HasPrefix(declared, account+":") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAccounts returns an error for each split which refers to an
+// account undeclared (by the data scanned).  It has no effect unless
+// strict.
+func (this *settings) checkAccounts(scanner *TxScanner, tx TxLines) (errs []error) {
+	if !this.strict {
+		return nil
+	}
+	_, payeeIndex := tx.Payee()
+	for i, line := range tx.Line[payeeIndex+1:] {
+		split, ok := this.parseSplit(line)
+		if !ok {
+			continue
+		}
+		if !scanner.Declared(split.account, false) {
+			errs = append(errs, lineErrorf(tx.Start+payeeIndex+1+i, "unknown account (%q)", split.account))
+		}
+	}
+	return errs
+}
+
+// checkQualifier returns an error if generated lot accounts would
+// refer to a qualifier which is not a declared account, i.e. because
+// of a typo in source data.  It has no effect unless strict.
+func (this *settings) checkQualifier(scanner *TxScanner, tx TxLines, qualifier string) error {
+	if !this.strict || qualifier == "" {
+		return nil
+	}
+	if !scanner.Declared(qualifier, true) {
+		return lineErrorf(tx.Start, "lot qualifier (%q) is not a declared account", qualifier)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// basisAdjustment is a change to the basis of open lots, i.e. a wash
+// sale loss disallowed and added to the basis of replacement shares,
+// as a broker reports it (see lot -basis-adjust).
+type basisAdjustment struct {
+	row       int       // of CSV
+	date      time.Time // of adjustment (i.e. of the wash sale)
+	asset     Asset
+	acquired  time.Time // of lots adjusted
+	qualifier string    // of lots adjusted, "" for any queue
+	amount    *big.Rat  // base currency added to basis
+}
+
+// loadBasisAdjustments reads adjustments (CSV), in order of date.
+// Columns are recognized by common names, as of compare-lots.
+func (this *settings) loadBasisAdjustments(r io.Reader) ([]basisAdjustment, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	column := csvColumns(header, map[string][]string{
+		"date":       {"date", "date sold", "sale date", "adjustment date"},
+		"asset":      {"symbol", "asset", "currency", "ticker", "coin"},
+		"acquired":   {"acquired", "date acquired", "open date", "acquisition date"},
+		"adjustment": {"adjustment", "basis adjustment", "wash sale loss disallowed", "wash sale"},
+		"account":    {"account"},
+	})
+	for _, key := range []string{"date", "asset", "acquired", "adjustment"} {
+		if _, ok := column[key]; !ok {
+			return nil, fmt.Errorf("CSV has no %s column (header %q)", key, header)
+		}
+	}
+	_, byAccount := column["account"]
+
+	var ret []basisAdjustment
+	for row := 2; ; row++ { // row 1 is header
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+		field := func(key string) string {
+			i := column[key]
+			if i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		day := func(key string) (time.Time, error) {
+			t, err := parseTimestamp(field(key))
+			if err != nil {
+				return t, fmt.Errorf("row %d: %w", row, err)
+			}
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+		adj := basisAdjustment{row: row, asset: Asset(field("asset"))}
+		adj.date, err = day("date")
+		if err != nil {
+			return nil, err
+		}
+		adj.acquired, err = day("acquired")
+		if err != nil {
+			return nil, err
+		}
+		if adj.acquired.After(adj.date) {
+			adj.date = adj.acquired // replacement bought after the sale
+		}
+		var ok bool
+		adj.amount, ok = new(big.Rat).SetString(strings.TrimLeft(strings.ReplaceAll(field("adjustment"), ",", ""), "$"))
+		if !ok {
+			return nil, fmt.Errorf("row %d: failed to parse adjustment (%q)", row, field("adjustment"))
+		}
+		if byAccount && field("account") != "" {
+			adj.qualifier = this.qualifier(field("account"))
+		}
+		ret = append(ret, adj)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].date.Before(ret[j].date) })
+	return ret, nil
+}
+
+// adjustBasis adds an adjustment to the basis of the open lots of its
+// asset and acquisition date, in proportion to inventory, and returns
+// splits recording it.  The adjustment is offset in account.  On
+// error, no lot is changed.
+func (this *lotter) adjustBasis(adj basisAdjustment, account string) ([]Posting, error) {
+	var match []*Lot
+	held := new(big.Rat)
+	var quals []string
+	for qual := range this.lotQueue[adj.asset] {
+		if adj.qualifier == "" || qual == adj.qualifier {
+			quals = append(quals, qual)
+			this.saveQueue(adj.asset, qual)
+		}
+	}
+	sort.Strings(quals)
+	for _, qual := range quals {
+		queue := this.lotQueue[adj.asset][qual]
+		for i := range queue.lot {
+			l := &queue.lot[i]
+			if l.inventory.Sign() > 0 && l.date.Equal(adj.acquired) {
+				match = append(match, l)
+				held.Add(held, l.inventory.Rat)
+			}
+		}
+	}
+	if len(match) == 0 {
+		return nil, fmt.Errorf("no open lot of %s acquired %s, to adjust basis (row %d)", adj.asset, adj.acquired.Format("2006/01/02"), adj.row)
+	}
+
+	var ret []Posting
+	price := make([]*big.Rat, len(match))
+	for i, l := range match {
+		share := new(big.Rat).Mul(adj.amount, new(big.Rat).Quo(l.inventory.Rat, held))
+		basis := new(big.Rat).Mul(l.price, l.inventory.Rat)
+		basis.Add(basis, share)
+		if basis.Sign() < 0 {
+			return nil, fmt.Errorf("adjustment (%s) of lot (%q) leaves negative basis (row %d)", this.NewAmount(this.base, *share), l.name, adj.row)
+		}
+		price[i] = basis.Quo(basis, l.inventory.Rat)
+		ret = append(ret, Posting{Account: l.name, Amount: this.NewAmount(this.base, *share), Comment: ":ADJUST: (basis)"})
+	}
+	for i, l := range match {
+		l.price = price[i] // a new price, as checkpoints share the old
+	}
+	for _, queue := range this.lotQueue[adj.asset] {
+		sort.Stable(queue) // i.e. by price, with hifo
+	}
+	ret = append(ret, Posting{Account: account, Amount: this.NewAmount(this.base, *new(big.Rat).Neg(adj.amount)), Comment: ":ADJUST:"})
+	return ret, nil
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadBasisAdjustments(t *testing.T) {
+	csv := `Date Sold,Symbol,Date Acquired,Wash Sale Loss Disallowed
+2021/03/01,ABC,2021/01/01,"$1,234.50"
+2021/02/01,XYZ,2021/02/15,10
+`
+	adjustments, err := newSettings().loadBasisAdjustments(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adjustments) != 2 {
+		t.Fatalf("%d adjustments, expected 2", len(adjustments))
+	}
+	// in order of date, which is the date acquired when later
+	expect := []struct {
+		row          int
+		asset        Asset
+		date, amount string
+	}{
+		{3, "XYZ", "2021/02/15", "10"},
+		{2, "ABC", "2021/03/01", "2469/2"},
+	}
+	for i, e := range expect {
+		adj := adjustments[i]
+		if adj.row != e.row || adj.asset != e.asset || adj.date.Format("2006/01/02") != e.date || adj.amount.RatString() != e.amount {
+			t.Errorf("adjustment %d is row %d, %s dated %s, %s; expected row %d, %s dated %s, %s", i, adj.row, adj.asset, adj.date.Format("2006/01/02"), adj.amount.RatString(), e.row, e.asset, e.date, e.amount)
+		}
+	}
+
+	_, err = newSettings().loadBasisAdjustments(strings.NewReader("Date,Symbol,Adjustment\n"))
+	if err == nil {
+		t.Error("expected error of CSV without date acquired")
+	}
+}
+
+// TestAdjustBasis adjusts two lots acquired the same day, in proportion
+// to inventory.  An adjustment leaving either lot with negative basis
+// must change neither.
+func TestAdjustBasis(t *testing.T) {
+	settings := newSettings()
+	acquired := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	queue := LotQueue{order: FIFO}
+	for i, buy := range [][2]int64{{1, 100}, {3, 30}} { // inventory, basis
+		lot, err := NewLot("Lot::"+string(rune('A'+i)), acquired, settings.NewAmount("ABC", *big.NewRat(buy[0], 1)), settings.NewAmount(settings.base, *big.NewRat(buy[1], 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = queue.Buy(*lot)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := &lotter{settings: settings, lotQueue: map[Asset]map[string]LotQueue{"ABC": {"": queue}}}
+	price := func() (ret []string) {
+		for _, lot := range l.lotQueue["ABC"][""].lot {
+			ret = append(ret, lot.price.RatString())
+		}
+		return ret
+	}
+	adjust := func(amount int64) ([]Posting, error) {
+		return l.adjustBasis(basisAdjustment{row: 2, asset: "ABC", acquired: acquired, amount: big.NewRat(amount, 1)}, "Income:wash sale")
+	}
+
+	posting, err := adjust(40) // 10 to the lot of 1, 30 to the lot of 3
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(price(), " "); got != "110 20" {
+		t.Errorf("prices %s after adjustment, expected 110 20", got)
+	}
+	var amounts []string
+	for _, p := range posting {
+		amounts = append(amounts, p.Amount.Rat.RatString())
+	}
+	if got := strings.Join(amounts, " "); got != "10 30 -40" {
+		t.Errorf("adjustment splits %s, expected 10 30 -40", got)
+	}
+
+	_, err = adjust(-100) // -25 leaves 85, but -75 leaves the lot of 3 with -15
+	if err == nil {
+		t.Fatal("expected error of negative basis")
+	}
+	if got := strings.Join(price(), " "); got != "110 20" {
+		t.Errorf("prices %s after failed adjustment, expected 110 20 (unchanged)", got)
+	}
+}
+
+// TestBasisAdjustSummary lots with an adjustment which fails, as no lot
+// of its date is open, and one which follows it.  The failed row is
+// listed by -summary, and the later adjustment applied.
+func TestBasisAdjustSummary(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "adjust.csv")
+	err := os.WriteFile(filename, []byte(`Date,Symbol,Date Acquired,Adjustment
+2021/02/01,ABC,2021/01/05,7
+2021/03/01,ABC,2021/01/01,5
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := `2021/01/01 Buy
+    Assets:Broker          2 ABC @ 10 USD
+    Assets:Cash
+
+2021/02/01 Interest
+    Assets:Cash            1 USD
+    Income:Interest
+
+2021/03/01 Interest
+    Assets:Cash            1 USD
+    Income:Interest
+`
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err = runOperation(&out, newSettings(), problems, []byte(journal), "lot", "-basis-adjust="+filename, "-summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["basis adjustment"] != 1 {
+		t.Errorf("%d basis adjustment problems, expected 1", problems.count["basis adjustment"])
+	}
+	if !strings.Contains(out.String(), "; basis adjustment not applied: row 2, 7 USD ABC acquired 2021/01/05\n") {
+		t.Errorf("summary does not list failed row:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "5 USD  ; :ADJUST: (basis)") {
+		t.Errorf("later adjustment not applied:\n%s", out.String())
+	}
+}
@@ -18,7 +18,9 @@ package main
 import (
 	"fmt"
 	"math/big"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
 // Assets are currencies, i.e. "BTC" or "ETH".
@@ -26,12 +28,29 @@ type Asset string
 
 const AssetUnknown Asset = "" // for unbalanced splits
 
-// Like ledger-cli, we observe the decimal places found in the source
-// data, and later round to that precision.
-var decimalPlaces = make(map[Asset]int)
+// isBase returns true if the asset is accounted for as base currency,
+// that is, without lots.
+func (this *settings) isBase(asset Asset) bool {
+	return asset == this.base || (this.baseEquivalent[asset] && !this.trackEquivalent)
+}
+
+// toBase converts an amount of a base equivalent into an amount of
+// base currency.  Other amounts are returned unchanged.
+func (this *settings) toBase(amount Amount) Amount {
+	if this.baseEquivalent[amount.Asset] {
+		return this.NewAmount(this.base, *amount.Rat)
+	}
+	return amount
+}
 
-func precision(asset Asset) int {
-	p, ok := decimalPlaces[asset]
+// precision returns the decimal places of an asset, observed in source
+// data or set by -precision.  Without settings, the default of
+// ledger-cli.
+func (this *settings) precision(asset Asset) int {
+	if this == nil {
+		return 6
+	}
+	p, ok := this.decimalPlaces[asset]
 	if !ok {
 		p = 6 // ledger-cli defaults to 6
 	}
@@ -42,44 +61,134 @@ type Amount struct {
 	Asset
 	// we use rational numbers, because so does ledger-cli (https://www.ledger-cli.org/3.0/doc/ledger3.html#Integer-Amounts)
 	*big.Rat
+
+	// settings decide how the amount is written (i.e. precision of its
+	// asset), nil for defaults
+	settings *settings
 }
 
-func NewAmount(asset Asset, amount big.Rat) Amount {
-	return Amount{asset, &amount}
+// NewAmount returns an amount, written according to the settings.
+func (this *settings) NewAmount(asset Asset, amount big.Rat) Amount {
+	return Amount{asset, &amount, this}
 }
 
 // We require "<amount> <asset>", i.e. "100 USD" - unlike ledger-cli
 // which is supports other formats as well.
-func parseAmount(str string) (this Amount, err error) {
-	this.Rat = new(big.Rat)
-	spacePart := strings.Split(strings.TrimSpace(str), " ")
+func (this *settings) parseAmount(str string) (ret Amount, err error) {
+	ret.Rat, ret.settings = new(big.Rat), this
+	spacePart := strings.Fields(str)
+	if len(spacePart) == 1 {
+		// i.e. "€10", symbol preceding number
+		if asset, number, ok := splitSymbol(spacePart[0]); ok {
+			spacePart = []string{number, asset}
+		}
+	}
 	if len(spacePart) < 2 {
 		err = fmt.Errorf("failed to parse amount (%q), expected amount and asset name", str)
 		return
 	}
-	this.Asset = Asset(spacePart[1])
+	ret.Asset = Asset(spacePart[1])
 
 	// ledger supports math i.e. "(1 USD + 2 USD)", but we require a simple number i.e. "3 USD"
-	_, ok := this.Rat.SetString(spacePart[0])
+	_, ok := ret.Rat.SetString(spacePart[0])
 	if !ok {
 		err = fmt.Errorf("failed to parse amount (%q)", str)
 		return
 	}
-	decimalPart := strings.Split(spacePart[0], ".")
+	places := decimals(spacePart[0])
+	if this != nil && places > this.precision(ret.Asset) {
+		this.decimalPlaces[ret.Asset] = places
+	}
+	return
+}
+
+// splitSymbol splits an amount with symbol preceding number, i.e.
+// "€10" or "-$0.50", into symbol and number.
+func splitSymbol(str string) (symbol, number string, ok bool) {
+	sign := ""
+	if strings.HasPrefix(str, "-") {
+		sign, str = "-", str[1:]
+	}
+	i := strings.IndexFunc(str, func(r rune) bool { return unicode.IsDigit(r) || r == '-' || r == '.' })
+	if i < 1 {
+		return "", "", false
+	}
+	return str[:i], sign + str[i:], true
+}
+
+// decimals returns the count of decimal places in a number, which may
+// be in scientific notation, i.e. "1e-18" has 18 places.
+func decimals(number string) int {
+	exponent := 0
+	mantissa := strings.SplitN(strings.ToLower(number), "e", 2)
+	if len(mantissa) > 1 {
+		exp, err := strconv.Atoi(mantissa[1])
+		if err == nil {
+			exponent = exp
+		}
+	}
+	places := 0
+	decimalPart := strings.Split(mantissa[0], ".")
 	if len(decimalPart) > 1 {
-		if len(decimalPart[1]) > precision(this.Asset) {
-			decimalPlaces[this.Asset] = len(decimalPart[1])
+		places = len(decimalPart[1])
+	}
+	places -= exponent
+	if places < 0 {
+		places = 0
+	}
+	return places
+}
+
+// setPrecision parses explicit precision, i.e. "ETH=18,USD=2".
+// Explicit precision replaces the default, but (like ledger-cli) more
+// decimal places observed in source data will be used.
+func (this *settings) setPrecision(str string) error {
+	return parsePrecision(str, this.decimalPlaces)
+}
+
+// setNamePrecision parses the cap of decimal places in lot names and
+// comments, i.e. "USD=2,ETH=8".
+func (this *settings) setNamePrecision(str string) error {
+	return parsePrecision(str, this.namePlaces)
+}
+
+// namePlace returns the cap of decimal places in lot names and
+// comments of an asset, if any.
+func (this *settings) namePlace(asset Asset) (int, bool) {
+	if this == nil {
+		return 0, false
+	}
+	places, ok := this.namePlaces[asset]
+	return places, ok
+}
+
+// parsePrecision parses decimal places per asset, i.e. "ETH=18,USD=2",
+// into places.
+func parsePrecision(str string, places map[Asset]int) error {
+	for _, field := range strings.Split(str, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		part := strings.SplitN(field, "=", 2)
+		if len(part) != 2 {
+			return fmt.Errorf("bad precision (%q), expected <asset>=<decimal places>", field)
 		}
+		n, err := strconv.Atoi(strings.TrimSpace(part[1]))
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad precision (%q), expected <asset>=<decimal places>", field)
+		}
+		places[Asset(strings.TrimSpace(part[0]))] = n
 	}
-	return
+	return nil
 }
 
 // TODO(dnc): clone methods should probably return *Amount
 
 func (this Amount) ZeroClone() Amount {
 	return Amount{
-		Asset: this.Asset,
-		Rat:   new(big.Rat),
+		Asset:    this.Asset,
+		Rat:      new(big.Rat),
+		settings: this.settings,
 	}
 }
 
@@ -105,20 +214,82 @@ func (this Amount) Compatible(x Amount) bool {
 	return this.Asset == x.Asset
 }
 
+// Round returns the amount rounded to the precision of its asset, the
+// same value rendered by String(), without converting to a string and
+// back.
+func (this Amount) Round() *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(this.settings.precision(this.Asset))), nil)
+	num := new(big.Int).Mul(this.Num(), scale)
+	quo, rem := new(big.Int).QuoRem(num, this.Denom(), new(big.Int))
+
+	// round half away from zero, as does big.Rat.FloatString()
+	rem.Abs(rem).Lsh(rem, 1)
+	if rem.Cmp(this.Denom()) >= 0 {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	return new(big.Rat).SetFrac(quo, scale)
+}
+
 func (this Amount) FloatString() string {
-	f := this.Rat.FloatString(precision(this.Asset))
+	f := this.Rat.FloatString(this.settings.precision(this.Asset))
+	return f
+}
+
+// Number is the amount without asset, rounded to the asset's
+// precision, and without trailing zeros.
+func (this Amount) Number() string {
+	return this.number(this.settings.precision(this.Asset))
+}
+
+// number is the amount without asset, rounded to places, and without
+// trailing zeros.
+func (this Amount) number(places int) string {
+	if s := this.settings; s != nil && this.Asset == s.base && s.basePlaces >= 0 {
+		f := this.Rat.FloatString(s.basePlaces)
+		if strings.Trim(f, "-0.") == "" {
+			f = strings.TrimPrefix(f, "-") // negative amount too small to render
+		}
+		return f
+	}
+	f := this.Rat.FloatString(places)
+
+	if strings.IndexByte(f, '.') != -1 {
+		f = strings.TrimRight(f, "0")  // omit trailing 0 after decimal
+		f = strings.TrimSuffix(f, ".") // omit decimal place
+	}
+	if f == "-0" {
+		f = "0" // negative amount too small to render
+	}
 	return f
 }
 
 func (this Amount) String() string {
-	f := this.FloatString()
+	return this.format(this.Number())
+}
+
+// Brief is the amount as String writes it, but with decimal places
+// capped (see -name-precision).  Lot names and comments are brief, so
+// that an amount with many decimal places (i.e. a price calculated
+// from cost) does not make them enormous.
+func (this Amount) Brief() string {
+	places := this.settings.precision(this.Asset)
+	if limit, ok := this.settings.namePlace(this.Asset); ok && limit < places {
+		places = limit
+	}
+	return this.format(this.number(places))
+}
 
-	parts := strings.Split(f, ".")
-	if len(parts) > 1 {
-		parts[1] = strings.TrimRight(parts[1], "0") // omit trailing 0 after decimal
-		if parts[1] == "" {
-			parts = parts[0:1] // omit decimal place
+// format writes number with the asset's name or symbol.
+func (this Amount) format(number string) string {
+	if s := this.settings; s != nil && this.Asset == s.base && s.basePrefix {
+		if strings.HasPrefix(number, "-") {
+			return fmt.Sprintf("-%s%s", this.Asset, number[1:]) // i.e. "-€10"
 		}
+		return fmt.Sprintf("%s%s", this.Asset, number)
 	}
-	return fmt.Sprintf("%s %s", strings.Join(parts, "."), this.Asset)
+	return fmt.Sprintf("%s %s", number, this.Asset)
 }
@@ -0,0 +1,159 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/big"
+	"time"
+)
+
+// checkpoint is the state of lotting (lot queues, margin positions,
+// and names of lots), taken before a transaction is lotted.  When the
+// transaction fails, and lot continues (see -max-errors), the
+// checkpoint is restored, so that later transactions are lotted as if
+// the failed one were not in the journal.
+//
+// A checkpoint does not copy every open lot.  Rather, a queue (or
+// margin position) is saved when the transaction first changes it (see
+// saveQueue), so a checkpoint costs as much as the lots the transaction
+// touches.  Lots are copied, as selling a lot changes its inventory in
+// place.
+type checkpoint struct {
+	lotter *lotter
+
+	lotQueue       map[queueKey]*LotQueue // nil, if queue did not exist
+	marginPosition map[string]*position   // nil, if position did not exist
+
+	weightDay time.Time
+	weights   *dayWeights // of weightDay, nil if none
+	lotIDSeq  int
+}
+
+type queueKey struct {
+	asset     Asset
+	qualifier string
+}
+
+// saveCheckpoint returns the checkpoint of the transaction about to
+// be lotted, which is kept until the transaction is lotted (see
+// lotter.lotting).
+func (this *lotter) saveCheckpoint() *checkpoint {
+	this.lotting = &checkpoint{
+		lotter:         this,
+		lotQueue:       make(map[queueKey]*LotQueue),
+		marginPosition: make(map[string]*position),
+		weightDay:      this.weightDay,
+		weights:        this.weightDays[dayNumber(this.weightDay)].clone(),
+		lotIDSeq:       this.lotIDSeq,
+	}
+	return this.lotting
+}
+
+// saveQueue saves a queue to the checkpoint of the transaction being
+// lotted, before the transaction changes it.  Called each time the
+// queue is about to change, it saves the queue only the first time.
+func (this *lotter) saveQueue(asset Asset, qualifier string) {
+	lotting := this.lotting
+	if lotting == nil {
+		return
+	}
+	k := queueKey{asset, qualifier}
+	if _, ok := lotting.lotQueue[k]; ok {
+		return
+	}
+	queue, ok := this.lotQueue[asset][qualifier]
+	if !ok {
+		lotting.lotQueue[k] = nil
+		return
+	}
+	saved := LotQueue{order: queue.order, lot: make([]Lot, len(queue.lot))}
+	for i, l := range queue.lot {
+		saved.lot[i] = l.clone()
+	}
+	lotting.lotQueue[k] = &saved
+}
+
+// savePosition saves a margin position, as saveQueue saves a queue.
+func (this *lotter) savePosition(key string) {
+	lotting := this.lotting
+	if lotting == nil {
+		return
+	}
+	if _, ok := lotting.marginPosition[key]; ok {
+		return
+	}
+	p, ok := this.marginPosition[key]
+	if !ok {
+		lotting.marginPosition[key] = nil
+		return
+	}
+	lotting.marginPosition[key] = &position{
+		name:     p.name,
+		quantity: new(big.Rat).Set(p.quantity),
+		cost:     new(big.Rat).Set(p.cost),
+	}
+}
+
+// restore returns lotting to the state of the checkpoint, and discards
+// rows of the lot map not yet written.  A checkpoint is restored at
+// most once, as its lots become those of the queues.
+func (this *checkpoint) restore() {
+	l := this.lotter
+	for k, saved := range this.lotQueue {
+		if saved == nil {
+			delete(l.lotQueue[k.asset], k.qualifier)
+			continue
+		}
+		if l.lotQueue[k.asset] == nil {
+			l.lotQueue[k.asset] = make(map[string]LotQueue)
+		}
+		l.lotQueue[k.asset][k.qualifier] = *saved
+	}
+	for key, saved := range this.marginPosition {
+		if saved == nil {
+			delete(l.marginPosition, key)
+			continue
+		}
+		l.marginPosition[key] = saved
+	}
+	l.weightDay = this.weightDay
+	if this.weights == nil {
+		delete(l.weightDays, dayNumber(l.weightDay))
+	} else {
+		l.weightDays[dayNumber(l.weightDay)] = this.weights
+	}
+	for _, name := range l.named {
+		if l.names[name]--; l.names[name] == 0 {
+			delete(l.names, name)
+		}
+	}
+	l.named = l.named[:0]
+	l.lotIDSeq = this.lotIDSeq
+	l.discardLotMap()
+	if l.lotting == this {
+		l.lotting = nil
+	}
+}
+
+// clone returns a copy of the lot, sharing nothing that Sell changes.
+func (this Lot) clone() Lot {
+	inventory := this.inventory.Clone()
+	if this.startInventory.Rat == this.inventory.Rat {
+		this.startInventory = inventory
+	}
+	this.inventory = inventory
+	return this
+}
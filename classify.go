@@ -0,0 +1,333 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// Transactions are classified by prices and tags, or by a hook.  A
+// hook is an external process which classifies transactions, so that
+// rules particular to a user (or firm) need not be built into lotter.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+// Classes of transaction.  Without a hook (or when a hook answers
+// with no class), lot infers the class from prices and tags.
+var txClass = [...]string{
+	"trade",    // splits with price buy and sell lots
+	"move",     // lots move from one account to another
+	"income",   // assets received are income, at fair market value
+	"spend",    // assets spent are sold, at fair market value
+	"donation", // assets donated are disposed of, without gain
+	"gift",     // assets given are disposed of, without gain
+	"lost",     // assets lost are disposed of, without gain
+	"ignore",   // lots are not affected
+}
+
+// i.e. "; :DISPOSAL:donation:"
+var disposalPattern = regexp.MustCompile(`:DISPOSAL:([A-Za-z]+):`)
+
+// disposalTag returns the class of a transaction tagged as a disposal,
+// i.e. "spend" when tagged ":DISPOSAL:spend:".  Returns "" when not
+// tagged.
+func disposalTag(tx TxLines) (string, error) {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return "", nil
+	}
+	for _, line := range tx.Line[payeeIndex:] {
+		commentSplit := strings.SplitN(line, ";", 2)
+		if len(commentSplit) < 2 {
+			continue
+		}
+		m := disposalPattern.FindStringSubmatch(commentSplit[1])
+		if m == nil {
+			continue
+		}
+		switch kind := strings.ToLower(m[1]); kind {
+		case "spend", "donation", "gift", "lost":
+			return kind, nil
+		default:
+			return "", fmt.Errorf("unexpected disposal (%q), expected spend, donation, gift or lost", m[1])
+		}
+	}
+	return "", nil
+}
+
+// classRule classifies transactions with a split to an account
+// matching a pattern.
+type classRule struct {
+	pattern *regexp.Regexp
+	class   string
+}
+
+// classRules are read from the file named by `lot -classes`.
+type classRules []classRule
+
+// readClasses reads rules, one per line, of an account pattern
+// (regular expression) and class, separated by two or more spaces (or
+// tab).  For example,
+//
+//     ^Income:Staking(:|$)       income
+//     ^Expenses:Donations(:|$)   donation
+//     ^Expenses:                 spend
+//
+// Blank lines and comments (beginning with ";" or "#") are ignored.
+func readClasses(in io.Reader) (classRules, error) {
+	var ret classRules
+	s := bufio.NewScanner(in)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := accountSeparator.Split(text, 2)
+		if len(field) != 2 || strings.TrimSpace(field[1]) == "" {
+			return nil, lineErrorf(line, "expected account pattern and class (%q)", text)
+		}
+		pattern, err := regexp.Compile(field[0])
+		if err != nil {
+			return nil, lineErrorf(line, "bad account pattern (%q): %w", field[0], err)
+		}
+		class := strings.TrimSpace(field[1])
+		if !containsString(txClass[:], class) {
+			return nil, lineErrorf(line, "unexpected class (%q), expected one of %s", class, strings.Join(txClass[:], ", "))
+		}
+		ret = append(ret, classRule{pattern: pattern, class: class})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read classes: %w", err)
+	}
+	return ret, nil
+}
+
+// class returns the class of the first rule matching the account of
+// any split of a transaction.  Returns "" when no rule matches.
+func (this classRules) class(s *settings, tx TxLines) string {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound || len(this) == 0 {
+		return ""
+	}
+	var account []string
+	for _, line := range tx.Line[payeeIndex+1:] {
+		if split, ok := s.parseSplit(line); ok {
+			account = append(account, split.account)
+		}
+	}
+	for _, rule := range this {
+		for _, a := range account {
+			if rule.pattern.MatchString(a) {
+				return rule.class
+			}
+		}
+	}
+	return ""
+}
+
+// hookResponse is a hook's answer, one line of JSON per transaction,
+// i.e. `{"class":"spend","order":"hifo"}`.
+type hookResponse struct {
+	Class string `json:"class,omitempty"` // one of txClass, or empty
+	Order string `json:"order,omitempty"` // lot order of this transaction, or empty
+}
+
+// txHook is a running hook process.  Each transaction is written to
+// it as one line of JSON (as in `-format=json` output, without
+// generated postings), and one line of JSON is read in response.
+type txHook struct {
+	cmd      *exec.Cmd
+	in       io.WriteCloser
+	out      *bufio.Reader
+	settings *settings // of transactions written to the hook
+
+	closed bool
+}
+
+func startHook(command string, settings *settings) (*txHook, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start hook (%q): %w", command, err)
+	}
+	return &txHook{cmd: cmd, in: in, out: bufio.NewReader(out), settings: settings}, nil
+}
+
+// Classify writes a transaction to the hook and reads its response.
+func (this *txHook) Classify(tx TxLines) (hookResponse, error) {
+	var ret hookResponse
+	request, err := json.Marshal(this.settings.structure(tx, nil))
+	if err != nil {
+		return ret, err
+	}
+	_, err = fmt.Fprintf(this.in, "%s\n", request)
+	if err != nil {
+		return ret, fmt.Errorf("failed to write to hook: %w", err)
+	}
+	response, err := this.out.ReadBytes('\n')
+	if err != nil {
+		return ret, fmt.Errorf("failed to read from hook: %w", err)
+	}
+	err = json.Unmarshal(response, &ret)
+	if err != nil {
+		return ret, fmt.Errorf("failed to parse hook response (%q): %w", strings.TrimSpace(string(response)), err)
+	}
+	if ret.Class != "" && !containsString(txClass[:], ret.Class) {
+		return ret, fmt.Errorf("unexpected class (%q) from hook, expected one of %s", ret.Class, strings.Join(txClass[:], ", "))
+	}
+	if ret.Order != "" {
+		err = checkOrder(ret.Order)
+		if err != nil {
+			return ret, fmt.Errorf("unexpected order from hook: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+// Close ends input to the hook, and waits for it to exit.  Close
+// after the first has no effect.
+func (this *txHook) Close() error {
+	if this.closed {
+		return nil
+	}
+	this.closed = true
+	this.in.Close()
+	return this.cmd.Wait()
+}
+
+// incomeClass tags the assets received by a transaction as income.
+func (this *lotter) incomeClass(splits map[Asset]map[string][]Split) {
+	for asset, qualified := range splits {
+		if this.isBase(asset) {
+			continue
+		}
+		for qual := range qualified {
+			for i := range qualified[qual] {
+				s := &qualified[qual][i]
+				if s.delta != nil && s.delta.Sign() > 0 && !strings.Contains(s.comment, ":INCOME:") {
+					s.comment += " :INCOME:"
+				}
+			}
+		}
+	}
+}
+
+// spendClass prices the assets spent by a transaction at fair market
+// value, so that they are sold.  The split receiving an asset spent
+// (i.e. "Expenses:Coffee") is valued in base currency, as proceeds of
+// the sale.
+func (this *lotter) spendClass(splits map[Asset]map[string][]Split, date time.Time, prices PriceHistory) error {
+	for _, asset := range sortedAssets(splits) {
+		if this.isBase(asset) {
+			continue
+		}
+		for _, qual := range sortedQualifiers(splits[asset]) {
+			for i := range splits[asset][qual] {
+				s := &splits[asset][qual][i]
+				if s.delta == nil || s.price != nil || s.cost != nil {
+					continue
+				}
+				fmv, ok := prices.Lookup(date, asset)
+				if !ok {
+					return fmt.Errorf("missing price of %s on %s", asset, date.Format("2006/01/02"))
+				}
+				if s.delta.Sign() < 0 {
+					price := this.NewAmount(this.base, *fmv)
+					s.price = &price
+				} else {
+					value := this.NewAmount(this.base, *new(big.Rat).Mul(fmv, s.delta.Rat))
+					s.delta = &value
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// disposeClass consumes the assets disposed of by a transaction
+// without proceeds or gain (i.e. donated or lost).  Basis consumed is
+// split to an account of the disposal (i.e. "Lot:Disposal:donation"),
+// rather than to gains.
+func (this *lotter) disposeClass(splits map[Asset]map[string][]Split, kind string) (lot []Lot, inventory []Amount, basis []Amount, comment []string, err error) {
+	for _, asset := range sortedAssets(splits) {
+		if this.isBase(asset) {
+			continue
+		}
+		for _, qual := range sortedQualifiers(splits[asset]) {
+			for _, s := range splits[asset][qual] {
+				if s.delta == nil || s.delta.Sign() >= 0 {
+					continue // recipient of assets disposed of
+				}
+				l, i, b, e := this.sell(qual, *s.delta)
+				if e != nil {
+					err = fmt.Errorf("failed to consume %s (%q): %w", kind, s.line, e)
+					return
+				}
+				for j := range l {
+					lot = append(lot, l[j])
+					inventory = append(inventory, i[j].Clone())
+					basis = append(basis, b[j].Clone())
+					comment = append(comment, fmt.Sprintf(":DISPOSAL:%s:", strings.ToUpper(kind)))
+				}
+			}
+		}
+	}
+	return
+}
+
+// disposalValues returns a comment, per lot donated or given, of its
+// fair market value (from the price directive of the day), basis, and
+// holding period, as a charitable deduction (or gift) requires.  For
+// example, ":DISPOSAL:DONATION: 0.1 BTC fair market value 5000 USD,
+// basis 1000 USD, acquired 2020/01/01 held 517d (long term)".
+func (this *lotter) disposalValues(lot []Lot, inventory, basis []Amount, date time.Time, prices PriceHistory, kind string) (generated []Posting) {
+	for i := range lot {
+		if inventory[i].Sign() <= 0 {
+			continue
+		}
+		value := "unknown (no price directive)"
+		if fmv, ok := prices.Lookup(date, inventory[i].Asset); ok {
+			value = this.NewAmount(this.base, *new(big.Rat).Mul(fmv, inventory[i].Rat)).String()
+		} else {
+			command.V(0).Infof("warning, fair market value of %s %s on %s unknown, no price directive", inventory[i], kind, date.Format("2006/01/02"))
+		}
+		term := "short term"
+		if _, years, _, _, _, _, _, _ := Elapsed(lot[i].date, date); years > 0 {
+			term = "long term"
+		}
+		generated = append(generated, Posting{Comment: fmt.Sprintf(":DISPOSAL:%s: %s fair market value %s, basis %s, acquired %s held %dd (%s)",
+			strings.ToUpper(kind), inventory[i], value, basis[i].NegClone(), lot[i].date.Format("2006/01/02"), heldDays(lot[i].date, date), term)})
+	}
+	return generated
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// txBlock returns the transaction of output with payee, as lines.
+func txBlock(output, payee string) string {
+	for _, tx := range strings.Split(output, "\n\n") {
+		if strings.Contains(tx, " "+payee+"\n") {
+			return tx
+		}
+	}
+	return ""
+}
+
+const classifyJournal = `2021/01/01 Buy
+    Assets:Crypto            1 ABC @ 100 USD
+    Assets:Bank
+
+2021/02/01 Buy
+    Assets:Crypto            1 ABC @ 200 USD
+    Assets:Bank
+
+2021/03/01 Coffee
+    Expenses:Coffee          5 USD
+    Assets:Crypto         -0.1 ABC @ 50 USD
+
+2021/03/02 Sell
+    Assets:Crypto           -1 ABC @ 300 USD
+    Assets:Bank
+`
+
+// TestHook classifies transactions by a hook, which ignores one, and
+// sells lifo in another.
+func TestHook(t *testing.T) {
+	hook := `while read tx; do case "$tx" in *Coffee*) echo '{"class":"ignore"}';; *Sell*) echo '{"order":"lifo"}';; *) echo '{}';; esac; done`
+	out := string(lotJournal(t, classifyJournal, "-hook="+hook))
+
+	if coffee := txBlock(out, "Coffee"); coffee == "" || strings.Contains(coffee, "[Lot:") {
+		t.Errorf("transaction ignored by hook has lot splits:\n%s", coffee)
+	}
+	sell := txBlock(out, "Sell")
+	if !strings.Contains(sell, "[Lot::2021/02/01:1ABC@200USD]") || !strings.Contains(sell, "-100 USD  ; :GAIN:SHORTTERM:") {
+		t.Errorf("sale ordered lifo by hook consumed other than the lot of 2021/02/01:\n%s", sell)
+	}
+
+	// a class unknown is an error
+	var buf bytes.Buffer
+	err := runOperation(&buf, newSettings(), newProblemTally(-1), []byte(classifyJournal), "lot", `-hook=while read tx; do echo '{"class":"sale"}'; done`)
+	if err == nil || !strings.Contains(err.Error(), `unexpected class ("sale") from hook`) {
+		t.Errorf("error of unknown class is %v", err)
+	}
+}
+
+// scanTx returns the first transaction of journal.
+func scanTx(t *testing.T, journal string) TxLines {
+	t.Helper()
+	s := NewTxScanner(strings.NewReader(journal))
+	for s.Scan() {
+		tx := s.Lines()
+		if _, payeeIndex := tx.Payee(); payeeIndex != PayeeNotFound {
+			return tx
+		}
+	}
+	t.Fatalf("no transaction in %q (%v)", journal, s.Err())
+	return TxLines{}
+}
+
+// TestClasses classifies transactions by the first rule (in order of
+// file) matching any split's account.
+func TestClasses(t *testing.T) {
+	rules, err := readClasses(strings.NewReader(`; rules of account and class
+^Income:Staking(:|$)       income
+
+# donations are not spending
+^Expenses:Donations(:|$)	donation
+^Expenses:                 spend
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for journal, expect := range map[string]string{
+		"2021/01/01 Charity\n    Assets:Crypto  -1 ABC\n    Expenses:Donations:Red Cross  1 ABC\n": "donation",
+		"2021/01/01 Coffee\n    Assets:Crypto  -1 ABC\n    Expenses:Coffee  1 ABC\n":               "spend",
+		"2021/01/01 Reward\n    Assets:Crypto  1 ABC\n    Income:Staking\n":                        "income",
+		"2021/01/01 Reward\n    Assets:Crypto  1 ABC\n    Income:Staking Pool\n":                   "",
+		"2021/01/01 Move\n    Assets:Cold  1 ABC\n    Assets:Crypto\n":                             "",
+	} {
+		if class := rules.class(newSettings(), scanTx(t, journal)); class != expect {
+			t.Errorf("class of %q is %q, expected %q", journal, class, expect)
+		}
+	}
+
+	for file, expect := range map[string]string{
+		"^Expenses:  spend\n^Income:  wages\n": `line 2: unexpected class ("wages")`,
+		"^Expenses(  spend\n":                  `line 1: bad account pattern ("^Expenses(")`,
+		"\n^Expenses:\n":                       `line 2: expected account pattern and class ("^Expenses:")`,
+	} {
+		_, err := readClasses(strings.NewReader(file))
+		if err == nil || !strings.HasPrefix(err.Error(), expect) {
+			t.Errorf("error of %q is %v, expected %s", file, err, expect)
+		}
+	}
+}
+
+// TestDisposalValues records, per lot donated or given, its fair
+// market value, basis and holding period, realizing no gain.
+func TestDisposalValues(t *testing.T) {
+	journal, err := os.ReadFile(filepath.Join("testdata", "donation.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lotted := string(lotJournal(t, string(journal)))
+	_, donation, _ := strings.Cut(lotted, "Charity ; :DISPOSAL:donation:")
+	donation, gift, _ := strings.Cut(donation, "Nephew ; :DISPOSAL:gift:")
+	expectLines(t, reportLines(donation),
+		"[Lot:Disposal:donation] 2400 USD ; :DISPOSAL:DONATION:",
+		"; :DISPOSAL:DONATION: 0.1 BTC fair market value 3500 USD, basis 900 USD, acquired 2020/03/01 held 457d (long term)",
+		"; :DISPOSAL:DONATION: 0.05 BTC fair market value 1750 USD, basis 1500 USD, acquired 2021/05/01 held 31d (short term)",
+	)
+	expectLines(t, reportLines(gift),
+		"[Lot:Disposal:gift] 1500 USD ; :DISPOSAL:GIFT:",
+		"; :DISPOSAL:GIFT: 0.05 BTC fair market value 1750 USD, basis 1500 USD, acquired 2021/05/01 held 31d (short term)",
+	)
+	if strings.Contains(lotted, ":GAIN:") {
+		t.Errorf("gain of disposal:\n%s", lotted)
+	}
+
+	// without price directive
+	lotted = string(lotJournal(t, strings.Replace(string(journal), "P 2021/06/01 BTC 35000 USD", "", 1)))
+	expectLines(t, reportLines(lotted),
+		"; :DISPOSAL:GIFT: 0.05 BTC fair market value unknown (no price directive), basis 1500 USD, acquired 2021/05/01 held 31d (short term)",
+	)
+}
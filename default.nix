@@ -1,4 +1,7 @@
-{ buildGoModule }:
+{ lib, buildGoModule, go }:
+
+# go.mod requires go 1.18, for fuzz tests (testing.F)
+assert lib.versionAtLeast go.version "1.18";
 
 buildGoModule {
   pname = "lotter";
@@ -0,0 +1,146 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// diagnosis is a common mistake, found in a split of a transaction.
+type diagnosis struct {
+	kind string // i.e. "reversed price"
+	line int    // of split, in source data
+	why  string
+	fix  string // the split corrected, if known
+
+	explained bool // with why and fix (see -explain-errors)
+}
+
+func (this diagnosis) String() string {
+	if !this.explained {
+		return fmt.Sprintf("likely %s (line %d), see -explain-errors", this.kind, this.line)
+	}
+	hint := fmt.Sprintf("likely %s (line %d): %s", this.kind, this.line, this.why)
+	if this.fix != "" {
+		hint = fmt.Sprintf("%s, i.e. %q", hint, strings.TrimSpace(this.fix))
+	}
+	return hint
+}
+
+// explain adds hints to an error of a transaction, if diagnose
+// recognizes a mistake in it.
+func (this *settings) explain(tx TxLines, err error) error {
+	diag := this.diagnose(tx)
+	if len(diag) == 0 {
+		return err
+	}
+	var hint []string
+	for _, d := range diag {
+		hint = append(hint, d.String())
+	}
+	return fmt.Errorf("%w (%s)", err, strings.Join(hint, "; "))
+}
+
+// diagnose recognizes common mistakes of a transaction's prices:
+//
+//   - "@" where "@@" was meant (unit price is the total)
+//   - "@@" where "@" was meant (total is the unit price)
+//   - reversed price, i.e. "100 ABC @ 50 USD" where 2 USD were paid
+//
+// Mistakes are recognized only when the base currency split has an
+// explicit amount.  (Price on the base currency split, i.e. "-2 USD @
+// 50 ABC", is not a mistake, see reversePrice().)
+func (this *settings) diagnose(tx TxLines) []diagnosis {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return nil
+	}
+	var split []Split
+	var index []int
+	paid := new(big.Rat) // base currency sent or received, without price
+	for i, line := range tx.Line[payeeIndex+1:] {
+		s, ok := this.parseSplit(line)
+		if !ok || s.delta == nil || s.isLoan() {
+			continue
+		}
+		split = append(split, s)
+		index = append(index, tx.Start+payeeIndex+1+i)
+		if this.isBase(s.delta.Asset) && s.price == nil && s.cost == nil {
+			paid.Add(paid, new(big.Rat).Abs(s.delta.Rat))
+		}
+	}
+
+	abs := func(r *big.Rat) *big.Rat { return new(big.Rat).Abs(r) }
+	// withPrice writes a split with its amount priced, i.e. "    Assets:Crypto  100 ABC @ 0.02 USD"
+	withPrice := func(s Split, op string, price Amount) string {
+		start, end, ok := amountIndex(s.line)
+		if !ok {
+			return ""
+		}
+		amount := strings.TrimSpace(strings.SplitN(s.line[start:end], "@", 2)[0])
+		return fmt.Sprintf("%s%s %s %s", s.line[:start], amount, op, price)
+	}
+
+	var ret []diagnosis
+	for i, s := range split {
+		if s.price == nil && s.cost == nil {
+			continue
+		}
+		priceAsset := s.price
+		if priceAsset == nil {
+			priceAsset = s.cost
+		}
+
+		if this.isBase(s.delta.Asset) || !this.isBase(priceAsset.Asset) || paid.Sign() == 0 {
+			continue
+		}
+		quantity := abs(s.delta.Rat)
+		tmp := s // Cost() calculates, and would hide which of price or cost was written
+		total := abs(tmp.Cost().Rat)
+		if near(total, paid) {
+			continue // balances, no mistake
+		}
+		switch {
+		case s.cost == nil && near(abs(s.price.Rat), paid) && quantity.Cmp(big.NewRat(1, 1)) != 0:
+			ret = append(ret, diagnosis{kind: `"@" where "@@" was meant`, line: index[i],
+				why: fmt.Sprintf("%s is the total paid, not the price of each %s", s.price, s.delta.Asset),
+				fix: withPrice(s, "@@", this.NewAmount(s.price.Asset, *abs(s.price.Rat)))})
+		case s.cost != nil && near(new(big.Rat).Mul(abs(s.cost.Rat), quantity), paid):
+			ret = append(ret, diagnosis{kind: `"@@" where "@" was meant`, line: index[i],
+				why: fmt.Sprintf("%s is the price of each %s, not the total paid", s.cost, s.delta.Asset),
+				fix: withPrice(s, "@", this.NewAmount(s.cost.Asset, *abs(s.cost.Rat)))})
+		case s.cost == nil && s.price.Sign() != 0 && near(new(big.Rat).Quo(quantity, abs(s.price.Rat)), paid):
+			ret = append(ret, diagnosis{kind: "reversed price", line: index[i],
+				why: fmt.Sprintf("the price (%s) appears to be %s per %s, rather than %s per %s", s.price, s.delta.Asset, s.price.Asset, s.price.Asset, s.delta.Asset),
+				fix: withPrice(s, "@", this.NewAmount(s.price.Asset, *new(big.Rat).Inv(abs(s.price.Rat))))})
+		}
+	}
+	for i := range ret {
+		ret[i].explained = this.explainErrors
+	}
+	return ret
+}
+
+// near returns true if a is within half a percent of b (allowing for
+// prices rounded in source data).
+func near(a, b *big.Rat) bool {
+	diff := new(big.Rat).Sub(a, b)
+	diff.Abs(diff)
+	limit := new(big.Rat).Mul(new(big.Rat).Abs(b), big.NewRat(1, 200))
+	return diff.Cmp(limit) <= 0
+}
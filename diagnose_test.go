@@ -0,0 +1,90 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestDiagnose recognizes mistakes of price, and the split corrected.
+func TestDiagnose(t *testing.T) {
+	for _, test := range []struct {
+		split string // of a purchase, paid from Assets:Bank
+		kind  string // of diagnosis, if any
+		fix   string
+	}{
+		{"100 ABC @ 0.02 USD", "", ""},
+		{"100 ABC @@ 2 USD", "", ""},
+		{"100 ABC @ 2 USD", `"@" where "@@" was meant`, "Assets:Crypto    100 ABC @@ 2 USD"},
+		{"100 ABC @@ 0.02 USD", `"@@" where "@" was meant`, "Assets:Crypto    100 ABC @ 0.02 USD"},
+		{"100 ABC @ 50 USD", "reversed price", "Assets:Crypto    100 ABC @ 0.02 USD"},
+		{"100 ABC @ 50.1 USD", "reversed price", "Assets:Crypto    100 ABC @ 0.01996 USD"},
+		{"1 ABC @ 5 USD", "", ""}, // not balanced, but "@" and "@@" agree
+		{"100 ABC @ 7 USD", "", ""},
+	} {
+		journal := "2021/01/01 Buy\n    Assets:Crypto    " + test.split + "\n    Assets:Bank    -2 USD\n"
+		settings := newSettings()
+		diag := settings.diagnose(scanTx(t, journal))
+		if test.kind == "" {
+			if len(diag) != 0 {
+				t.Errorf("%q: unexpected %v", test.split, diag)
+			}
+			continue
+		}
+		if len(diag) != 1 || diag[0].kind != test.kind || diag[0].line != 2 || strings.TrimSpace(diag[0].fix) != test.fix {
+			t.Errorf("%q: got %+v, expected %s, i.e. %q", test.split, diag, test.kind, test.fix)
+		}
+	}
+
+	// An unpriced amount of base currency is needed to diagnose, and a
+	// price on the base currency split is not a mistake.
+	for _, journal := range []string{
+		"2021/01/01 Buy\n    Assets:Crypto    100 ABC @ 2 USD\n    Assets:Bank\n",
+		"2021/01/01 Buy\n    Assets:Crypto    100 ABC\n    Assets:Bank    -2 USD @ 50 ABC\n",
+	} {
+		if diag := newSettings().diagnose(scanTx(t, journal)); len(diag) != 0 {
+			t.Errorf("%q: unexpected %v", journal, diag)
+		}
+	}
+}
+
+// TestExplain adds hints to an error, briefly unless -explain-errors.
+func TestExplain(t *testing.T) {
+	tx := scanTx(t, "2021/01/01 Buy\n    Assets:Crypto    100 ABC @ 2 USD\n    Assets:Bank    -2 USD\n")
+	failed := errors.New("transaction does not balance")
+
+	settings := newSettings()
+	err := settings.explain(tx, failed)
+	if !errors.Is(err, failed) {
+		t.Errorf("%v does not wrap %v", err, failed)
+	}
+	if expect := `transaction does not balance (likely "@" where "@@" was meant (line 2), see -explain-errors)`; err.Error() != expect {
+		t.Errorf("got %q, expected %q", err, expect)
+	}
+
+	settings.explainErrors = true
+	err = settings.explain(tx, failed)
+	if expect := `transaction does not balance (likely "@" where "@@" was meant (line 2): 2 USD is the total paid, not the price of each ABC, i.e. "Assets:Crypto    100 ABC @@ 2 USD")`; err.Error() != expect {
+		t.Errorf("got %q, expected %q", err, expect)
+	}
+
+	balanced := scanTx(t, "2021/01/01 Buy\n    Assets:Crypto    100 ABC @@ 2 USD\n    Assets:Bank    -2 USD\n")
+	if err := settings.explain(balanced, failed); err != failed {
+		t.Errorf("got %q, expected no hint", err)
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+var inputDialect = [...]string{
+	"ledger",
+	"beancount",
+	"xml",
+	"json",
+}
+
+// NewDialectReader returns a reader of ledger-cli data, converted (if
+// necessary) from the input dialect.
+func NewDialectReader(dialect string, in io.Reader) (io.Reader, error) {
+	switch dialect {
+	case "ledger":
+		return in, nil
+	case "beancount":
+		s := bufio.NewScanner(in)
+		s.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+		return &beancountReader{scanner: s}, nil
+	case "xml":
+		return &convertReader{next: ledgerXMLConverter(in)}, nil
+	case "json":
+		return &convertReader{next: lotterJSONConverter(in)}, nil
+	}
+	return nil, fmt.Errorf("unknown input dialect (%q), expected one of %s", dialect, strings.Join(inputDialect[:], ", "))
+}
+
+// beancountReader converts Beancount (https://beancount.github.io/)
+// data to ledger-cli data, line by line.  Line numbers are preserved,
+// so that errors refer to the line in the Beancount source.
+type beancountReader struct {
+	scanner *bufio.Scanner
+	buf     bytes.Buffer
+}
+
+func (this *beancountReader) Read(p []byte) (int, error) {
+	for this.buf.Len() < len(p) && this.scanner.Scan() {
+		this.buf.WriteString(beancountLine(this.scanner.Text()))
+		this.buf.WriteByte('\n')
+	}
+	if this.buf.Len() == 0 {
+		if err := this.scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	return this.buf.Read(p)
+}
+
+var (
+	beancountDated    = regexp.MustCompile(`^(\d{4}-\d\d-\d\d)\s+(\S+)\s*(.*)$`)
+	beancountString   = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"`)
+	beancountTag      = regexp.MustCompile(`(?:^|\s)([#^])([A-Za-z0-9_/.-]+)`)
+	beancountPosting  = regexp.MustCompile(`^(\s+)(?:[!*]\s+)?([A-Z][^\s;]*)(?:\s+([^;]*?))?\s*(;.*)?$`)
+	beancountAmount   = regexp.MustCompile(`^(\S+)\s+([A-Z][A-Z0-9'._-]*)\s*(\{\{[^}]*\}\}|\{[^}]*\})?\s*(@@?\s*\S+\s+\S+)?$`)
+	beancountMetadata = regexp.MustCompile(`^(\s+)([a-z][A-Za-z0-9_-]*):\s*(.*)$`)
+)
+
+// beancountLine converts one line of Beancount data.  Directives with
+// no ledger-cli equivalent are commented out.
+func beancountLine(line string) string {
+	if m := beancountDated.FindStringSubmatch(line); m != nil {
+		date, directive, rest := strings.ReplaceAll(m[1], "-", "/"), m[2], m[3]
+		switch directive {
+		case "*", "!", "txn":
+			state := ""
+			if directive != "txn" {
+				state = directive + " "
+			}
+			var str []string
+			for _, s := range beancountString.FindAllStringSubmatch(rest, -1) {
+				str = append(str, s[1])
+			}
+			var tag []string
+			for _, t := range beancountTag.FindAllStringSubmatch(beancountString.ReplaceAllString(rest, ""), -1) {
+				if t[1] == "#" {
+					tag = append(tag, t[2])
+				} else {
+					tag = append(tag, "link-"+t[2])
+				}
+			}
+			payee := fmt.Sprintf("%s %s%s", date, state, strings.Join(str, " | "))
+			if len(tag) > 0 {
+				payee = fmt.Sprintf("%s ; :%s:", payee, strings.Join(tag, ":"))
+			}
+			return payee
+		case "open":
+			field := strings.Fields(rest)
+			if len(field) > 0 {
+				return fmt.Sprintf("account %s", field[0])
+			}
+		case "price":
+			return fmt.Sprintf("P %s %s", date, rest)
+		}
+		return "; " + line
+	}
+
+	if m := beancountMetadata.FindStringSubmatch(line); m != nil {
+		// i.e. `  txid: "abc"` becomes `  ; txid: abc`
+		return fmt.Sprintf("%s; %s: %s", m[1], m[2], strings.Trim(m[3], `"`))
+	}
+
+	if m := beancountPosting.FindStringSubmatch(line); m != nil {
+		indent, account, amount, comment := m[1], m[2], m[3], m[4]
+		if amount != "" {
+			a := beancountAmount.FindStringSubmatch(amount)
+			if a == nil {
+				return fmt.Sprintf("%s%s  %s %s", indent, account, amount, comment) // let parser report error
+			}
+			number, asset, cost, price := strings.ReplaceAll(a[1], ",", ""), a[2], a[3], a[4]
+			amount = fmt.Sprintf("%s %s", number, asset)
+			switch {
+			case price != "":
+				// price of sale takes precedence over cost of lot
+				amount = fmt.Sprintf("%s %s", amount, price)
+			case cost != "":
+				// i.e. "{0.02 USD, 2016-01-01}", use only the amount
+				c := strings.Split(strings.Trim(cost, "{}"), ",")
+				if len(strings.Fields(c[0])) == 2 {
+					op := "@"
+					if strings.HasPrefix(cost, "{{") {
+						op = "@@"
+					}
+					amount = fmt.Sprintf("%s %s %s", amount, op, strings.TrimSpace(c[0]))
+				}
+			}
+			line = fmt.Sprintf("%s%s  %s", indent, account, amount)
+		} else {
+			line = indent + account
+		}
+		if comment != "" {
+			line = fmt.Sprintf("%s %s", line, comment)
+		}
+		return line
+	}
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, ";") {
+		return line
+	}
+	// option, plugin, include, pushtag, etc.
+	return "; " + line
+}
+
+// convertReader reads ledger-cli data, converted one chunk at a time
+// by next().
+type convertReader struct {
+	next func() (string, error) // returns io.EOF when no more data
+	buf  bytes.Buffer
+	err  error
+}
+
+func (this *convertReader) Read(p []byte) (int, error) {
+	for this.buf.Len() < len(p) && this.err == nil {
+		var chunk string
+		chunk, this.err = this.next()
+		this.buf.WriteString(chunk)
+	}
+	if this.buf.Len() == 0 {
+		return 0, this.err
+	}
+	return this.buf.Read(p)
+}
+
+// Structure of `ledger xml` output, only as much as lotter needs.
+type (
+	ledgerXMLAmount struct {
+		Symbol   string `xml:"commodity>symbol"`
+		Quantity string `xml:"quantity"`
+	}
+	ledgerXMLMetadata struct {
+		Tag   []string `xml:"tag"`
+		Value []struct {
+			Key    string `xml:"key,attr"`
+			String string `xml:"string"`
+		} `xml:"value"`
+	}
+	ledgerXMLPosting struct {
+		State    string            `xml:"state,attr"`
+		Virtual  bool              `xml:"virtual,attr"`
+		Account  string            `xml:"account>name"`
+		Amount   *ledgerXMLAmount  `xml:"post-amount>amount"`
+		Cost     *ledgerXMLAmount  `xml:"cost>amount"`
+		Note     string            `xml:"note"`
+		Metadata ledgerXMLMetadata `xml:"metadata"`
+	}
+	ledgerXMLTransaction struct {
+		State    string             `xml:"state,attr"`
+		Date     string             `xml:"date"`
+		Code     string             `xml:"code"`
+		Payee    string             `xml:"payee"`
+		Note     string             `xml:"note"`
+		Metadata ledgerXMLMetadata  `xml:"metadata"`
+		Posting  []ledgerXMLPosting `xml:"postings>posting"`
+	}
+)
+
+func (this ledgerXMLAmount) String() string {
+	return fmt.Sprintf("%s %s", strings.ReplaceAll(this.Quantity, ",", ""), this.Symbol)
+}
+
+// comments returns the note and metadata, as ledger-cli comments.
+func (this ledgerXMLMetadata) comments(note string) (ret []string) {
+	for _, n := range strings.Split(strings.TrimSpace(note), "\n") {
+		if n = strings.TrimSpace(n); n != "" {
+			ret = append(ret, n)
+		}
+	}
+	if len(this.Tag) > 0 {
+		ret = append(ret, fmt.Sprintf(":%s:", strings.Join(this.Tag, ":")))
+	}
+	for _, v := range this.Value {
+		ret = append(ret, fmt.Sprintf("%s: %s", v.Key, v.String))
+	}
+	return ret
+}
+
+// ledgerXMLConverter converts the transactions of `ledger xml`
+// output.  Other elements (i.e. accounts and commodities) are
+// ignored.
+func ledgerXMLConverter(in io.Reader) func() (string, error) {
+	dec := xml.NewDecoder(in)
+	return func() (string, error) {
+		for {
+			token, err := dec.Token()
+			if err != nil {
+				return "", err
+			}
+			start, ok := token.(xml.StartElement)
+			if !ok || start.Name.Local != "transaction" {
+				continue
+			}
+			var tx ledgerXMLTransaction
+			err = dec.DecodeElement(&tx, &start)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse ledger xml: %w", err)
+			}
+
+			var b strings.Builder
+			payee := strings.ReplaceAll(tx.Date, "-", "/")
+			switch tx.State {
+			case "cleared":
+				payee += " *"
+			case "pending":
+				payee += " !"
+			}
+			if tx.Code != "" {
+				payee += fmt.Sprintf(" (%s)", tx.Code)
+			}
+			fmt.Fprintf(&b, "%s %s\n", payee, tx.Payee)
+			for _, c := range tx.Metadata.comments(tx.Note) {
+				fmt.Fprintf(&b, "    ; %s\n", c)
+			}
+			for _, p := range tx.Posting {
+				account := p.Account
+				if p.Virtual {
+					account = "[" + account + "]"
+				}
+				switch p.State {
+				case "cleared":
+					account = "* " + account
+				case "pending":
+					account = "! " + account
+				}
+				amount := ""
+				if p.Amount != nil {
+					amount = p.Amount.String()
+					if p.Cost != nil && p.Cost.Symbol != p.Amount.Symbol {
+						amount = fmt.Sprintf("%s @@ %s", amount, strings.TrimPrefix(p.Cost.String(), "-"))
+					}
+				}
+				fmt.Fprintf(&b, "    %s\n", importSplit(account, amount))
+				for _, c := range p.Metadata.comments(p.Note) {
+					fmt.Fprintf(&b, "        ; %s\n", c)
+				}
+			}
+			b.WriteString("\n")
+			return b.String(), nil
+		}
+	}
+}
+
+// lotterJSONConverter converts JSON written by `lotter -format json`.
+// Generated postings are omitted, so that lots may be generated anew.
+func lotterJSONConverter(in io.Reader) func() (string, error) {
+	dec := json.NewDecoder(in)
+	return func() (string, error) {
+		var tx outputTx
+		err := dec.Decode(&tx)
+		if err != nil {
+			if err != io.EOF {
+				err = fmt.Errorf("failed to parse json: %w", err)
+			}
+			return "", err
+		}
+
+		var b strings.Builder
+		payee := strings.ReplaceAll(tx.Date, "-", "/")
+		if tx.State != "" {
+			payee += " " + tx.State
+		}
+		fmt.Fprintf(&b, "%s %s\n", payee, tx.Payee)
+		for _, c := range tx.Comment {
+			fmt.Fprintf(&b, "    ; %s\n", c)
+		}
+		lotted := false
+		for _, p := range tx.Postings {
+			lotted = lotted || p.Generated
+		}
+		for _, p := range tx.Postings {
+			if p.Generated {
+				continue
+			}
+			if lotted && p.Price == "" && strings.HasPrefix(p.Comment, "@") {
+				// restore price commented out by lot
+				p.Price, p.Comment = p.Comment, ""
+			}
+			amount := ""
+			if p.Amount != "" {
+				amount = strings.TrimSpace(fmt.Sprintf("%s %s %s", p.Amount, p.Asset, p.Price))
+			}
+			if p.Comment != "" {
+				amount = strings.TrimSpace(fmt.Sprintf("%s ; %s", amount, p.Comment))
+			}
+			fmt.Fprintf(&b, "    %s\n", importSplit(p.Account, amount))
+		}
+		b.WriteString("\n")
+		return b.String(), nil
+	}
+}
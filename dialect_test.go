@@ -0,0 +1,145 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// dialect returns input converted from dialect.
+func dialect(t *testing.T, dialect string, input string) string {
+	t.Helper()
+	r, err := NewDialectReader(dialect, strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(converted)
+}
+
+func TestXMLDialect(t *testing.T) {
+	got := dialect(t, "xml", `<?xml version="1.0" encoding="utf-8"?>
+<ledger version="197120">
+  <commodities><commodity flags="S"><symbol>USD</symbol></commodity></commodities>
+  <accounts><account id="1"><name>Assets</name></account></accounts>
+  <transactions>
+    <transaction state="cleared">
+      <date>2021-01-02</date>
+      <code>42</code>
+      <payee>Buy</payee>
+      <note> order 7</note>
+      <metadata><tag>TRADE</tag><value key="txid"><string>abc</string></value></metadata>
+      <postings>
+        <posting>
+          <account ref="1"><name>Assets:Broker</name></account>
+          <post-amount><amount><commodity><symbol>ABC</symbol></commodity><quantity>1,000</quantity></amount></post-amount>
+          <cost><amount><commodity><symbol>USD</symbol></commodity><quantity>20</quantity></amount></cost>
+        </posting>
+        <posting state="pending" virtual="true">
+          <account ref="2"><name>Assets:Cash</name></account>
+          <post-amount><amount><commodity><symbol>USD</symbol></commodity><quantity>-20</quantity></amount></post-amount>
+          <note>fee waived</note>
+        </posting>
+      </postings>
+    </transaction>
+  </transactions>
+</ledger>
+`)
+	expect := "2021/01/02 * (42) Buy\n" +
+		"    ; order 7\n" +
+		"    ; :TRADE:\n" +
+		"    ; txid: abc\n" +
+		"    " + importSplit("Assets:Broker", "1000 ABC @@ 20 USD") + "\n" + // total cost
+		"    " + importSplit("! [Assets:Cash]", "-20 USD") + "\n" +
+		"        ; fee waived\n" +
+		"\n"
+	if got != expect {
+		t.Errorf("xml converted:\n%s\nexpected:\n%s", got, expect)
+	}
+
+	r, _ := NewDialectReader("xml", strings.NewReader("<ledger><transactions><transaction><date>"))
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("no error reading truncated xml")
+	}
+	if _, err := NewDialectReader("hledger", nil); err == nil {
+		t.Error("no error of unknown dialect")
+	}
+}
+
+// Lotting JSON written by lot, then read with -dialect json, matches
+// lotting the original journal.
+func TestJSONDialect(t *testing.T) {
+	settings := newSettings()
+	var lotted bytes.Buffer
+	output, err := NewOutput("json", &lotted, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.NewReader(summaryJournal)
+	env := &environment{settings: settings, scanner: NewTxScanner(in), input: in, output: output, problems: newProblemTally(-1)}
+	err = Pipeline{{Operation: "lot"}}.Run(env)
+	if err == nil {
+		err = output.Flush()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	converted := dialect(t, "json", lotted.String())
+	if strings.Contains(converted, "[Lot") {
+		t.Errorf("generated splits not omitted:\n%s", converted)
+	}
+	relotted := lotJournal(t, converted)
+	expect := lotJournal(t, summaryJournal)
+	if strings.Join(reportLines(string(relotted)), "\n") != strings.Join(reportLines(string(expect)), "\n") {
+		t.Errorf("json lotted:\n%s\nexpected:\n%s", relotted, expect)
+	}
+}
+
+func TestBeancountDialect(t *testing.T) {
+	for line, expect := range map[string]string{
+		`2021-01-02 * "Broker" "Buy ABC" #trade ^order-7`:   "2021/01/02 * Broker | Buy ABC ; :trade:link-order-7:",
+		`2021-01-02 txn "Sell"`:                             "2021/01/02 Sell",
+		`2021-01-01 open Assets:Broker USD,ABC`:             "account Assets:Broker",
+		`2021-01-03 price ABC 21 USD`:                       "P 2021/01/03 ABC 21 USD",
+		`2021-01-04 balance Assets:Broker 10 ABC`:           "; 2021-01-04 balance Assets:Broker 10 ABC",
+		`option "operating_currency" "USD"`:                 `; option "operating_currency" "USD"`,
+		`  txid: "abc"`:                                     "  ; txid: abc",
+		`  Assets:Broker  1,000 ABC {0.02 USD, 2016-01-01}`: "  Assets:Broker  1000 ABC @ 0.02 USD", // cost of lot, date dropped
+		`  Assets:Broker  10 ABC {{20 USD}}`:                "  Assets:Broker  10 ABC @@ 20 USD",
+		`  Assets:Broker  -10 ABC {0.02 USD} @ 0.03 USD`:    "  Assets:Broker  -10 ABC @ 0.03 USD", // price of sale, not cost
+		`  ! Assets:Cash  -20 USD ; fee`:                    "  Assets:Cash  -20 USD ; fee",
+		`  Assets:Cash`:                                     "  Assets:Cash",
+		`  ; comment`:                                       "  ; comment",
+	} {
+		if got := beancountLine(line); got != expect {
+			t.Errorf("beancount %q converted %q, expected %q", line, got, expect)
+		}
+	}
+
+	// line numbers preserved, so errors refer to beancount source
+	got := dialect(t, "beancount", "option \"title\" \"x\"\n\n2021-01-02 * \"Buy\"\n  Assets:Broker  1 ABC {20 USD}\n  Assets:Cash\n")
+	expect := "; option \"title\" \"x\"\n\n2021/01/02 * Buy\n  Assets:Broker  1 ABC @ 20 USD\n  Assets:Cash\n"
+	if got != expect {
+		t.Errorf("beancount converted:\n%s\nexpected:\n%s", got, expect)
+	}
+}
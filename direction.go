@@ -0,0 +1,114 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// directionRule declares that accounts matching a pattern only acquire
+// (i.e. payouts of a mining rig) or only dispose of assets.
+type directionRule struct {
+	pattern   *regexp.Regexp
+	direction string // "acquire" or "dispose"
+	asset     map[Asset]bool
+}
+
+// directionRules are read from the file named by `lot -directions`.
+type directionRules []directionRule
+
+// readDirections reads rules, one per line, of an account pattern
+// (regular expression), direction, and optionally the assets (comma
+// separated) the rule applies to, separated by two or more spaces (or
+// tab).  Without assets, a rule applies to all but base currency.  For
+// example,
+//
+//     ^Assets:Mining(:|$)       acquire
+//     ^Assets:Exchange:Sell$    dispose    BTC,ETH
+//
+// Blank lines and comments (beginning with ";" or "#") are ignored.
+func readDirections(in io.Reader) (directionRules, error) {
+	var ret directionRules
+	s := bufio.NewScanner(in)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := accountSeparator.Split(text, 3)
+		if len(field) < 2 {
+			return nil, lineErrorf(line, "expected account pattern and direction (%q)", text)
+		}
+		pattern, err := regexp.Compile(field[0])
+		if err != nil {
+			return nil, lineErrorf(line, "bad account pattern (%q): %w", field[0], err)
+		}
+		rule := directionRule{pattern: pattern, direction: strings.TrimSpace(field[1])}
+		if rule.direction != "acquire" && rule.direction != "dispose" {
+			return nil, lineErrorf(line, "unexpected direction (%q), expected acquire or dispose", rule.direction)
+		}
+		if len(field) == 3 {
+			rule.asset = make(map[Asset]bool)
+			for _, a := range strings.Split(field[2], ",") {
+				if a = strings.TrimSpace(a); a != "" {
+					rule.asset[Asset(a)] = true
+				}
+			}
+		}
+		ret = append(ret, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read directions: %w", err)
+	}
+	return ret, nil
+}
+
+// check returns an error for each split of a transaction against the
+// direction of its account, i.e. a disposal from an account which
+// only acquires, likely a mistake of data entry.
+func (this directionRules) check(s *settings, tx TxLines) []error {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound || len(this) == 0 {
+		return nil
+	}
+	var ret []error
+	for i, line := range tx.Line[payeeIndex+1:] {
+		split, ok := s.parseSplit(line)
+		if !ok || split.delta == nil || split.delta.Sign() == 0 {
+			continue
+		}
+		for _, rule := range this {
+			if !rule.pattern.MatchString(split.account) {
+				continue
+			}
+			if rule.asset == nil && s.isBase(split.delta.Asset) || rule.asset != nil && !rule.asset[split.delta.Asset] {
+				continue
+			}
+			switch {
+			case rule.direction == "acquire" && split.delta.Sign() < 0:
+				ret = append(ret, lineErrorf(tx.Start+payeeIndex+1+i, "disposal of %s from account (%q) which only acquires, see -directions", split.delta.NegClone(), split.account))
+			case rule.direction == "dispose" && split.delta.Sign() > 0:
+				ret = append(ret, lineErrorf(tx.Start+payeeIndex+1+i, "acquisition of %s to account (%q) which only disposes, see -directions", split.delta, split.account))
+			}
+			break // first rule matching decides
+		}
+	}
+	return ret
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDirections(t *testing.T) {
+	rules, err := readDirections(strings.NewReader(`^Assets:Mining(:|$)       acquire
+# BTC and ETH only, others are decided by rules below
+^Assets:Exchange:Sell$    dispose    BTC, ETH
+^Assets:                  acquire
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := scanTx(t, `; splits against the direction of their account
+2021/01/01 Mistakes
+    Assets:Mining:Rig             -1 BTC
+    Assets:Exchange:Sell           1 BTC
+    Assets:Exchange:Sell          -1 ABC
+    Assets:Exchange:Sell           1 ABC
+    Assets:Mining:Rig             -5 USD
+    Assets:Exchange:Sell          -1 ETH
+    Expenses:Fees                  5 USD
+`)
+	errs := rules.check(newSettings(), tx)
+	expect := []string{
+		`line 3: disposal of 1 BTC from account ("Assets:Mining:Rig") which only acquires, see -directions`,
+		`line 4: acquisition of 1 BTC to account ("Assets:Exchange:Sell") which only disposes, see -directions`,
+		`line 5: disposal of 1 ABC from account ("Assets:Exchange:Sell") which only acquires, see -directions`,
+	}
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("errors:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+
+	_, err = readDirections(strings.NewReader("^Assets:Mining  receive\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), `line 1: unexpected direction ("receive")`) {
+		t.Errorf("error of unknown direction is %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"src.d10.dev/command"
+)
+
+// Dust is an amount of an asset too small to matter (i.e. less than
+// exchanges permit to trade, or less than its display precision).
+// With thresholds set (see lot -dust), splits of dust are not lotted,
+// and the remainder of a lot which falls below the threshold is
+// written off to dustAccount, rather than kept open.
+type dustLimit struct {
+	dustThreshold map[Asset]*big.Rat
+	dustAccount   string
+}
+
+// parseDust sets thresholds, i.e. "BTC=0.00000546,ETH=1e-9".
+func (this *dustLimit) parseDust(str string) error {
+	for _, field := range strings.Split(str, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		part := strings.SplitN(field, "=", 2)
+		if len(part) != 2 {
+			return fmt.Errorf("bad dust (%q), expected <asset>=<amount>", field)
+		}
+		threshold, ok := new(big.Rat).SetString(strings.TrimSpace(part[1]))
+		if !ok || threshold.Sign() < 0 {
+			return fmt.Errorf("bad dust (%q), expected <asset>=<amount>", field)
+		}
+		this.dustThreshold[Asset(strings.TrimSpace(part[0]))] = threshold
+	}
+	return nil
+}
+
+// isDust returns true if amount is non-zero, and less (in magnitude)
+// than the threshold of its asset.
+func (this *dustLimit) isDust(amount Amount) bool {
+	threshold, ok := this.dustThreshold[amount.Asset]
+	if !ok || amount.Sign() == 0 {
+		return false
+	}
+	return new(big.Rat).Abs(amount.Rat).Cmp(threshold) < 0
+}
+
+// dropDust removes splits of dust from those of a transaction, and
+// returns a comment for each removed.
+func (this *lotter) dropDust(splits map[Asset]map[string][]Split) (generated []Posting) {
+	for _, asset := range sortedAssets(splits) {
+		if this.isBase(asset) {
+			continue
+		}
+		for _, qual := range sortedQualifiers(splits[asset]) {
+			var keep []Split
+			for _, s := range splits[asset][qual] {
+				if s.delta != nil && this.isDust(*s.delta) {
+					command.V(1).Infof("dust %s (%q) not lotted", s.delta, s.line)
+					generated = append(generated, Posting{Comment: fmt.Sprintf(":DUST: %s of %s not lotted", s.delta, s.account)})
+					continue
+				}
+				keep = append(keep, s)
+			}
+			if len(keep) == 0 {
+				delete(splits[asset], qual)
+			} else {
+				splits[asset][qual] = keep
+			}
+		}
+		if len(splits[asset]) == 0 {
+			delete(splits, asset)
+		}
+	}
+	return generated
+}
+
+// writeOffDust closes lots left holding dust, by the consumption of
+// lots.  Their inventory and basis are moved to dustAccount.
+func (this *lotter) writeOffDust(consumed []Lot) (generated []Posting) {
+	if len(this.dustThreshold) == 0 {
+		return nil
+	}
+	type key struct {
+		asset     Asset
+		qualifier string
+	}
+	checked := make(map[key]bool)
+	for _, l := range consumed {
+		k := key{l.inventory.Asset, l.qualifier}
+		if checked[k] || this.dustThreshold[k.asset] == nil {
+			continue
+		}
+		checked[k] = true
+
+		// a lot partially consumed is last in queue (next consumed)
+		queue := this.lotQueue[k.asset][k.qualifier]
+		for queue.Len() > 0 && this.isDust(queue.lot[queue.Len()-1].inventory) {
+			dust := queue.lot[queue.Len()-1]
+			queue.lot[queue.Len()-1] = Lot{}
+			queue.lot = queue.lot[:queue.Len()-1]
+
+			basis := this.NewAmount(this.base, *new(big.Rat).Mul(dust.price, dust.inventory.Rat))
+			generated = append(generated,
+				Posting{Account: dust.name, Amount: dust.inventory.Clone(), Comment: ":DUST: (inventory written off)"},
+				Posting{Account: dust.name, Amount: basis.NegClone(), Comment: ":DUST: (basis written off)", Disabled: basis.Sign() == 0},
+				Posting{Account: this.dustAccount, Amount: dust.inventory.NegClone(), Comment: ":DUST: (inventory)"},
+				Posting{Account: this.dustAccount, Amount: basis, Comment: ":DUST: (basis)", Disabled: basis.Sign() == 0},
+			)
+		}
+		this.lotQueue[k.asset][k.qualifier] = queue
+	}
+	return generated
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDust(t *testing.T) {
+	d := dustLimit{dustThreshold: make(map[Asset]*big.Rat)}
+	err := d.parseDust("BTC=0.00000546, ETH=1e-9,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := newSettings()
+	for _, test := range []struct {
+		amount Amount
+		dust   bool
+	}{
+		{settings.NewAmount("BTC", *big.NewRat(-5, 1e8)), true}, // in magnitude
+		{settings.NewAmount("BTC", *big.NewRat(546, 1e8)), false},
+		{settings.NewAmount("ETH", *big.NewRat(1, 1e10)), true},
+		{settings.NewAmount("ETH", *new(big.Rat)), false},
+		{settings.NewAmount("XYZ", *big.NewRat(1, 1e10)), false}, // no threshold
+	} {
+		if got := d.isDust(test.amount); got != test.dust {
+			t.Errorf("%s is dust %t, expected %t", test.amount, got, test.dust)
+		}
+	}
+
+	for _, bad := range []string{"BTC", "BTC=", "BTC=-1", "BTC=tiny"} {
+		if err := d.parseDust(bad); err == nil {
+			t.Errorf("no error parsing %q", bad)
+		}
+	}
+}
+
+// TestDust writes off dust left in a lot by a sale, so that the lot
+// closes, and does not lot dust swept later.
+func TestDust(t *testing.T) {
+	journal, err := os.ReadFile(filepath.Join("testdata", "dust.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lotted := string(lotJournal(t, string(journal), "-dust=BTC=0.00001", "-dust-account=Expenses:Dust:Written"))
+	_, sale, _ := strings.Cut(lotted, "2021/02/01 Sell most")
+	expectLines(t, reportLines(sale),
+		"[Lot::2021/01/01:1BTC@30000USD] 0.000000001 BTC ; :DUST: (inventory written off)",
+		"[Lot::2021/01/01:1BTC@30000USD] -0.00003 USD ; :DUST: (basis written off)",
+		"[Expenses:Dust:Written] -0.000000001 BTC ; :DUST: (inventory)",
+		"[Expenses:Dust:Written] 0.00003 USD ; :DUST: (basis)",
+	)
+	expectLines(t, reportLines(lotted),
+		"; :DUST: -0.000000001 BTC of Assets:Exchange not lotted",
+		"; :DUST: 0.000000001 BTC of Expenses:Dust not lotted",
+	)
+
+	// without -dust, the lot stays open
+	for _, test := range []struct {
+		arg    []string
+		expect string
+	}{
+		{nil, "BTC (all accounts), fifo: 0.000000001 BTC, basis 0.00003 USD"},
+		{[]string{"-dust=BTC=0.00001"}, ""},
+	} {
+		var out bytes.Buffer
+		err := runOperation(&out, newSettings(), newProblemTally(-1), journal, "queue", test.arg...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _, _ := strings.Cut(out.String(), "\n"); got != test.expect {
+			t.Errorf("queue %v: %q, expected %q", test.arg, got, test.expect)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"src.d10.dev/command"
+)
+
+// groupFills returns a scanner of the transactions of in, with
+// consecutive partial fills of one order (disposals with the same
+// date, payee and asset) grouped into one transaction.  The splits of
+// each fill are kept, and the payee line of each fill after the first
+// is kept as a comment (i.e. "; fill: 2021/01/01 Sell ABC").
+func (this *settings) groupFills(in *TxScanner) *TxScanner {
+	var pending []TxLines // read ahead, not yet returned
+	next := func() (TxLines, bool) {
+		if len(pending) > 0 {
+			tx := pending[0]
+			pending = pending[1:]
+			return tx, true
+		}
+		if !in.Scan() {
+			return TxLines{}, false
+		}
+		return in.Lines(), true
+	}
+
+	return newTxSource(func() (TxLines, bool) {
+		first, ok := next()
+		if !ok {
+			return first, false
+		}
+		key := this.fillKey(first)
+		if key == "" {
+			return first, true
+		}
+		fill := []TxLines{first}
+		for {
+			tx, ok := next()
+			if !ok {
+				break
+			}
+			if this.fillKey(tx) != key {
+				pending = append(pending, tx)
+				break
+			}
+			fill = append(fill, tx)
+		}
+		if len(fill) == 1 {
+			return first, true
+		}
+
+		// Amounts left blank are written, as ledger-cli permits only
+		// one null-amount split per transaction.
+		var group TxLines
+		for i, tx := range fill {
+			tx, err := this.explicitSplits(tx)
+			if err != nil {
+				// not grouped, lot will report the problem
+				command.V(1).Infof("not grouping fills of %q (line %d): %s", first.Line[0], first.Start, err)
+				pending = append(fill[1:], pending...)
+				return first, true
+			}
+			if i == 0 {
+				group = tx
+			} else {
+				group = appendLeg(group, tx, "fill")
+			}
+		}
+		_, payeeIndex := group.Payee()
+		command.V(1).Infof("grouped %d fills of %q (line %d)", len(fill), group.Line[payeeIndex], group.Start+payeeIndex)
+		return group, true
+	})
+}
+
+// fillKey returns date, payee and asset disposed of a transaction
+// which may be a partial fill, or empty string if it may not.
+func (this *settings) fillKey(tx TxLines) string {
+	payee, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound || !this.disposes(tx) {
+		return ""
+	}
+	for _, line := range tx.Line[:payeeIndex] {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, ";") {
+			return "" // i.e. a directive, not a comment
+		}
+	}
+	_, _, description, _ := payeeFields(payee)
+	for _, line := range tx.Line[payeeIndex+1:] {
+		split, ok := this.parseSplit(line)
+		if ok && split.delta != nil && split.delta.Sign() < 0 && !this.isBase(split.delta.Asset) && !split.isLoan() {
+			return fmt.Sprintf("%s %s %s", tx.Date.Format("2006/01/02"), split.delta.Asset, description)
+		}
+	}
+	return ""
+}
+
+// appendLeg adds the lines of a fill (or leg of an order) to the
+// group.  Lines which would end the transaction (its payee line, and
+// comments before it) are indented, as comments, the payee line
+// tagged with label (i.e. "; fill: ...").
+func appendLeg(group, fill TxLines, label string) TxLines {
+	_, payeeIndex := fill.Payee()
+	line := append([]string(nil), group.Line...)
+	for i, l := range fill.Line {
+		switch {
+		case i == payeeIndex:
+			line = append(line, "    ; "+label+": "+strings.TrimSpace(l))
+		case i < payeeIndex:
+			if l = strings.TrimSpace(l); l != "" {
+				line = append(line, "    "+l)
+			}
+		default:
+			line = append(line, l)
+		}
+	}
+	group.Line = line
+	group.joined = fill.joined
+	group.Generated = append(append([]string(nil), group.Generated...), fill.Generated...)
+	return group
+}
+
+// explicitSplits writes the calculated amount of each null-amount
+// split of a transaction (one split per asset balanced).
+func (this *settings) explicitSplits(tx TxLines) (TxLines, error) {
+	_, payeeIndex := tx.Payee()
+	splits, _, balanced, err := this.produceSplits(tx.Line[payeeIndex+1:])
+	if err != nil || balanced {
+		return tx, err
+	}
+
+	calculated := make(map[string][]Amount) // by line
+	for _, asset := range sortedAssets(splits) {
+		for _, qual := range sortedQualifiers(splits[asset]) {
+			for _, split := range splits[asset][qual] {
+				if split.nullAmount {
+					calculated[split.line] = append(calculated[split.line], *split.delta)
+				}
+			}
+		}
+	}
+
+	// aligned with other amounts, when possible
+	column := amountColumn(tx)
+
+	line := append([]string(nil), tx.Line[:payeeIndex+1]...)
+	for _, l := range tx.Line[payeeIndex+1:] {
+		amount, ok := calculated[l]
+		if !ok {
+			line = append(line, l)
+			continue
+		}
+		commentSplit := strings.SplitN(l, ";", 2)
+		account := strings.TrimRight(commentSplit[0], " \t")
+		for i, a := range amount {
+			pad := column - utf8.RuneCountInString(account) - utf8.RuneCountInString(a.String())
+			if pad < 2 {
+				pad = 2
+			}
+			explicit := account + strings.Repeat(" ", pad) + a.String()
+			if i == 0 && len(commentSplit) > 1 {
+				explicit = fmt.Sprintf("%s ;%s", explicit, commentSplit[1])
+			}
+			line = append(line, explicit)
+		}
+		delete(calculated, l) // in case of duplicate lines
+	}
+	tx.Line = line
+	return tx, nil
+}
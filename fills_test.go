@@ -0,0 +1,102 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const fillsJournal = `2021/01/01 Buy ABC
+    Assets:Exchange             10 ABC @ 1 USD
+    Assets:Bank
+
+2021/03/01 Sell ABC
+    Assets:Exchange             -2 ABC @ 3 USD
+    Assets:Bank
+
+2021/03/01 Sell ABC
+    Assets:Exchange             -3 ABC @ 4 USD
+    Assets:Bank
+
+2021/03/01 Sell ABC now
+    Assets:Exchange             -1 ABC @ 4 USD
+    Assets:Bank
+
+2021/03/02 Sell ABC
+    Assets:Exchange             -1 ABC @ 4 USD
+    Assets:Bank
+`
+
+// TestGroupFills groups consecutive fills of one date, payee and
+// asset, but not a fill of another payee or date.
+func TestGroupFills(t *testing.T) {
+	s := newSettings().groupFills(NewTxScanner(strings.NewReader(fillsJournal)))
+	var payee []string
+	var grouped TxLines
+	for s.Scan() {
+		tx := s.Lines()
+		p, payeeIndex := tx.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		payee = append(payee, p)
+		if len(payee) == 2 {
+			grouped = tx
+			grouped.Line = append([]string(nil), tx.Line...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "2021/01/01 Buy ABC, 2021/03/01 Sell ABC, 2021/03/01 Sell ABC now, 2021/03/02 Sell ABC"
+	if got := strings.Join(payee, ", "); got != expect {
+		t.Errorf("transactions %s, expected %s", got, expect)
+	}
+
+	// splits of each fill, with null amounts written
+	var split []string
+	for _, line := range grouped.Line {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			split = append(split, line)
+		}
+	}
+	want := []string{
+		"2021/03/01 Sell ABC",
+		"Assets:Exchange -2 ABC @ 3 USD",
+		"Assets:Bank 6 USD",
+		"; fill: 2021/03/01 Sell ABC",
+		"Assets:Exchange -3 ABC @ 4 USD",
+		"Assets:Bank 12 USD",
+	}
+	if strings.Join(split, "\n") != strings.Join(want, "\n") {
+		t.Errorf("grouped:\n%s\nexpected:\n%s", strings.Join(split, "\n"), strings.Join(want, "\n"))
+	}
+
+	// one gain split of the fills grouped
+	lotted := string(lotJournal(t, fillsJournal, "-group-fills"))
+	_, sale, _ := strings.Cut(lotted, "2021/03/01 Sell ABC\n")
+	sale, _, _ = strings.Cut(sale, "2021/03/01 Sell ABC now")
+	var gain []string
+	for _, line := range generatedLines(sale) {
+		if strings.HasPrefix(line, "[Lot:Income:") {
+			gain = append(gain, line)
+		}
+	}
+	if strings.Join(gain, "\n") != "[Lot:Income:short term gain] -13 USD ; :GAIN:SHORTTERM:" {
+		t.Errorf("gain of fills grouped:\n%s", sale)
+	}
+}
@@ -1,6 +1,6 @@
 module src.d10.dev/lotter
 
-go 1.15
+go 1.18
 
 require src.d10.dev/command v0.0.0-20201230093613-a8448f374bdf
 
@@ -0,0 +1,108 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+// Helpers for operations which import data other than ledger-cli.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns finds the index of each wanted column in a CSV header.
+// Wanted columns are named by a key, and matched (without regard to
+// case) against any of the names listed.  Columns not found are
+// omitted from the result.
+func csvColumns(header []string, want map[string][]string) map[string]int {
+	ret := make(map[string]int)
+	for key, names := range want {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), name) {
+					ret[key] = i
+					break
+				}
+			}
+			if _, ok := ret[key]; ok {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// columnNames returns the names a column may be known by, preferring
+// the name given by a command line flag (if any).
+func columnNames(flag string, names ...string) []string {
+	if flag != "" {
+		return []string{flag}
+	}
+	return names
+}
+
+var timestampFormat = [...]string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006/01/02 15:04:05",
+	"2006-01-02 15:04",
+	"01/02/2006 15:04:05",
+	"01/02/2006",
+}
+
+// parseTimestamp parses the date and time formats commonly found in
+// exported CSV, including unix time (seconds since epoch).
+func parseTimestamp(str string) (time.Time, error) {
+	str = strings.TrimSpace(str)
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	for _, f := range timestampFormat {
+		t, err := time.Parse(f, str)
+		if err == nil {
+			return t, nil
+		}
+	}
+	t, err := parseDate(str)
+	if err != nil {
+		return t, fmt.Errorf("failed to parse date/time (%q)", str)
+	}
+	return t, nil
+}
+
+// importTx composes a transaction from a payee line and splits.
+func importTx(date time.Time, payee string, split ...string) TxLines {
+	line := []string{fmt.Sprintf("%s %s", date.Format("2006/01/02"), payee)}
+	for _, s := range split {
+		line = append(line, "    "+s)
+	}
+	tx := TxLines{Line: line}
+	tx.findPayee()
+	return tx
+}
+
+// importSplit composes a split, i.e. "Assets:Crypto  1 ABC @@ 2 USD".
+func importSplit(account string, amount string) string {
+	if amount == "" {
+		return account
+	}
+	return fmt.Sprintf("%-40s  %s", account, amount)
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inputClient fetches URLs of -f.  The timeout includes reading the
+// body, so that a server which stalls fails the fetch, rather than
+// hanging lotter.
+var inputClient = &http.Client{Timeout: 2 * time.Minute}
+
+// openInput opens input named by -f: a file ("~/" is the home
+// directory), "-" for standard input, a URL (http or https, fetched
+// read-only), or a command whose output is read (i.e. "!ledger
+// print").
+func openInput(name string) (io.ReadCloser, error) {
+	switch {
+	case name == "-":
+		return ioutil.NopCloser(os.Stdin), nil
+	case isURL(name):
+		resp, err := inputClient.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetch failed (%s)", resp.Status)
+		}
+		return resp.Body, nil
+	case strings.HasPrefix(name, "!"):
+		cmd := exec.Command("sh", "-c", name[1:])
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		return &commandInput{cmd: cmd, out: out}, nil
+	}
+	path, err := expandHome(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// expandHome replaces a leading "~/" (or "~" alone) of a path with the
+// home directory, as a shell would when the path is not quoted.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path, err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// commandInput is the output of a command (see openInput).  When the
+// command fails, its error is returned in place of io.EOF, so that
+// partial output is not taken for the whole.
+type commandInput struct {
+	cmd  *exec.Cmd
+	out  io.ReadCloser
+	done bool
+}
+
+func (this *commandInput) Read(p []byte) (int, error) {
+	n, err := this.out.Read(p)
+	if err == io.EOF && !this.done {
+		this.done = true
+		if e := this.cmd.Wait(); e != nil {
+			return n, fmt.Errorf("command (%q) failed: %w", strings.Join(this.cmd.Args[2:], " "), e)
+		}
+	}
+	return n, err
+}
+
+func (this *commandInput) Close() error {
+	if this.done {
+		return nil
+	}
+	this.done = true
+	this.out.Close()
+	return this.cmd.Wait()
+}
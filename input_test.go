@@ -0,0 +1,77 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readInput returns all of the input named, as -f would read it.
+func readInput(name string) (string, error) {
+	in, err := openInput(name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	b, err := ioutil.ReadAll(in)
+	return string(b), err
+}
+
+func TestOpenInput(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := os.WriteFile(filepath.Join(home, "journal.ledger"), []byte("from home"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/journal.ledger" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("from URL"))
+	}))
+	defer server.Close()
+
+	for name, expect := range map[string]string{
+		"~/journal.ledger":                    "from home",
+		server.URL + "/journal.ledger":        "from URL",
+		"!printf 'from %s' command":           "from command",
+		filepath.Join(home, "journal.ledger"): "from home",
+	} {
+		got, err := readInput(name)
+		if err != nil || got != expect {
+			t.Errorf("input %q is %q (%v), expected %q", name, got, err, expect)
+		}
+	}
+
+	for name, expect := range map[string]string{
+		"~journal.ledger":         "no such file", // not home
+		server.URL + "/missing":   "fetch failed (404 Not Found)",
+		"!printf partial; exit 3": `command ("printf partial; exit 3") failed`,
+	} {
+		_, err := readInput(name)
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("error of input %q is %v, expected %s", name, err, expect)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// lineageGraph writes which lots funded which (see lot -lineage-out),
+// as a Graphviz DOT graph.  A lot consumed by a move funds the lot of
+// the same asset created at its destination, and a lot consumed by a
+// trade with deferred basis funds each lot the trade creates.
+type lineageGraph struct {
+	w *bufio.Writer
+}
+
+func newLineageGraph(w io.Writer) *lineageGraph {
+	this := &lineageGraph{w: bufio.NewWriter(w)}
+	fmt.Fprintln(this.w, "digraph lineage {")
+	fmt.Fprintln(this.w, "\trankdir=LR;")
+	fmt.Fprintln(this.w, "\tnode [shape=box];")
+	return this
+}
+
+// edges returns the edges from lots consumed by a transaction to lots
+// it created, labeled with its payee line.  Lots are those generated
+// for the transaction, with the comment of each.
+func (this *lineageGraph) edges(payee string, lot []Lot, inventory []Amount, comment []string) []string {
+	var ret []string
+	for i := range lot {
+		if inventory[i].Sign() <= 0 {
+			continue // created, not consumed
+		}
+		for j := range lot {
+			if inventory[j].Sign() >= 0 || lot[i].name == lot[j].name {
+				continue
+			}
+			moved := strings.HasPrefix(comment[i], ":MOVE:") && lot[j].from == lot[i].name
+			deferred := strings.HasPrefix(comment[i], ":SELL:DEFER:") && strings.HasPrefix(comment[j], ":BUY:DEFER:")
+			if !moved && !deferred {
+				continue
+			}
+			edge := fmt.Sprintf("\t%s -> %s [label=%s];", dotQuote(lot[i].name), dotQuote(lot[j].name), dotQuote(strings.TrimSpace(payee)))
+			if !containsString(ret, edge) {
+				ret = append(ret, edge)
+			}
+		}
+	}
+	return ret
+}
+
+// write edges, of a transaction lotted without error.
+func (this *lineageGraph) write(edges []string) {
+	for _, edge := range edges {
+		fmt.Fprintln(this.w, edge)
+	}
+}
+
+func (this *lineageGraph) Close() error {
+	fmt.Fprintln(this.w, "}")
+	return this.w.Flush()
+}
+
+// dotQuote returns str as a DOT string, i.e. "\"Lot::L1\"".
+func dotQuote(str string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(str) + `"`
+}
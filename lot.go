@@ -16,6 +16,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/csv"
 	"fmt"
 	"log"
 	"math/big"
@@ -28,7 +30,10 @@ import (
 type Lot struct {
 	name   string
 	date   time.Time
-	weight uint // order tie-break when dates are equal
+	weight uint64   // order tie-break when dates are equal
+	seq    *big.Rat // tie-break from "seq" metadata, preferred to weight
+
+	qualifier string // lot queue this lot belongs to
 
 	inventory Amount
 
@@ -36,63 +41,150 @@ type Lot struct {
 	startCost      Amount
 
 	price *big.Rat
+
+	from string // name of lot moved, when created by a move
+}
+
+// lotNames names the lots a lotter creates, and weighs them.
+//
+// Weight breaks ties between lots of the same date.  It is derived
+// from the day of the transaction creating a lot, and the sequence of
+// lots created that day, so that a transaction added (or removed) on
+// one day does not change the weight, or name, of lots created on
+// other days.
+//
+// Lot names describe the lot (i.e. "Lot::2021/01/01:10ETH@1000USD"),
+// unless lotNaming is "sequence" or "hash".  Then an opaque ID replaces
+// the date and description, so that balances shared do not reveal
+// quantity or price.  The details are recorded in lotMap, if any.
+type lotNames struct {
+	weightDay  time.Time              // of the transaction creating lots
+	weightDays map[uint64]*dayWeights // per day (see dayNumber)
+
+	names map[string]int // lots of each name (see uniqueLotName)
+	named []string       // names counted since weighDay, see checkpoint
+
+	// "seq" metadata (i.e. "; seq: 1614556800.123") of the transaction
+	// creating lots, if any
+	weightMeta *big.Rat
+
+	lotNaming string
+	lotMap    *csv.Writer
+	lotMapRow [][]string      // recorded, but not yet written (see writeLotMap)
+	lotIDs    map[string]bool // IDs recorded in lotMap
+	lotIDSeq  int
+}
+
+// dayWeights are the sequence of lots created on one day, by however
+// many transactions (not necessarily adjacent in source).
+type dayWeights struct {
+	seq uint64
+}
+
+func (this *dayWeights) clone() *dayWeights {
+	if this == nil {
+		return nil
+	}
+	ret := *this
+	return &ret
 }
 
-var weight uint // counter for each lot created
+// dayNumber is a day's order among days, i.e. key of weightDays.
+func dayNumber(date time.Time) uint64 {
+	return uint64(date.Year())*400 + uint64(date.YearDay())
+}
 
-func NewLot(name string, date time.Time, inventory, basis Amount) *Lot {
+// weighDay prepares to create lots, in a transaction of date.
+func (this *lotNames) weighDay(date time.Time) {
+	this.weightDay = date
+	this.named = this.named[:0]
+}
+
+// weighing returns the sequence of lots created on weightDay.
+func (this *lotNames) weighing() *dayWeights {
+	if this.weightDays == nil {
+		this.weightDays = make(map[uint64]*dayWeights)
+	}
+	day := dayNumber(this.weightDay)
+	if this.weightDays[day] == nil {
+		this.weightDays[day] = &dayWeights{}
+	}
+	return this.weightDays[day]
+}
+
+// uniqueLotName returns name, unless a lot of that name was created
+// before (i.e. bought the same day, or moved to the same account).
+// Then a sequence is appended, i.e. "Lot::2021/01/01:10ETH@1000USD#2".
+func (this *lotNames) uniqueLotName(name string) string {
+	if this.names == nil {
+		this.names = make(map[string]int)
+	}
+	this.names[name]++
+	this.named = append(this.named, name)
+	if n := this.names[name]; n > 1 {
+		return fmt.Sprintf("%s#%d", name, n)
+	}
+	return name
+}
+
+// NewLot returns a lot, or an error if inventory is not positive or
+// basis is negative (i.e. a trade of odd data).
+func NewLot(name string, date time.Time, inventory, basis Amount) (*Lot, error) {
 	if inventory.Sign() < 1 {
-		log.Panicf("lot must have positive inventory (%s)", inventory.String()) // sanity
+		return nil, fmt.Errorf("lot (%q) must have positive inventory (%s)", name, inventory.String())
 	}
 	if basis.Sign() < 0 {
-		log.Panicf("lot must have non-negative basis (%s)", basis.String()) // sanity
+		return nil, fmt.Errorf("lot (%q) must have non-negative basis (%s)", name, basis.String())
 	}
 
 	price := new(big.Rat).Quo(basis.Rat, inventory.Rat) // price = (total cost) / (how many)
 
-	weight++
 	this := &Lot{
 		name:           name,
 		date:           date,
-		weight:         weight,
 		inventory:      inventory,
 		startInventory: inventory,
 		startCost:      basis,
 		price:          price,
 	}
 
-	// sanity
-	if this.price.Sign() < 0 {
-		log.Panicf("Calculated new lot (%q) price %s = %s / %s", name, this.price, this.startCost, this.startInventory)
+	return this, nil
+}
+
+// newLot returns a lot (see NewLot), weighed as the next created on
+// weightDay.
+func (this *lotNames) newLot(name string, date time.Time, inventory, basis Amount) (*Lot, error) {
+	l, err := NewLot(name, date, inventory, basis)
+	if err != nil {
+		return nil, err
 	}
-	return this
+	w := this.weighing()
+	w.seq++
+	l.weight, l.seq = dayNumber(this.weightDay)<<32|w.seq, this.weightMeta
+	return l, nil
 }
 
-func (this *Lot) Sell(delta Amount) (actual, basis Amount) {
-	// sanity
+// Sell consumes inventory of the lot, as much of delta (negative) as
+// it holds.
+func (this *Lot) Sell(delta Amount) (actual, basis Amount, err error) {
 	if delta.Sign() > -1 {
-		log.Panicf("lot.Sell() expects negative amount, got %s", delta)
+		return actual, basis, fmt.Errorf("sale from lot (%q) of non-negative amount (%s)", this.name, delta)
 	}
 	if !delta.Compatible(this.inventory) {
-		log.Panic("lot.Sell() account/asset mismatch")
+		return actual, basis, fmt.Errorf("sale of %s from lot (%q) holding %s", delta.Asset, this.name, this.inventory.Asset)
 	}
 
 	tmp := new(big.Rat)
 	tmp.Add(this.inventory.Rat, delta.Rat) // adding negative delta
 	// tmp is now (inventory - amount to sell)
-	switch tmp.Sign() {
-	case -1:
+	remain := this.inventory.ZeroClone()
+	if tmp.Sign() == -1 {
 		// inventory does not cover delta, actual is limited to inventory amount
-		actual = this.inventory
-		this.inventory = this.inventory.ZeroClone() // nothing remains in inventory
-	case 1:
-		// inventory has more than enough, put remainder back
-		this.inventory.Set(tmp)
-		actual = delta.NegClone()
-	case 0:
-		// exact amount, actual is full delta, set inventory to zero
+		actual = this.inventory.Clone()
+	} else {
+		// inventory covers delta, put remainder (if any) back
+		remain.Set(tmp)
 		actual = delta.NegClone()
-		this.inventory = this.inventory.ZeroClone() // nothing remains
 	}
 
 	// calculate basis that corresponds to inventory consumed
@@ -100,15 +192,16 @@ func (this *Lot) Sell(delta Amount) (actual, basis Amount) {
 	basis.Mul(this.price, actual.Rat)
 	basis.Neg(basis.Rat) // convention: amount sold is positive, basis is negative
 
-	// sanity
+	// sanity, before the lot is changed
 	if actual.Sign() < 1 {
-		log.Panic("lot.Sell() calculated:", actual)
+		return actual, basis, fmt.Errorf("sale from lot (%q) of %s consumed %s", this.name, delta, actual)
 	}
 	if basis.Sign() > 0 { // Note that 0 basis is allowed (i.e. BCH from hard fork)
-		log.Panic("lot.Sell() basis: ", basis, " from price ", this.price)
+		return actual, basis, fmt.Errorf("sale from lot (%q) consumed basis %s, from price %s", this.name, basis, this.price.FloatString(basis.settings.precision(basis.Asset)))
 	}
 
-	return actual, basis
+	this.inventory = remain // a new amount, as checkpoints share the old
+	return actual, basis, nil
 }
 
 type order string
@@ -116,44 +209,97 @@ type order string
 const (
 	FIFO order = "fifo" // first in, first out
 	LIFO order = "lifo" // last in, first out
+	HIFO order = "hifo" // highest (price) in, first out
 )
 
+var lotOrder = [...]order{FIFO, LIFO, HIFO}
+
+// checkOrder returns an error if str is not a supported lot order.
+func checkOrder(str string) error {
+	for _, o := range lotOrder {
+		if order(str) == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad -order (%q), expected fifo, lifo or hifo", str)
+}
+
 type LotQueue struct {
 	lot   []Lot
 	order order
 }
 
-func (this LotQueue) Len() int      { return len(this.lot) }
-func (this LotQueue) Swap(i, j int) { this.lot[i], this.lot[j] = this.lot[j], this.lot[i] }
-func (this LotQueue) Less(i, j int) bool {
+func (this LotQueue) Len() int           { return len(this.lot) }
+func (this LotQueue) Swap(i, j int)      { this.lot[i], this.lot[j] = this.lot[j], this.lot[i] }
+func (this LotQueue) Less(i, j int) bool { return this.less(&this.lot[i], &this.lot[j]) }
+
+func (this LotQueue) less(a, b *Lot) bool {
 	// we sell from the tail of slice
 	switch this.order {
 	case FIFO:
 		// earliest lot comes last in slice
 		// treat equal as later, respecting order of transactions in source
-		return this.lot[i].date.After(this.lot[j].date) || (this.lot[i].date.Equal(this.lot[j].date) && this.lot[i].weight > this.lot[j].weight)
+		return a.date.After(b.date) || (a.date.Equal(b.date) && earlier(b, a))
 	case LIFO:
-		return this.lot[i].date.Before(this.lot[j].date) || (this.lot[i].date.Equal(this.lot[j].date) && this.lot[i].weight < this.lot[j].weight)
+		return a.date.Before(b.date) || (a.date.Equal(b.date) && earlier(a, b))
+	case HIFO:
+		// highest price comes last in slice, FIFO when prices are equal
+		switch a.price.Cmp(b.price) {
+		case 0:
+			return a.date.After(b.date) || (a.date.Equal(b.date) && earlier(b, a))
+		default:
+			return a.price.Cmp(b.price) < 0
+		}
 	}
 	log.Panicf("unexpected lot order (%q)", this.order)
 	return false
 }
 
-func (this *LotQueue) Buy(lot Lot) {
-	this.sanity(lot.inventory)
-	// TODO(dnc): perhaps we can be more efficient than calling sort
-	// each time, given we are already ordered.
-	this.lot = append(this.lot, lot)
-	sort.Sort(this)
+// earlier returns true if lot a was created before b, of the same
+// date.  When both have "seq" metadata, it decides, otherwise order of
+// transactions in source.
+func earlier(a, b *Lot) bool {
+	if a.seq != nil && b.seq != nil && a.seq.Cmp(b.seq) != 0 {
+		return a.seq.Cmp(b.seq) < 0
+	}
+	return a.weight < b.weight
+}
+
+func (this *LotQueue) Buy(lot Lot) error {
+	if err := this.sanity(lot.inventory); err != nil {
+		return err
+	}
+	// The queue is already ordered, so insert rather than sort.  This
+	// keeps buying cheap when many lots are open.
+	i := sort.Search(this.Len(), func(i int) bool { return this.less(&lot, &this.lot[i]) })
+	this.lot = append(this.lot, Lot{})
+	copy(this.lot[i+1:], this.lot[i:])
+	this.lot[i] = lot
+	return nil
 }
 
 // Sell consumes inventory and basis from lots.
 func (this *LotQueue) Sell(delta Amount) (lot []Lot, inventory, basis []Amount, err error) {
-	this.sanity(delta)
+	err = this.sanity(delta)
+	if err != nil {
+		return
+	}
 	command.V(1).Infof("LotQueue.Sell() %s from queue of %d lots", delta.String(), this.Len()) // troubleshoot
 
 	remaining := delta.Clone()
 
+	// should the sale fail, lots consumed are pushed back, so the queue
+	// is as it was
+	var popped []Lot
+	defer func() {
+		if err != nil {
+			for i := len(popped) - 1; i >= 0; i-- {
+				this.lot = append(this.lot, popped[i])
+			}
+			lot, inventory, basis = nil, nil, nil
+		}
+	}()
+
 	var l Lot
 	for remaining.Sign() != 0 {
 
@@ -164,13 +310,15 @@ func (this *LotQueue) Sell(delta Amount) (lot []Lot, inventory, basis []Amount,
 		}
 
 		// pop from end of slice
-		l, this.lot = this.lot[len(this.lot)-1], this.lot[:len(this.lot)-1]
-
-		sold, soldBasis := l.Sell(remaining)
-
-		// sanity
-		if sold.Sign() == -1 || soldBasis.Sign() == 1 { // basis may be zero
-			log.Panicf("insane sale: sold %s, basis %s", sold, soldBasis)
+		l = this.lot[len(this.lot)-1]
+		this.lot[len(this.lot)-1] = Lot{} // release, so memory is bounded by open lots
+		this.lot = this.lot[:len(this.lot)-1]
+		popped = append(popped, l) // Lot.Sell() changes a copy
+
+		sold, soldBasis, e := l.Sell(remaining)
+		if e != nil {
+			err = e
+			return
 		}
 
 		command.V(1).Infof("Sold %s (%s basis) from lot %s", sold, soldBasis, l.name)
@@ -184,7 +332,8 @@ func (this *LotQueue) Sell(delta Amount) (lot []Lot, inventory, basis []Amount,
 		if remaining.Sign() > -1 {
 			// entire amount has been consumed from inventory
 			if remaining.Sign() != 0 { // sanity
-				log.Panic("lotFIFO.Sell() remaining:", remaining) // should never be reached
+				err = fmt.Errorf("sale of %s consumed more than sold (%s)", delta, remaining)
+				return
 			}
 			if l.inventory.Sign() > 0 {
 				// append unsold inventory back to queue
@@ -198,19 +347,65 @@ func (this *LotQueue) Sell(delta Amount) (lot []Lot, inventory, basis []Amount,
 	return lot, inventory, basis, err
 }
 
-func (this LotQueue) sanity(delta Amount) {
+// sanity returns an error if delta may not be bought or sold, i.e. a
+// sale of zero, or from an empty queue.
+func (this LotQueue) sanity(delta Amount) error {
 	if delta.Sign() == 0 {
-		log.Panic("attempt to buy/sell zero amount")
+		return fmt.Errorf("attempt to buy/sell zero amount (%s)", delta.Asset)
 	}
 	if this.Len() == 0 {
 		if delta.Sign() < 0 {
-			log.Panicf("attempt to sell (%#v %s) from empty inventory (%#v)", delta, delta.Asset, this)
-		} else {
-			return
+			return fmt.Errorf("attempt to sell %s from empty inventory", delta)
 		}
+		return nil
 	}
-	// sanity
 	if delta.Asset != this.lot[0].inventory.Asset {
-		log.Panicf("currency mismatch: want %q, got %q", delta.Asset, this.lot[0].inventory.Asset)
+		return fmt.Errorf("currency mismatch: want %q, got %q", delta.Asset, this.lot[0].inventory.Asset)
+	}
+	return nil
+}
+
+// lotID returns the name of a new lot, given the descriptive name.
+// By sequence, lots are numbered in the order created (i.e.
+// "Lot::L1").  By hash, the ID is a digest of the descriptive name
+// (i.e. "Lot::5f3c8e2a1b9d"), stable when transactions are added.
+func (this *lotNames) lotID(qual, name string, date time.Time, inventory, basis Amount) string {
+	var id string
+	switch this.lotNaming {
+	case "sequence":
+		this.lotIDSeq++
+		id = fmt.Sprintf("Lot:%s:L%d", qual, this.lotIDSeq)
+	case "hash":
+		sum := sha256.Sum256([]byte(name))
+		id = fmt.Sprintf("Lot:%s:%x", qual, sum[:6])
+	default:
+		return name
+	}
+
+	if this.lotMap != nil && !this.lotIDs[id] {
+		if this.lotIDs == nil {
+			this.lotIDs = make(map[string]bool)
+		}
+		this.lotIDs[id] = true
+		this.lotMapRow = append(this.lotMapRow, []string{id, name, date.Format("2006/01/02"), inventory.String(), basis.String()})
+	}
+	return id
+}
+
+// writeLotMap writes the rows recorded for lots created so far, once
+// the transactions creating them are lotted without error.
+func (this *lotNames) writeLotMap() {
+	if this.lotMap != nil {
+		this.lotMap.WriteAll(this.lotMapRow)
+	}
+	this.lotMapRow = nil
+}
+
+// discardLotMap forgets the rows recorded for lots of a transaction
+// which failed.
+func (this *lotNames) discardLotMap() {
+	for _, row := range this.lotMapRow {
+		delete(this.lotIDs, row[0])
 	}
+	this.lotMapRow = nil
 }
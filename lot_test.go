@@ -0,0 +1,102 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSeqTieBreak consumes lots of one day in order of "seq" metadata,
+// rather than order in the file, when each has it.
+func TestSeqTieBreak(t *testing.T) {
+	journal := `2021/01/01 Buy
+    ; seq: 20
+    Assets:Broker          1 ABC @ 10 USD
+    Assets:Cash
+
+2021/01/01 Buy
+    ; seq: 10.5
+    Assets:Broker          1 ABC @ 20 USD
+    Assets:Cash
+
+2021/01/02 Sell
+    Assets:Broker          -1 ABC @ 50 USD
+    Assets:Cash
+`
+	for _, test := range []struct {
+		journal, order, consumed string
+	}{
+		{journal, "fifo", "Lot::2021/01/01:1ABC@20USD"},
+		{journal, "lifo", "Lot::2021/01/01:1ABC@10USD"},
+		{strings.ReplaceAll(journal, "    ; seq: 10.5\n", ""), "fifo", "Lot::2021/01/01:1ABC@10USD"}, // order in file
+	} {
+		lotted := string(lotJournal(t, test.journal, "-order="+test.order))
+		_, sale, _ := strings.Cut(lotted, "2021/01/02 Sell")
+		if !strings.HasPrefix(strings.Join(generatedLines(sale), "\n"), "["+test.consumed+"] 1 ABC ; :SELL:") {
+			t.Errorf("%s sale did not consume %s:\n%s", test.order, test.consumed, sale)
+		}
+	}
+
+	problems := newProblemTally(0)
+	err := runOperation(&bytes.Buffer{}, newSettings(), problems, []byte(strings.Replace(journal, "seq: 20", "seq: twenty", 1)), "lot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["bad metadata"] != 1 {
+		t.Errorf("%d bad metadata, expected 1", problems.count["bad metadata"])
+	}
+}
+
+// BenchmarkLotQueue buys a lot, and sells as much, per iteration,
+// with 1000 lots open.
+func BenchmarkLotQueue(b *testing.B) {
+	const open = 1000
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	settings := newSettings()
+	buy := func(queue *LotQueue, i int) {
+		inventory := settings.NewAmount("ABC", *big.NewRat(2, 1))
+		basis := settings.NewAmount(settings.base, *big.NewRat(int64(i%97+1), 1))
+		lot, err := NewLot(fmt.Sprintf("Lot::%d", i), date.AddDate(0, 0, i), inventory, basis)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = queue.Buy(*lot)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	for _, o := range lotOrder {
+		b.Run(string(o), func(b *testing.B) {
+			queue := LotQueue{order: o}
+			for i := 0; i < open; i++ {
+				buy(&queue, i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buy(&queue, open+i)
+				_, _, _, err := queue.Sell(settings.NewAmount("ABC", *big.NewRat(-2, 1)))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
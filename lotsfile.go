@@ -0,0 +1,170 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lotsFile is what a lots file, written previously by lot -lots-out,
+// records: the transactions already lotted, and (loaded into lot
+// queues) the lots remaining open.
+type lotsFile struct {
+	done  map[string]int // transactions lotted, by key (see lottedKey)
+	last  time.Time      // date of latest transaction lotted
+	count int            // transactions lotted, not yet matched
+}
+
+// lottedKey identifies a transaction by date and payee line.
+func lottedKey(tx TxLines) string {
+	payee, _ := tx.Payee()
+	return fmt.Sprintf("%s %s", tx.Date.Format("2006/01/02"), strings.TrimSpace(payee))
+}
+
+// i.e. "Lot:Assets:Crypto:2021/03/01:10ABC@2USD", qualifier then date
+var lotDatePattern = regexp.MustCompile(`^Lot:(.*?):?(\d{4}/\d{2}/\d{2}):`)
+
+// i.e. "Lot::L12", by -lot-names=sequence
+var lotSeqPattern = regexp.MustCompile(`:L(\d+)$`)
+
+// loadLots reads a lots file, and buys each lot it leaves open into
+// the lotter's queues.  Inventory and basis of a lot are the sum of its splits,
+// as written (so rounded, when basis was rounded for output).  A lot's
+// date is taken from its name, or when the name has none (i.e.
+// -lot-names=hash), the date of the transaction which first has it.
+// Likewise its seq, if any.
+func (this *lotter) loadLots(r io.Reader) (*lotsFile, error) {
+	ret := &lotsFile{done: make(map[string]int)}
+
+	type loaded struct {
+		name      string
+		date      time.Time
+		inventory *Amount
+		basis     *big.Rat
+		seq       *big.Rat // of the transaction which first has it
+	}
+	var lots []*loaded // in order first seen
+	byName := make(map[string]*loaded)
+
+	s := NewTxScanner(r)
+	for s.Scan() {
+		txLines := s.Lines()
+		_, payeeIndex := txLines.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		ret.done[lottedKey(txLines)]++
+		ret.count++
+		if txLines.Date.After(ret.last) {
+			ret.last = txLines.Date
+		}
+
+		for i, line := range txLines.Line[payeeIndex+1:] {
+			split, ok := this.parseSplit(line)
+			if !ok || split.delta == nil {
+				continue
+			}
+			// (as translated, if written with -translate)
+			inventory := strings.Contains(split.comment, "(inventory") || strings.Contains(split.comment, this.translation.text("(inventory"))
+			if !inventory && !strings.Contains(split.comment, "(basis") && !strings.Contains(split.comment, this.translation.text("(basis")) {
+				continue // gains, proceeds, and so on
+			}
+			name := strings.Trim(split.account, "[]")
+			if name == this.dustAccount || name == this.translation.account(this.dustAccount) {
+				continue // not a lot
+			}
+			l := byName[name]
+			if l == nil {
+				l = &loaded{name: name, date: txLines.Date, basis: new(big.Rat)}
+				l.seq, _ = new(big.Rat).SetString(txLines.Metadata("seq"))
+				if m := lotDatePattern.FindStringSubmatch(name); m != nil {
+					if date, err := parseDate(m[2]); err == nil {
+						l.date = date
+					}
+				}
+				byName[name] = l
+				lots = append(lots, l)
+			}
+			switch {
+			case !inventory:
+				if !this.isBase(split.delta.Asset) {
+					return nil, lineErrorf(txLines.Start+payeeIndex+1+i, "basis of lot (%q) not in base currency: %s", name, split.delta)
+				}
+				l.basis.Add(l.basis, split.delta.Rat)
+			case l.inventory == nil:
+				tmp := split.delta.NegClone() // inventory held is negative
+				l.inventory = &tmp
+			case l.inventory.Asset != split.delta.Asset:
+				return nil, lineErrorf(txLines.Start+payeeIndex+1+i, "inventory of lot (%q) in both %s and %s", name, l.inventory.Asset, split.delta.Asset)
+			default:
+				l.inventory.Sub(l.inventory.Rat, split.delta.Rat)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range lots {
+		// continue the sequence of lot names
+		if m := lotSeqPattern.FindStringSubmatch(l.name); m != nil {
+			if n, _ := strconv.Atoi(m[1]); n > this.lotIDSeq {
+				this.lotIDSeq = n
+			}
+		}
+		if l.inventory == nil || l.inventory.Sign() == 0 {
+			continue // consumed
+		}
+		if l.inventory.Sign() < 0 || l.basis.Sign() < 0 {
+			return nil, fmt.Errorf("lot (%q) has negative inventory (%s) or basis (%s)", l.name, l.inventory, this.NewAmount(this.base, *l.basis))
+		}
+		qualifier := strings.TrimPrefix(l.name, "Lot:")
+		if m := lotDatePattern.FindStringSubmatch(l.name); m != nil {
+			qualifier = m[1]
+		} else if i := strings.LastIndexByte(qualifier, ':'); i != -1 {
+			qualifier = qualifier[:i]
+		}
+		this.weighDay(l.date)
+		this.weightMeta = l.seq
+		lot, err := this.newLot(l.name, l.date, *l.inventory, this.NewAmount(this.base, *l.basis))
+		if err == nil {
+			err = this.buy(*lot, qualifier)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	this.weightMeta = nil
+	return ret, nil
+}
+
+// lotted returns true if tx is one the lots file records (each
+// recorded transaction matches only once).
+func (this *lotsFile) lotted(tx TxLines) bool {
+	key := lottedKey(tx)
+	if this.done[key] == 0 {
+		return false
+	}
+	this.done[key]--
+	this.count--
+	return true
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// generatedLines returns the lot and gain splits of lotted output,
+// without the tag of -keep-prices.
+func generatedLines(lotted string) []string {
+	var ret []string
+	for _, line := range strings.Split(lotted, "\n") {
+		if strings.HasPrefix(line, "    [Lot") {
+			ret = append(ret, strings.Join(strings.Fields(strings.Replace(line, ":LOTTER:", ":", 1)), " "))
+		}
+	}
+	return ret
+}
+
+// TestLotsOut writes generated splits to a lots file, leaving the
+// journal as it was.
+func TestLotsOut(t *testing.T) {
+	lots := filepath.Join(t.TempDir(), "lots.ledger")
+	out := string(lotJournal(t, nettingJournal, "-lots-out="+lots))
+	if strings.TrimRight(out, "\n") != strings.TrimRight(nettingJournal, "\n") {
+		t.Errorf("output with -lots-out differs from journal:\n%s", out)
+	}
+	written, err := os.ReadFile(lots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(written), `; lots and gains generated by lotter, include from the journal (i.e. "include `+lots+`")`) {
+		t.Errorf("lots file lacks header:\n%s", written)
+	}
+	expect := generatedLines(string(lotJournal(t, nettingJournal)))
+	if got := generatedLines(string(written)); len(expect) == 0 || strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("lots file has splits:\n%s\nexpected those of lot:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+}
+
+// TestAppend lots the transactions of 2018, then appends those of 2019
+// to the lots file, which must then be as if all were lotted at once.
+func TestAppend(t *testing.T) {
+	dir := t.TempDir()
+	whole, appended := filepath.Join(dir, "whole.ledger"), filepath.Join(dir, "appended.ledger")
+	lotJournal(t, nettingJournal, "-lots-out="+whole)
+
+	earlier := nettingJournal[:strings.Index(nettingJournal, "2019/")]
+	lotJournal(t, earlier, "-lots-out="+appended)
+	lotJournal(t, nettingJournal, "-lots-out="+appended, "-append")
+
+	expect, err := os.ReadFile(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// but for the name of the lots file, in its header
+	got = bytes.Replace(got, []byte(appended), []byte(whole), 1)
+	if !bytes.Equal(got, expect) {
+		t.Errorf("lots file appended:\n%s\nexpected:\n%s", got, expect)
+	}
+
+	// a transaction dated before the last lotted is not appended
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err = runOperation(&out, newSettings(), problems, []byte(nettingJournal+`
+2019/01/01 Buy
+    Assets:Crypto            1 ABC @ 50 USD
+    Assets:Bank
+`), "lot", "-lots-out="+appended, "-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["lotted out of order"] != 1 {
+		t.Errorf("%d transactions lotted out of order, expected 1", problems.count["lotted out of order"])
+	}
+}
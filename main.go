@@ -56,15 +56,15 @@
 //     2016-01-01 Bought ABC
 //         Assets:Crypto                               100 ABC ; @ 0.02 USD
 //         Equity:Cash
-//         [Lot::2016/01/01:100ABC@0.02USD]            -100 ABC        ; :BUY: (inventory)
-//         [Lot::2016/01/01:100ABC@0.02USD]            2 USD           ; :BUY: (basis)
+//         [Lot::2016/01/01:100ABC@0.02USD]  -100 ABC  ; :BUY: (inventory)
+//         [Lot::2016/01/01:100ABC@0.02USD]     2 USD  ; :BUY: (basis)
 //
 //     2017-01-01 Sell some ABC
 //         Assets:Crypto                               -1 ABC ; @ 1 USD
 //         Assets:Exchange
-//         [Lot::2016/01/01:100ABC@0.02USD]            1 ABC           ; :SELL: (inventory consumed)
-//         [Lot::2016/01/01:100ABC@0.02USD]            -0.02 USD       ; :SELL: (basis consumed)
-//         [Lot:Income:long term gain]                 -0.98 USD       ; :GAIN:LONGTERM:
+//         [Lot::2016/01/01:100ABC@0.02USD]      1 ABC  ; :SELL: (inventory consumed)
+//         [Lot::2016/01/01:100ABC@0.02USD]  -0.02 USD  ; :SELL: (basis consumed)
+//         [Lot:Income:long term gain]       -0.98 USD  ; :GAIN:LONGTERM:
 //
 // If your wondering why the last line ("long term gain") shows a
 // negative number, when the actual gain is a positive 98 cents,
@@ -84,14 +84,191 @@
 //
 //    lotter -f testdata/simple.ledger lot | ledger -f - bal
 //
+// Precision
+//
+// Like `ledger-cli`, `lotter` observes the decimal places found in
+// source data, and rounds amounts of each asset to that precision
+// (six places, by default).  Amounts may be written in scientific
+// notation, i.e. "1e-18 ETH".  Use `-precision` to set decimal places
+// explicitly, i.e. `-precision ETH=18,USD=2`.
+//
+// One amount with many decimal places raises the precision of all
+// amounts of its asset, so that lot names (which include quantity and
+// unit price) may become very long.  Use `-name-precision` to cap the
+// decimal places written in lot names and comments, i.e.
+// `-name-precision USD=2`.  Amounts of splits are written with full
+// precision, so that they balance.
+//
+// Base Equivalents
+//
+// Stablecoins may be declared equivalent to the base currency, i.e.
+// `-base-equivalent USDC,USDT`.  Trades priced in an equivalent are
+// then treated as trades for base currency, realizing gains, rather
+// than creating lots with deferred basis.  Equivalents themselves
+// have no lots, unless `-track-equivalent` is also used.  When
+// tracking, equivalents are bought and sold at the value of base
+// currency, so that their own small gains (or losses) are realized.
+//
+// Base Symbols
+//
+// The base currency may be a symbol, i.e. `-base €`.  By default
+// base amounts are written as other amounts are, i.e. "10 €".  Use
+// `-base-position prefix` to write "€10", and `-base-places 2` to
+// always write two decimal places, i.e. "€10.00".  Source data may
+// use either position.
+//
+// Lot Queues
+//
+// By default, all lots of an asset are in one queue, no matter which
+// account holds them.  Use `-prune` to queue lots per account, by
+// account name pruned to a depth.  For example, with `-prune 2`,
+// "Assets:Exchange:Trading" and "Assets:Exchange:Savings" share a
+// queue, while "Assets:Wallet" has its own.  With `-prune -1`, each
+// account has its own queue.  The flag is common to all operations,
+// so use the same `-prune` when running `lot`, `holdings`, `queue` or
+// `simulate` on the same data.
+//
+// When pruning is too blunt, use `-qualifiers` to name a file of
+// rules, each an account pattern (regular expression) and the name of
+// its lot queue.  For example,
+//
+//     ^Assets:Crypto:Kraken(Margin)?(:|$)    Kraken
+//     ^Assets:Crypto:Cold                    Cold
+//
+// puts lots of "Assets:Crypto:Kraken:Spot" and
+// "Assets:Crypto:KrakenMargin:BTC" in one queue, and those of
+// "Assets:Crypto:Cold:Ledger" in another.  The first matching rule
+// applies.  Accounts matching no rule are pruned as usual.
+//
+// Input
+//
+// Besides a file name (where "~/" is the home directory, as in a
+// shell), `-f` accepts "-" for standard input, a URL, and a command
+// (prefixed "!") whose output is read.  A URL (http or https) is
+// fetched, read-only.  A command is run with `sh -c`, and its failure
+// is an error of input, i.e.
+//
+//     lotter -f ~/finance/main.ledger lot
+//     lotter -f https://example.com/journal.ledger lot
+//     lotter -f '!ledger -f main.ledger print' lot
+//
+// Many Files
+//
+// Use `-f` more than once to lot files together, i.e. a journal per
+// year, as `ledger-cli` would an `include` of each.  Transactions of
+// all files are merged in order of date.  Those of the same date are
+// ordered by `-merge-order`, by default "file,time,seq": the order of
+// files given to `-f`, then "time" metadata (i.e. "; time: 14:05:00"),
+// then "seq" metadata (i.e. "; seq: 1042").  A key which a transaction
+// lacks does not decide, and transactions otherwise equal keep the
+// order found.  Comments and directives stay with the transaction
+// following them.  Line numbers of errors are those of the file a
+// transaction is from.
+//
+// Manifest
+//
+// Use `-manifest` to begin output with comments recording how it was
+// produced: the version of `lotter`, its command line, base currency,
+// lot order, and a SHA-256 checksum of each input file.  So that a
+// file regenerated later can be audited, and a difference between two
+// runs explained, i.e.
+//
+//     ; lotter manifest
+//     ;   version  v1.2.0
+//     ;   command  lotter -manifest -f journal.ledger lot -order=hifo
+//     ;   base     USD
+//     ;   order    hifo
+//     ;   input    journal.ledger sha256 9f86d081884c7d65...
+//
+// A manifest found in input (i.e. of an earlier `lot`) is not copied
+// to output.
+//
+// Strict Accounts
+//
+// Use `-strict` to require that accounts are declared (i.e. "account
+// Assets:Crypto") before they are used, as `ledger --strict` does.  In
+// strict mode, `lotter` reports the line number of each split
+// referring to an undeclared account, so that a typo in an account
+// name does not silently create a new lot queue.
+//
+// Errors
+//
+// Problems found in a transaction are written to output, as a
+// "FIXME" split that `ledger-cli` will refuse, and to the log.  When
+// done, `lotter` logs a summary of problems, counted by kind with the
+// line number of the first occurrence.  Use `-max-errors` to stop
+// after a number of problems.  By default, the `lot` operation stops
+// after the first, because inventory and basis of lots are unreliable
+// after any problem.  Other operations do not stop.  When `lot`
+// continues, a transaction which fails is written as found (with no
+// splits generated, apart from FIXME), and later transactions are
+// lotted as if it were not in the journal.
+//
+// When a transaction which fails has a common mistake of its prices
+// ("@" where "@@" was meant or the reverse, or a price reversed), the
+// error names the likely mistake.  Such a
+// mistake may balance nonetheless (with basis wrong), so `lot` also
+// logs a warning when a trade which succeeds has one.  Use
+// `-explain-errors` for an explanation, and the split corrected.
+//
+// Use `-validate=syntax` to check the splits `lotter` writes, or
+// `-validate=ledger` to check all output with `ledger-cli` (which must
+// be installed).  Output which would be rejected is a problem, and
+// `lotter` exits with non-zero status.  Output is still written as
+// each transaction is processed; for `ledger-cli`, a copy is kept in a
+// temporary file, until output is complete.
+//
+// Exit Status
+//
+// Wrapper scripts may distinguish failures by `lotter`'s exit status:
+//
+//     0  success
+//     1  processing errors (i.e. missing price, invalid output)
+//     2  usage errors (i.e. unknown flag or operation)
+//     3  failed to parse input
+//     4  inconsistent inventory (i.e. sale exceeds lots held)
+//
+// When problems of more than one kind are found, the status reflects
+// the first.
+//
+// Input and Output Formats
+//
+// By default, `lotter` reads `ledger-cli` data.  A `bucket` (or `A`)
+// directive names the account which balances transactions of one
+// posting; `lotter` adds the posting to such transactions (with no
+// amount), so output balances as the input does.  Use `-dialect
+// beancount` to read a Beancount journal instead.  Beancount
+// transactions, costs (i.e. "{0.02 USD}"), prices, `open` directives
+// and metadata are converted to their `ledger-cli` equivalents; other
+// directives are ignored.
+//
+// Use `-dialect xml` to read the structured output of `ledger xml`,
+// sidestepping ambiguities of parsing text.  Transactions are read
+// (with cost, notes and metadata); other elements are ignored.  Use
+// `-dialect json` to read JSON written by `lotter -format json`.
+// Postings generated by an earlier run are omitted, and prices it
+// commented out are restored.  Either way, line numbers in error
+// messages refer to the converted data, not the input.
+//
+// By default, operations write `ledger-cli` data.  Use `-format` to
+// write JSON (one object per transaction), CSV (one row per split),
+// or Beancount data instead.  For example,
+//
+//    lotter -f testdata/simple.ledger -format csv lot
+//
+// Reports (i.e. of `holdings`) are written as aligned columns, or with
+// `-format json` or `-format csv`, as one record per row.
+//
 package main
 
 import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"src.d10.dev/command"
 )
@@ -99,63 +276,312 @@ import (
 // `go get src.d10.dev/dumbdown`
 //go:generate sh -c "go doc | dumbdown > README.md"
 
-var (
+// environment is the data an operation processes, where it writes
+// results, and the settings of the command.  Each operation is given
+// its own (see registerOperation), so that one operation may run
+// another (see Pipeline), or run more than once.  Lots are those of a
+// lotter (see newLotter), created by the operation.
+type environment struct {
+	*settings
+
 	// operations will scan and process ledger data
 	scanner *TxScanner
 
+	// importers read other data directly
+	input io.Reader
+
+	// operations write results through output
+	output Output
+
+	// problems found by operations (see -max-errors)
+	problems *problemTally
+
+	// exit status of a StatusError returned by the operation, if any
+	// (see operationError)
+	status int
+}
+
+// operationInfo describes a registered operation, for main,
+// completion and pipelines.
+type operationInfo struct {
+	name, syntax, description string
+	handler                   func(*environment) error
+}
+
+// operations are those registered by registerOperation.  The command
+// package keeps its own registry, but does not export it.
+var operations []operationInfo
+
+// registerOperation remembers an operation, which main registers with
+// the command package (see commandOperations).
+func registerOperation(handler func(*environment) error, name, syntax, description string) {
+	operations = append(operations, operationInfo{name: name, syntax: syntax, description: description, handler: handler})
+}
+
+// commandOperations registers operations with the command package,
+// which calls handlers without arguments.  Each is given the
+// environment env refers to, when the operation is run.  An error
+// returned by the handler is a usage error, unless a StatusError (see
+// operationError()).
+func commandOperations(env **environment) {
+	for _, op := range operations {
+		handler := op.handler
+		command.RegisterOperation(func() error {
+			log.SetPrefix(log.Prefix() + ": ") // i.e. "lotter lot: line 4: ...", command sets no separator
+			return (*env).operationError(handler(*env))
+		}, op.name, op.syntax, op.description)
+	}
+}
+
+// settings of the command decide how amounts are parsed and written,
+// and how lots are queued, for every operation.
+type settings struct {
 	// base asset is what cost basis and gains are tallied in
 	base Asset
-)
+
+	// Base equivalents (i.e. stablecoins "USDC" or "USDT") are valued
+	// the same as the base asset.  Unless tracking equivalents, they are
+	// treated as if they were the base asset, and have no lots.
+	baseEquivalent  map[Asset]bool
+	trackEquivalent bool
+
+	// Amounts of base currency may be written with the symbol preceding
+	// the number (i.e. "€10", see -base-position), and with a fixed
+	// count of decimal places (i.e. "0.50 GBP", see -base-places).
+	// Otherwise, amounts are written as "10 EUR", without trailing
+	// zeros.
+	basePrefix bool
+	basePlaces int
+
+	// Like ledger-cli, we observe the decimal places found in the
+	// source data, and later round to that precision.
+	decimalPlaces map[Asset]int
+
+	// namePlaces caps the decimal places of brief amounts, per asset
+	// (see Brief).
+	namePlaces map[Asset]int
+
+	// prune is the name depth of account-specific lots (see `-prune`).
+	// Negative means no pruning, so each account has its own lot
+	// queues.
+	prune int
+
+	// qualifierRules are read from the file named by `-qualifiers`,
+	// and override pruning.
+	qualifierRules []qualifierRule
+
+	// When strict, like `ledger --strict`, accounts must be declared
+	// (i.e. "account Assets:Crypto") before they are used.
+	strict bool
+
+	// When explainErrors (see -explain-errors), hints describe the
+	// likely mistake in a transaction, and the split which fixes it.
+	// Otherwise, hints only name the mistake.
+	explainErrors bool
+}
+
+// newSettings returns the defaults of the command's flags.
+func newSettings() *settings {
+	return &settings{
+		base:           "USD",
+		baseEquivalent: make(map[Asset]bool),
+		basePlaces:     -1,
+		decimalPlaces:  make(map[Asset]int),
+		namePlaces:     make(map[Asset]int),
+	}
+}
 
 func main() {
+	args := append([]string(nil), os.Args[1:]...) // before parsing, see -manifest
+
+	var env *environment // of the operation, prepared below
+	commandOperations(&env)
+
 	command.RegisterCommand(
 		"lotter",
 		"lotter -f <filename> <operation> [<flag> ...]",
 		"Add virtual splits to ledger-cli files, representing \"lots\" of inventory, to better track gains and losses.",
-		command.OptionVerbose, //command.OptionConfig
+		command.OptionVerbose, command.OptionProfile, //command.OptionConfig
 	)
 
 	// define flags
-	fFlag := flag.String("f", "", "file to parse, use '-' for stdin")
+	settings := newSettings()
+	var fFlag fileList
+	flag.Var(&fFlag, "f", "file to parse, use '-' for stdin, a URL, or '!<command>' for a command's output (may be repeated, to merge files)")
+	mergeOrderFlag := flag.String("merge-order", "file,time,seq", fmt.Sprintf("order of transactions of the same date, from more than one file, by keys %s", strings.Join(mergeKey[:], ", ")))
 	baseFlag := flag.String("base", "USD", "asset used for cost basis and gains")
+	positionFlag := flag.String("base-position", "suffix", "where the base symbol is written, prefix (i.e. \"€10\") or suffix (i.e. \"10 EUR\")")
+	flag.IntVar(&settings.basePlaces, "base-places", settings.basePlaces, "decimal places of base amounts, written even when zero (i.e. 2 for \"0.50 GBP\"), -1 to omit trailing zeros")
+	equivalentFlag := flag.String("base-equivalent", "", "comma separated assets valued the same as base, i.e. \"USDC,USDT\"")
+	trackFlag := flag.Bool("track-equivalent", false, "maintain lots of base equivalents, realizing their (usually small) gains")
+	flag.IntVar(&settings.prune, "prune", 0, "name depth of account-specific lots, -1 for lots per account")
+	qualifiersFlag := flag.String("qualifiers", "", "file of account patterns and the lot queue of each, overriding -prune")
+	precisionFlag := flag.String("precision", "", "decimal places per asset, i.e. \"ETH=18,USD=2\"")
+	namePrecisionFlag := flag.String("name-precision", "", "most decimal places written in lot names and comments, per asset, i.e. \"USD=2,ETH=8\"")
+	maxErrorsFlag := flag.Int("max-errors", -1, "stop after this many errors, 0 for no limit (by default, lot stops at the first error and other operations do not stop)")
+	validateFlag := flag.String("validate", "none", fmt.Sprintf("check output, one of %s", strings.Join(validateMethod[:], ", ")))
+	strictFlag := flag.Bool("strict", false, "require accounts to be declared before use, like ledger's --strict")
+	flag.BoolVar(&settings.explainErrors, "explain-errors", false, "explain likely mistakes of prices, and suggest a fix")
+	dialectFlag := flag.String("dialect", "ledger", fmt.Sprintf("input syntax, one of %s", strings.Join(inputDialect[:], ", ")))
+	manifestFlag := flag.Bool("manifest", false, "begin output with comments recording version, command line, base, lot order and checksums of input")
+	formatFlag := flag.String("format", "ledger", fmt.Sprintf("output format, one of %s", strings.Join(outputFormat[:], ", ")))
 
 	err := command.Parse()
 	if err != nil {
 		command.CheckUsage(err)
 	}
 
+	op := flag.Arg(0)
+	if op == "" {
+		op = "lot" // default operation
+	}
+
+	// omit date from log entries (confusing because log also shows dates from payee lines)
+	log.SetFlags(0)
+
 	// validate flags
-	if *fFlag == "" {
+	if len(fFlag) == 0 && op != "completion" && op != "gen-testdata" { // these read no input
 		command.CheckUsage(errors.New("Use \"-f <filename>\" to specify ledger data file.  Or use \"-f -\" for stdin."))
 	}
+	mergeOrder, err := parseMergeOrder(*mergeOrderFlag)
+	if err != nil {
+		command.CheckUsage(err)
+	}
 
-	var file *os.File
-	if *fFlag == "-" {
-		file = os.Stdin
-	} else {
-		file, err = os.Open(*fFlag)
+	var file []io.Reader
+	if len(fFlag) == 0 {
+		file = append(file, os.Stdin)
+	}
+	for _, name := range fFlag {
+		f, err := openInput(name)
 		if err != nil {
-			command.Check(fmt.Errorf("failed to open ledger file (%q): %w", *fFlag, err))
+			command.Check(fmt.Errorf("failed to open ledger file (%q): %w", name, err))
 		}
-		defer file.Close()
+		defer f.Close()
+		file = append(file, f)
 	}
 
-	base = Asset(*baseFlag)
+	problems := newProblemTally(*maxErrorsFlag)
 
-	scanner = NewTxScanner(file)
+	if *qualifiersFlag != "" {
+		f, err := os.Open(*qualifiersFlag)
+		if err != nil {
+			command.Check(fmt.Errorf("failed to open qualifiers (%q): %w", *qualifiersFlag, err))
+		}
+		err = settings.readQualifiers(f)
+		f.Close()
+		if err != nil {
+			problems.fatal(exitInput, fmt.Errorf("qualifiers (%q): %w", *qualifiersFlag, err))
+		}
+	}
 
-	// omit date from log entries (confusing because log also shows dates from payee lines)
-	log.SetFlags(0)
+	settings.base = Asset(*baseFlag)
+	switch *positionFlag {
+	case "prefix", "suffix":
+		settings.basePrefix = *positionFlag == "prefix"
+	default:
+		command.CheckUsage(fmt.Errorf("bad -base-position (%q), expected prefix or suffix", *positionFlag))
+	}
+	if settings.basePlaces < -1 {
+		command.CheckUsage(fmt.Errorf("bad -base-places (%d), expected a number of decimal places, or -1", settings.basePlaces))
+	}
+	if settings.prune < -1 {
+		command.CheckUsage(fmt.Errorf("bad -prune (%d), expected a name depth, or -1 for lots per account", settings.prune))
+	}
+	if *maxErrorsFlag < -1 {
+		command.CheckUsage(fmt.Errorf("bad -max-errors (%d), expected a number of errors, or 0 for no limit", *maxErrorsFlag))
+	}
+	settings.strict = *strictFlag
+	err = settings.setPrecision(*precisionFlag)
+	if err != nil {
+		command.CheckUsage(err)
+	}
+	err = settings.setNamePrecision(*namePrecisionFlag)
+	if err != nil {
+		command.CheckUsage(err)
+	}
+	for _, asset := range strings.Split(*equivalentFlag, ",") {
+		if asset = strings.TrimSpace(asset); asset != "" {
+			settings.baseEquivalent[Asset(asset)] = true
+		}
+	}
+	settings.trackEquivalent = *trackFlag
 
-	op := flag.Arg(0)
-	if op == "" {
-		op = "lot" // default operation
+	// check output as it is written, when it is to be validated
+	var syntax *syntaxValidator
+	var ledger *ledgerValidator
+	var w io.Writer = os.Stdout
+	switch *validateFlag {
+	case "none":
+	case "syntax", "ledger":
+		if *formatFlag != "ledger" {
+			command.CheckUsage(fmt.Errorf("-validate requires ledger format (not %q)", *formatFlag))
+		}
+		if *validateFlag == "syntax" {
+			syntax = &syntaxValidator{}
+			w = io.MultiWriter(os.Stdout, syntax)
+		} else {
+			ledger, err = newLedgerValidator()
+			if err != nil {
+				command.Check(fmt.Errorf("failed to keep a copy of output, to validate: %w", err))
+			}
+			w = io.MultiWriter(os.Stdout, ledger)
+		}
+	default:
+		command.CheckUsage(fmt.Errorf("unknown -validate (%q), expected one of %s", *validateFlag, strings.Join(validateMethod[:], ", ")))
+	}
+
+	output, err := NewOutput(*formatFlag, w, settings)
+	if err != nil {
+		command.CheckUsage(err)
+	}
+
+	if *manifestFlag {
+		output = &manifestOutput{Output: output, manifest: func() []string { return settings.manifest(args, fFlag) }}
+	}
+
+	var in []io.Reader
+	var scanner []*TxScanner
+	for _, f := range file {
+		r, err := NewDialectReader(*dialectFlag, f)
+		if err != nil {
+			command.CheckUsage(err)
+		}
+		in = append(in, r)
+		scanner = append(scanner, NewTxScanner(r))
+	}
+	env = &environment{settings: settings, scanner: scanner[0], input: in[0], output: output, problems: problems}
+	if len(file) > 1 {
+		env.scanner = mergeScanners(scanner, mergeOrder)
+		env.input = io.MultiReader(in...)
 	}
+
 	command.Operate(op)
+	command.Check(output.Flush())
+	if env.status != exitOK {
+		if ledger != nil {
+			ledger.Remove()
+		}
+		problems.summary()
+		problems.exit(env.status)
+	}
+	switch {
+	case syntax != nil:
+		for _, err := range syntax.Close() {
+			problems.add("invalid output", err)
+		}
+	case ledger != nil:
+		if err := ledger.Validate(); err != nil {
+			problems.add("invalid output", err)
+		}
+	}
+	problems.summary()
 
 	// check for errors parsing file
-	command.Check(scanner.Err())
+	if err := env.scanner.Err(); err != nil {
+		problems.fatal(exitInput, err)
+	}
 
-	command.Exit()
+	problems.exit(exitOK)
 }
 
@@ -0,0 +1,217 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runOperation runs an operation over input, as `lotter -f <input>
+// <op> <arg>...` would, given the settings and tally of problems main
+// derives from flags.  Output is written to w.
+func runOperation(w io.Writer, settings *settings, problems *problemTally, input []byte, op string, arg ...string) error {
+	output, err := NewOutput("ledger", w, settings)
+	if err != nil {
+		return err
+	}
+	in := bytes.NewReader(input)
+	env := &environment{settings: settings, scanner: NewTxScanner(in), input: in, output: output, problems: problems}
+	err = Pipeline{{Operation: op, Arg: arg}}.Run(env)
+	if ferr := output.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// lotJournal returns the output of lot over journal, for operations
+// which read a lotted file.
+func lotJournal(t *testing.T, journal string, arg ...string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), newProblemTally(-1), []byte(journal), "lot", arg...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// reportLines returns the lines of a report, with space between
+// columns collapsed, i.e. "2018 short term gain 0 USD".
+func reportLines(report string) []string {
+	var ret []string
+	for _, line := range strings.Split(strings.TrimRight(report, "\n"), "\n") {
+		ret = append(ret, strings.Join(strings.Fields(line), " "))
+	}
+	return ret
+}
+
+// benchmarkCounts are the sizes of journals benchmarks generate, in
+// transactions.  The largest are skipped with -short.
+var benchmarkCounts = []int{10000, 100000, 1000000}
+
+// journals generated (see genJournal), by count of transactions
+var journals = make(map[int][]byte)
+
+// genJournal returns a journal of count transactions, written by
+// gen-testdata.  Journals are generated once, as benchmarks run more
+// than once.
+func genJournal(b *testing.B, count int) []byte {
+	if testing.Short() && count > 10000 {
+		b.Skip("large journal, with -short")
+	}
+	if journal, ok := journals[count]; ok {
+		return journal
+	}
+	var journal bytes.Buffer
+	err := runOperation(&journal, newSettings(), newProblemTally(-1), nil, "gen-testdata", fmt.Sprintf("-count=%d", count))
+	if err != nil {
+		b.Fatal(err)
+	}
+	journals[count] = journal.Bytes()
+	return journals[count]
+}
+
+// reportRate reports the transactions per second of a benchmark,
+// which took elapsed for b.N runs of count transactions.  Compare runs
+// before and after a change (i.e. with benchstat) to notice a
+// regression of throughput.
+func reportRate(b *testing.B, count int, elapsed time.Duration) {
+	b.ReportMetric(float64(count)*float64(b.N)/elapsed.Seconds(), "tx/s")
+}
+
+// testdataLedgers returns the names of ledger files of testdata, i.e.
+// as a seed corpus.
+func testdataLedgers(t testing.TB) []string {
+	name, err := filepath.Glob(filepath.Join("testdata", "*.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+var updateFlag = flag.Bool("update", false, "write expected output of TestGolden, rather than compare")
+
+// goldenTests are journals of testdata, each with an operation and
+// its expected output (i.e. testdata/rebalance.lot.golden).  Use `go
+// test -run TestGolden -update` to write expected output, and review
+// the change with `git diff`.
+var goldenTests = []struct {
+	ledger   string
+	prune    int // i.e. -1, as of `lotter -prune -1`
+	limit    int // of problems, as of `lotter -max-errors`, if not zero
+	op       string
+	arg      []string
+	problems int // expected, of transactions meant to fail
+}{
+	{ledger: "rebalance", op: "lot"},
+	{ledger: "convert-duplicate", op: "base"},
+	{ledger: "moves", prune: -1, op: "lot", problems: 1},
+	{ledger: "dust", prune: -1, op: "lot", arg: []string{"-dust", "BTC=0.00001"}},
+	{ledger: "fills", op: "lot", arg: []string{"-group-fills"}},
+	{ledger: "directives", op: "lot"},
+	{ledger: "diagnose", op: "lot"},
+	{ledger: "seq", op: "lot"},
+	{ledger: "recur", op: "lot"},
+	{ledger: "bucket", op: "lot"},
+	{ledger: "infer", op: "lot"},
+	{ledger: "signs", op: "lot"},
+	{ledger: "donation", op: "lot"},
+	{ledger: "convert", prune: -1, op: "lot"},
+	{ledger: "convert-fee", prune: -1, op: "lot"},
+	{ledger: "deferred", op: "lot"},
+	{ledger: "ref", op: "lot"},
+	{ledger: "holdings", op: "holdings", arg: []string{"-asof", "2021/12/31"}},
+	{ledger: "malformed", limit: 10, op: "lot", problems: 3},
+}
+
+func TestGolden(t *testing.T) {
+	for _, test := range goldenTests {
+		t.Run(test.ledger+"."+test.op, func(t *testing.T) {
+			input, err := ioutil.ReadFile(filepath.Join("testdata", test.ledger+".ledger"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings := newSettings()
+			settings.prune = test.prune
+			problems := newProblemTally(-1)
+			if test.limit != 0 {
+				problems = newProblemTally(test.limit)
+			}
+			var out bytes.Buffer
+			err = runOperation(&out, settings, problems, input, test.op, test.arg...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if problems.total != test.problems {
+				t.Fatalf("%d problem(s), expected %d", problems.total, test.problems)
+			}
+			golden := filepath.Join("testdata", test.ledger+"."+test.op+".golden")
+			if *updateFlag {
+				err = ioutil.WriteFile(golden, out.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expect, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), expect) {
+				t.Errorf("output differs from %s:\n%s", golden, out.Bytes())
+			}
+		})
+	}
+}
+
+// TestCompletion checks that completion (of bash and fish) offers
+// every flag each operation defines.
+func TestCompletion(t *testing.T) {
+	script := make(map[string]string)
+	for _, shell := range []string{"bash", "fish"} {
+		var out bytes.Buffer
+		err := runOperation(&out, newSettings(), newProblemTally(-1), nil, "completion", shell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script[shell] = out.String()
+	}
+
+	for _, op := range operations {
+		bash := ""
+		for _, line := range strings.Split(script["bash"], "\n") {
+			if strings.HasPrefix(line, "\t"+op.name+") ") {
+				bash = strings.TrimSuffix(line, `" ;;`) + " "
+			}
+		}
+		fish := fmt.Sprintf("complete -c lotter -n '__fish_seen_subcommand_from %s' -o ", op.name)
+		for _, name := range op.flags() {
+			if !strings.Contains(bash, " -"+name+" ") {
+				t.Errorf("bash completion of %s lacks -%s", op.name, name)
+			}
+			if !strings.Contains(script["fish"], fish+name+"\n") {
+				t.Errorf("fish completion of %s lacks -%s", op.name, name)
+			}
+		}
+	}
+}
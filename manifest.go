@@ -0,0 +1,163 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// version of lotter, set when built, i.e. with `go build -ldflags "-X
+// main.version=v1.2.0"`.  Otherwise, the module version is reported.
+var version string
+
+func lotterVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+const manifestComment = "; lotter manifest"
+
+// manifest returns comments recording how output was produced: the
+// version of lotter, its command line, base currency, lot order, and
+// a checksum of each input file (see -manifest).  Nothing varies from
+// one run to the next, unless version, flags or input do.
+func (this *settings) manifest(args []string, files []string) []string {
+	var command []string
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\;") {
+			arg = strconv.Quote(arg)
+		}
+		command = append(command, arg)
+	}
+	ret := []string{
+		manifestComment,
+		fmt.Sprintf(";   version  %s", lotterVersion()),
+		fmt.Sprintf(";   command  lotter %s", strings.Join(command, " ")),
+		fmt.Sprintf(";   base     %s", this.base),
+	}
+	if order := flag.Lookup("order"); order != nil { // defined by the operation, if it lots
+		ret = append(ret, fmt.Sprintf(";   order    %s", order.Value))
+	}
+	for _, name := range files {
+		sum, err := fileChecksum(name)
+		if err != nil {
+			ret = append(ret, fmt.Sprintf(";   input    %s (%s)", name, err))
+			continue
+		}
+		ret = append(ret, fmt.Sprintf(";   input    %s sha256 %s", name, sum))
+	}
+	return ret
+}
+
+// fileChecksum returns the SHA-256 of a file, in hex.  Standard input,
+// URLs and commands are not read twice, so not checksummed.
+func fileChecksum(name string) (string, error) {
+	switch {
+	case name == "-":
+		return "", fmt.Errorf("standard input, not checksummed")
+	case isURL(name):
+		return "", fmt.Errorf("URL, not checksummed")
+	case strings.HasPrefix(name, "!"):
+		return "", fmt.Errorf("command, not checksummed")
+	}
+	path, err := expandHome(name)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// dropManifest returns the lines of tx following a manifest, if tx
+// begins with one.  As comments, a manifest is scanned with the
+// transaction following it.
+func dropManifest(tx TxLines) TxLines {
+	if len(tx.Line) == 0 || tx.Line[0] != manifestComment {
+		return tx
+	}
+	n := 1
+	for n < len(tx.Line) && strings.HasPrefix(tx.Line[n], ";   ") {
+		n++
+	}
+	for n < len(tx.Line) && strings.TrimSpace(tx.Line[n]) == "" {
+		n++
+	}
+	tx.Line = tx.Line[n:]
+	tx.Start += n
+	tx.payee = nil
+	return tx
+}
+
+// manifestOutput writes a manifest before anything else, so that
+// flags of the operation are parsed when it is written.  A manifest of
+// input (i.e. of the run which wrote it) is dropped, as it does not
+// describe this output.
+type manifestOutput struct {
+	Output
+	manifest func() []string // nil once written
+}
+
+func (this *manifestOutput) write() {
+	if this.manifest != nil {
+		this.Output.Lines(this.manifest())
+		this.manifest = nil
+	}
+}
+
+func (this *manifestOutput) Lines(lines []string) {
+	this.write()
+	lines = dropManifest(TxLines{Line: lines}).Line
+	if len(lines) == 0 {
+		return
+	}
+	this.Output.Lines(lines)
+}
+
+func (this *manifestOutput) Tx(tx TxLines, generated []Posting) {
+	this.write()
+	this.Output.Tx(dropManifest(tx), generated)
+}
+
+func (this *manifestOutput) Report(rows [][]string) {
+	this.write()
+	this.Output.Report(rows)
+}
+
+func (this *manifestOutput) Flush() error {
+	this.write()
+	return this.Output.Flush()
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "my journal.ledger")
+	err := os.WriteFile(journal, []byte("abc"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := newSettings().manifest([]string{"-f", journal, "lot", "-short-gain=Income:short term"}, []string{journal, "-", "https://example.com/journal.ledger", "!cat journal.ledger"})
+	manifest := strings.Join(lines, "\n")
+	for _, expect := range []string{
+		`;   command  lotter -f "` + journal + `" lot "-short-gain=Income:short term"`,
+		";   base     USD",
+		";   input    " + journal + " sha256 ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", // of "abc"
+		";   input    - (standard input, not checksummed)",
+		";   input    https://example.com/journal.ledger (URL, not checksummed)",
+		";   input    !cat journal.ledger (command, not checksummed)",
+	} {
+		if !strings.Contains(manifest, expect) {
+			t.Errorf("manifest lacks %q:\n%s", expect, manifest)
+		}
+	}
+}
+
+// TestManifestOutput writes a manifest before output, dropping that of
+// input (of an earlier run).
+func TestManifestOutput(t *testing.T) {
+	settings := newSettings()
+	var out bytes.Buffer
+	output, err := NewOutput("ledger", &out, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output = &manifestOutput{Output: output, manifest: func() []string { return []string{manifestComment, ";   base     USD"} }}
+	s := NewTxScanner(strings.NewReader(`; lotter manifest
+;   version  v0.1.0
+;   base     EUR
+
+2021/01/01 Buy
+    Assets:Crypto            1 ABC
+    Assets:Bank
+`))
+	for s.Scan() {
+		output.Tx(s.Lines(), nil)
+	}
+	err = output.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out.String(), manifestComment); n != 1 || !strings.HasPrefix(out.String(), manifestComment+"\n;   base     USD\n") || strings.Contains(out.String(), "EUR") {
+		t.Errorf("output has %d manifests, expected only that of this run:\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), "2021/01/01 Buy\n") {
+		t.Errorf("output lacks transaction:\n%s", out.String())
+	}
+}
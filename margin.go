@@ -0,0 +1,154 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Margin (and futures) accounts hold positions which are not lots.
+// Positions may be long or short, and are opened and closed at
+// average cost.  Realized profit and loss is always a short term gain
+// (or loss).
+type margins struct {
+	marginAccount []string
+	marginGain    string
+
+	// keyed by account and asset
+	marginPosition map[string]*position
+}
+
+type position struct {
+	name     string   // generated account
+	quantity *big.Rat // negative when short
+	cost     *big.Rat // in base currency, negative when short
+}
+
+// isMargin returns true if the account is (or is beneath) a margin
+// account.
+func (this *margins) isMargin(account string) bool {
+	account = strings.Trim(account, "[]()")
+	for _, m := range this.marginAccount {
+		if account == m || strings.HasPrefix(account, m+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// separateMargin removes splits of margin accounts, returning them
+// separately.  Returns also whether remaining splits are a trade.
+func (this *margins) separateMargin(splits map[Asset]map[string][]Split) (margin []Split, isTrade bool) {
+	for _, asset := range sortedAssets(splits) {
+		for _, qual := range sortedQualifiers(splits[asset]) {
+			var spot []Split
+			for _, s := range splits[asset][qual] {
+				if this.isMargin(s.account) {
+					margin = append(margin, s)
+					continue
+				}
+				if s.price != nil || s.cost != nil {
+					isTrade = true
+				}
+				spot = append(spot, s)
+			}
+			if len(spot) == 0 {
+				delete(splits[asset], qual)
+			} else {
+				splits[asset][qual] = spot
+			}
+		}
+		if len(splits[asset]) == 0 {
+			delete(splits, asset)
+		}
+	}
+	return margin, isTrade
+}
+
+// consumeMargin opens and closes positions, returning splits for the
+// position's inventory and basis, and realized gains.
+func (this *lotter) consumeMargin(margin []Split) (generated []Posting, err error) {
+	for _, split := range margin {
+		if this.isBase(split.delta.Asset) {
+			continue // i.e. collateral
+		}
+		if split.price == nil && split.cost == nil {
+			continue // i.e. transfer between margin accounts
+		}
+		tally := this.toBase(*split.Tally())
+		if tally.Asset != this.base {
+			return nil, fmt.Errorf("margin position priced in non-base currency: %q", split.line)
+		}
+
+		key := fmt.Sprintf("%s %s", split.account, split.delta.Asset)
+		this.savePosition(key)
+		p, ok := this.marginPosition[key]
+		if !ok {
+			p = &position{
+				name:     fmt.Sprintf("Lot:Margin:%s:%s", split.account, split.delta.Asset),
+				quantity: new(big.Rat),
+				cost:     new(big.Rat),
+			}
+			this.marginPosition[key] = p
+		}
+
+		quantity := new(big.Rat).Set(split.delta.Rat)
+		value := new(big.Rat).Set(tally.Rat)
+
+		// close (some or all of) position, if opposite direction
+		if p.quantity.Sign() != 0 && p.quantity.Sign() != quantity.Sign() {
+			closed := new(big.Rat).Set(quantity)
+			if new(big.Rat).Abs(closed).Cmp(new(big.Rat).Abs(p.quantity)) > 0 {
+				closed.Neg(p.quantity) // close entire position, remainder opens
+			}
+			ratio := new(big.Rat).Quo(closed, quantity)
+			closedValue := new(big.Rat).Mul(value, ratio)
+			closedCost := new(big.Rat).Quo(new(big.Rat).Mul(p.cost, closed), p.quantity)
+			closedCost.Neg(closedCost) // portion of cost, sign of position
+
+			// gain = proceeds - cost, where proceeds are opposite of value
+			gain := new(big.Rat).Add(closedValue, closedCost)
+			gain.Neg(gain)
+
+			p.quantity.Add(p.quantity, closed)
+			p.cost.Sub(p.cost, closedCost)
+
+			generated = append(generated,
+				Posting{Account: p.name, Amount: this.NewAmount(split.delta.Asset, *new(big.Rat).Neg(closed)), Comment: ":MARGIN:CLOSE: (position)"},
+				Posting{Account: p.name, Amount: this.NewAmount(this.base, *new(big.Rat).Neg(closedCost)), Comment: ":MARGIN:CLOSE: (basis)"},
+			)
+			if gain.Sign() != 0 {
+				generated = append(generated, Posting{Account: this.marginGain, Amount: this.NewAmount(this.base, *gain.Neg(gain)), Comment: ":MARGIN:GAIN:"})
+			}
+
+			quantity.Sub(quantity, closed)
+			value.Sub(value, closedValue)
+		}
+
+		// open (or add to) position
+		if quantity.Sign() != 0 {
+			p.quantity.Add(p.quantity, quantity)
+			p.cost.Add(p.cost, value)
+			generated = append(generated,
+				Posting{Account: p.name, Amount: this.NewAmount(split.delta.Asset, *new(big.Rat).Neg(quantity)), Comment: ":MARGIN:OPEN: (position)"},
+				Posting{Account: p.name, Amount: this.NewAmount(this.base, *value), Comment: ":MARGIN:OPEN: (basis)"},
+			)
+		}
+	}
+	return generated, nil
+}
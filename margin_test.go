@@ -0,0 +1,98 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestMargin opens a position at average cost, closes part, reverses
+// it to short, and covers the short.
+func TestMargin(t *testing.T) {
+	journal := `2021/01/01 Spot
+    Assets:Wallet          1 BTC @ 50 USD
+    Assets:Cash
+
+2021/01/02 Long
+    Assets:Futures         1 BTC @ 100 USD
+    Assets:Futures:Margin
+
+2021/01/03 Long
+    Assets:Futures         1 BTC @ 200 USD
+    Assets:Futures:Margin
+
+2021/01/04 Close
+    Assets:Futures         -1.5 BTC @ 180 USD
+    Assets:Futures:Margin
+
+2021/01/05 Flip
+    Assets:Futures         -1.5 BTC @ 100 USD
+    Assets:Futures:Margin
+
+2021/01/06 Cover
+    Assets:Futures         1 BTC @ 80 USD
+    Assets:Futures:Margin
+`
+	got := generatedLines(string(lotJournal(t, journal, "-margin=Assets:Futures")))
+	expect := []string{
+		"[Lot::2021/01/01:1BTC@50USD] -1 BTC ; :BUY: (inventory)",
+		"[Lot::2021/01/01:1BTC@50USD] 50 USD ; :BUY: (basis)",
+		"[Lot:Margin:Assets:Futures:BTC] -1 BTC ; :MARGIN:OPEN: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] 100 USD ; :MARGIN:OPEN: (basis)",
+		"[Lot:Margin:Assets:Futures:BTC] -1 BTC ; :MARGIN:OPEN: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] 200 USD ; :MARGIN:OPEN: (basis)",
+
+		// 1.5 of 2 BTC, at average cost 150 USD
+		"[Lot:Margin:Assets:Futures:BTC] 1.5 BTC ; :MARGIN:CLOSE: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] -225 USD ; :MARGIN:CLOSE: (basis)",
+		"[Lot:Income:short term gain] -45 USD ; :MARGIN:GAIN:",
+
+		// remaining 0.5 BTC closed at a loss, then 1 BTC short opened
+		"[Lot:Margin:Assets:Futures:BTC] 0.5 BTC ; :MARGIN:CLOSE: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] -75 USD ; :MARGIN:CLOSE: (basis)",
+		"[Lot:Income:short term gain] 25 USD ; :MARGIN:GAIN:",
+		"[Lot:Margin:Assets:Futures:BTC] 1 BTC ; :MARGIN:OPEN: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] -100 USD ; :MARGIN:OPEN: (basis)",
+
+		// short covered lower
+		"[Lot:Margin:Assets:Futures:BTC] -1 BTC ; :MARGIN:CLOSE: (position)",
+		"[Lot:Margin:Assets:Futures:BTC] 100 USD ; :MARGIN:CLOSE: (basis)",
+		"[Lot:Income:short term gain] -20 USD ; :MARGIN:GAIN:",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("margin lotted:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+
+	// spot lot unaffected by margin trades in the same asset
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), newProblemTally(-1), []byte(journal), "queue", "-margin=Assets:Futures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, reportLines(out.String()), "BTC (all accounts), fifo: 1 BTC, basis 50 USD")
+
+	// margin priced in other than base
+	problems := newProblemTally(0)
+	err = runOperation(&bytes.Buffer{}, newSettings(), problems, []byte(journal+"\n2021/01/07 Long\n    Assets:Futures         1 BTC @ 1 ETH\n    Assets:Futures:Margin\n"), "lot", "-margin=Assets:Futures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["failed margin"] != 1 {
+		t.Errorf("%d failed margin, expected 1", problems.count["failed margin"])
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// fileList is the value of a flag which may be repeated (see -f).
+type fileList []string
+
+func (this *fileList) String() string { return strings.Join(*this, ",") }
+
+func (this *fileList) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
+// mergeKey is a way to order transactions of the same date, from more
+// than one file (see -merge-order).
+var mergeKey = [...]string{
+	"file", // order of files, as given to -f
+	"time", // "time" metadata, i.e. "; time: 14:05:00"
+	"seq",  // "seq" metadata, i.e. "; seq: 1042"
+}
+
+// parseMergeOrder parses keys in order of precedence, i.e.
+// "file,time,seq".
+func parseMergeOrder(str string) ([]string, error) {
+	var order []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(str, ",") {
+		key = strings.TrimSpace(key)
+		if !containsString(mergeKey[:], key) || seen[key] {
+			return nil, fmt.Errorf("bad -merge-order (%q), expected keys %s, comma separated", str, strings.Join(mergeKey[:], ", "))
+		}
+		seen[key] = true
+		order = append(order, key)
+	}
+	return order, nil
+}
+
+// mergeGroup is a transaction of one file, with the data which is not
+// a transaction (i.e. comments, directives) preceding it.
+type mergeGroup struct {
+	file  int
+	block []TxLines // the transaction is last
+}
+
+func (this mergeGroup) tx() *TxLines { return &this.block[len(this.block)-1] }
+
+// mergeInput reads groups from the scanner of one file.
+type mergeInput struct {
+	scanner *TxScanner
+	head    *mergeGroup // next group, nil when none
+	rest    []TxLines   // data following the last transaction
+}
+
+func (this *mergeInput) next(file int) {
+	this.head = nil
+	var block []TxLines
+	for this.scanner.Scan() {
+		tx := this.scanner.Lines()
+		_, payeeIndex := tx.Payee() // sets date
+		block = append(block, tx)
+		if payeeIndex != PayeeNotFound {
+			this.head = &mergeGroup{file: file, block: block}
+			return
+		}
+	}
+	this.rest = block
+}
+
+// mergeScanners returns a scanner of the transactions of many files,
+// in order of date.  Each file is expected in order of date, as lot
+// expects of one.  Transactions of the same date are ordered by keys
+// (see parseMergeOrder), then as found.  Data which is not a
+// transaction stays with the transaction following it, and data
+// following the last transaction of each file is last, in order of
+// files.
+func mergeScanners(scanner []*TxScanner, order []string) *TxScanner {
+	input := make([]*mergeInput, len(scanner))
+	for i, s := range scanner {
+		input[i] = &mergeInput{scanner: s}
+		input[i].next(i)
+	}
+
+	var pending []TxLines // of the day merged, in order
+	rest := false         // pending is the data following transactions
+	merged := newTxSource(func() (TxLines, bool) {
+		for len(pending) == 0 {
+			if rest {
+				return TxLines{}, false
+			}
+			pending = mergeDay(input, order)
+			if len(pending) == 0 {
+				rest = true
+				for _, in := range input {
+					pending = append(pending, in.rest...)
+				}
+			}
+		}
+		tx := pending[0]
+		pending = pending[1:]
+		return tx, true
+	})
+	merged.merged = scanner
+	return merged
+}
+
+// mergeDay reads, from each input, the transactions of the earliest
+// date among them, and returns them ordered.
+func mergeDay(input []*mergeInput, order []string) []TxLines {
+	var group []mergeGroup
+	for {
+		var earliest *mergeInput
+		for _, in := range input {
+			if in.head != nil && (earliest == nil || in.head.tx().Date.Before(earliest.head.tx().Date)) {
+				earliest = in
+			}
+		}
+		if earliest == nil || (len(group) > 0 && !earliest.head.tx().Date.Equal(group[0].tx().Date)) {
+			break
+		}
+		group = append(group, *earliest.head)
+		earliest.next(earliest.head.file)
+	}
+
+	sort.SliceStable(group, func(i, j int) bool { return mergeLess(group[i], group[j], order) })
+	var ret []TxLines
+	for _, g := range group {
+		ret = append(ret, g.block...)
+	}
+	return ret
+}
+
+// mergeLess compares groups of the same date by keys.  A key which
+// either transaction lacks (i.e. no "time" metadata) does not decide.
+func mergeLess(a, b mergeGroup, order []string) bool {
+	for _, key := range order {
+		switch key {
+		case "file":
+			if a.file != b.file {
+				return a.file < b.file
+			}
+		case "time":
+			at, aok := a.tx().Time()
+			bt, bok := b.tx().Time()
+			if aok && bok && !at.Equal(bt) {
+				return at.Before(bt)
+			}
+		case "seq":
+			as, aok := new(big.Rat).SetString(a.tx().Metadata("seq"))
+			bs, bok := new(big.Rat).SetString(b.tx().Metadata("seq"))
+			if aok && bok && as.Cmp(bs) != 0 {
+				return as.Cmp(bs) < 0
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMergeOrder(t *testing.T) {
+	order, err := parseMergeOrder("seq, time")
+	if err != nil || strings.Join(order, ",") != "seq,time" {
+		t.Errorf("parsed %q (%v)", order, err)
+	}
+	for _, bad := range []string{"", "date", "time,time", "file,"} {
+		if _, err := parseMergeOrder(bad); err == nil {
+			t.Errorf("no error parsing %q", bad)
+		}
+	}
+}
+
+// merged returns the payees and comments of files merged, in order.
+func merged(t *testing.T, order string, file ...string) []string {
+	t.Helper()
+	key, err := parseMergeOrder(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var scanner []*TxScanner
+	for _, f := range file {
+		scanner = append(scanner, NewTxScanner(strings.NewReader(f)))
+	}
+	s := mergeScanners(scanner, key)
+	var ret []string
+	for s.Scan() {
+		for _, line := range s.Lines().Line {
+			if line != "" && !strings.HasPrefix(line, " ") {
+				ret = append(ret, line)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestMergeScanners(t *testing.T) {
+	a := `; before A1
+2021/01/01 A1
+    ; time: 14:00:00
+    ; seq: 5
+    Assets:Cash  1 USD
+    Income:Misc
+
+2021/01/03 A3
+    Assets:Cash  1 USD
+    Income:Misc
+
+; after A
+`
+	b := `2021/01/01 B1
+    ; time: 09:00:00
+    ; seq: 9
+    Assets:Cash  1 USD
+    Income:Misc
+
+2021/01/01 B1 without time
+    ; seq: 1
+    Assets:Cash  1 USD
+    Income:Misc
+
+2021/01/02 B2
+    Assets:Cash  1 USD
+    Income:Misc
+
+; after B
+`
+	for _, test := range []struct {
+		order  string
+		file   []string
+		expect []string
+	}{
+		{
+			// file first, then within file B, seq (as B1 without time is undecided by time)
+			order:  "file,time,seq",
+			file:   []string{a, b},
+			expect: []string{"; before A1", "2021/01/01 A1", "2021/01/01 B1 without time", "2021/01/01 B1", "2021/01/02 B2", "2021/01/03 A3", "; after A", "; after B"},
+		},
+		{
+			order:  "time,seq",
+			file:   []string{a, b},
+			expect: []string{"2021/01/01 B1 without time", "2021/01/01 B1", "; before A1", "2021/01/01 A1", "2021/01/02 B2", "2021/01/03 A3", "; after A", "; after B"},
+		},
+		{
+			order:  "seq",
+			file:   []string{a, b},
+			expect: []string{"2021/01/01 B1 without time", "; before A1", "2021/01/01 A1", "2021/01/01 B1", "2021/01/02 B2", "2021/01/03 A3", "; after A", "; after B"},
+		},
+		{
+			// B first, and transactions of one file keep their order
+			order:  "file",
+			file:   []string{b, a},
+			expect: []string{"2021/01/01 B1", "2021/01/01 B1 without time", "; before A1", "2021/01/01 A1", "2021/01/02 B2", "2021/01/03 A3", "; after B", "; after A"},
+		},
+	} {
+		got := merged(t, test.order, test.file...)
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("merged by %s:\n%s\nexpected:\n%s", test.order, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+	}
+}
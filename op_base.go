@@ -31,14 +31,36 @@
 // transaction, this operation rewrites the transaction splits
 // converting the original cost currency into the _base_.
 //
+// Converted costs are written as total cost (i.e. "@@ 25000 USD"),
+// or with `-cost-style=unit` as unit price (i.e. "@ 2500 USD").  Use
+// `-cost-precision` to round them to a number of decimal places.
+//
+// Price directives may include a time (i.e. "P 2021/05/19 14:00:00
+// BTC 38000 USD").  When a transaction has "time" metadata (i.e. ";
+// time: 14:05:00"), the price nearest in time is used, rather than
+// the last price of the day.
+//
+// Price directives are written as found, unless
+// `-price-directives=drop` (they are omitted from output) or
+// `-price-directives=normalize` (they are rewritten in a consistent
+// form, i.e. "P 2004/06/21 TWCUX 27.76 USD").  Other directives,
+// comments and tags are always written as found.
+//
+// Problems converting a transaction are written to output, as
+// "FIXME" splits which `ledger-cli` rejects.  Use
+// `-errors-out=<filename>` to write them to that file instead (a line
+// per problem), and the transaction as found, unconverted.  So output
+// never holds FIXME lines, while the file lists transactions to fix.
+//
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"math/big"
+	"os"
 	"strings"
 	"time"
 
@@ -46,17 +68,21 @@ import (
 )
 
 func init() {
-	command.RegisterOperation(
+	registerOperation(
 		baseMain,
 		"base",
-		"base [-b=<begin date>]",
+		"base [-b=<begin date>] [-cost-style=<total|unit>] [-cost-precision=<places>] [-price-directives=<keep|drop|normalize>] [-errors-out=<filename>]",
 		"Convert price/cost information to base currency (using ledger-cli price data).",
 	)
 }
 
-func baseMain() error {
+func baseMain(env *environment) error {
 	// define flags
 	beginFlag := flag.String("b", "", "begin date")
+	styleFlag := flag.String("cost-style", "total", "write converted cost as total (\"@@\") or unit price (\"@\")")
+	placesFlag := flag.Int("cost-precision", -1, "decimal places of converted cost, -1 for precision of base currency")
+	directivesFlag := flag.String("price-directives", "keep", fmt.Sprintf("how price directives are written (%s)", strings.Join(priceDirectiveMode[:], ", ")))
+	errorsOutFlag := flag.String("errors-out", "", "file to write problems to, rather than output (as FIXME), leaving transactions with problems unconverted")
 
 	err := command.Parse()
 	if err != nil {
@@ -64,94 +90,110 @@ func baseMain() error {
 	}
 
 	// validate flags
-	if base == "" {
+	if env.base == "" {
 		return errors.New("A base currency is required, i.e. `-base=USD`.")
 	}
 
+	if *styleFlag != "total" && *styleFlag != "unit" {
+		return fmt.Errorf("unexpected -cost-style (%q), expected total or unit", *styleFlag)
+	}
+	if !containsString(priceDirectiveMode[:], *directivesFlag) {
+		return fmt.Errorf("unexpected -price-directives (%q), expected one of %s", *directivesFlag, strings.Join(priceDirectiveMode[:], ", "))
+	}
+	if *placesFlag < -1 {
+		return fmt.Errorf("bad -cost-precision (%d), expected a number of decimal places, or -1", *placesFlag)
+	}
+
 	var begin time.Time
 	if *beginFlag != "" {
 		begin, err = time.Parse("2006/01/02", *beginFlag)
 		if err != nil {
-			command.Check(fmt.Errorf("bad begin date (%q): %w", *beginFlag, err))
+			return fmt.Errorf("bad begin date (%q): %w", *beginFlag, err)
 		}
 	}
 
+	var errorsOut *bufio.Writer
+	if *errorsOutFlag != "" {
+		f, err := os.Create(*errorsOutFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create errors file (%q): %w", *errorsOutFlag, err)
+		}
+		defer f.Close()
+		errorsOut = bufio.NewWriter(f)
+	}
+
 	// observe price information, if any
-	priceHistory := make(map[string]*big.Rat)
+	priceHistory := newPriceHistory(env.settings)
 
-	for scanner.Scan() {
-		txLines := scanner.Lines()
+	for env.scanner.Scan() {
+		txLines := env.scanner.Lines()
 
 		for _, line := range txLines.Line {
-			// we're looking for, i.e. "P 2004/06/21 02:17:58 TWCUX 27.76 USD"
-			// https://www.ledger-cli.org/3.0/doc/ledger3.html#Commodity-price-histories
-			if strings.HasPrefix(line, "P ") {
-				command.V(2).Info("\t", line) // debug
-				seg := strings.SplitN(line, ";", 2)
-				field := strings.Fields(seg[0])
-
-				// support "P 2004/06/21 TWCUX 27.76 USD" by inserting a time
-				if len(field) == 5 {
-					field = append(field[:2+1], field[2:]...)
-					field[2] = "00:00:00"
-				}
-
-				counterIdx, invert := -1, false
-				if field[5] == string(base) {
-					counterIdx, invert = 3, false
-				} else if field[3] == string(base) {
-					counterIdx, invert = 5, true
-				} else {
-					command.V(1).Infof("ignoring non-base price (%q)", line)
-					continue
-				}
-
-				date, err := time.Parse("2006/01/02 15:04:05", strings.Join(field[1:3], " "))
-				if err != nil {
-					command.Check(fmt.Errorf("failed to parse historical price (%q): %w", line, err))
-				}
-
-				price, ok := new(big.Rat).SetString(field[4])
-				if !ok {
-					command.Check(fmt.Errorf("failed to parse historical price (%q)", line))
-				}
-				if invert {
-					price.Inv(price)
-				}
-
-				key := historyKey(date, Asset(field[counterIdx]))
-				old, ok := priceHistory[key]
-				if ok {
-					// TODO(dnc): round strings to proper precision
-					command.V(1).Infof("updating price history (was %s, now %s)\n\t%s", old.FloatString(6), price.FloatString(6), line)
-				}
-				priceHistory[key] = price
+			_, err := priceHistory.Observe(line)
+			if err != nil {
+				return statusError(exitInput, err)
 			}
 		} // end collect price history
 
 		payee, payeeIndex := txLines.Payee()
 		if payeeIndex == PayeeNotFound {
 			// not a transaction (maybe a comment)
-			writeLines(append(txLines.Line, "")) // with a blank
+			lines := env.priceDirectives(txLines.Line, *directivesFlag)
+			if len(lines) > 0 {
+				env.output.Lines(lines)
+			}
 			continue
 		}
 		if begin.After(txLines.Date) {
-			writeLines(append(txLines.Line, "")) // with a blank
+			txLines.Line = env.priceDirectives(txLines.Line, *directivesFlag)
+			txLines.payee = nil
+			env.output.Tx(txLines, nil)
 			continue
 		}
 
 		command.V(2).Info("\t", payee) // debug
 
-		// prepare to display multiple errors
-		var errs []error
+		// prepare to display multiple errors, written to ledger data
+		// (or with -errors-out, to that file)
+		original := txLines
+		original.Line = append([]string(nil), txLines.Line...)
+		var fixme []Posting
+		stop, unparsed := false, false
+		report := func(kind string, err error) {
+			stop = env.problems.add(kind, err) || stop
+			fixme = append(fixme, Posting{Err: fmt.Errorf("base: %w", err)})
+		}
+		for _, err := range env.checkAccounts(env.scanner, txLines) {
+			report("undeclared account", err)
+		}
 
-		// first pass, find conversions to base
-		conversion := make(map[string]Amount)
-		for _, line := range txLines.Line[payeeIndex+1:] {
-			split, ok := parseSplit(line)
+		// With "time" metadata, the price nearest in time is used.
+		// Otherwise, the last price directive of the day.
+		lookup := priceHistory.Lookup
+		if when, ok := txLines.Time(); ok {
+			lookup = func(_ time.Time, asset Asset) (*big.Rat, bool) {
+				return priceHistory.LookupTime(when, asset)
+			}
+		}
+
+		// first pass, find conversions to base, of each split (by index)
+		type convert struct {
+			cost  Amount // in other than base
+			basis Amount // in base
+		}
+		conversion := make(map[int]convert)
+		var converted []int // indexes, in order
+		for i, line := range txLines.Line[payeeIndex+1:] {
+			split, ok, err := env.parseSplitError(line)
+			if err != nil {
+				report("unparsed transaction", lineErrorf(txLines.Start+payeeIndex+1+i, "%w", err))
+				unparsed = true
+				continue
+			}
 			if !ok {
 				if !strings.HasPrefix(strings.TrimLeft(line, " \t"), ";") { // check comment
-					command.Check(fmt.Errorf("failed to parse transaction split: %q", line))
+					report("unparsed transaction", lineErrorf(txLines.Start+payeeIndex+1+i, "failed to parse transaction split: %q", line))
+					unparsed = true
 				}
 				continue // comment is noop
 			}
@@ -162,87 +204,147 @@ func baseMain() error {
 			}
 
 			cost := split.Cost()
-			if cost == nil || cost.Asset == base {
+			if cost == nil || cost.Asset == env.base {
 				continue
 			}
 
 			// here we have a cost that must be converted into base currency
 
-			key := historyKey(txLines.Date, cost.Asset)
-			price, ok := priceHistory[key]
+			price, ok := lookup(txLines.Date, cost.Asset)
 			if ok {
 				// conversion based on cost
 				tmp := new(big.Rat).Mul(price, cost.Rat)
-				basis := NewAmount(base, *tmp)
-				conversion[cost.String()] = basis
+				conversion[i] = convert{cost: *cost, basis: env.NewAmount(env.base, *tmp.Abs(tmp))}
+				converted = append(converted, i)
 			} else {
 				// alternately, convert based on delta
-				key = historyKey(txLines.Date, split.delta.Asset)
-				price, ok = priceHistory[key]
+				price, ok = lookup(txLines.Date, split.delta.Asset)
 				if ok {
 					tmp := new(big.Rat).Mul(price, split.delta.Rat)
-					basis := NewAmount(base, *tmp.Abs(tmp))
-					conversion[cost.String()] = basis
+					conversion[i] = convert{cost: *cost, basis: env.NewAmount(env.base, *tmp.Abs(tmp))}
+					converted = append(converted, i)
 				} else {
-					errs = append(errs, fmt.Errorf("missing price of %s or %s on %s", cost.Asset, split.delta.Asset, txLines.Date.Format("2006/01/02")))
+					report("missing price", lineErrorf(txLines.Start+payeeIndex+1+i, "missing price of %s or %s on %s", cost.Asset, split.delta.Asset, txLines.Date.Format("2006/01/02")))
 				}
 			}
 
 		} // end first pass
 
-		if len(conversion) > 0 {
+		if len(conversion) > 0 && !unparsed {
 			// second pass, alter
+			paired := make(map[int]bool) // conversions paired with a split without price
 			for index, line := range txLines.Line[payeeIndex+1:] {
-				split, ok := parseSplit(line)
+				split, ok := env.parseSplit(line)
 				if !ok {
 					continue // comment is noop
 				}
 
-				if split.cost != nil || split.price != nil {
-					basis, ok := conversion[split.Cost().String()]
-					basis = basis.AbsClone()
-					if ok {
-						// replace existing cost/price with basis
-						txLines.Line[payeeIndex+1+index] = strings.Replace(line, "@", fmt.Sprintf("@@ %s ; @", basis), 1)
-					}
-				} else if split.delta != nil {
-					deltaStr := split.delta.NegClone().String()
-					basis, ok := conversion[deltaStr]
-					if ok {
-						// add basis where there may be no price, here we expect "<amount><space><asset>"
-						field := strings.Fields(line)
-						txLines.Line[payeeIndex+1+index] = strings.Replace(line, fmt.Sprintf("%s %s", field[1], field[2]), fmt.Sprintf("%s @@ %s ; ", split.delta, basis), 1)
-						// sanity
-						if txLines.Line[payeeIndex+1+index] == line {
-							log.Panicf("failed to replace %q in line (%q)", deltaStr, line)
+				if c, ok := conversion[index]; ok {
+					// replace existing cost/price with basis
+					txLines.Line[payeeIndex+1+index] = strings.Replace(line, "@", fmt.Sprintf("%s ; @", formatCost(c.basis, *split.delta, *styleFlag, *placesFlag)), 1)
+				} else if split.cost == nil && split.price == nil && split.delta != nil && !env.isBase(split.delta.Asset) {
+					// The other side of a conversion (i.e. "-10 ETH",
+					// when another split costs "@@ 10 ETH").  Each is
+					// paired with one conversion, in order, so that
+					// splits of the same amount are not confused.
+					match := -1
+					for _, i := range converted {
+						c := conversion[i]
+						if !paired[i] && c.cost.Asset == split.delta.Asset && c.cost.Cmp(new(big.Rat).Neg(split.delta.Rat)) == 0 {
+							match = i
+							break
 						}
-					} else {
-						// troubleshoot
-						for key, _ := range conversion {
-							log.Println("conversion available:", key)
+					}
+					if match == -1 {
+						for _, c := range conversion {
+							if c.cost.Asset == split.delta.Asset {
+								// asset is converted, but not this amount
+								report("missing price", lineErrorf(txLines.Start+payeeIndex+1+index, "no conversion to base currency of %s (%q)", split.delta, line))
+								break
+							}
 						}
-						log.Panicf("failed to convert %q to base currency", deltaStr)
+						continue
+					}
+					paired[match] = true
+
+					start, end, ok := amountIndex(line)
+					if !ok {
+						report("unparsed transaction", lineErrorf(txLines.Start+payeeIndex+1+index, "failed to find amount of split (%q)", line))
+						continue
+					}
+					rest := line[end:]
+					if !strings.HasPrefix(strings.TrimSpace(rest), ";") {
+						rest = " ; " + rest
 					}
+					txLines.Line[payeeIndex+1+index] = line[:start] + fmt.Sprintf("%s %s", split.delta, formatCost(conversion[match].basis, *split.delta, *styleFlag, *placesFlag)) + rest
 				}
 
 			} // end second pass
 		}
 
 		// write txLines (which may have been modified above)
-		writeLines(txLines.Line)
-		for _, err = range errs {
-			command.Error(err)
-			fmt.Println("    FIXME:lotter base:  ", err) // write error to ledger data
+		if errorsOut != nil && len(fixme) > 0 {
+			for _, p := range fixme {
+				fmt.Fprintln(errorsOut, p.Err)
+			}
+			txLines, fixme = original, nil
+		}
+		txLines.Line = env.priceDirectives(txLines.Line, *directivesFlag)
+		txLines.payee = nil
+		env.output.Tx(txLines, fixme)
+		if stop {
+			break
 		}
-
-		fmt.Println("") // blank line between transactions
 
 	} // end scan loop
 
+	if errorsOut != nil {
+		err = errorsOut.Flush()
+		if err != nil {
+			return statusError(exitError, fmt.Errorf("failed to write errors file (%q): %w", *errorsOutFlag, err))
+		}
+	}
 	return nil
 }
 
-func historyKey(date time.Time, asset Asset) string {
-	return fmt.Sprintf("%s %s", date.Format("2006/01/02"), asset)
+var priceDirectiveMode = [...]string{"keep", "drop", "normalize"}
+
+// priceDirectives applies -price-directives to the price directives
+// found in lines.  Other lines are returned as found.
+func (this *settings) priceDirectives(lines []string, mode string) []string {
+	if mode == "keep" {
+		return lines
+	}
+	var ret []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "P ") {
+			ret = append(ret, line)
+			continue
+		}
+		if mode == "normalize" {
+			normal, err := this.normalizePrice(line)
+			if err != nil {
+				normal = line // unreachable, as price was observed
+			}
+			ret = append(ret, normal)
+		}
+	}
+	return ret
 }
 
+// formatCost renders a cost converted to base currency, as total cost
+// ("@@") or unit price ("@") of delta, rounded to places (unless
+// negative).  It is written as other base amounts are (see
+// -base-position and -base-places).
+func formatCost(basis Amount, delta Amount, style string, places int) string {
+	op, value := "@@", basis.Rat
+	if style == "unit" && delta.Sign() != 0 {
+		op, value = "@", new(big.Rat).Quo(basis.Rat, new(big.Rat).Abs(delta.Rat))
+	}
+	cost := basis.ZeroClone()
+	cost.Set(value)
+	if places >= 0 {
+		return fmt.Sprintf("%s %s", op, cost.format(cost.number(places)))
+	}
+	return fmt.Sprintf("%s %s", op, cost)
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestBaseDuplicateAmounts converts two trades of the same cost, each
+// paired in order with one of two splits of the same amount.
+func TestBaseDuplicateAmounts(t *testing.T) {
+	journal := `P 2021/05/19 BTC 40000 USD
+P 2021/05/19 XYZ 1 USD
+P 2021/05/20 BTC 40000 USD
+
+2021/05/19 Trade
+    Assets:Wallet          -10 ETH
+    Assets:Exchange        -10 ETH ; memo
+    Assets:Wallet          1 BTC @@ 10 ETH
+    Assets:Exchange        25000 XYZ @@ 10 ETH
+
+2021/05/20 Trade
+    Assets:Wallet          1 BTC @@ 10 ETH
+    Assets:Wallet          -5 ETH
+    Assets:Exchange        -5 ETH
+`
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err := runOperation(&out, newSettings(), problems, []byte(journal), "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reportLines(out.String())
+	expectLines(t, got,
+		"2021/05/19 Trade",
+		"Assets:Wallet -10 ETH @@ 40000 USD ;", // first conversion
+		"Assets:Exchange -10 ETH @@ 25000 USD ; memo",
+		"Assets:Wallet 1 BTC @@ 40000 USD ; @@ 10 ETH",
+		"Assets:Exchange 25000 XYZ @@ 25000 USD ; @@ 10 ETH",
+	)
+
+	// amounts of no conversion are not converted, and are counted
+	expectLines(t, got,
+		"Assets:Wallet 1 BTC @@ 40000 USD ; @@ 10 ETH",
+		"Assets:Wallet -5 ETH",
+		"Assets:Exchange -5 ETH",
+	)
+	if problems.count["missing price"] != 2 {
+		t.Errorf("%d missing price, expected 2:\n%s", problems.count["missing price"], strings.Join(got, "\n"))
+	}
+}
+
+func TestAmountIndex(t *testing.T) {
+	for line, expect := range map[string]string{
+		"    Assets:Crypto  -10 ETH ; memo":     "-10 ETH",
+		"    Assets:Crypto\t-10 ETH":            "-10 ETH",
+		"    Assets:My Wallet  1 BTC @@ 10 ETH": "1 BTC @@ 10 ETH",
+		"    Assets:Crypto ; no amount":         "",
+		"    Assets:Crypto":                     "",
+	} {
+		start, end, ok := amountIndex(line)
+		got := ""
+		if ok {
+			got = line[start:end]
+		}
+		if got != expect {
+			t.Errorf("amount of %q is %q, expected %q", line, got, expect)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation compare-lots
+//
+// Usage:
+//
+//     lotter -f <filename> compare-lots -statement <lots.csv> [-asof <date>] [-tolerance <amount>]
+//
+// The `compare-lots` operation replays transactions, as the `lot`
+// operation does, and compares the open lots found against a broker
+// statement of open lots (CSV).  Lots are compared by asset and
+// acquisition date (and by lot queue, when the statement has an
+// account column), so that a broker's lot split in two still matches
+// one lot of `lotter`.  Each difference in quantity or basis, beyond
+// `-tolerance`, is reported as a problem.  For example,
+//
+//     ABC  2016/01/01  quantity 79 ABC (statement 80 ABC)  basis 1.58 USD (statement 1.6 USD)
+//     QQQ  2019/01/01  missing from lots (statement 1 QQQ, basis 5 USD)
+//     XYZ  2018/02/02  missing from statement (1000 XYZ, basis 10 USD)
+//
+// Columns are recognized by common names (i.e. "symbol", "acquired",
+// "quantity", "cost basis").  Use flags to name the columns found in
+// other statements.  Transactions are replayed by the same code as
+// `lot`, which accepts the flags of `lot` deciding how transactions
+// are lotted (i.e. `-order`, `-margin`, `-classes`, `-hook`).  Use the
+// same flags (and `-prune`) as when running `lot`.
+//
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		compareLotsMain,
+		"compare-lots",
+		"compare-lots -statement=<filename> [-asof=<date>] [-tolerance=<amount>] [-order=<fifo|lifo|hifo>] [<lot flags>]",
+		"Compare open lots against a broker statement (CSV), reporting mismatches.",
+	)
+}
+
+// openLots tallies inventory and basis of lots, acquired on a date.
+type openLots struct {
+	asset     Asset
+	date      time.Time
+	qualifier string
+	inventory *big.Rat
+	basis     *big.Rat
+}
+
+func compareLotsMain(env *environment) error {
+	// define flags
+	statementFlag := flag.String("statement", "", "CSV file of open lots, from broker")
+	asofFlag := flag.String("asof", "", "compare lots as of this date (i.e. the date of statement)")
+	toleranceFlag := flag.String("tolerance", "0.01", "difference of quantity or basis (in base currency) tolerated, i.e. rounding")
+	lotting := defineLotFlags()
+	dateColumn := flag.String("date-column", "", "name of acquisition date column")
+	assetColumn := flag.String("asset-column", "", "name of asset column")
+	quantityColumn := flag.String("quantity-column", "", "name of quantity column")
+	basisColumn := flag.String("basis-column", "", "name of cost basis (in base currency) column")
+	accountColumn := flag.String("account-column", "", "name of account column (optional)")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	if *statementFlag == "" {
+		return errors.New("A statement is required, i.e. `-statement=lots.csv`.")
+	}
+	tolerance, ok := new(big.Rat).SetString(*toleranceFlag)
+	if !ok || tolerance.Sign() < 0 {
+		return fmt.Errorf("bad -tolerance (%q), expected a non-negative number", *toleranceFlag)
+	}
+	var asof time.Time
+	if *asofFlag != "" {
+		asof, err = parseDate(*asofFlag)
+		if err != nil {
+			return fmt.Errorf("bad -asof date (%q): %w", *asofFlag, err)
+		}
+	}
+
+	f, err := os.Open(*statementFlag)
+	if err != nil {
+		return fmt.Errorf("failed to open statement (%q): %w", *statementFlag, err)
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	column := csvColumns(header, map[string][]string{
+		"date":     columnNames(*dateColumn, "acquired", "date acquired", "open date", "acquisition date", "date"),
+		"asset":    columnNames(*assetColumn, "symbol", "asset", "currency", "ticker", "coin"),
+		"quantity": columnNames(*quantityColumn, "quantity", "shares", "amount", "units"),
+		"basis":    columnNames(*basisColumn, "cost basis", "basis", "cost", "total cost"),
+		"account":  columnNames(*accountColumn, "account"),
+	})
+	for _, key := range []string{"date", "asset", "quantity", "basis"} {
+		if _, ok := column[key]; !ok {
+			return fmt.Errorf("CSV has no %s column (header %q), use -%s-column", key, header, key)
+		}
+	}
+	_, byAccount := column["account"]
+
+	key := func(asset Asset, date time.Time, qual string) string {
+		return fmt.Sprintf("%s %s %s", asset, date.Format("2006/01/02"), qual)
+	}
+	tally := func(m map[string]*openLots, asset Asset, date time.Time, qual string, inventory, basis *big.Rat) {
+		k := key(asset, date, qual)
+		if m[k] == nil {
+			m[k] = &openLots{asset: asset, date: date, qualifier: qual, inventory: new(big.Rat), basis: new(big.Rat)}
+		}
+		m[k].inventory.Add(m[k].inventory, inventory)
+		m[k].basis.Add(m[k].basis, basis)
+	}
+
+	// open lots, according to statement
+	statement := make(map[string]*openLots)
+	for row := 2; ; row++ { // row 1 is header
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read CSV: %w", err)
+		}
+		field := func(key string) string {
+			i := column[key]
+			if i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		t, err := parseTimestamp(field("date"))
+		if err != nil {
+			return statusError(exitInput, fmt.Errorf("row %d: %w", row, err))
+		}
+		date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		asset := Asset(field("asset"))
+		quantity, ok := new(big.Rat).SetString(strings.ReplaceAll(field("quantity"), ",", ""))
+		if !ok {
+			return statusError(exitInput, fmt.Errorf("row %d: failed to parse quantity (%q)", row, field("quantity")))
+		}
+		basis, ok := new(big.Rat).SetString(strings.TrimLeft(strings.ReplaceAll(field("basis"), ",", ""), "$"))
+		if !ok {
+			return statusError(exitInput, fmt.Errorf("row %d: failed to parse basis (%q)", row, field("basis")))
+		}
+		qual := ""
+		if byAccount {
+			qual = env.qualifier(field("account"))
+		}
+		tally(statement, asset, date, qual, quantity, basis)
+	}
+
+	// open lots, according to lotter
+	lotted, err := replayLots(env, lotting, asof, nil)
+	if err != nil {
+		return err
+	}
+	computed := make(map[string]*openLots)
+	for asset, queues := range lotted.lotQueue {
+		for q, queue := range queues {
+			if !byAccount {
+				q = ""
+			}
+			for _, l := range queue.lot {
+				if l.inventory.Sign() == 0 {
+					continue
+				}
+				tally(computed, asset, l.date, q, l.inventory.Rat, new(big.Rat).Mul(l.price, l.inventory.Rat))
+			}
+		}
+	}
+
+	// compare, in order of asset, date and qualifier
+	var keys []string
+	for k := range statement {
+		keys = append(keys, k)
+	}
+	for k := range computed {
+		if statement[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	differs := func(a, b *big.Rat) bool {
+		diff := new(big.Rat).Sub(a, b)
+		return diff.Abs(diff).Cmp(tolerance) > 0
+	}
+
+	w := newReportWriter(env.output)
+	mismatch := 0
+	for _, k := range keys {
+		s, c := statement[k], computed[k]
+		lots := s
+		if lots == nil {
+			lots = c
+		}
+		where := fmt.Sprintf("%s\t%s", lots.asset, lots.date.Format("2006/01/02"))
+		if byAccount {
+			where = fmt.Sprintf("%s\t%s", where, lots.qualifier)
+		}
+
+		var msg string
+		switch {
+		case c == nil:
+			msg = fmt.Sprintf("missing from lots (statement %s, basis %s)", env.NewAmount(s.asset, *s.inventory), env.NewAmount(env.base, *s.basis))
+		case s == nil:
+			msg = fmt.Sprintf("missing from statement (%s, basis %s)", env.NewAmount(c.asset, *c.inventory), env.NewAmount(env.base, *c.basis))
+		case differs(c.inventory, s.inventory) || differs(c.basis, s.basis):
+			msg = fmt.Sprintf("quantity %s (statement %s)\tbasis %s (statement %s)",
+				env.NewAmount(c.asset, *c.inventory), env.NewAmount(s.asset, *s.inventory),
+				env.NewAmount(env.base, *c.basis), env.NewAmount(env.base, *s.basis))
+		default:
+			continue // match
+		}
+		fmt.Fprintf(w, "%s\t%s\n", where, msg)
+		mismatch++
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if mismatch > 0 {
+		env.problems.add("lot mismatch", fmt.Errorf("%d of %d lots differ from statement (%q)", mismatch, len(keys), *statementFlag))
+	} else {
+		command.V(1).Infof("all %d lots match statement (%q)", len(keys), *statementFlag)
+	}
+	return nil
+}
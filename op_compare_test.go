@@ -0,0 +1,86 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCompareLots compares open lots against a statement which splits
+// a lot in two, lacks one lot, and has a lot lotter lacks.
+func TestCompareLots(t *testing.T) {
+	statement := filepath.Join(t.TempDir(), "lots.csv")
+	err := os.WriteFile(statement, []byte(`Symbol,Date Acquired,Quantity,Cost Basis
+ABC,2021/01/01,40,$80.00
+ABC,2021/01/01,39,78.005
+QQQ,2019/01/01,1,5
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := []byte(`2021/01/01 Buy
+    Assets:Broker           50 ABC @ 2 USD
+    Assets:Bank
+
+2021/01/01 Buy again
+    Assets:Broker           30 ABC @ 2 USD
+    Assets:Bank
+
+2021/02/02 Buy
+    Assets:Broker         1000 XYZ @ 0.01 USD
+    Assets:Bank
+
+2021/03/01 Sell
+    Assets:Broker           -1 ABC @ 3 USD
+    Assets:Bank
+`)
+	compare := func(arg ...string) ([]string, int) {
+		t.Helper()
+		var out bytes.Buffer
+		problems := newProblemTally(0)
+		err := runOperation(&out, newSettings(), problems, journal, "compare-lots", append([]string{"-statement=" + statement}, arg...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reportLines(out.String()), problems.count["lot mismatch"]
+	}
+
+	// lots of one day match the statement's rows of that day, within
+	// -tolerance (by default, 0.01)
+	report, mismatch := compare()
+	expect := []string{
+		"QQQ 2019/01/01 missing from lots (statement 1 QQQ, basis 5 USD)",
+		"XYZ 2021/02/02 missing from statement (1000 XYZ, basis 10 USD)",
+	}
+	if strings.Join(report, "\n") != strings.Join(expect, "\n") || mismatch != 1 {
+		t.Errorf("report (%d problems):\n%s\nexpected (1 problem):\n%s", mismatch, strings.Join(report, "\n"), strings.Join(expect, "\n"))
+	}
+
+	report, _ = compare("-tolerance=0")
+	if len(report) != 3 || report[0] != "ABC 2021/01/01 quantity 79 ABC (statement 79 ABC) basis 158 USD (statement 158.005 USD)" {
+		t.Errorf("report with -tolerance=0:\n%s", strings.Join(report, "\n"))
+	}
+
+	// before the sale
+	report, _ = compare("-asof=2021/02/15")
+	if len(report) != 3 || report[0] != "ABC 2021/01/01 quantity 80 ABC (statement 79 ABC) basis 160 USD (statement 158.005 USD)" {
+		t.Errorf("report with -asof=2021/02/15:\n%s", strings.Join(report, "\n"))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation compare-gains
+//
+// Usage:
+//
+//     lotter -f <lotted.ledger> compare-gains -previous <lotted.ledger> [-tolerance <amount>]
+//
+// The `compare-gains` operation compares the gains realized in a
+// lotted file against those of a file lotted previously (i.e. the one
+// used to file taxes), per year and gain account.  Each difference,
+// beyond `-tolerance`, is reported as a problem.  For example,
+//
+//     lotter -f journal.ledger lot > lotted.ledger
+//     lotter -f lotted.ledger compare-gains -previous filed-2021.ledger
+//
+//     2017  Lot:Income:long term gain   9.8 USD (previous 10 USD, change -0.2 USD)
+//     2018  Lot:Income:short term gain  0 USD (previous 5 USD, change -5 USD)
+//
+// Gains are shown as positive, losses negative.  Use it after
+// editing old transactions, to learn whether the edit alters a year
+// already filed.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		compareGainsMain,
+		"compare-gains",
+		"compare-gains -previous=<filename> [-tolerance=<amount>]",
+		"Compare gains realized (per year) against an earlier lotted file, reporting changes.",
+	)
+}
+
+func compareGainsMain(env *environment) error {
+	// define flags
+	previousFlag := flag.String("previous", "", "file lotted previously")
+	toleranceFlag := flag.String("tolerance", "0", "difference of gain (in base currency) tolerated, i.e. rounding")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	if *previousFlag == "" {
+		return errors.New("A previously lotted file is required, i.e. `-previous=lotted.ledger`.")
+	}
+	tolerance, ok := new(big.Rat).SetString(*toleranceFlag)
+	if !ok || tolerance.Sign() < 0 {
+		return fmt.Errorf("bad -tolerance (%q), expected a non-negative number", *toleranceFlag)
+	}
+
+	f, err := os.Open(*previousFlag)
+	if err != nil {
+		return fmt.Errorf("failed to open previous (%q): %w", *previousFlag, err)
+	}
+	defer f.Close()
+
+	previous, err := env.tallyGains(NewTxScanner(f))
+	if err != nil {
+		return statusError(exitInput, fmt.Errorf("failed to read previous (%q): %w", *previousFlag, err))
+	}
+	current, err := env.tallyGains(env.scanner)
+	if err != nil {
+		return statusError(exitInput, err)
+	}
+
+	// compare, in order of year and account
+	var keys []string
+	for k := range previous {
+		keys = append(keys, k)
+	}
+	for k := range current {
+		if previous[k] == nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	w := newReportWriter(env.output)
+	changed := make(map[string]bool) // years
+	var year []string
+	for _, k := range keys {
+		p, c := previous[k], current[k]
+		if p == nil {
+			p = new(big.Rat)
+		}
+		if c == nil {
+			c = new(big.Rat)
+		}
+		change := new(big.Rat).Sub(c, p)
+		if new(big.Rat).Abs(change).Cmp(tolerance) <= 0 {
+			continue
+		}
+		field := strings.SplitN(k, " ", 2) // year, account
+		fmt.Fprintf(w, "%s\t%s\t%s (previous %s, change %s)\n", field[0], field[1], env.NewAmount(env.base, *c), env.NewAmount(env.base, *p), env.NewAmount(env.base, *change))
+		if !changed[field[0]] {
+			changed[field[0]] = true
+			year = append(year, field[0])
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(year) > 0 {
+		env.problems.add("gains changed", fmt.Errorf("gains of %s differ from previous (%q)", strings.Join(year, ", "), *previousFlag))
+	} else {
+		command.V(1).Infof("gains of all years match previous (%q)", *previousFlag)
+	}
+	return nil
+}
+
+// tallyGains sums the gain splits generated by lot, keyed by year and
+// account (i.e. "2017 Lot:Income:long term gain").  Gains are
+// positive, losses negative.
+func (this *settings) tallyGains(s *TxScanner) (map[string]*big.Rat, error) {
+	tally := make(map[string]*big.Rat)
+	for s.Scan() {
+		txLines := s.Lines()
+		_, payeeIndex := txLines.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		for _, line := range txLines.Line[payeeIndex+1:] {
+			if !generatedSplitPattern.MatchString(line) {
+				continue
+			}
+			split, ok := this.parseSplit(line)
+			if !ok || split.delta == nil || !this.isBase(split.delta.Asset) || !strings.Contains(split.comment, ":GAIN:") {
+				continue
+			}
+			k := fmt.Sprintf("%d %s", txLines.Date.Year(), strings.Trim(split.account, "[]"))
+			if tally[k] == nil {
+				tally[k] = new(big.Rat)
+			}
+			tally[k].Sub(tally[k], split.delta.Rat) // gain splits are credits
+		}
+	}
+	return tally, s.Err()
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCompareGains compares gains of a journal edited after filing
+// (the sale of 2019 at a lower price, and a sale added in 2020)
+// against those filed.
+func TestCompareGains(t *testing.T) {
+	previous := filepath.Join(t.TempDir(), "filed.ledger")
+	err := os.WriteFile(previous, lotJournal(t, nettingJournal), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(nettingJournal, "-10 XYZ @ 110 USD", "-10 XYZ @ 100 USD", 1) + `
+2020/01/02 Buy
+    Assets:Crypto            1 ABC @ 10 USD
+    Assets:Bank
+
+2020/02/01 Sell
+    Assets:Crypto           -1 ABC @ 12.5 USD
+    Assets:Bank
+`
+	compare := func(input []byte, arg ...string) ([]string, int) {
+		t.Helper()
+		var out bytes.Buffer
+		problems := newProblemTally(0)
+		err := runOperation(&out, newSettings(), problems, input, "compare-gains", append([]string{"-previous=" + previous}, arg...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() == 0 {
+			return nil, problems.count["gains changed"]
+		}
+		return reportLines(out.String()), problems.count["gains changed"]
+	}
+
+	report, changed := compare(lotJournal(t, nettingJournal))
+	if len(report) != 0 || changed != 0 {
+		t.Errorf("gains of journal unchanged reported changed (%d):\n%s", changed, strings.Join(report, "\n"))
+	}
+
+	report, changed = compare(lotJournal(t, edited))
+	expect := []string{
+		"2019 Lot:Income:short term gain 900 USD (previous 1000 USD, change -100 USD)",
+		"2020 Lot:Income:short term gain 2.5 USD (previous 0 USD, change 2.5 USD)",
+	}
+	if strings.Join(report, "\n") != strings.Join(expect, "\n") || changed != 1 {
+		t.Errorf("report of edited journal (%d problems):\n%s\nexpected (1 problem):\n%s", changed, strings.Join(report, "\n"), strings.Join(expect, "\n"))
+	}
+
+	report, _ = compare(lotJournal(t, edited), "-tolerance=50")
+	if len(report) != 1 || !strings.HasPrefix(report[0], "2019 ") {
+		t.Errorf("report with -tolerance=50:\n%s\nexpected 2019 only", strings.Join(report, "\n"))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation completion
+//
+// Usage:
+//
+//     lotter completion <bash|zsh|fish>
+//
+// The `completion` operation writes a script which completes
+// `lotter`'s operations and flags, for the shell named.  For example,
+// in bash,
+//
+//     source <(lotter completion bash)
+//
+// or in fish,
+//
+//     lotter completion fish > ~/.config/fish/completions/lotter.fish
+//
+// Flags of each operation are those it defines, as listed by `lotter
+// help <operation>`.
+//
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		completionMain,
+		"completion",
+		"completion <bash|zsh|fish>",
+		"Write a shell script completing operations and flags.",
+	)
+}
+
+// flagSet returns the flags the operation defines.  Handlers define
+// their flags, then parse them (see command.Parse) before doing
+// anything else, so the handler is run with "-h" and returns at
+// parse.
+func (this operationInfo) flagSet() *flag.FlagSet {
+	defer func(global *flag.FlagSet, arg []string) {
+		flag.CommandLine, os.Args = global, arg
+	}(flag.CommandLine, os.Args)
+
+	flagset := flag.NewFlagSet(this.name, flag.ContinueOnError)
+	flagset.SetOutput(ioutil.Discard)
+	flag.CommandLine, os.Args = flagset, []string{this.name, "-h"}
+	this.handler(&environment{}) // flag.ErrHelp, expected
+	return flagset
+}
+
+// flags returns the names of flags the operation defines.
+func (this operationInfo) flags() (ret []string) {
+	this.flagSet().VisitAll(func(f *flag.Flag) {
+		ret = append(ret, f.Name)
+	})
+	return ret
+}
+
+func completionMain(env *environment) error {
+	// flags common to all operations (copied by command.Operate)
+	var global []*flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		global = append(global, f)
+	})
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+	if flag.NArg() != 1 {
+		return fmt.Errorf("expected shell, one of bash, zsh, fish")
+	}
+
+	sort.Slice(operations, func(i, j int) bool { return operations[i].name < operations[j].name })
+
+	var script bytes.Buffer
+	switch shell := flag.Arg(0); shell {
+	case "bash":
+		completionBash(&script, global)
+	case "zsh":
+		// zsh runs bash completion functions, with bashcompinit
+		fmt.Fprintln(&script, "autoload -U +X bashcompinit && bashcompinit")
+		completionBash(&script, global)
+	case "fish":
+		completionFish(&script, global)
+	default:
+		return fmt.Errorf("unknown shell (%q), expected one of bash, zsh, fish", shell)
+	}
+	env.output.Lines(strings.Split(strings.TrimSuffix(script.String(), "\n"), "\n"))
+	return nil
+}
+
+func completionBash(w io.Writer, global []*flag.Flag) {
+	var name, globalFlag []string
+	for _, op := range operations {
+		name = append(name, op.name)
+	}
+	for _, f := range global {
+		globalFlag = append(globalFlag, "-"+f.Name)
+	}
+
+	fmt.Fprintln(w, "# bash completion for lotter")
+	fmt.Fprintln(w, `_lotter() {`)
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" op="" word`)
+	fmt.Fprintln(w, `	for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do`)
+	fmt.Fprintln(w, `		case "$word" in`)
+	fmt.Fprintf(w, "\t\t%s) op=\"$word\"; break ;;\n", strings.Join(name, "|"))
+	fmt.Fprintln(w, `		esac`)
+	fmt.Fprintln(w, `	done`)
+	fmt.Fprintf(w, "\tlocal words=%q\n", strings.Join(globalFlag, " "))
+	fmt.Fprintln(w, `	case "$op" in`)
+	fmt.Fprintf(w, "\t\"\") words=\"$words %s\" ;;\n", strings.Join(name, " "))
+	for _, op := range operations {
+		var opFlag []string
+		for _, f := range op.flags() {
+			opFlag = append(opFlag, "-"+f)
+		}
+		if len(opFlag) > 0 {
+			fmt.Fprintf(w, "\t%s) words=\"$words %s\" ;;\n", op.name, strings.Join(opFlag, " "))
+		}
+	}
+	fmt.Fprintln(w, `	esac`)
+	fmt.Fprintln(w, `	COMPREPLY=($(compgen -W "$words" -- "$cur"))`)
+	fmt.Fprintln(w, `}`)
+	fmt.Fprintln(w, `complete -o default -F _lotter lotter`)
+}
+
+func completionFish(w io.Writer, global []*flag.Flag) {
+	var name []string
+	for _, op := range operations {
+		name = append(name, op.name)
+	}
+	noOp := fmt.Sprintf("not __fish_seen_subcommand_from %s", strings.Join(name, " "))
+
+	fmt.Fprintln(w, "# fish completion for lotter")
+	for _, f := range global {
+		fmt.Fprintf(w, "complete -c lotter -o %s -d %s\n", f.Name, fishQuote(f.Usage))
+	}
+	for _, op := range operations {
+		fmt.Fprintf(w, "complete -c lotter -f -n %s -a %s -d %s\n", fishQuote(noOp), op.name, fishQuote(op.description))
+		for _, f := range op.flags() {
+			fmt.Fprintf(w, "complete -c lotter -n %s -o %s\n", fishQuote("__fish_seen_subcommand_from "+op.name), f)
+		}
+	}
+}
+
+// fishQuote quotes a string for fish, which (in single quotes)
+// escapes only quote and backslash.
+func fishQuote(str string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str) + "'"
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation gen-testdata
+//
+// Usage:
+//
+//     lotter [-base <currency>] gen-testdata [-count=<number>] [-seed=<number>]
+//
+// The `gen-testdata` operation writes a random journal, of buys,
+// sells and moves between accounts, with a price directive for each
+// day.  The journal is consistent: assets are sold or moved only from
+// an account holding them, so the `lot` operation never runs out of
+// inventory.  For example,
+//
+//     lotter gen-testdata -count=1000000 > big.ledger
+//     time lotter -f big.ledger lot > /dev/null
+//
+// Use it to reproduce a problem (of performance, or otherwise)
+// without sharing private data.  The same `-seed` produces the same
+// journal.  No input is read, so `-f` is not required.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		genTestdataMain,
+		"gen-testdata",
+		"gen-testdata [-count=<number>] [-assets=<assets>] [-accounts=<accounts>] [-start=<date>] [-seed=<number>]",
+		"Write a random (but consistent) journal of buys, sells, moves and prices.",
+	)
+}
+
+func genTestdataMain(env *environment) error {
+	// define flags
+	countFlag := flag.Int("count", 100, "number of transactions")
+	assetsFlag := flag.String("assets", "ABC,XYZ", "assets traded, comma separated")
+	accountsFlag := flag.String("accounts", "Assets:Exchange,Assets:Wallet", "accounts holding assets, comma separated")
+	cashFlag := flag.String("cash", "Assets:Bank", "account of base currency paid and received")
+	startFlag := flag.String("start", "2020/01/01", "date of the first transaction")
+	seedFlag := flag.Int64("seed", 1, "seed of random numbers, the same seed generates the same journal")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	if *countFlag < 0 {
+		return fmt.Errorf("bad -count (%d), expected a positive number", *countFlag)
+	}
+	asset := genList(*assetsFlag)
+	if len(asset) == 0 {
+		return errors.New("At least one asset is required, i.e. `-assets=ABC`.")
+	}
+	account := genList(*accountsFlag)
+	if len(account) == 0 {
+		return errors.New("At least one account is required, i.e. `-accounts=Assets:Crypto`.")
+	}
+	for _, a := range account {
+		if err := checkAccountFlag("accounts", a); err != nil {
+			return err
+		}
+	}
+	if err := checkAccountFlag("cash", *cashFlag); err != nil {
+		return err
+	}
+	date, err := parseDate(*startFlag)
+	if err != nil {
+		return fmt.Errorf("bad -start (%q): %w", *startFlag, err)
+	}
+
+	random := rand.New(rand.NewSource(*seedFlag))
+
+	// price of each asset, in cents, follows a random walk
+	price := make(map[string]int64)
+	for _, a := range asset {
+		price[a] = 100 + random.Int63n(100000)
+	}
+
+	// quantity held, per account and asset, in units of 0.0001
+	const unit = 10000
+	held := make(map[string]int64)
+	var holding []string // keys of held, with positive quantity
+
+	cents := func(c int64) *big.Rat { return big.NewRat(c, 100) }
+	quantity := func(a string, q int64) Amount { return env.NewAmount(Asset(a), *big.NewRat(q, unit)) }
+	hold := func(key string, q int64) {
+		if held[key] == 0 && q > 0 {
+			holding = append(holding, key)
+		}
+		held[key] += q
+		if held[key] == 0 {
+			i := sort.SearchStrings(holding, key)
+			holding = append(holding[:i], holding[i+1:]...)
+		}
+		sort.Strings(holding)
+	}
+
+	var priced time.Time
+	for i := 0; i < *countFlag; i++ {
+		if i > 0 && random.Intn(3) == 0 {
+			date = date.AddDate(0, 0, 1+random.Intn(3))
+		}
+
+		// prices of the day
+		if !date.Equal(priced) {
+			var directive []string
+			for _, a := range asset {
+				change := 1 + random.NormFloat64()*0.03
+				price[a] = int64(math.Max(1, math.Round(float64(price[a])*change)))
+				directive = append(directive, fmt.Sprintf("P %s %s %s", date.Format("2006/01/02"), a, env.NewAmount(env.base, *cents(price[a]))))
+			}
+			env.output.Lines(directive)
+			priced = date
+		}
+
+		var tx TxLines
+		choice := random.Intn(100)
+		switch {
+		case len(holding) == 0 || choice < 45: // buy
+			a := asset[random.Intn(len(asset))]
+			acct := account[random.Intn(len(account))]
+			q := 1 + random.Int63n(100*unit)
+			tx = importTx(date, fmt.Sprintf("buy %s", a),
+				importSplit(acct, fmt.Sprintf("%s @ %s", quantity(a, q), env.NewAmount(env.base, *cents(price[a])))),
+				importSplit(*cashFlag, ""),
+			)
+			hold(acct+" "+a, q)
+
+		case len(account) < 2 || choice < 80: // sell
+			key := holding[random.Intn(len(holding))]
+			acct, a := genKey(key)
+			q := 1 + random.Int63n(held[key])
+			tx = importTx(date, fmt.Sprintf("sell %s", a),
+				importSplit(acct, fmt.Sprintf("%s @ %s", quantity(a, -q), env.NewAmount(env.base, *cents(price[a])))),
+				importSplit(*cashFlag, ""),
+			)
+			hold(key, -q)
+
+		default: // move
+			key := holding[random.Intn(len(holding))]
+			acct, a := genKey(key)
+			to := account[random.Intn(len(account))]
+			for to == acct {
+				to = account[random.Intn(len(account))]
+			}
+			q := 1 + random.Int63n(held[key])
+			tx = importTx(date, fmt.Sprintf("move %s", a),
+				importSplit(to, quantity(a, q).String()),
+				importSplit(acct, quantity(a, -q).String()),
+			)
+			hold(key, -q)
+			hold(to+" "+a, q)
+		}
+		env.output.Tx(tx, nil)
+	}
+	return nil
+}
+
+// genList splits a comma separated flag value.
+func genList(str string) (ret []string) {
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// genKey splits "<account> <asset>".
+func genKey(key string) (account, asset string) {
+	i := strings.LastIndex(key, " ")
+	return key[:i], key[i+1:]
+}
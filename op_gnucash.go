@@ -0,0 +1,210 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation gnucash
+//
+// Usage:
+//
+//     lotter -f <transactions.csv> gnucash
+//
+// The `gnucash` operation imports transactions exported from GnuCash
+// ("File > Export > Export Transactions to CSV", with "Use Quotes"
+// and without "Simple Layout").  The output is `ledger-cli` data,
+// ready for the `lot` operation.  GnuCash's full account names are
+// preserved, so that `-prune` qualifies lots as the GnuCash account
+// hierarchy does.
+//
+// Splits in a commodity other than the transaction currency are
+// written with their value (i.e. "1.5 BTC @@ 15000 USD"), so that
+// `lot` finds the cost of each trade.
+//
+// GnuCash SQL (sqlite) files are not read directly; export to CSV
+// first.
+//
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		gnucashMain,
+		"gnucash",
+		"gnucash",
+		"Import transactions exported from GnuCash (CSV).",
+	)
+}
+
+func gnucashMain(env *environment) error {
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+	if flag.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments (%q)", flag.Args()[1:])
+	}
+
+	reader := csv.NewReader(env.input)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	column := csvColumns(header, map[string][]string{
+		"date":        {"Date"},
+		"id":          {"Transaction ID"},
+		"number":      {"Number"},
+		"description": {"Description"},
+		"notes":       {"Notes"},
+		"currency":    {"Commodity/Currency"},
+		"memo":        {"Memo"},
+		"account":     {"Full Account Name"},
+		"amountSym":   {"Amount With Sym"},
+		"amount":      {"Amount Num.", "Amount Num"},
+		"valueSym":    {"Value With Sym"},
+		"value":       {"Value Num.", "Value Num"},
+		"price":       {"Rate/Price"},
+		"reconcile":   {"Reconcile"},
+	})
+	for _, key := range []string{"date", "account", "amount"} {
+		if _, ok := column[key]; !ok {
+			return fmt.Errorf("CSV has no %s column (header %q), expected GnuCash export without \"Simple Layout\"", key, header)
+		}
+	}
+	field := func(record []string, key string) string {
+		i, ok := column[key]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var (
+		id       string // current transaction
+		date     time.Time
+		payee    string
+		currency Asset
+		notes    string
+		split    []string
+		cleared  bool
+	)
+	flush := func() {
+		if split == nil {
+			return
+		}
+		if cleared {
+			payee = "* " + payee
+		}
+		if notes != "" {
+			split = append([]string{"; " + notes}, split...)
+		}
+		env.output.Tx(importTx(date, payee, split...), nil)
+		split = nil
+	}
+
+	for row := 2; ; row++ { // row 1 is header
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		// A transaction is the first row with a date, and the rows
+		// that follow (with same ID, or without date).
+		newTx := field(record, "date") != "" && (field(record, "id") == "" || field(record, "id") != id)
+		if newTx {
+			flush()
+			id = field(record, "id")
+			date, err = parseTimestamp(field(record, "date"))
+			if err != nil {
+				return statusError(exitInput, fmt.Errorf("row %d: %w", row, err))
+			}
+			payee = field(record, "description")
+			if number := field(record, "number"); number != "" {
+				payee = fmt.Sprintf("(%s) %s", number, payee)
+			}
+			notes = field(record, "notes")
+			currency = gnucashCommodity(field(record, "currency"))
+			cleared = true
+		}
+
+		account := field(record, "account")
+		if account == "" {
+			continue // no split on this row
+		}
+		amount := gnucashNumber(field(record, "amount"))
+		asset := gnucashSymbol(field(record, "amountSym"), currency)
+
+		s := fmt.Sprintf("%s %s", amount, asset)
+		if asset != currency && currency != "" {
+			if value := gnucashNumber(field(record, "value")); value != "" {
+				s = fmt.Sprintf("%s @@ %s %s", s, strings.TrimLeft(value, "-"), currency)
+			} else if price := gnucashNumber(field(record, "price")); price != "" {
+				s = fmt.Sprintf("%s @ %s %s", s, price, currency)
+			}
+		}
+		if memo := field(record, "memo"); memo != "" {
+			s = fmt.Sprintf("%s ; %s", s, memo)
+		}
+		split = append(split, importSplit(account, s))
+
+		// transaction is cleared only if all splits are reconciled/cleared
+		if r := field(record, "reconcile"); r != "c" && r != "y" && r != "C" && r != "Y" {
+			cleared = false
+		}
+	}
+	flush()
+
+	return nil
+}
+
+// gnucashCommodity converts "CURRENCY::USD" to "USD".
+func gnucashCommodity(str string) Asset {
+	part := strings.Split(str, "::")
+	return Asset(part[len(part)-1])
+}
+
+// gnucashNumber removes thousands separators.
+func gnucashNumber(str string) string {
+	return strings.ReplaceAll(strings.TrimSpace(str), ",", "")
+}
+
+// gnucashSymbol finds the asset in an amount, i.e. "1.5 BTC".  When
+// the amount has only a symbol (i.e. "$100.00"), the transaction
+// currency is assumed.
+func gnucashSymbol(amount string, currency Asset) Asset {
+	symbol := strings.TrimFunc(amount, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsSpace(r) || strings.ContainsRune(".,-+", r)
+	})
+	field := strings.Fields(symbol)
+	if len(field) > 0 {
+		last := field[len(field)-1]
+		if strings.IndexFunc(last, unicode.IsLetter) == 0 {
+			return Asset(last)
+		}
+	}
+	return currency
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGnucash(t *testing.T) {
+	csv := `"Date","Transaction ID","Number","Description","Notes","Commodity/Currency","Void Reason","Action","Memo","Full Account Name","Account Name","Amount With Sym","Amount Num.","Value With Sym","Value Num.","Reconcile","Reconcile Date","Rate/Price"
+"01/02/2021","a1","42","Buy BTC","via exchange","CURRENCY::USD","","","","Assets:Crypto:BTC","BTC","1.5 BTC","1.5","$15,000.00","15,000.00","c","","10,000"
+"","","","","","","","","fee","Assets:Bank","Bank","-$15,000.00","-15,000.00","-$15,000.00","-15,000.00","c","","1"
+"01/03/2021","b2","","Coffee","","CURRENCY::USD","","","","Expenses:Food","Food","$3.00","3.00","$3.00","3.00","n","","1"
+"01/03/2021","b2","","","","","","","","Assets:Bank","Bank","-$3.00","-3.00","-$3.00","-3.00","c","","1"
+"01/04/2021","c3","","Sell BTC","","CURRENCY::USD","","","","Assets:Crypto:BTC","BTC","-0.5 BTC","-0.5","","","y","","12,000"
+"","","","","","","","","","Assets:Bank","Bank","$6,000.00","6,000.00","$6,000.00","6,000.00","y","","1"
+`
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), newProblemTally(-1), []byte(csv), "gnucash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"2021/01/02 * (42) Buy BTC", // cleared, as all splits are reconciled
+		"; via exchange",
+		"Assets:Crypto:BTC 1.5 BTC @@ 15000.00 USD", // value of split
+		"Assets:Bank -15000.00 USD ; fee",
+		"",
+		"2021/01/03 Coffee", // rows of same ID are one transaction, not cleared
+		"Expenses:Food 3.00 USD",
+		"Assets:Bank -3.00 USD",
+		"",
+		"2021/01/04 * Sell BTC",
+		"Assets:Crypto:BTC -0.5 BTC @ 12000 USD", // price, without value
+		"Assets:Bank 6000.00 USD",
+	}
+	got := reportLines(out.String())
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("gnucash imported:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+
+	err = runOperation(&bytes.Buffer{}, newSettings(), newProblemTally(-1), []byte("\"Date\",\"Account Name\",\"Amount Num.\"\n"), "gnucash")
+	if err == nil || !strings.Contains(err.Error(), "CSV has no account column") {
+		t.Errorf("error of simple layout is %v", err)
+	}
+}
+
+func TestGnucashSymbol(t *testing.T) {
+	for amount, expect := range map[string]Asset{
+		"1.5 BTC":     "BTC",
+		"-$15,000.00": "USD", // transaction currency
+		"€3.00":       "USD",
+		"10 VTI":      "VTI",
+	} {
+		if got := gnucashSymbol(amount, "USD"); got != expect {
+			t.Errorf("symbol of %q is %q, expected %q", amount, got, expect)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation holdings
+//
+// Usage:
+//
+//     lotter [-base <currency>] -f <filename> holdings [-asof <date>] [-prices <filename>]
+//
+// The `holdings` operation replays transactions, as the `lot`
+// operation does, and reports the inventory and basis remaining in
+// each lot queue.  When a price is known, it reports market value and
+// unrealized gain (or loss) as well.
+//
+// Use `-asof` to replay only transactions on or before a date, i.e.
+// `-asof 2022/12/31` to reconstruct positions and basis at the end of
+// a quarter or year.  Market value is based on the most recent price
+// directive (i.e. "P 2022/12/30 ABC 0.35 USD") on or before that date,
+// found in the input or in the file named by `-prices`.  When some
+// holdings have no price, total value and unrealized gain (of those
+// priced) are marked "(partial)".
+//
+// Transactions are replayed by the same code as `lot`, which accepts
+// the flags of `lot` deciding how transactions are lotted (i.e.
+// `-order`, `-margin`, `-classes`, `-hook`, `-reorder-day`).  Use the
+// same flags (and `-prune`) as when running `lot`, so that lot queues
+// are the same.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		holdingsMain,
+		"holdings",
+		"holdings [-asof=<date>] [-prices=<filename>] [-order=<fifo|lifo|hifo>] [<lot flags>]",
+		"Report inventory, basis and unrealized gains, as of a given date.",
+	)
+}
+
+func holdingsMain(env *environment) error {
+	// define flags
+	asofFlag := flag.String("asof", "", "report holdings as of this date (i.e. 2022/12/31)")
+	pricesFlag := flag.String("prices", "", "ledger-cli file with price directives")
+	lotting := defineLotFlags()
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	var asof time.Time
+	if *asofFlag != "" {
+		asof, err = parseDate(*asofFlag)
+		if err != nil {
+			return fmt.Errorf("bad -asof date (%q): %w", *asofFlag, err)
+		}
+	}
+
+	priceHistory := newPriceHistory(env.settings)
+	if *pricesFlag != "" {
+		f, err := os.Open(*pricesFlag)
+		if err != nil {
+			return fmt.Errorf("failed to open prices (%q): %w", *pricesFlag, err)
+		}
+		err = priceHistory.Read(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	lotted, err := replayLots(env, lotting, asof, &priceHistory)
+	if err != nil {
+		return err
+	}
+
+	// latest prices, when no date given
+	when := asof
+	if when.IsZero() {
+		when = time.Now()
+	}
+
+	var asset []Asset
+	for a := range lotted.lotQueue {
+		asset = append(asset, a)
+	}
+	sort.Slice(asset, func(i, j int) bool { return asset[i] < asset[j] })
+
+	totalBasis := new(big.Rat)
+	totalValue := new(big.Rat)
+	totalGain := new(big.Rat) // of priced holdings only
+	var priced, unpriced int  // count of rows with, and without, a price
+	w := newReportWriter(env.output)
+	fmt.Fprintln(w, "asset\tqualifier\tinventory\tbasis\tprice\tvalue\tunrealized gain")
+	for _, a := range asset {
+		var qualifier []string
+		for q := range lotted.lotQueue[a] {
+			qualifier = append(qualifier, q)
+		}
+		sort.Strings(qualifier)
+
+		price, priceDate, ok := priceHistory.Latest(when, a)
+
+		for _, q := range qualifier {
+			queue := lotted.lotQueue[a][q]
+			if queue.Len() == 0 {
+				continue
+			}
+			inventory := new(big.Rat)
+			basis := new(big.Rat)
+			for _, l := range queue.lot {
+				inventory.Add(inventory, l.inventory.Rat)
+				basis.Add(basis, new(big.Rat).Mul(l.price, l.inventory.Rat))
+			}
+			totalBasis.Add(totalBasis, basis)
+
+			qual := q
+			if qual == "" {
+				qual = "(all accounts)"
+			}
+			row := fmt.Sprintf("%s\t%s\t%s\t%s", a, qual, env.NewAmount(a, *inventory), env.NewAmount(env.base, *basis))
+			if ok {
+				priced++
+				value := new(big.Rat).Mul(price, inventory)
+				gain := new(big.Rat).Sub(value, basis)
+				totalValue.Add(totalValue, value)
+				totalGain.Add(totalGain, gain)
+				row = fmt.Sprintf("%s\t%s (%s)\t%s\t%s", row,
+					env.NewAmount(env.base, *price), priceDate.Format("2006/01/02"),
+					env.NewAmount(env.base, *value),
+					env.NewAmount(env.base, *gain),
+				)
+			} else {
+				unpriced++
+				row = fmt.Sprintf("%s\t(no price)\t\t", row)
+			}
+			fmt.Fprintln(w, row)
+		}
+	}
+
+	// value and gain are totals of priced holdings only, so are marked
+	// partial when any holding has no price (or blank, when none has)
+	var value, gain string
+	if priced > 0 {
+		value, gain = env.NewAmount(env.base, *totalValue).String(), env.NewAmount(env.base, *totalGain).String()
+		if unpriced > 0 {
+			value, gain = value+" (partial)", gain+" (partial)"
+		}
+	}
+	fmt.Fprintf(w, "total\t\t\t%s\t\t%s\t%s\n", env.NewAmount(env.base, *totalBasis), value, gain)
+	return w.Flush()
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation income
+//
+// Usage:
+//
+//     lotter -f <filename> income [-year=<year>]
+//
+// The `income` operation reports income, as distinct from capital
+// gains, per year and per asset.  Income is what the `lot` operation
+// recognizes as such: splits tagged `:INCOME:` (i.e. staking, mining,
+// or payment received), valued at fair market value, and rebates
+// (assets acquired at negative price or cost).  For example,
+//
+//     2021  ABC    rebate  10 ABC    1 USD    (1)
+//     2021  BTC    income  0.02 BTC  850 USD  (2)
+//     2021  total                    851 USD
+//
+// Fair market value is taken from the split's price if any,
+// otherwise from the price directive of the same day, as `lot` does.
+// Input may be lotted already, or not.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		incomeMain,
+		"income",
+		"income [-year=<year>]",
+		"Report income (as opposed to capital gains), per year and asset.",
+	)
+}
+
+func incomeMain(env *environment) error {
+	// define flags
+	yearFlag := flag.Int("year", 0, "report only this year")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	if *yearFlag < 0 {
+		return fmt.Errorf("bad -year (%d), expected i.e. 2021", *yearFlag)
+	}
+
+	// lines generated by lot, if any, are not needed
+	env.scanner.unlot = true
+
+	type incomeTally struct {
+		year     int
+		asset    Asset
+		kind     string // "income" or "rebate"
+		quantity *big.Rat
+		value    *big.Rat
+		count    int
+	}
+	tally := make(map[string]*incomeTally)
+
+	priceHistory := newPriceHistory(env.settings)
+	for env.scanner.Scan() {
+		txLines := env.scanner.Lines()
+		for _, line := range txLines.Line {
+			_, err := priceHistory.Observe(line)
+			if err != nil {
+				return statusError(exitInput, err)
+			}
+		}
+
+		_, payeeIndex := txLines.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		if *yearFlag != 0 && txLines.Date.Year() != *yearFlag {
+			continue
+		}
+
+		for i, line := range txLines.Line[payeeIndex+1:] {
+			split, ok := env.parseSplit(line)
+			if !ok || split.delta == nil || split.delta.Sign() < 1 || env.isBase(split.delta.Asset) {
+				continue
+			}
+
+			var kind string
+			switch {
+			case strings.Contains(split.comment, ":INCOME:"):
+				kind = "income"
+				if split.price == nil && split.cost == nil {
+					fmv, ok := priceHistory.Lookup(txLines.Date, split.delta.Asset)
+					if !ok {
+						env.problems.add("missing price", lineErrorf(txLines.Start+payeeIndex+1+i, "missing price of %s on %s", split.delta.Asset, txLines.Date.Format("2006/01/02")))
+						continue
+					}
+					price := env.NewAmount(env.base, *fmv)
+					split.price = &price
+				}
+			case split.rebate:
+				kind = "rebate"
+			default:
+				continue
+			}
+
+			key := fmt.Sprintf("%d %s %s", txLines.Date.Year(), split.delta.Asset, kind)
+			t, ok := tally[key]
+			if !ok {
+				t = &incomeTally{year: txLines.Date.Year(), asset: split.delta.Asset, kind: kind, quantity: new(big.Rat), value: new(big.Rat)}
+				tally[key] = t
+			}
+			t.quantity.Add(t.quantity, split.delta.Rat)
+			t.value.Add(t.value, new(big.Rat).Abs(env.toBase(*split.Cost()).Rat))
+			t.count++
+		}
+	}
+
+	var key []string
+	for k := range tally {
+		key = append(key, k)
+	}
+	sort.Strings(key)
+
+	w := newReportWriter(env.output)
+	total := new(big.Rat)
+	for i, k := range key {
+		t := tally[k]
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t(%d)\n", t.year, t.asset, t.kind, env.NewAmount(t.asset, *t.quantity), env.NewAmount(env.base, *t.value), t.count)
+		total.Add(total, t.value)
+
+		// total of each year follows the assets of that year
+		if i+1 == len(key) || tally[key[i+1]].year != t.year {
+			fmt.Fprintf(w, "%d\ttotal\t\t\t%s\n", t.year, env.NewAmount(env.base, *total))
+			total = new(big.Rat)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// incomeJournal holds income priced by split and by price directive,
+// and a rebate (acquired at negative price).
+const incomeJournal = `P 2021/02/01 BTC 40000 USD
+
+2020/12/01 Staking
+    Assets:Wallet          2 ETH @ 600 USD ; :INCOME:
+    Income:Staking
+
+2021/01/01 Staking
+    Assets:Wallet          1 ETH @ 700 USD ; :INCOME:
+    Income:Staking
+
+2021/02/01 Mining
+    Assets:Wallet          0.01 BTC ; :INCOME:
+    Income:Mining
+
+2021/03/01 Rebate
+    Assets:Broker          10 ABC @ -0.1 USD
+    Assets:Cash
+
+2021/03/02 Buy
+    Assets:Broker          10 ABC @ 1 USD
+    Assets:Cash
+`
+
+func income(t *testing.T, problems *problemTally, input []byte, arg ...string) []string {
+	t.Helper()
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), problems, input, "income", arg...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reportLines(out.String())
+}
+
+func TestIncome(t *testing.T) {
+	year2021 := []string{
+		"2021 ABC rebate 10 ABC 1 USD (1)",
+		"2021 BTC income 0.01 BTC 400 USD (1)", // price of same day
+		"2021 ETH income 1 ETH 700 USD (1)",
+		"2021 total 1101 USD",
+	}
+	for _, test := range []struct {
+		input  []byte
+		arg    []string
+		expect []string
+	}{
+		{
+			input:  []byte(incomeJournal),
+			expect: append([]string{"2020 ETH income 2 ETH 1200 USD (1)", "2020 total 1200 USD"}, year2021...),
+		},
+		{
+			input:  []byte(incomeJournal),
+			arg:    []string{"-year=2021"},
+			expect: year2021,
+		},
+		{
+			// lotted already, with prices commented out
+			input:  lotJournal(t, incomeJournal),
+			arg:    []string{"-year=2021"},
+			expect: year2021,
+		},
+	} {
+		got := income(t, newProblemTally(-1), test.input, test.arg...)
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("income %v:\n%s\nexpected:\n%s", test.arg, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+	}
+
+	// income without price is counted, and the rest reported
+	problems := newProblemTally(0)
+	got := income(t, problems, []byte(incomeJournal+"\n2021/02/02 Mining\n    Assets:Wallet          0.01 XYZ ; :INCOME:\n    Income:Mining\n"), "-year=2021")
+	if problems.count["missing price"] != 1 {
+		t.Errorf("%d missing prices, expected 1", problems.count["missing price"])
+	}
+	if strings.Join(got, "\n") != strings.Join(year2021, "\n") {
+		t.Errorf("income without price:\n%s", strings.Join(got, "\n"))
+	}
+}
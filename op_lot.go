@@ -25,343 +25,1745 @@
 // Each lot is a `ledger-cli` "account", named by convention with
 // prefix "Lot", followed by the date the lot was created, and
 // inventory and cost information.  This naming convention is intended
-// to provide unique lot names.  (It could fail to do so, if multiple
-// purchases occur on the same day, for the same amount and cost.)
+// to provide unique lot names.  When more than one purchase occurs on
+// the same day, for the same amount and cost, a sequence is appended
+// to the names of the later (i.e. "Lot::2021/01/01:10ETH@1000USD#2").
+// Likewise when lots of the same name are moved to one account.  The
+// sequence counts only lots of the same name, so names of lots are
+// stable when transactions creating other lots are added.
+//
+// Lot names reveal quantity and price, to anyone reading balances.
+// To share balances privately, use `-lot-names=sequence` (i.e.
+// "Lot::L1", "Lot::L2", in order created) or `-lot-names=hash` (i.e.
+// "Lot::5f3c8e2a1b9d", a digest of the descriptive name, so stable
+// when transactions are added).  With `-lot-map=<filename>`, a CSV
+// file records the date, inventory, basis and descriptive name of
+// each lot.
 //
 // `lotter` considers a transaction to be a purchase when it finds a
 // split for a positive amount, with cost information associated with
 // it.  When constructing your ledger entries, use for example "100
 // ABC @ 0.02 USD" or "100 ABC @@ 2 USD".
 //
+// A transaction without price or cost, of one asset and base currency
+// (i.e. "Assets:Crypto  1 BTC" and "Assets:Bank  -30000 USD"), is a
+// trade as well.  The price is inferred from the base currency which
+// balances the asset (as `ledger-cli` infers it).  Likewise when the
+// price is written on the base currency split (i.e. "-30000 USD @@ 1
+// BTC"), the base currency is the cost of the other asset.
+//
 // Similarly, `lotter` considers a transaction to be a sale when the
 // amount is negative and has a cost associated.  To these
 // transactions, `lotter` adds splits that "consume" inventory (and
-// basis) acquired earlier.
+// basis) acquired earlier.  The comment of each describes the lot
+// consumed, i.e. "; :SELL: 0.02 USD/ABC acquired 2016/01/01 held
+// 366d", so that the price a sale matched is seen at a glance.
+//
+// A trade may involve more than two assets, i.e. an exchange
+// "convert" which sells ETH, buys BTC, and charges a fee in BNB.  An
+// asset with no price, which is not the price of another split (the
+// BNB), is moved rather than traded, like the splits of a move
+// transaction.  When priced (i.e. "-1 BNB @ 30 USD"), the fee is sold
+// like the ETH.  Each asset sold is valued at its own price, and its
+// gain tallied apart.
+//
+// A split tagged `:INCOME:` (i.e. "Assets:Crypto  0.01 BTC ;
+// :INCOME:") is an asset received as payment, i.e. wages or an
+// invoice paid.  The lot created has basis of fair market value,
+// taken from the split's price if any, otherwise from the price
+// directive (i.e. "P 2021/02/04 BTC 40000 USD") of the same day.  The
+// value is split to the `-income` account, tagged `:INCOME:` to
+// distinguish it from capital gains.
+//
+// Splits tagged `:BORROW:` or `:REPAY:` (i.e. "Assets:Crypto  1 BTC ;
+// :BORROW:") are loans.  Lots are neither created nor consumed when
+// an asset is borrowed or repaid.  Moving collateral to a lending
+// platform is a move, like any other, and interest received is
+// income which creates a lot.
+//
+// Use `-margin` to name margin or futures accounts (i.e.
+// "Assets:Exchange:Futures").  Positions in these accounts, long or
+// short, are not lots.  They are tracked at average cost, and profit
+// or loss realized when a position is closed is split to the
+// `-margin-gain` account (by default, short term gain).  Spot lots
+// are unaffected by margin trades in the same asset.
+//
+// An acquisition with negative price or cost (i.e. "10 ABC @ -0.1
+// USD", an exchange rebate or negative funding payment) creates a lot
+// with zero basis.  (The price or cost of a disposal is taken as
+// positive, whichever sign is written.)  The rebate is income, split to
+// "Lot:Income:rebate".
+//
+// A trade priced in an asset other than base currency (i.e. "1000 XYZ
+// @ 0.01 ABC") defers gain.  The lot bought has the basis of the
+// inventory traded for it, split `:BUY:DEFER:`.  By default it also
+// has the date of that inventory, so that a later sale is long or
+// short term as the original would have been.  When the trade consumes
+// more than one lot, the date is that of the lot consumed last; use
+// `-defer-date=earliest` or `-defer-date=latest` to choose, or
+// `-defer-date=split` to buy one lot per lot consumed, each with the
+// date and basis of its source and a proportional share of inventory.
+// Where the trade instead starts a new holding period, use
+// `-defer-date=trade`.
+//
+// Option contracts are lots, like any other asset.  Tag the split
+// disposing of a contract to describe what became of it.  With
+// `:EXPIRE:`, the contract is disposed of without proceeds (no price
+// is needed), so its basis is a loss.  With `:EXERCISE:`, the basis
+// of the contract (the premium paid) rolls into the lot of the
+// underlying asset bought (a call), or reduces proceeds of the
+// underlying asset sold (a put).  For example,
+//
+//     2023/03/17 Exercise call
+//         Assets:Broker    -1 XYZC50 @ 0 USD ; :EXERCISE:
+//         Assets:Broker   100 XYZ @ 50 USD
+//         Assets:Cash
+//
+// Written options are not lots.  A split tagged `:ASSIGN:` (the
+// written contract closed by assignment) is ignored, so the
+// underlying asset is bought or sold at the strike price, and the
+// premium received remains as recorded when the option was written.
+//
+// When lots are per-account (see `-prune`), a move from one account
+// to another consumes lots of the source and creates lots (with the
+// same date and basis) in the destination.  By default, lots created
+// are named for the destination.  Use `-move-name=source` to keep the
+// name of the lot consumed, or i.e. `-move-name=Assets:Cold=Vault` to
+// name lots moved to "Assets:Cold" as "Lot:Vault:...".
+//
+// When lots are per-account (see `-prune`), use `-gain-qualifier` to
+// attribute gains to the account inventory was consumed from.  With
+// `-gain-qualifier=account`, the qualifier is appended to the gain
+// account name (i.e. "Lot:Income:long term gain:Assets:Exchange"), so
+// that `ledger-cli` reports show gains per exchange or wallet.  With
+// `-gain-qualifier=tag`, gain splits are tagged instead (i.e.
+// "qualifier: Assets:Exchange").  When one transaction sells from
+// more than one account, gains of each are split separately, and
+// proceeds are divided in proportion to the quantity sold from each.
+//
+// Use `-short-gain` and `-long-gain` to name the accounts of gains.
+// Each is a template (see Go's text/template) of the asset sold, i.e.
+// with `-long-gain='Income:CapGains:{{.Asset}}:Long'` (and likewise
+// `-short-gain`), `ledger bal Income:CapGains:BTC` reports gains of
+// BTC.
+//
+// Where gains are not divided by holding period, use
+// `-term-split=false`.  All gains are then split to one account,
+// `-gain` (by default "Lot:Income:gain", also a template), tagged
+// `:GAIN:`.
+//
+// Use `-matches-out=<filename>` to write a CSV file with a row per lot
+// consumed by a sale: date sold, lot name, date acquired, quantity,
+// basis consumed, proceeds (the sale's, divided in proportion to
+// quantity), gain, and term ("short" or "long").
+//
+// Use `-lineage-out=<filename>` to write a Graphviz DOT graph of which
+// lots funded which.  Edges lead from a lot moved to the lot created
+// at its destination, and from lots traded with deferred basis to the
+// lots bought.  To trace where a lot's basis came from, i.e.
+//
+//     dot -Tsvg lineage.dot > lineage.svg
+//
+// Metadata following each gain split records the holding period, as
+// tax forms require it: dates acquired and sold, and days held (i.e.
+// "; acquired: 2016/01/01", "; sold: 2017/01/01", "; held: 366").
+// `ledger-cli` exports include them, i.e. `ledger csv --csv-format
+// '...%(tag("held"))...'`.  When the lots sold were acquired on
+// different dates, acquired is "various" and held is a range.
+//
+// Some tools downstream of `ledger-cli` mangle or drop virtual
+// splits.  Use `-metadata` to record lots and gains as metadata of
+// the original splits instead, i.e.
+//
+//     2016/01/01 Bought ABC
+//         Assets:Crypto          100 ABC @ 0.02 USD
+//         ; lot: Lot:2016/01/01:100ABC@0.02USD  -100 ABC  :BUY: (inventory)
+//         ; lot: Lot:2016/01/01:100ABC@0.02USD  2 USD  :BUY: (basis)
+//         Equity:Cash
+//
+// Such metadata survives `ledger print`.  Prices are not commented
+// out, as no virtual splits express them.  The `report` operation
+// reads the metadata back.
+//
+// Other reports may rely on prices of the original splits (i.e.
+// `ledger-cli`'s market value).  Use `-keep-prices` to leave them
+// intact.  Generated splits are then tagged `:LOTTER:`, so that such
+// reports may exclude them (i.e. `ledger bal not tag LOTTER`), while
+// reports of lots and gains include them.
+//
+// Alternatively, use `-write-prices` to write a price directive for
+// each price commented out, preceding the transaction, i.e.
+//
+//     ; prices of trades, written by lotter
+//     P 2017/01/01 ABC 1 USD
+//
+// so that `ledger-cli` values assets (i.e. `ledger bal -V`) with the
+// market data of trades.  A total cost ("@@") is written as the price
+// per unit.  The `relot` operation removes these directives, with
+// other content generated by `lot`.
+//
+// To keep a hand-maintained journal apart from what `lotter`
+// generates, use `-lots-out` to write generated splits to a separate
+// file, i.e.
+//
+//     lotter -f journal.ledger lot -lots-out lots.ledger > /dev/null
+//
+// Each transaction of that file has the date and payee of the
+// original, followed by its generated splits.  Original transactions
+// are written to output unchanged (as with `-keep-prices`), so the
+// journal, with `include lots.ledger`, balances as before and reports
+// lots and gains.
+//
+// Later, use `-append` (with the same `-lots-out`) to load the lots of
+// that file, rather than recalculate them, and append the splits of
+// transactions it does not have (matched by date and payee).  Lots
+// loaded are authoritative, as written.  A transaction new to the
+// journal, but dated before the last of the lots file, is a problem,
+// as is a transaction of the lots file missing from the journal.  Lot
+// from scratch (without `-append`) after editing older transactions.
+//
+// A transaction tagged `:DISPOSAL:spend:`, `:DISPOSAL:donation:`,
+// `:DISPOSAL:gift:` or `:DISPOSAL:lost:` disposes of the assets it
+// sends.  Assets spent are sold at fair market value (from the price
+// directive of the same day).  Assets donated, given or lost are
+// disposed of without gain or loss, their basis split to
+// "Lot:Disposal:donation" (and so on).  For example,
+//
+//     2021/06/01 Charity ; :DISPOSAL:donation:
+//         Assets:Crypto       -0.1 BTC
+//         Expenses:Donations
+//
+// For each lot donated or given, a comment records the fair market
+// value (from the price directive of the day), basis, and holding
+// period, as a deduction requires, i.e.
+//
+//     ; :DISPOSAL:DONATION: 0.1 BTC fair market value 3500 USD, basis 900 USD, acquired 2020/03/01 held 457d (long term)
+//
+// Use `-classes` to classify transactions by account, rather than by
+// tags, when your chart of accounts is consistent.  The file names an
+// account pattern (regular expression) and class on each line, i.e.
+//
+//     ^Income:Staking(:|$)       income
+//     ^Expenses:Donations(:|$)   donation
+//     ^Expenses:                 spend
+//
+// A transaction with a split to a matching account is of that class
+// (the first rule matching any split).  Tags take precedence over
+// rules.
+//
+// Some accounts only acquire (i.e. payouts of a mining rig), and some
+// only dispose.  Use `-directions` to declare them, so that a split
+// against the direction of its account, likely a mistake of data
+// entry, fails.  The file names an account pattern, direction
+// ("acquire" or "dispose") and, optionally, assets on each line, i.e.
+//
+//     ^Assets:Mining(:|$)       acquire
+//     ^Assets:Exchange:Sell$    dispose    BTC,ETH
+//
+// Without assets, a rule applies to all but base currency.  The first
+// rule matching a split's account and asset decides.  Moves (i.e. of
+// payouts to a wallet) neither acquire nor dispose.
+//
+// Use `-hook` to classify transactions by rules of your own.  The
+// command is started once, and each transaction is written to it as a
+// line of JSON (as with `-format=json`).  It answers each with a line
+// of JSON, i.e.
+//
+//     {"class": "spend", "order": "hifo"}
+//
+// where class is one of "trade", "move", "income" (assets received
+// are income), "spend" (assets spent are sold at fair market value),
+// "donation", "gift" or "lost" (see above), or "ignore" (lots are not
+// affected).  When class is empty, it is
+// inferred from prices and tags as usual.  An order, if any,
+// overrides `-order` for that transaction.
+//
+// Use `-proceeds` to split the gross proceeds of each sale, per
+// asset, i.e. with `-proceeds=Lot:Proceeds`,
+//
+//     [Lot:Proceeds:ABC]         -1 USD  ; :PROCEEDS:
+//     [Lot:Equity:proceeds]       1 USD  ; :PROCEEDS:
+//
+// so that `ledger-cli` reports proceeds per asset per year (i.e.
+// `ledger bal Lot:Proceeds -p 2023`), as needed for Form 8949.
+//
+// When a sale consumes lots of both short and long term, a comment
+// shows how quantity and proceeds are divided, as brokers report them,
+// i.e.
+//
+//     ; :PROCEEDS:TERM: short term 50 ABC for 150 USD, long term 100 ABC for 300 USD
+//
+// It is tagged apart from the splits of `-proceeds`, as it is not a
+// split.
+//
+// Transactions dated after today (i.e. budget or forecast entries)
+// are written unchanged, and neither create nor consume lots.  Use
+// `-ignore-after` to choose another date (i.e. the end of a tax
+// year), or `-ignore-after=none` to lot every transaction.  Likewise,
+// with `-cleared-only`, transactions not marked cleared (i.e.
+// "2021/01/01 * Bought ABC") are written unchanged, so that pending
+// ("!") trades do not affect basis until confirmed.
+//
+// Exported data is not always in order within a day, so that a sale
+// may precede the purchase of the same day.  Use `-reorder-day` to
+// process transactions which acquire assets before those which
+// dispose of them (sell or move), within each day.  Output is in the
+// original order.
+//
+// Lots of the same date are consumed in the order of transactions
+// which created them.  When data includes an exchange's sequence
+// number or trade ID, add it as "seq" metadata (i.e. "; seq: 1042", or
+// a timestamp with fractional seconds, "; seq: 1614556800.123") and
+// lots of transactions which have it are consumed in that order
+// instead, regardless of order in the file.
+//
+// Exchanges may report one order as many partial fills, seconds
+// apart.  Use `-group-fills` to treat consecutive disposals of the
+// same date, payee and asset as one transaction, with one gain split.
+// Splits of each fill are kept in output, and the payee line of each
+// fill after the first is kept as a comment (i.e. "; fill: 2021/03/01
+// Sell ABC").  Amounts left blank are written, as `ledger-cli` permits
+// only one per transaction.
+//
+// Exchanges may also report one trade as two transactions of the same
+// day, the sell leg and the buy leg, each unbalanced alone.  When each
+// leg has the order's ID as "order" metadata (i.e. "; order: 8812"),
+// use `-pair-orders` to combine the legs into one transaction, so that
+// the trade defers or realizes gain as a trade written whole would.
+// Splits of each leg are kept in output, and the payee line of each
+// leg after the first is kept as a comment (i.e. "; leg: 2021/03/01
+// Buy XYZ").
+//
+// Exchanges and wallets leave dust, amounts too small to trade or to
+// show at the asset's precision.  Use `-dust` to set, per asset, the
+// amount below which a split is not lotted (i.e.
+// `-dust=BTC=0.00000546`), so that sweeping dust does not fail for
+// want of inventory.  A lot left holding less than that amount, after
+// a sale or move, is closed and its inventory and basis written off to
+// `-dust-account` (by default, "Lot:Dust"), where dust accumulates.
+//
+// A broker's basis may differ from lotter's where the broker adjusts
+// it, i.e. adding a wash sale loss disallowed to the basis of the
+// shares which replaced those sold.  Use `-basis-adjust=<filename>`
+// to apply the broker's adjustments (CSV, a row per adjustment, with
+// columns "date", "symbol", "date acquired" and "wash sale loss
+// disallowed" or "adjustment"), so that basis and gains reconcile to
+// the broker's 1099-B.  Each adjustment is added to the basis of the
+// lots of the asset acquired on that date, in proportion to inventory,
+// by the first transaction lotted on or after its date (or the date
+// acquired, when later).  Splits tagged `:ADJUST:` record it, offset
+// in `-adjust-account` (by default, "Lot:Income:wash sale").  When an
+// "account" column is present, only lots of its lot queue are
+// adjusted.  An adjustment which fails (i.e. no lot of that date is
+// open) changes no lot, and `-summary` lists its row.
+//
+// A transaction's `txid` or `ref` metadata (i.e. "; txid: 0xabc") is
+// copied to the comment of each split generated, so that lot and gain
+// splits can be traced back to the blockchain or exchange record that
+// produced them.  A split's own metadata (i.e. "-1 BTC @ 300 USD ;
+// ref: order-9") is copied instead, to the lot and gain splits
+// generated from it.
+//
+// Use `-price-sanity` to check that the price of each trade is near
+// the price directive (if any) of the same day.  For example, with
+// `-price-sanity=20` a trade priced more than 20% above or below the
+// "P" directive's price is an error.  This catches typos such as "@"
+// (price per unit) where "@@" (total cost) was meant, which otherwise
+// silently produce absurd basis.
+//
+// Use `-summary` to append, after all transactions, comments which
+// summarize each year: short and long term gain, income, and lots open
+// at the end of the year (count, inventory and basis).  So a lotted
+// file documents the numbers it implies, i.e.
+//
+//     ; 2017  short term gain     0 USD
+//     ;       long term gain      0.98 USD
+//     ;       income              0 USD
+//     ;       open lots           2  89 ABC, 1000 XYZ
+//     ;       basis of open lots  1.98 USD
+//
+// Use `-translate=<filename>` to translate the accounts and comments
+// of generated splits (i.e. for books kept in German).  Each line of
+// the file is English text, two or more spaces, and its translation:
+//
+//     short term gain      kurzfristiger Gewinn
+//     long term gain       langfristiger Gewinn
+//     inventory consumed   Bestand verbraucht
+//
+// A part of an account name (between colons) is translated when it
+// matches entirely; text of comments wherever it is found.  Tags (i.e.
+// ":SELL:"), and the prefix "Lot" of lot names, are not translated, as
+// `lotter` reads them back (i.e. `relot`).
+//
+// Basis and gains are tallied exactly, and rounded only when output.
+// As a result, a gain split may differ (by the smallest unit of the
+// base currency) from the sum of the rounded basis splits.  Use
+// `-round-tally` to instead tally amounts as rounded for output, so
+// that the splits of each transaction balance exactly as value.
 //
 // To see options available, run `lotter help lot`.
 //
 package main
 
 import (
+	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/big"
 	"os"
+	"sort"
 	"strings"
-	"text/tabwriter"
+	"text/template"
 	"time"
 
 	"src.d10.dev/command"
 )
 
 func init() {
-	command.RegisterOperation(
+	registerOperation(
 		lotMain,
 		"lot",
-		"lot [-prune=<int>]",
+		"lot [-order=<fifo|lifo|hifo>] [-gain-qualifier=<none|account|tag>] [-price-sanity=<percent>] [-margin=<accounts>] [-margin-gain=<account>] [-short-gain=<template>] [-long-gain=<template>] [-term-split=false [-gain=<template>]] [-income=<account>] [-move-name=<destination|source|map>] [-lot-names=<detail|sequence|hash>] [-lot-map=<filename>] [-matches-out=<filename>] [-lineage-out=<filename>] [-proceeds=<account>] [-classes=<filename>] [-directions=<filename>] [-hook=<command>] [-reorder-day] [-group-fills] [-pair-orders] [-keep-prices] [-write-prices] [-metadata] [-lots-out=<filename> [-append]] [-dust=<amounts>] [-dust-account=<account>] [-basis-adjust=<filename> [-adjust-account=<account>]] [-defer-date=<original|earliest|latest|split|trade>] [-summary] [-translate=<filename>] [-ignore-after=<date|none>] [-cleared-only] [-round-tally]",
 		"Add inventory, basis, and gain splits to ledger-cli data.",
 	)
 }
 
-// simple output helper
-func writeLines(lines []string) {
-	for _, line := range lines {
-		fmt.Println(line)
-	}
+// lotFlags are the flags of the lot operation which decide how
+// transactions are lotted.  Reports of lots (see replayLots) define
+// them too, so that their lots are those lot produces.
+type lotFlags struct {
+	order, gainQualifier       *string
+	roundTally                 *bool
+	moveName, lotNames         *string
+	shortGain, longGain, gain  *string
+	termSplit                  *bool
+	income                     *string
+	margin, marginGain         *string
+	priceSanity                *float64
+	reorderDay                 *bool
+	pairOrders, groupFills     *bool
+	classes, directions, hook  *string
+	dust, dustAccount          *string
+	basisAdjust, adjustAccount *string
+	deferDate                  *string
+	clearedOnly                *bool
+	ignoreAfter                *string
 }
 
-var (
-	// command line flags
-	pruneFlag *int
-	orderFlag *string
+func defineLotFlags() *lotFlags {
+	this := &lotFlags{}
+	this.order = flag.String("order", "fifo", "order in which lot inventory is consumed, may be fifo, lifo or hifo")
+	this.roundTally = flag.Bool("round-tally", false, "tally basis and gains as rounded for output, so that gains match the value splits")
+	this.moveName = flag.String("move-name", "destination", "name of moved lots, may be destination, source, or a map of destination to name (i.e. \"Assets:Cold=Assets:Crypto\")")
+	this.shortGain = flag.String("short-gain", "Lot:Income:short term gain", "account of short term gains, a template of the asset sold (i.e. \"Income:CapGains:{{.Asset}}:Short\")")
+	this.longGain = flag.String("long-gain", "Lot:Income:long term gain", "account of long term gains, a template of the asset sold (i.e. \"Income:CapGains:{{.Asset}}:Long\")")
+	this.termSplit = flag.Bool("term-split", true, "distinguish long term gains from short term, otherwise all gains are split to -gain")
+	this.gain = flag.String("gain", "Lot:Income:gain", "account of gains, with -term-split=false, a template like -short-gain")
+	this.income = flag.String("income", "Lot:Income:payment", "account of income, when assets are received as payment (split tagged :INCOME:)")
+	this.margin = flag.String("margin", "", "margin or futures accounts, comma separated, whose positions are not lots")
+	this.marginGain = flag.String("margin-gain", "Lot:Income:short term gain", "account of gains realized by closing margin positions")
+	this.priceSanity = flag.Float64("price-sanity", 0, "percent by which a trade's price may differ from a price directive of the same day, 0 to not check")
+	this.reorderDay = flag.Bool("reorder-day", false, "process acquisitions before disposals of the same day (output order is unchanged)")
+	this.pairOrders = flag.Bool("pair-orders", false, "combine transactions of the same date and \"order\" metadata (legs of one trade) into one transaction")
+	this.groupFills = flag.Bool("group-fills", false, "group consecutive disposals of the same date, payee and asset (partial fills of one order) into one transaction")
+	this.classes = flag.String("classes", "", "file of account patterns and the class of transactions with splits to each")
+	this.directions = flag.String("directions", "", "file of account patterns which only acquire or only dispose of assets")
+	this.hook = flag.String("hook", "", "command which classifies each transaction (JSON lines in, and out)")
+	this.lotNames = flag.String("lot-names", "detail", "how lots are named, may be detail, sequence or hash (opaque IDs)")
+	this.gainQualifier = flag.String("gain-qualifier", "none", "attribute gains to the qualifier (i.e. exchange account) of inventory consumed, may be none, account or tag")
+	this.dust = flag.String("dust", "", "amounts too small to lot, per asset, i.e. \"BTC=0.00000546,ETH=1e-9\"")
+	this.dustAccount = flag.String("dust-account", "Lot:Dust", "account to which dust left in lots is written off")
+	this.basisAdjust = flag.String("basis-adjust", "", "file (CSV) of adjustments to the basis of lots, i.e. wash sale loss disallowed, from a broker")
+	this.adjustAccount = flag.String("adjust-account", "Lot:Income:wash sale", "account offsetting -basis-adjust adjustments")
+	this.deferDate = flag.String("defer-date", "original", "date of lots with deferred basis, may be original (of the lot traded last), earliest, latest, split (one lot per lot traded) or trade")
+	this.clearedOnly = flag.Bool("cleared-only", false, "pass through, not lotted, transactions not marked cleared (\"*\")")
+	this.ignoreAfter = flag.String("ignore-after", "", "pass through, not lotted, transactions dated after this date (default today), or none")
+	return this
+}
 
-	// indexes to the lot queue are a qualifier and an asset
-	// qualifier is non-empty when lots are per-account (not just per-asset)
-	lotQueue = make(map[Asset]map[string]LotQueue)
-)
+func lotMain(env *environment) error {
+	return lotOperate(env, false)
+}
 
-func lotMain() error {
+// lotOperate is the lot operation, and (if relot) the relot operation,
+// which first removes splits of an earlier lot.
+func lotOperate(env *environment, relot bool) error {
+	scanner, output := env.scanner, env.output
 
 	// define flags
-	pruneFlag = flag.Int("prune", 0, "name depth of account-specific lots") // TODO(dnc): document prune (maybe rename)
-	orderFlag = flag.String("order", "fifo", "order in which lot inventory is consumed, may be fifo or lifo")
+	lotting := defineLotFlags()
+	proceedsFlag := flag.String("proceeds", "", "account of proceeds, i.e. \"Lot:Proceeds\", to split gross proceeds of each sale (per asset)")
+	keepPricesFlag := flag.Bool("keep-prices", false, "leave price/cost of original splits intact, and tag generated splits :LOTTER:")
+	writePricesFlag := flag.Bool("write-prices", false, "write a price directive (i.e. \"P 2021/01/01 ABC 2 USD\") for each price commented out")
+	matchesOutFlag := flag.String("matches-out", "", "file to write (CSV), with a row per lot consumed by a sale: dates, quantity, basis, proceeds, gain and term")
+	lineageOutFlag := flag.String("lineage-out", "", "file to write (Graphviz DOT), with edges from lots moved or traded with deferred basis to the lots they funded")
+	lotMapFlag := flag.String("lot-map", "", "file to write (CSV), mapping each lot name to date, inventory and basis")
+	metadataFlag := flag.Bool("metadata", false, "record lots and gains as metadata of the original splits (i.e. \"; lot: ...\"), rather than as virtual splits")
+	appendFlag := flag.Bool("append", false, "with -lots-out, load lots from that file (written previously), and append splits of new transactions only")
+	lotsOutFlag := flag.String("lots-out", "", "file to write generated splits to, rather than interleaving them with original transactions (implies -keep-prices)")
+	translateFlag := flag.String("translate", "", "file of words and their translation, for accounts and comments of generated splits")
+	summaryFlag := flag.Bool("summary", false, "append a summary, per year, of gains, income and open lots (as comments)")
+	var freezeFlag *string
+	if relot {
+		freezeFlag = flag.String("freeze-before", "", "fail if lot, basis or gain splits dated before this date (i.e. 2022/01/01) would change")
+	}
 
 	err := command.Parse()
 	if err != nil {
 		return fmt.Errorf("unable to parse flags: %w", err)
 	}
 
+	if relot {
+		scanner.unlot = true // remove splits of an earlier lot
+	}
+
 	// validate flags
-	if base == "" {
-		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	l, err := newLotter(env, lotting)
+	if err != nil {
+		return err
+	}
+	defer l.Close() // if lot stops early
+	if *proceedsFlag != "" {
+		if err := checkAccountFlag("proceeds", *proceedsFlag); err != nil {
+			return err
+		}
 	}
+	if freezeFlag != nil && *freezeFlag != "" {
+		l.freeze, err = parseDate(*freezeFlag)
+		if err != nil {
+			return fmt.Errorf("bad -freeze-before date (%q): %w", *freezeFlag, err)
+		}
+	}
+	if *lotsOutFlag != "" {
+		if *metadataFlag {
+			return errors.New("-lots-out and -metadata are exclusive, as metadata is written to original splits")
+		}
+		*keepPricesFlag = true // original transactions must balance without generated splits
+	}
+	if *appendFlag {
+		if *lotsOutFlag == "" {
+			return errors.New("-append requires -lots-out")
+		}
+		if l.moveName != "destination" {
+			return fmt.Errorf("-append requires -move-name=destination (not %q), as lots are loaded by name", l.moveName)
+		}
+	}
+	l.proceeds, l.keepPrices, l.writePrices, l.metadata = *proceedsFlag, *keepPricesFlag, *writePricesFlag, *metadataFlag
 
-	// prepare to add lot splits to ledger data
-	writer := tabwriter.NewWriter(os.Stdout, 4, 8, 0, '\t', 0)
+	if *translateFlag != "" {
+		f, err := os.Open(*translateFlag)
+		if err != nil {
+			return fmt.Errorf("failed to open translation (%q): %w", *translateFlag, err)
+		}
+		l.translation, err = readTranslation(f)
+		f.Close()
+		if err != nil {
+			return statusError(exitInput, fmt.Errorf("translation (%q): %w", *translateFlag, err))
+		}
+	}
 
-	for scanner.Scan() {
+	if *lotMapFlag != "" {
+		f, err := os.Create(*lotMapFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create lot map (%q): %w", *lotMapFlag, err)
+		}
+		defer f.Close()
+		l.lotMap = csv.NewWriter(f)
+		l.lotMap.Write([]string{"lot", "detail", "date", "inventory", "basis"})
+	}
 
-		txLines := scanner.Lines()
+	if *matchesOutFlag != "" {
+		f, err := os.Create(*matchesOutFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create matches file (%q): %w", *matchesOutFlag, err)
+		}
+		defer f.Close()
+		l.matchesOut = csv.NewWriter(f)
+		l.matchesOut.Write([]string{"sold", "lot", "acquired", "quantity", "basis", "proceeds", "gain", "term"})
+	}
 
-		payee, payeeIndex := txLines.Payee()
-		if payeeIndex == PayeeNotFound {
-			// not a transaction (maybe a comment)
-			writeLines(append(txLines.Line, "")) // with a blank
-			continue
+	if *lineageOutFlag != "" {
+		f, err := os.Create(*lineageOutFlag)
+		if err != nil {
+			return fmt.Errorf("failed to create lineage file (%q): %w", *lineageOutFlag, err)
 		}
+		defer f.Close()
+		l.lineage = newLineageGraph(f)
+	}
 
-		command.V(1).Info("transaction:\n\t", payee)
+	// lots written previously, when appending
+	if *appendFlag {
+		f, err := os.Open(*lotsOutFlag)
+		if err == nil {
+			l.lotted, err = l.loadLots(f)
+			f.Close()
+			if err != nil {
+				return statusError(exitInput, fmt.Errorf("failed to load lots file (%q): %w", *lotsOutFlag, err))
+			}
+			l.writeLotMap()
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to open lots file (%q): %w", *lotsOutFlag, err)
+		}
+	}
 
-		// keep track of lots affected by this transaction
-		var lot []Lot
-		var inventory []Amount
-		var basis []Amount
-		var comment []string
-		// (original intent was to track moves and trades both in each transaction; however currently we treat each transaction as either a move or trades, not both)
+	if *lotsOutFlag != "" {
+		var f *os.File
+		if l.lotted != nil {
+			f, err = os.OpenFile(*lotsOutFlag, os.O_APPEND|os.O_WRONLY, 0)
+		} else {
+			f, err = os.Create(*lotsOutFlag)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create lots file (%q): %w", *lotsOutFlag, err)
+		}
+		defer f.Close()
+		lots, _ := NewOutput("ledger", f, env.settings)
+		if l.lotted == nil {
+			lots.Lines([]string{fmt.Sprintf("; lots and gains generated by lotter, include from the journal (i.e. \"include %s\")", *lotsOutFlag)})
+		}
+		defer func() {
+			output.Flush() // lots, before file is closed
+		}()
+		output = lotsOutput{Output: output, lots: lots}
+	}
+
+	if *summaryFlag {
+		l.summary = newLotSummary(l)
+		l.summary.termSplit = *lotting.termSplit
+	}
+
+	l.output = output
+	err = l.run()
+	if err != nil {
+		return err
+	}
+
+	if l.summary != nil {
+		output.Lines(l.summary.Lines())
+	}
+
+	if l.adjustNext < len(l.adjustments) {
+		env.problems.add("basis adjustment", fmt.Errorf("%d adjustment(s) of basis (%q) dated after the last transaction lotted, not applied", len(l.adjustments)-l.adjustNext, *lotting.basisAdjust))
+	}
+
+	if l.lotted != nil && l.lotted.count > 0 {
+		env.problems.add("lots file mismatch", fmt.Errorf("%d transaction(s) of lots file (%q) not found in journal, lot without -append", l.lotted.count, *lotsOutFlag))
+	}
 
-		splits, isTrade, _, err := produceSplits(txLines.Line[payeeIndex+1:])
+	err = l.Close()
+	if err != nil {
+		return err
+	}
+	if l.matchesOut != nil {
+		l.matchesOut.Flush()
+		err = l.matchesOut.Error()
 		if err != nil {
-			writeLines(txLines.Line)
-			log.Printf("\nFailed to process transaction (%q):\n\t", payee)
-			log.Println(err)
-			os.Exit(1)
+			return statusError(exitError, fmt.Errorf("failed to write matches file (%q): %w", *matchesOutFlag, err))
 		}
+	}
+	if l.lineage != nil {
+		err = l.lineage.Close()
+		if err != nil {
+			return statusError(exitError, fmt.Errorf("failed to write lineage file (%q): %w", *lineageOutFlag, err))
+		}
+	}
+	if l.lotMap != nil {
+		l.lotMap.Flush()
+		err = l.lotMap.Error()
+		if err != nil {
+			return statusError(exitError, fmt.Errorf("failed to write lot map (%q): %w", *lotMapFlag, err))
+		}
+	}
+	return nil
+}
 
-		if !isTrade {
-			// Moves are splits without a price/cost associated (i.e. moving
-			// an asset from a hot wallet to a cold wallet)
+// lotter lots transactions, one at a time (see lot()).  The lot
+// operation writes each transaction with the splits generated, and
+// reports of lots replay transactions through a lotter which writes
+// nothing (see replayLots).  Each lotter begins with no lots, so
+// lotting more than once (i.e. stages of pipe, or orders simulated)
+// starts over each time.
+type lotter struct {
+	*settings
+	scanner  *TxScanner
+	output   Output
+	problems *problemTally
+
+	order                     order
+	gainQualifier             string
+	roundTally                bool
+	priceSanity               float64
+	reorderDay                bool
+	deferDate                 string
+	moveName                  string
+	moveNameMap               map[string]string // of -move-name, when a map
+	shortGain, longGain, gain gainAccount
+	termSplit                 bool
+	income                    string
+	clearedOnly               bool
+	ignoreAfter               time.Time
+	classRules                classRules
+	directionRules            directionRules
+	hook                      *txHook
+	hookCommand               string
+	adjustments               []basisAdjustment
+	adjustNext                int // of adjustments, first not yet applied
+	adjustFailed              []basisAdjustment
+	adjustAccount             string
+	translation               *translation // nil, if not translated
 
-			// tally moves by qualifier
-			moves := produceMoves(splits)
+	// indexes to the lot queue are a qualifier and an asset
+	// qualifier is non-empty when lots are per-account (not just per-asset)
+	lotQueue map[Asset]map[string]LotQueue
+
+	// lot order of the current transaction, when a hook overrides
+	// -order (see sell())
+	sellOrder order
+
+	// checkpoint of the transaction being lotted, if any
+	lotting *checkpoint
+
+	lotNames  // names and weights of lots created (see lot.go)
+	margins   // positions of margin accounts (see margin.go)
+	dustLimit // amounts not lotted (see dust.go)
+
+	// observed price information, if any, for sanity checks and income
+	priceHistory PriceHistory
+
+	// set by the lot operation, to write more than lots and gains
+	proceeds                          string
+	keepPrices, writePrices, metadata bool
+	summary                           *lotSummary
+	matchesOut                        *csv.Writer
+	lineage                           *lineageGraph
+	lotted                            *lotsFile // lots written previously, when appending
+	freeze                            time.Time
+}
 
-			l, i, b, c, err := consumeMoves(moves)
-			if err != nil {
-				writeLines(txLines.Line)
-				log.Printf("Failed to process move transaction (%q):", payee)
-				log.Println("\t", err)
-				os.Exit(1)
-			}
-			lot = append(lot, l...)
-			inventory = append(inventory, i...)
-			basis = append(basis, b...)
-			comment = append(comment, c...)
-		} else {
-			l, i, b, c, err := consumeTrades(splits, txLines.Date)
-			if err != nil {
-				writeLines(txLines.Line)
-				log.Printf("Failed to process trade transaction (%q):", payee)
-				log.Println("\t", err)
-				os.Exit(1)
-			}
-			lot = append(lot, l...)
-			inventory = append(inventory, i...)
-			basis = append(basis, b...)
-			comment = append(comment, c...)
-		}
-
-		// sanity check that inventory, lot, basis, comment arrays have equal length
-		if len(lot) != len(inventory) || len(lot) != len(basis) || len(lot) != len(comment) {
-			log.Panic("mismatch of lot/inventory/basis changes")
-		}
-
-		// Before writing original splits, we comment out the price/cost
-		// portion of the split.  That information is now expressed in lot
-		// basis and/or gains.
-		for i, line := range txLines.Line[payeeIndex+1:] {
-			priceIndex := strings.IndexByte(line, '@')
-			if priceIndex != -1 {
-				commentIndex := strings.IndexByte(line, ';')
-				if commentIndex == -1 || commentIndex > priceIndex {
-					// comment out price/cost
-					_ = i
-					txLines.Line[payeeIndex+1+i] = strings.Replace(line, "@", "; @", 1)
-				}
+// newLotter validates flags (see defineLotFlags), and loads the files
+// they name.  The lotter reads transactions from the scanner of env,
+// beginning with no lots.
+func newLotter(env *environment, flags *lotFlags) (*lotter, error) {
+	var err error
+	if env.base == "" {
+		return nil, errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	err = checkOrder(*flags.order)
+	if err != nil {
+		return nil, err
+	}
+	switch *flags.gainQualifier {
+	case "none", "account", "tag":
+	default:
+		return nil, fmt.Errorf("bad -gain-qualifier (%q), expected none, account or tag", *flags.gainQualifier)
+	}
+	for _, a := range [][2]string{{"income", *flags.income}, {"margin-gain", *flags.marginGain}, {"dust-account", *flags.dustAccount}, {"adjust-account", *flags.adjustAccount}} {
+		if err := checkAccountFlag(a[0], a[1]); err != nil {
+			return nil, err
+		}
+	}
+	this := &lotter{
+		settings:      env.settings,
+		scanner:       env.scanner,
+		problems:      env.problems,
+		order:         order(*flags.order),
+		gainQualifier: *flags.gainQualifier,
+		roundTally:    *flags.roundTally,
+		priceSanity:   *flags.priceSanity,
+		reorderDay:    *flags.reorderDay,
+		deferDate:     *flags.deferDate,
+		moveName:      *flags.moveName,
+		termSplit:     *flags.termSplit,
+		income:        *flags.income,
+		clearedOnly:   *flags.clearedOnly,
+		adjustAccount: *flags.adjustAccount,
+		lotQueue:      make(map[Asset]map[string]LotQueue),
+		lotNames:      lotNames{lotNaming: *flags.lotNames},
+		margins:       margins{marginGain: *flags.marginGain, marginPosition: make(map[string]*position)},
+		dustLimit:     dustLimit{dustThreshold: make(map[Asset]*big.Rat), dustAccount: *flags.dustAccount},
+		priceHistory:  newPriceHistory(env.settings),
+	}
+	this.shortGain, err = parseGainAccount("short-gain", *flags.shortGain)
+	if err != nil {
+		return nil, err
+	}
+	this.longGain, err = parseGainAccount("long-gain", *flags.longGain)
+	if err != nil {
+		return nil, err
+	}
+	this.gain, err = parseGainAccount("gain", *flags.gain)
+	if err != nil {
+		return nil, err
+	}
+	if this.priceSanity < 0 {
+		return nil, fmt.Errorf("bad -price-sanity (%v), expected a positive percent", this.priceSanity)
+	}
+	switch this.deferDate {
+	case "original", "earliest", "latest", "split", "trade":
+	default:
+		return nil, fmt.Errorf("bad -defer-date (%q), expected original, earliest, latest, split or trade", this.deferDate)
+	}
+	switch this.lotNaming {
+	case "detail", "sequence", "hash":
+	default:
+		return nil, fmt.Errorf("bad -lot-names (%q), expected detail, sequence or hash", this.lotNaming)
+	}
+	switch this.moveName {
+	case "destination", "source":
+	default:
+		this.moveNameMap = make(map[string]string)
+		for _, m := range strings.Split(this.moveName, ",") {
+			pair := strings.SplitN(m, "=", 2)
+			if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+				return nil, fmt.Errorf("bad -move-name (%q), expected destination, source, or i.e. \"Assets:Cold=Assets:Crypto\"", this.moveName)
 			}
+			this.moveNameMap[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
 		}
+	}
+	now := time.Now()
+	this.ignoreAfter = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch *flags.ignoreAfter {
+	case "":
+	case "none":
+		this.ignoreAfter = time.Time{}
+	default:
+		this.ignoreAfter, err = parseDate(*flags.ignoreAfter)
+		if err != nil {
+			return nil, fmt.Errorf("bad -ignore-after date (%q), expected a date or none: %w", *flags.ignoreAfter, err)
+		}
+	}
+	err = this.parseDust(*flags.dust)
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range strings.Split(*flags.margin, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			this.marginAccount = append(this.marginAccount, account)
+		}
+	}
+	this.problems.defaultLimit(1) // lots are unreliable after any error
 
-		// write lot inventory and basis splits
-		for i, _ := range inventory {
-			// compose a more verbose comment
-			var verbose string
-			switch inventory[i].Sign() {
-			case 0:
-				log.Panicf("zero inventory! %q", payee)
-			case 1:
-				// positive inventory means lot consumed
-				verbose = fmt.Sprintf("%s (inventory consumed)", comment[i])
-			case -1:
-				verbose = fmt.Sprintf("%s (inventory)", comment[i])
-			}
-			fmt.Fprintf(writer, "    [%s]\t\t%s \t; %s\n", lot[i].name, inventory[i].String(), verbose)
-			switch basis[i].Sign() {
-			case 0:
-				verbose = fmt.Sprintf("%s (basis unchanged)", comment[i])
-			case 1:
-				// positive basis means inventory added
-				verbose = fmt.Sprintf("%s (basis)", comment[i])
-			case -1:
-				verbose = fmt.Sprintf("%s (basis consumed)", comment[i])
-			}
-			if basis[i].Sign() == 0 {
-				// comment out 0 basis
-				fmt.Fprintf(writer, "    ;[%s]\t\t%s \t; %s\n", lot[i].name, basis[i].String(), verbose)
-			} else {
-				fmt.Fprintf(writer, "    [%s]\t\t%s \t; %s\n", lot[i].name, basis[i].String(), verbose)
+	if *flags.classes != "" {
+		f, err := os.Open(*flags.classes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open classes (%q): %w", *flags.classes, err)
+		}
+		this.classRules, err = readClasses(f)
+		f.Close()
+		if err != nil {
+			return nil, statusError(exitInput, fmt.Errorf("classes (%q): %w", *flags.classes, err))
+		}
+	}
+
+	if *flags.directions != "" {
+		f, err := os.Open(*flags.directions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open directions (%q): %w", *flags.directions, err)
+		}
+		this.directionRules, err = readDirections(f)
+		f.Close()
+		if err != nil {
+			return nil, statusError(exitInput, fmt.Errorf("directions (%q): %w", *flags.directions, err))
+		}
+	}
+
+	if *flags.basisAdjust != "" {
+		f, err := os.Open(*flags.basisAdjust)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open basis adjustments (%q): %w", *flags.basisAdjust, err)
+		}
+		this.adjustments, err = this.loadBasisAdjustments(f)
+		f.Close()
+		if err != nil {
+			return nil, statusError(exitInput, fmt.Errorf("basis adjustments (%q): %w", *flags.basisAdjust, err))
+		}
+	}
+
+	if *flags.hook != "" {
+		this.hook, err = startHook(*flags.hook, this.settings)
+		if err != nil {
+			return nil, err
+		}
+		this.hookCommand = *flags.hook
+	}
+
+	// legs of an order, combined into one transaction
+	if *flags.pairOrders {
+		this.scanner = this.pairOrders(this.scanner)
+	}
+
+	// partial fills, grouped into one transaction
+	if *flags.groupFills {
+		this.scanner = this.groupFills(this.scanner)
+	}
+	return this, nil
+}
+
+// Close stops the hook, if any.
+func (this *lotter) Close() error {
+	if this.hook == nil {
+		return nil
+	}
+	err := this.hook.Close()
+	if err != nil {
+		return statusError(exitError, fmt.Errorf("hook (%q) failed: %w", this.hookCommand, err))
+	}
+	return nil
+}
+
+// run lots each transaction of the scanner, until a problem stops it
+// (see -max-errors).
+func (this *lotter) run() error {
+	// transactions, possibly reordered within each day
+	var txScan interface {
+		Scan() bool
+		Lines() TxLines
+	} = this.scanner
+	if this.reorderDay {
+		day := newDayScanner(this.scanner, this.output, this.settings)
+		txScan = day
+		this.output = dayOutput{scanner: day}
+		defer func() {
+			day.Flush()
+			this.output = day.output
+		}()
+	}
+
+	for txScan.Scan() {
+		stop, err := this.lot(txScan.Lines())
+		if err != nil {
+			return err
+		}
+		if stop {
+			break
+		}
+	}
+	return nil
+}
+
+// lot lots one transaction, and writes it (with the splits generated)
+// to output.  Returns true when lotting should stop, because the limit
+// on problems has been reached.
+func (this *lotter) lot(txLines TxLines) (bool, error) {
+	// directives written by an earlier lot are not market data, and
+	// its manifest does not describe this output
+	if this.scanner.unlot {
+		txLines = dropManifest(txLines)
+		if len(txLines.Line) == 0 {
+			return false, nil
+		}
+	}
+	if this.scanner.unlot && isTradePrices(txLines) {
+		return false, nil
+	}
+
+	for _, line := range txLines.Line {
+		_, err := this.priceHistory.Observe(line)
+		if err != nil {
+			if this.priceSanity > 0 {
+				return true, statusError(exitInput, err)
 			}
+			command.V(1).Info(err) // prices needed only for sanity check and income
+		}
+	}
+
+	payee, payeeIndex := txLines.Payee()
+	if payeeIndex == PayeeNotFound {
+		// not a transaction (maybe a comment)
+		this.output.Lines(txLines.Line)
+		return false, nil
+	}
 
+	command.V(1).Info("transaction:\n\t", payee)
+
+	// keep track of lots affected by this transaction
+	var lot []Lot
+	var inventory []Amount
+	var basis []Amount
+	var comment []string
+	var trace []string // txid or ref of split consumed, if any
+	// (original intent was to track moves and trades both in each transaction; however currently we treat each transaction as either a move or trades, not both)
+
+	// Problems with a transaction are written to output (as FIXME,
+	// which ledger-cli rejects) and to the log.  The transaction is
+	// written as found, without splits generated before the
+	// problem, and when lot continues its lots are undone.
+	original := txLines
+	original.Line = append([]string(nil), txLines.Line...)
+	var saved *checkpoint
+	fail := func(kind string, err ...error) bool {
+		var fixme []Posting
+		stop := false
+		for _, e := range err {
+			e = this.explain(original, e)
+			fixme = append(fixme, Posting{Err: fmt.Errorf("lot: %w", e)})
+			stop = this.problems.add(kind, e) || stop
 		}
+		if saved != nil {
+			saved.restore()
+		}
+		this.output.Tx(original, fixme)
+		return stop
+	}
+	line := txLines.Start + payeeIndex // line number of payee
 
-		// tally whether gains are long or short term
-		// note that we tally the rendered amounts, which may be rounded
-		longBasis := new(big.Rat)
-		shortBasis := new(big.Rat)
-		var longInventory, shortInventory *Amount
+	// already lotted, when appending
+	if this.lotted != nil && this.lotted.lotted(txLines) {
+		this.output.Tx(txLines, nil)
+		return false, nil
+	}
 
-		totalValue := new(big.Rat) // positive indicates sell, negative indicates buy
-		if isTrade {
-			for _, qualified := range splits {
-				for _, split := range qualified {
-					for _, s := range split {
-						if s.delta.Asset == base {
-							printed, ok := new(big.Rat).SetString(s.delta.FloatString())
-							if !ok {
-								log.Panicf("bad amount %s", s.delta)
-							}
-							totalValue.Add(totalValue, printed)
-						}
-					}
+	// forecast and budget entries do not consume lots
+	if !this.ignoreAfter.IsZero() && txLines.Date.After(this.ignoreAfter) {
+		command.V(1).Infof("transaction (%q) dated after %s, not lotted", payee, this.ignoreAfter.Format("2006/01/02"))
+		this.output.Tx(txLines, nil)
+		return false, nil
+	}
+
+	// pending trades do not affect basis, until confirmed
+	if this.clearedOnly && !txLines.Cleared() {
+		command.V(1).Infof("transaction (%q) not cleared, not lotted", payee)
+		this.output.Tx(txLines, nil)
+		return false, nil
+	}
+
+	// lots created (by trade, move or otherwise) are weighed by the
+	// day of the transaction, which the checkpoint saves
+	this.weighDay(txLines.Date)
+	if this.problems.limit != 1 {
+		saved = this.saveCheckpoint()
+	}
+
+	if this.summary != nil {
+		this.summary.observe(txLines.Date.Year())
+	}
+
+	// sequence, i.e. exchange's trade ID, breaks ties between lots of one day
+	this.weightMeta = nil
+	if seq := txLines.Metadata("seq"); seq != "" {
+		var ok bool
+		this.weightMeta, ok = new(big.Rat).SetString(seq)
+		if !ok {
+			this.weightMeta = nil
+			return fail("bad metadata", lineErrorf(line, "bad seq of transaction (%q), expected a number: %q", payee, seq)), nil
+		}
+	}
+
+	splits, isTrade, _, err := this.produceSplits(txLines.Line[payeeIndex+1:])
+	if err != nil {
+		return fail("unparsed transaction", lineErrorf(line, "failed to process transaction (%q): %w", payee, err)), nil
+	}
+	dust := this.dropDust(splits)
+
+	// a hook may classify the transaction, overriding what is
+	// inferred from prices and tags
+	var class hookResponse
+	if this.hook != nil {
+		class, err = this.hook.Classify(txLines)
+		if err != nil {
+			return true, statusError(exitError, lineErrorf(line, "failed to classify transaction (%q): %w", payee, err))
+		}
+		command.V(1).Infof("hook classified %q as %+v", payee, class)
+	}
+	if class.Class == "" {
+		class.Class, err = disposalTag(txLines)
+		if err != nil {
+			return fail("unparsed transaction", lineErrorf(line, "failed to process transaction (%q): %w", payee, err)), nil
+		}
+	}
+	if class.Class == "" {
+		class.Class = this.classRules.class(this.settings, txLines)
+	}
+	this.sellOrder = order(class.Order)
+	switch class.Class {
+	case "ignore":
+		this.output.Tx(txLines, nil)
+		return false, nil
+	case "trade":
+		isTrade = true
+	case "income":
+		this.incomeClass(splits)
+	case "spend":
+		err = this.spendClass(splits, txLines.Date, this.priceHistory)
+		isTrade = true
+	}
+	if err != nil {
+		return fail("missing price", lineErrorf(line, "failed to process spend transaction (%q): %w", payee, err)), nil
+	}
+
+	// in strict mode, accounts and lot qualifiers must be declared
+	errs := this.checkAccounts(this.scanner, txLines)
+	for _, qual := range qualifiers(splits) {
+		if e := this.checkQualifier(this.scanner, txLines, qual); e != nil {
+			errs = append(errs, e)
+		}
+	}
+	if len(errs) > 0 {
+		return fail("undeclared account", errs...), nil
+	}
+
+	// price differing from price directive is likely a typo
+	if this.priceSanity > 0 {
+		errs = this.priceHistory.Check(txLines, this.priceSanity)
+		if len(errs) > 0 {
+			return fail("price sanity", errs...), nil
+		}
+	}
+
+	// margin positions are not lots
+	var marginGenerated []Posting
+	if len(this.marginAccount) > 0 {
+		var margin []Split
+		margin, isTrade = this.separateMargin(splits)
+		marginGenerated, err = this.consumeMargin(margin)
+		if err != nil {
+			return fail("failed margin", lineErrorf(line, "failed to process margin transaction (%q): %w", payee, err)), nil
+		}
+	}
+
+	// Assets received as payment (i.e. wages) are income, at fair
+	// market value.
+	income, err := this.incomeSplits(splits, txLines.Date, this.priceHistory)
+	if err != nil {
+		return fail("missing price", lineErrorf(line, "failed to process income transaction (%q): %w", payee, err)), nil
+	}
+	if income.Sign() != 0 {
+		isTrade = true
+	}
+	if class.Class == "move" || class.Class == "donation" || class.Class == "gift" || class.Class == "lost" {
+		isTrade = false
+	}
+
+	// a split against the direction of its account is likely a
+	// typo, though a move is neither acquisition nor disposal
+	moved := !isTrade && class.Class != "donation" && class.Class != "gift" && class.Class != "lost"
+	if errs = this.directionRules.check(this.settings, txLines); len(errs) > 0 && !moved {
+		return fail("wrong direction", errs...), nil
+	}
+
+	if class.Class == "donation" || class.Class == "gift" || class.Class == "lost" {
+		l, i, b, c, err := this.disposeClass(splits, class.Class)
+		if err != nil {
+			return fail("failed trade", lineErrorf(line, "failed to process %s transaction (%q): %w", class.Class, payee, err)), nil
+		}
+		lot = append(lot, l...)
+		inventory = append(inventory, i...)
+		basis = append(basis, b...)
+		comment = append(comment, c...)
+		trace = append(trace, make([]string, len(l))...)
+	} else if !isTrade {
+		// Moves are splits without a price/cost associated (i.e. moving
+		// an asset from a hot wallet to a cold wallet)
+
+		// tally moves by qualifier
+		moves := produceMoves(splits)
+
+		l, i, b, c, err := this.consumeMoves(moves)
+		if err != nil {
+			return fail("failed move", lineErrorf(line, "failed to process move transaction (%q): %w", payee, err)), nil
+		}
+		lot = append(lot, l...)
+		inventory = append(inventory, i...)
+		basis = append(basis, b...)
+		comment = append(comment, c...)
+		trace = append(trace, make([]string, len(l))...)
+	} else {
+		l, i, b, c, t, err := this.consumeTrades(splits, txLines.Date)
+		if err != nil {
+			return fail("failed trade", lineErrorf(line, "failed to process trade transaction (%q): %w", payee, err)), nil
+		}
+
+		// a mistake of prices may not fail, but basis is then wrong
+		for _, d := range this.diagnose(txLines) {
+			command.V(0).Info(lineErrorf(line, "warning, transaction (%q) has %s", payee, d))
+		}
+		lot = append(lot, l...)
+		inventory = append(inventory, i...)
+		basis = append(basis, b...)
+		comment = append(comment, c...)
+		trace = append(trace, t...)
+	}
+
+	// sanity check that inventory, lot, basis, comment, trace arrays have equal length
+	if len(lot) != len(inventory) || len(lot) != len(basis) || len(lot) != len(comment) || len(lot) != len(trace) {
+		log.Panic("mismatch of lot/inventory/basis changes")
+	}
+	err = this.checkInventory(lot, inventory)
+	if err != nil {
+		return fail("failed trade", lineErrorf(line, "failed to process transaction (%q): %w", payee, err)), nil
+	}
+
+	// broker's adjustments of basis, due by the date of this
+	// transaction (see -basis-adjust)
+	var adjusted []Posting
+	adjustDue := this.adjustNext
+	for adjustDue < len(this.adjustments) && !this.adjustments[adjustDue].date.After(txLines.Date) {
+		var p []Posting
+		p, err = this.adjustBasis(this.adjustments[adjustDue], this.adjustAccount)
+		if err != nil {
+			// not retried, when lot continues, but listed by -summary
+			this.adjustFailed = append(this.adjustFailed, this.adjustments[adjustDue])
+			this.adjustments = append(this.adjustments[:adjustDue], this.adjustments[adjustDue+1:]...)
+			break
+		}
+		adjusted = append(adjusted, p...)
+		adjustDue++
+	}
+	if err != nil {
+		return fail("basis adjustment", lineErrorf(line, "failed to adjust basis, at transaction (%q): %w", payee, err)), nil
+	}
+
+	// Before writing original splits, we comment out the price/cost
+	// portion of the split.  That information is now expressed in lot
+	// basis and/or gains.  When no lots are affected (i.e. trading
+	// base equivalents) the price is left intact.
+	var tradePrices []string
+	for i, line := range txLines.Line[payeeIndex+1:] {
+		if (len(inventory) == 0 && len(marginGenerated) == 0) || this.metadata || this.keepPrices {
+			break
+		}
+		if s, ok := this.parseSplit(line); ok && s.delta != nil && this.isBase(s.delta.Asset) && !this.isBase(s.Tally().Asset) {
+			// price of base currency (see reversePrice()) is left
+			// intact, as a null-amount split may be calculated from it
+			continue
+		}
+		priceIndex := strings.IndexByte(line, '@')
+		if priceIndex != -1 {
+			commentIndex := strings.IndexByte(line, ';')
+			if commentIndex == -1 || commentIndex > priceIndex {
+				// comment out price/cost
+				_ = i
+				txLines.Line[payeeIndex+1+i] = strings.Replace(line, "@", "; @", 1)
+				if this.writePrices {
+					tradePrices = this.appendTradePrice(tradePrices, txLines.Date, line)
 				}
 			}
 		}
+	}
 
-		// totalGain starts equal to totalValue, but will be reduced by
-		// basis of inventory consumed.
-		totalGain := new(big.Rat).Set(totalValue)
+	// lot inventory, basis and gain splits
+	var generated []Posting
+
+	for i, _ := range inventory {
+		// compose a more verbose comment
+		var verbose string
+		switch inventory[i].Sign() {
+		case 1:
+			// positive inventory means lot consumed
+			verbose = fmt.Sprintf("%s (inventory consumed)", comment[i])
+			if strings.HasPrefix(comment[i], ":SELL") {
+				// which lot the sale matched, at a glance
+				verbose = fmt.Sprintf("%s %s (inventory consumed)", comment[i], this.lotDetail(lot[i], txLines.Date))
+			}
+		case -1:
+			verbose = fmt.Sprintf("%s (inventory)", comment[i])
+		}
+		if trace[i] != "" {
+			verbose = fmt.Sprintf("%s %s", verbose, trace[i])
+		}
+		generated = append(generated, Posting{Account: lot[i].name, Amount: inventory[i], Comment: verbose})
+		switch basis[i].Sign() {
+		case 0:
+			verbose = fmt.Sprintf("%s (basis unchanged)", comment[i])
+		case 1:
+			// positive basis means inventory added
+			verbose = fmt.Sprintf("%s (basis)", comment[i])
+		case -1:
+			verbose = fmt.Sprintf("%s (basis consumed)", comment[i])
+		}
+		if trace[i] != "" {
+			verbose = fmt.Sprintf("%s %s", verbose, trace[i])
+		}
+		// comment out 0 basis
+		generated = append(generated, Posting{Account: lot[i].name, Amount: basis[i], Comment: verbose, Disabled: basis[i].Sign() == 0})
 
-		for i, _ := range inventory {
+	}
 
-			var isLongTerm, isShortTerm bool
-			if inventory[i].Sign() > 0 { // double-entry, positive inventory indicates sell
-				// in U.S.A, distinguish long term gain/loss from short term
-				_, years, _, _, _, _, _, _ := Elapsed(lot[i].date, txLines.Date)
-				if years > 0 {
-					isLongTerm = true
-				} else {
-					isShortTerm = true
-				}
+	generated = append(generated, adjusted...)
+	generated = append(generated, marginGenerated...)
 
-				if longInventory == nil {
-					tmp := inventory[i].ZeroClone()
-					longInventory = &tmp
-					tmp2 := inventory[i].ZeroClone()
-					shortInventory = &tmp2
-					// TODO(dnc): if `tmp = ` instead of `tmp2 := ` above, longInventory and shortInventory end up the same pointer!  investigate why.
-					// sanity
-					if fmt.Sprintf("%p", shortInventory) == fmt.Sprintf("%p", longInventory) {
-						log.Panic("longInventory and shortInventory are same pointer")
+	// basis of assets donated, given or lost is not a loss
+	if class.Class == "donation" || class.Class == "gift" || class.Class == "lost" {
+		disposed := new(big.Rat)
+		for i := range basis {
+			disposed.Sub(disposed, this.tallied(basis[i]))
+		}
+		if disposed.Sign() != 0 {
+			generated = append(generated, Posting{Account: "Lot:Disposal:" + class.Class, Amount: this.NewAmount(this.base, *disposed), Comment: fmt.Sprintf(":DISPOSAL:%s:", strings.ToUpper(class.Class))})
+		}
+		if class.Class != "lost" {
+			generated = append(generated, this.disposalValues(lot, inventory, basis, txLines.Date, this.priceHistory, class.Class)...)
+		}
+	}
+
+	// Trades in base equivalents are accounted for as if in base
+	// currency.  These splits convert from one to the other, so that
+	// generated splits balance.
+	if isTrade && !this.trackEquivalent {
+		for _, asset := range sortedAssets(splits) {
+			if !this.baseEquivalent[asset] {
+				continue
+			}
+			for _, qual := range sortedQualifiers(splits[asset]) {
+				for _, s := range splits[asset][qual] {
+					if s.delta.Asset != asset {
+						continue // a split priced in the equivalent
 					}
+					generated = append(generated,
+						Posting{Account: "Lot:Equity:base equivalent", Amount: s.delta.NegClone(), Comment: ":CONVERT:"},
+						Posting{Account: "Lot:Equity:base equivalent", Amount: this.toBase(*s.delta), Comment: ":CONVERT:"},
+					)
 				}
+			}
+		}
+	}
 
-				// sanity check, if fails inventory tally must be map[Asset]*Amount
-				if longInventory.Asset != inventory[i].Asset {
-					log.Panicf("trade with mixed inventory (%s and %s)", longInventory.Asset, inventory[i].Asset)
+	// note that with -round-tally, we tally the rendered amounts
+	totalValue := new(big.Rat) // positive indicates sell, negative indicates buy
+	if isTrade {
+		for _, qualified := range splits {
+			for _, split := range qualified {
+				for _, s := range split {
+					if this.isBase(s.delta.Asset) {
+						value := this.tallied(*s.delta)
+						totalValue.Add(totalValue, value)
+					}
 				}
+			}
+		}
+	}
+
+	// The basis of lots created is also value received, i.e. when
+	// one asset is traded for another.  (Unless basis is deferred,
+	// carried from the lots traded, which are not tallied below.)
+	for i := range inventory {
+		if inventory[i].Sign() < 0 && !strings.HasPrefix(comment[i], ":MOVE:") && comment[i] != ":BUY:DEFER:" {
+			value := this.tallied(basis[i])
+			totalValue.Add(totalValue, value)
+		}
+	}
 
+	// Income, like rebates, is not proceeds of a sale.
+	if income.Sign() != 0 {
+		totalValue.Sub(totalValue, income)
+		generated = append(generated, Posting{Account: this.income, Amount: this.NewAmount(this.base, *new(big.Rat).Neg(income)), Comment: ":INCOME:"})
+	}
+
+	// Rebates (assets acquired at negative cost) are income, not
+	// proceeds of a sale.
+	if isTrade {
+		rebate := new(big.Rat)
+		for _, asset := range sortedAssets(splits) {
+			for _, qual := range sortedQualifiers(splits[asset]) {
+				for _, s := range splits[asset][qual] {
+					if s.rebate && s.delta.Sign() > 0 && !this.isBase(s.delta.Asset) {
+						value := this.tallied(this.toBase(*s.Cost()))
+						rebate.Add(rebate, new(big.Rat).Abs(value))
+					}
+				}
 			}
+		}
+		if rebate.Sign() != 0 {
+			totalValue.Sub(totalValue, rebate)
+			generated = append(generated, Posting{Account: "Lot:Income:rebate", Amount: this.NewAmount(this.base, *rebate.Neg(rebate)), Comment: ":REBATE:"})
+		}
+	}
 
-			// use the rendered amount, so that our math uses same precision as output
-			printed, ok := new(big.Rat).SetString(basis[i].FloatString())
-			if !ok {
-				log.Panicf("bad amount (%q)", basis[i])
+	// Gains are tallied per qualifier of inventory consumed, so that
+	// a sale from more than one lot queue attributes gain to each.
+	// (Unless -gain-qualifier=none, when gains are not attributed.)
+	// And per asset, when a trade sells more than one.
+	type gainTally struct {
+		qualifier                     string
+		asset                         Asset
+		longBasis, shortBasis         *big.Rat
+		longInventory, shortInventory *Amount
+		longHeld, shortHeld           holdingPeriod
+		trace                         []string // of splits consumed, without duplicates
+	}
+	var gains []*gainTally
+	consumed := make(map[Asset]*big.Rat) // total inventory consumed, of all qualifiers
+	sold := make([]bool, len(inventory))
+	term := make([]string, len(inventory)) // "long" or "short", if -term-split
+
+	for i, _ := range inventory {
+
+		if !isTrade {
+			break // moves have no gain
+		}
+		if inventory[i].Sign() <= 0 { // double-entry, positive inventory indicates sell
+			continue
+		}
+		if strings.HasPrefix(comment[i], ":MOVE:") {
+			continue // unpriced asset of trade (see unpricedLegs())
+		}
+		if comment[i] == ":SELL:DEFER:" {
+			// basis is carried to the lot bought (see
+			// consumeTrades), so no gain is realized, of either term
+			continue
+		}
+		if comment[i] == ":SELL:EXERCISE:" {
+			// option exercised has no gain of its own, its basis
+			// is that of the underlying (tallied in value)
+			totalValue.Add(totalValue, this.tallied(basis[i]))
+			continue
+		}
+
+		qual := ""
+		if this.gainQualifier != "none" {
+			qual = lot[i].qualifier
+		}
+		var tally *gainTally
+		for _, g := range gains {
+			if g.qualifier == qual && g.asset == inventory[i].Asset {
+				tally = g
+			}
+		}
+		if tally == nil {
+			longInventory := inventory[i].ZeroClone()
+			shortInventory := inventory[i].ZeroClone()
+			tally = &gainTally{
+				qualifier:      qual,
+				asset:          inventory[i].Asset,
+				longBasis:      new(big.Rat),
+				shortBasis:     new(big.Rat),
+				longInventory:  &longInventory,
+				shortInventory: &shortInventory,
 			}
-			if isLongTerm {
-				longBasis.Add(longBasis, printed)
-				longInventory.Add(longInventory.Rat, inventory[i].Rat)
+			gains = append(gains, tally)
+		}
+
+		// in U.S.A, distinguish long term gain/loss from short term
+		// (without -term-split, all is tallied as short term)
+		value := this.tallied(basis[i])
+		long := false
+		if this.termSplit {
+			_, years, _, _, _, _, _, _ := Elapsed(lot[i].date, txLines.Date)
+			long = years > 0
+			term[i] = "short"
+			if long {
+				term[i] = "long"
 			}
-			if isShortTerm {
-				shortBasis.Add(shortBasis, printed)
-				shortInventory.Add(shortInventory.Rat, inventory[i].Rat)
+		}
+		sold[i] = true
+		if trace[i] != "" && !containsString(tally.trace, trace[i]) {
+			tally.trace = append(tally.trace, trace[i])
+		}
+		if long {
+			tally.longBasis.Add(tally.longBasis, value)
+			tally.longInventory.Add(tally.longInventory.Rat, inventory[i].Rat)
+			tally.longHeld.add(lot[i].date)
+		} else {
+			tally.shortBasis.Add(tally.shortBasis, value)
+			tally.shortInventory.Add(tally.shortInventory.Rat, inventory[i].Rat)
+			tally.shortHeld.add(lot[i].date)
+		}
+		if consumed[inventory[i].Asset] == nil {
+			consumed[inventory[i].Asset] = new(big.Rat)
+		}
+		consumed[inventory[i].Asset].Add(consumed[inventory[i].Asset], inventory[i].Rat)
+	} // end inventory loop
+
+	proceeds, err := this.saleProceeds(splits, consumed, totalValue)
+	if err != nil {
+		return fail("failed trade", lineErrorf(line, "failed to process transaction (%q): %w", payee, err)), nil
+	}
+
+	for _, tally := range gains {
+		shortInventory, longInventory := tally.shortInventory, tally.longInventory
+
+		// value of sale is divided among qualifiers, in proportion to
+		// inventory consumed
+		totalInventory := new(big.Rat).Add(shortInventory.Rat, longInventory.Rat)
+		value := new(big.Rat).Mul(proceeds[tally.asset], new(big.Rat).Quo(totalInventory, consumed[tally.asset]))
+
+		// assume mix of short-term and long term gains
+		// short term gain = (total value * (short term inventory / total inventory)) - short term basis
+		shortTermRatio := new(big.Rat).Quo(shortInventory.Rat, totalInventory) // how much of inventory sold was short term?
+		shortTermValue := new(big.Rat).Mul(value, shortTermRatio)
+
+		shortTermGain := new(big.Rat).Add(shortTermValue, tally.shortBasis) // Add (not sub) because in double entry gains and basis have opposite signs (gains negative, basis positive)
+
+		// long term gain = (total gain) - (short term gain)
+		totalGain := new(big.Rat).Add(value, tally.shortBasis)
+		totalGain.Add(totalGain, tally.longBasis)
+		longTermGain := new(big.Rat).Sub(totalGain, shortTermGain)
+
+		// when a sale is both short and long term, show how quantity
+		// and proceeds are divided, as brokers report them
+		if shortInventory.Sign() != 0 && longInventory.Sign() != 0 {
+			longTermValue := new(big.Rat).Sub(value, shortTermValue)
+			generated = append(generated, Posting{Comment: fmt.Sprintf(":PROCEEDS:TERM: short term %s for %s, long term %s for %s",
+				shortInventory, this.NewAmount(this.base, *shortTermValue),
+				longInventory, this.NewAmount(this.base, *longTermValue),
+			)})
+		}
+
+		if this.proceeds != "" && value.Sign() != 0 {
+			// i.e. "Lot:Proceeds:ABC", for reports of gross proceeds
+			// per asset
+			proceeds := this.NewAmount(this.base, *new(big.Rat).Neg(value))
+			generated = append(generated,
+				Posting{Account: fmt.Sprintf("%s:%s", this.proceeds, shortInventory.Asset), Amount: proceeds, Comment: ":PROCEEDS:"},
+				Posting{Account: "Lot:Equity:proceeds", Amount: proceeds.NegClone(), Comment: ":PROCEEDS:"},
+			)
+		}
+
+		shortAccount, shortComment := this.shortGain.account(shortInventory.Asset), ":GAIN:SHORTTERM:"
+		longAccount, longComment := this.longGain.account(longInventory.Asset), ":GAIN:LONGTERM:"
+		if !this.termSplit {
+			shortAccount, shortComment = this.gain.account(shortInventory.Asset), ":GAIN:"
+		}
+		if tally.qualifier != "" {
+			switch this.gainQualifier {
+			case "account":
+				// i.e. "Lot:Income:short term gain:Assets:Crypto:CoinFace"
+				shortAccount = fmt.Sprintf("%s:%s", shortAccount, tally.qualifier)
+				longAccount = fmt.Sprintf("%s:%s", longAccount, tally.qualifier)
+			case "tag":
+				shortComment = fmt.Sprintf("%s qualifier: %s", shortComment, tally.qualifier)
+				longComment = fmt.Sprintf("%s qualifier: %s", longComment, tally.qualifier)
 			}
-			totalGain.Add(totalGain, printed) // lower totalGain by basis cost
-		} // end inventory loop
+		}
 
-		// if any inventory consumed, both shortInventory and longInventory will be non-nil
-		if shortInventory != nil && longInventory != nil {
+		// gains are traced to the splits consumed
+		for _, t := range tally.trace {
+			shortComment = fmt.Sprintf("%s %s", shortComment, t)
+			longComment = fmt.Sprintf("%s %s", longComment, t)
+		}
 
-			// assume mix of short-term and long term gains
-			// short term gain = (total value * (short term inventory / total inventory)) - short term basis
-			totalInventory := new(big.Rat).Add(shortInventory.Rat, longInventory.Rat)
-			shortTermRatio := new(big.Rat).Quo(shortInventory.Rat, totalInventory) // how much of inventory sold was short term?
-			shortTermValue := new(big.Rat).Mul(totalValue, shortTermRatio)
+		// finally add splits to represent gain or loss
+		// note in ledger-cli gains are negative
+		if shortTermGain.Sign() != 0 {
+			shortTermGain.Neg(shortTermGain)
+			generated = append(generated, Posting{Account: shortAccount, Amount: this.NewAmount(this.base, *shortTermGain), Comment: shortComment, Metadata: tally.shortHeld.metadata(txLines.Date)})
+		}
+		if longTermGain.Sign() != 0 {
+			longTermGain.Neg(longTermGain)
+			generated = append(generated, Posting{Account: longAccount, Amount: this.NewAmount(this.base, *longTermGain), Comment: longComment, Metadata: tally.longHeld.metadata(txLines.Date)})
+		}
+	} // end gains loop
+
+	// detail of each lot consumed by a sale, proceeds divided in
+	// proportion to inventory (see -matches-out)
+	var matches [][]string
+	if this.matchesOut != nil {
+		for i := range inventory {
+			if !sold[i] {
+				continue
+			}
+			asset := inventory[i].Asset
+			proceeds := new(big.Rat).Mul(proceeds[asset], new(big.Rat).Quo(inventory[i].Rat, consumed[asset]))
+			realized := new(big.Rat).Add(proceeds, this.tallied(basis[i]))
+			matches = append(matches, []string{
+				txLines.Date.Format("2006/01/02"), lot[i].name, lot[i].date.Format("2006/01/02"), inventory[i].String(),
+				basis[i].NegClone().String(), this.NewAmount(this.base, *proceeds).String(), this.NewAmount(this.base, *realized).String(), term[i],
+			})
+		}
+	}
+
+	// lots which funded lots created (see -lineage-out)
+	var edges []string
+	if this.lineage != nil {
+		edges = this.lineage.edges(txLines.Line[payeeIndex], lot, inventory, comment)
+	}
 
-			shortTermGain := new(big.Rat).Add(shortTermValue, shortBasis) // Add (not sub) because in double entry gains and basis have opposite signs (gains negative, basis positive)
+	// dust not lotted, and dust left in lots
+	generated = append(generated, dust...)
+	generated = append(generated, this.writeOffDust(lot)...)
 
-			// long term gain = (total gain) - (short term gain)
-			longTermGain := new(big.Rat).Sub(totalGain, shortTermGain)
+	// trace generated splits back to source data (unless already
+	// traced to the split consumed)
+	for _, key := range traceKeys {
+		if value := txLines.Metadata(key); value != "" {
+			for i := range generated {
+				if strings.Contains(generated[i].Comment, " "+key+": ") {
+					continue
+				}
+				generated[i].Comment = fmt.Sprintf("%s %s: %s", generated[i].Comment, key, value)
+			}
+		}
+	}
 
-			// finally add splits to represent gain or loss
-			// note in ledger-cli gains are negative
-			if shortTermGain.Sign() != 0 {
-				shortTermGain.Neg(shortTermGain)
-				fmt.Fprintf(writer, "    [Lot:Income:short term gain]\t\t %s \t; :GAIN:SHORTTERM: \n", NewAmount(base, *shortTermGain))
+	// with prices intact, generated splits are tagged, so that
+	// reports may exclude them
+	if this.keepPrices {
+		for i := range generated {
+			if generated[i].Account == "" || generated[i].Err != nil {
+				continue
 			}
-			if longTermGain.Sign() != 0 {
-				longTermGain.Neg(longTermGain)
-				fmt.Fprintf(writer, "    [Lot:Income:long term gain]\t\t %s \t; :GAIN:LONGTERM: \n", NewAmount(base, *longTermGain))
+			if strings.HasPrefix(generated[i].Comment, ":") {
+				generated[i].Comment = ":LOTTER" + generated[i].Comment
+			} else {
+				generated[i].Comment = ":LOTTER: " + generated[i].Comment
 			}
-		} // end if sale
+		}
+	}
 
-		// output
-		writeLines(txLines.Line)
-		writer.Flush()
-		fmt.Println("") // blank between transactions (truncated by Scan())
-	} // end txScan loop
+	this.translation.postings(generated)
+
+	// closed years (before -freeze-before) are not recalculated
+	if txLines.Date.Before(this.freeze) {
+		err = this.frozenChange(txLines, generated)
+		if err != nil {
+			return fail("frozen period changed", lineErrorf(line, "transaction (%q) dated before %s: %w", payee, this.freeze.Format("2006/01/02"), err)), nil
+		}
+	}
+
+	talliedTx := generated // before metadata replaces them
+	if this.metadata {
+		txLines.Line, generated = this.lotMetadata(txLines, payeeIndex, generated, lot, inventory)
+	}
 
+	// lots loaded are those after all transactions lotted, so a
+	// transaction inserted earlier would be lotted out of order
+	if this.lotted != nil && txLines.Date.Before(this.lotted.last) && len(generated) > 0 {
+		return fail("lotted out of order", lineErrorf(line, "transaction (%q) dated before the last of lots file (%s), lot without -append", payee, this.lotted.last.Format("2006/01/02"))), nil
+	}
+
+	// output
+	if this.summary != nil {
+		this.summary.add(txLines.Date.Year(), talliedTx)
+	}
+	if len(tradePrices) > 0 {
+		this.output.Lines(append([]string{tradePricesComment}, tradePrices...))
+	}
+	this.output.Tx(txLines, generated)
+	this.adjustNext = adjustDue
+	this.writeLotMap()
+	for _, m := range matches {
+		this.matchesOut.Write(m)
+	}
+	if this.lineage != nil {
+		this.lineage.write(edges)
+	}
+
+	return false, nil
+}
+
+// checkInventory returns an error if inventory of a lot is unchanged
+// (zero).
+func (this *lotter) checkInventory(lot []Lot, inventory []Amount) error {
+	for i := range inventory {
+		if inventory[i].Sign() == 0 {
+			return fmt.Errorf("zero inventory of lot (%q)", lot[i].name)
+		}
+	}
 	return nil
 }
 
-func getQueue(asset Asset, qualifier string) LotQueue {
+// saleProceeds divides the value of a trade (totalValue) among the
+// assets it sells.  When a trade sells more than one asset (i.e. ETH
+// for BTC, with a fee paid in BNB), each is valued at the price of its
+// splits.
+func (this *lotter) saleProceeds(splits map[Asset]map[string][]Split, consumed map[Asset]*big.Rat, totalValue *big.Rat) (map[Asset]*big.Rat, error) {
+	ret := make(map[Asset]*big.Rat)
+	if len(consumed) <= 1 {
+		for asset := range consumed {
+			ret[asset] = totalValue
+		}
+		return ret, nil
+	}
+
+	total := new(big.Rat)
+	for _, qualified := range splits {
+		for _, split := range qualified {
+			for _, s := range split {
+				if consumed[s.delta.Asset] == nil || s.delta.Sign() >= 0 || (s.price == nil && s.cost == nil) {
+					continue
+				}
+				value := new(big.Rat).Neg(this.tallied(this.toBase(*s.Cost())))
+				if ret[s.delta.Asset] == nil {
+					ret[s.delta.Asset] = new(big.Rat)
+				}
+				ret[s.delta.Asset].Add(ret[s.delta.Asset], value)
+				total.Add(total, value)
+			}
+		}
+	}
+	if total.Sign() == 0 {
+		if totalValue.Sign() != 0 {
+			return nil, fmt.Errorf("trade sells %d assets, none of value, for %s", len(consumed), this.NewAmount(this.base, *totalValue))
+		}
+		total.SetInt64(1) // all proceeds zero
+	}
+	for asset := range consumed {
+		if ret[asset] == nil {
+			ret[asset] = new(big.Rat)
+		}
+		ret[asset].Mul(totalValue, ret[asset].Quo(ret[asset], total))
+	}
+	return ret, nil
+}
+
+// getQueue returns the queue of asset and qualifier, to be changed
+// (see saveQueue).
+func (this *lotter) getQueue(asset Asset, qualifier string) (LotQueue, error) {
+	this.saveQueue(asset, qualifier)
+
 	// sanity check
-	if asset == base {
+	if this.isBase(asset) {
 		log.Printf("getQueue(%q): base currency requested!", asset)
 	}
 
-	_, ok := lotQueue[asset]
+	_, ok := this.lotQueue[asset]
 	if !ok {
-		lotQueue[asset] = make(map[string]LotQueue)
+		this.lotQueue[asset] = make(map[string]LotQueue)
 	}
-	_, ok = lotQueue[asset][qualifier]
+	_, ok = this.lotQueue[asset][qualifier]
 	if !ok {
-		lotQueue[asset][qualifier] = LotQueue{order: order(*orderFlag)}
+		this.lotQueue[asset][qualifier] = LotQueue{order: this.order}
 	}
 
 	// sanity check
-	if asset == base && lotQueue[asset][qualifier].Len() > 0 {
-		log.Panicf("getQueue(%q): base currency has lots!", asset)
+	if this.isBase(asset) && this.lotQueue[asset][qualifier].Len() > 0 {
+		return LotQueue{}, fmt.Errorf("base currency (%s) has lots", asset) // buy() prevents
 	}
 
-	return lotQueue[asset][qualifier]
+	return this.lotQueue[asset][qualifier], nil
 }
 
-func buy(lot Lot, qualifier string) {
-	queue := getQueue(lot.inventory.Asset, qualifier)
-	queue.Buy(lot)
-	lotQueue[lot.inventory.Asset][qualifier] = queue // store change made by queue.Buy()
+func (this *lotter) buy(lot Lot, qualifier string) error {
+	if this.isBase(lot.inventory.Asset) {
+		return fmt.Errorf("attempt to buy lot (%q) of base asset (%s)", lot.name, lot.inventory)
+	}
+	lot.qualifier = qualifier
+	queue, err := this.getQueue(lot.inventory.Asset, qualifier)
+	if err != nil {
+		return err
+	}
+	err = queue.Buy(lot)
+	this.lotQueue[lot.inventory.Asset][qualifier] = queue // store change made by queue.Buy()
+	return err
 }
 
-func sell(qualifier string, delta Amount) (lot []Lot, inventory []Amount, basis []Amount, err error) {
-	if delta.Asset == base {
+func (this *lotter) sell(qualifier string, delta Amount) (lot []Lot, inventory []Amount, basis []Amount, err error) {
+	if this.isBase(delta.Asset) {
 		err = fmt.Errorf("attempt to sell base asset (%s)", delta.String())
 		return
 	}
 
-	queue := getQueue(delta.Asset, qualifier)
+	queue, err := this.getQueue(delta.Asset, qualifier)
+	if err != nil {
+		return
+	}
 	if queue.Len() < 1 {
 		err = fmt.Errorf("attempt to sell (%s) from empty lot (%q[%s])", delta.String(), delta.Asset, qualifier)
 		return
 	}
+	if this.sellOrder != "" && this.sellOrder != queue.order {
+		// lot order overridden for this transaction
+		restore := queue.order
+		queue.order = this.sellOrder
+		sort.Stable(queue)
+		defer func() {
+			queue.order = restore
+			sort.Stable(queue)
+			this.lotQueue[delta.Asset][qualifier] = queue
+		}()
+	}
 	lot, inventory, basis, err = queue.Sell(delta)
 	if err != nil {
 		return
@@ -370,59 +1772,105 @@ func sell(qualifier string, delta Amount) (lot []Lot, inventory []Amount, basis
 		err = fmt.Errorf("sell lot count mismatch! (%d vs %d vs %d)", len(lot), len(inventory), len(basis)) // sanity
 		return
 	}
-	lotQueue[delta.Asset][qualifier] = queue // store changes made by queue.Sell()
+	this.lotQueue[delta.Asset][qualifier] = queue // store changes made by queue.Sell()
 	return
 }
 
-func getAssetQualifier(split Split) string {
+func (this *settings) getAssetQualifier(split Split) string {
+	return this.qualifier(split.account)
+}
 
-	qual := split.account
-	if *pruneFlag > -1 {
-		// prune account name
-		accountSeg := strings.Split(split.account, ":")
-		if len(accountSeg) > *pruneFlag {
-			// pruneFlag <= 2 treats "Assets:BTC:hot" and "Assets:BTC:cold" as
-			// the same lot queue.  pruneFlag >= 3 treats them as separate lot
-			// queues.  Pruning at 0 treats all BTC in the same lot queue.
-			qual = strings.Join(accountSeg[:*pruneFlag], ":")
-		}
-	}
+// moveSet tallies moves, per asset and qualifier.
+type moveSet struct {
+	delta map[Asset]map[string]*big.Rat
 
-	return qual
+	// qualifier of null-amount split (if any), which receives
+	// inventory remaining after explicit amounts are moved
+	remainder map[Asset]string
 }
 
-func produceMoves(splitSet map[Asset]map[string][]Split) map[Asset]map[string]*big.Rat {
-	ret := make(map[Asset]map[string]*big.Rat)
+func produceMoves(splitSet map[Asset]map[string][]Split) moveSet {
+	ret := moveSet{
+		delta:     make(map[Asset]map[string]*big.Rat),
+		remainder: make(map[Asset]string),
+	}
 
 	// tally per asset
 	for asset, qualified := range splitSet {
-		ret[asset] = make(map[string]*big.Rat)
+		ret.delta[asset] = make(map[string]*big.Rat)
 
 		for qual, splits := range qualified {
-			ret[asset][qual] = new(big.Rat)
+			ret.delta[asset][qual] = new(big.Rat)
 			for _, split := range splits {
 				if split.price != nil || split.cost != nil {
 					// splits with cost associated are not "moves"
 					continue
 				}
-				ret[asset][qual].Add(ret[asset][qual], split.delta.Rat)
+				if split.nullAmount {
+					ret.remainder[asset] = qual
+				}
+				ret.delta[asset][qual].Add(ret.delta[asset][qual], split.delta.Rat)
+			}
+		}
+	}
+	return ret
+}
+
+// checkMoves returns an error if moves of any asset would consume
+// more inventory than a qualifier holds, or add more inventory than is
+// consumed.
+func (this *lotter) checkMoves(moves moveSet, assets []Asset) error {
+	for _, asset := range assets {
+		if this.isBase(asset) {
+			continue
+		}
+		in, out := new(big.Rat), new(big.Rat)
+		for _, qual := range moves.sortedMoves(asset) {
+			delta := moves.delta[asset][qual]
+			switch delta.Sign() {
+			case 1:
+				in.Add(in, delta)
+			case -1:
+				out.Sub(out, delta)
+				held := new(big.Rat)
+				for _, l := range this.lotQueue[asset][qual].lot {
+					held.Add(held, l.inventory.Rat)
+				}
+				if held.Cmp(new(big.Rat).Neg(delta)) < 0 {
+					return fmt.Errorf("failed to move %s from %q, which holds %s", this.NewAmount(asset, *new(big.Rat).Neg(delta)), qual, this.NewAmount(asset, *held))
+				}
 			}
 		}
+		if in.Cmp(out) > 0 {
+			return fmt.Errorf("failed to move %s, as only %s is moved from inventory (unpriced trade?)", this.NewAmount(asset, *in), this.NewAmount(asset, *out))
+		}
+	}
+	return nil
+}
+
+// sortedMoves returns qualifiers in the order moves are processed,
+// with the remainder (if any) last.
+func (this moveSet) sortedMoves(asset Asset) []string {
+	var ret []string
+	for qual := range this.delta[asset] {
+		ret = append(ret, qual)
 	}
+	remainder, hasRemainder := this.remainder[asset]
+	sort.Slice(ret, func(i, j int) bool {
+		if hasRemainder && (ret[i] == remainder) != (ret[j] == remainder) {
+			return ret[j] == remainder
+		}
+		return ret[i] < ret[j]
+	})
 	return ret
 }
 
-/* non-trivial move example that consumeMoves must support:
+/* Moves must support transactions like these:
+
 2017/01/01 non-trivial move example
     Assets:Crypto:on-chain        -100.00 ABC ; consume 100 from source lot
     Assets:Crypto:exchange          79.90 ABC ; new lot has less than 100!
-    Expenses:Crypto:exchange:fee              ; ledger-cli will calculate, we won't bother
-
-note that to support transactions like this, we do not require that
-splits offset.  We require that the source data has correct, non-null,
-deltas!
-
-TODO(dnc): support following.  probably strategy is 1st pass consume non-null amounts, then second pass to consume anything that remains
+    Expenses:Crypto:exchange:fee              ; ledger-cli will calculate
 
 2017/01/05 example move sell side specified and fee
     Assets:Crypto:Exchange                        -1 XRP
@@ -430,12 +1878,16 @@ TODO(dnc): support following.  probably strategy is 1st pass consume non-null am
     Expenses:Crypto:Exchange:fee                0.01 XRP
     Assets:Crypto:RCL
 
-			// We must tolerate null amounts!  Because `ledger print`
-			// outputs null amounts even when the source data is explicit!
+We must tolerate null amounts!  Because `ledger print` outputs null
+amounts even when the source data is explicit!  The amount of a null
+split is calculated (see produceSplits()).  In the first pass, explicit
+negative amounts consume inventory.  In the second pass, explicit
+positive amounts receive inventory, then the null-amount split
+receives whatever inventory remains.
 
 */
 
-func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []Amount, basis []Amount, comment []string, err error) {
+func (this *lotter) consumeMoves(moves moveSet) (lot []Lot, inventory []Amount, basis []Amount, comment []string, err error) {
 
 	// Each move consumes inventory (like a sell) and creates
 	// offsetting inventory (like a buy).  The date of the original
@@ -444,14 +1896,31 @@ func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []A
 
 	tmpQueue := make(map[Asset]*LotQueue)
 
-	for asset, qualified := range moves {
-		if asset == base {
+	var assets []Asset
+	for asset := range moves.delta {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i] < assets[j] })
+
+	// A transaction may move several assets (i.e. a withdrawal of BTC
+	// and ETH from an exchange).  Each asset's moves are independent of
+	// the others', but all are checked before any inventory is
+	// consumed, so that a move which fails leaves lot queues unchanged.
+	err = this.checkMoves(moves, assets)
+	if err != nil {
+		return
+	}
+
+	for _, asset := range assets {
+		qualified := moves.delta[asset]
+		if this.isBase(asset) {
 			// moves of base currency have no effect on lots
 			continue
 		}
-		tmpQueue[asset] = &LotQueue{order: order(*orderFlag)}
+		tmpQueue[asset] = &LotQueue{order: this.order}
 
-		for qual, delta := range qualified {
+		for _, qual := range moves.sortedMoves(asset) {
+			delta := qualified[qual]
 			switch delta.Sign() {
 			case 0:
 				// offsetting splits net zero, noop
@@ -461,8 +1930,8 @@ func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []A
 				// handle this side of move in second pass
 			case -1:
 				// negative delta, consume inventory
-				amt := NewAmount(asset, *delta)
-				l, i, b, e := sell(qual, amt)
+				amt := this.NewAmount(asset, *delta)
+				l, i, b, e := this.sell(qual, amt)
 				if e != nil {
 					err = e
 					return
@@ -475,21 +1944,28 @@ func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []A
 					comment = append(comment, fmt.Sprintf(":MOVE: move %s from %s (%d of %d)", amt, qual, j+1, len(l)))
 
 					// remember this inventory for second pass
-					tmpLot := NewLot("tmp", l[j].date, i[j], b[j].NegClone())
-					tmpQueue[asset].Buy(*tmpLot)
+					tmpLot, e := this.newLot(l[j].name, l[j].date, i[j], b[j].NegClone())
+					if e == nil {
+						e = tmpQueue[asset].Buy(*tmpLot)
+					}
+					if e != nil {
+						err = e
+						return
+					}
 				}
 			}
 
 		} // end first pass
 
-		for qual, delta := range qualified {
+		for _, qual := range moves.sortedMoves(asset) {
+			delta := qualified[qual]
 			switch delta.Sign() {
 			case 0:
 				// offsetting splits net zero, noop
 				continue
 			case 1:
 				// positive delta, new inventory
-				amt := NewAmount(asset, *delta).NegClone()
+				amt := this.NewAmount(asset, *delta).NegClone()
 				l, i, b, e := tmpQueue[asset].Sell(amt)
 				if e != nil {
 					err = e
@@ -499,13 +1975,19 @@ func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []A
 					// the new lot should have same date as old lot, a
 					// different quality, and inventory equaling the portion
 					// sold.
-					shortName := lotShortName(i[j], NewAmount(b[j].Asset, *l[j].price))
-					name := fmt.Sprintf("Lot:%s:%s:%s", qual, l[j].date.Format("2006/01/02"), shortName)
-					newLot := NewLot(name, l[j].date, i[j], b[j].NegClone())
-					newLot.weight = l[j].weight // same date and weight as consumed inventory
+					newLot, e := this.newLot(this.moveLotName(qual, l[j], i[j], b[j]), l[j].date, i[j], b[j].NegClone())
+					if e != nil {
+						err = e
+						return
+					}
+					newLot.weight, newLot.seq = l[j].weight, l[j].seq // same date and weight as consumed inventory
+					newLot.from = l[j].name
 
 					// new inventory
-					buy(*newLot, qual)
+					err = this.buy(*newLot, qual)
+					if err != nil {
+						return
+					}
 
 					// prepare for output
 					lot = append(lot, *newLot)
@@ -523,17 +2005,40 @@ func consumeMoves(moves map[Asset]map[string]*big.Rat) (lot []Lot, inventory []A
 	return
 }
 
+// moveLotName names a lot created by a move to qualifier.  By
+// default, the name refers to the destination qualifier.  With
+// `-move-name=source`, the lot keeps the name of the inventory
+// consumed, so that shuffling between wallets does not rename lots.
+// Otherwise, `-move-name` maps destination qualifiers to the
+// qualifier named.  With `-lot-names`, the name is an opaque ID (see
+// lotID()).
+func (this *lotter) moveLotName(qual string, consumed Lot, inventory, basis Amount) string {
+	if this.moveName == "source" {
+		return consumed.name
+	}
+	if mapped, ok := this.moveNameMap[qual]; ok {
+		qual = mapped
+	}
+	shortName := lotShortName(inventory, this.NewAmount(basis.Asset, *consumed.price))
+	name := fmt.Sprintf("Lot:%s:%s:%s", qual, consumed.date.Format("2006/01/02"), shortName)
+	return this.lotID(qual, this.uniqueLotName(name), consumed.date, inventory, basis.NegClone())
+}
+
 // this function inspects the splits, organizes by asset and
 // qualifier.  Returns true if trades are present (splits with
 // cost/price), and another true if splits balance (no null-amount).
-func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTrade bool, balanced bool, err error) {
+func (this *settings) produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTrade bool, balanced bool, err error) {
 	ret = make(map[Asset]map[string][]Split)
 	tally := make(map[Asset]*big.Rat)
 
-	var noDelta *Split // some transactions have a single split without delta
+	var noDelta []Split // splits without delta, to be calculated
 
 	for _, line := range splitLines {
-		split, ok := parseSplit(line)
+		split, ok, e := this.parseSplitError(line)
+		if e != nil {
+			err = e
+			return
+		}
 		if !ok {
 			if !strings.HasPrefix(strings.TrimLeft(line, " \t"), ";") { // check comment
 				err = fmt.Errorf("failed to parse transaction split: %q", line)
@@ -542,9 +2047,29 @@ func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTra
 			continue // comment is noop
 		}
 
+		if split.isLoan() {
+			// borrowed or repaid assets are not lot inventory
+			command.V(1).Infof("ignoring loan split (%q)", line)
+			continue
+		}
+
+		switch split.optionEvent() {
+		case "ASSIGN":
+			// written options are not lots, so the contract closed by
+			// assignment consumes none
+			command.V(1).Infof("ignoring assigned option split (%q)", line)
+			continue
+		case "EXPIRE", "EXERCISE":
+			if split.delta != nil && split.delta.Sign() < 0 && split.price == nil && split.cost == nil {
+				// option contract disposed of without proceeds
+				zero := this.NewAmount(this.base, *new(big.Rat))
+				split.price = &zero
+			}
+		}
+
 		if split.delta == nil {
 			// process null-amount split after all the others
-			noDelta = &split
+			noDelta = append(noDelta, split)
 			continue
 		}
 
@@ -552,7 +2077,7 @@ func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTra
 			isTrade = true
 		}
 
-		qualifier := getAssetQualifier(split)
+		qualifier := this.getAssetQualifier(split)
 
 		// tally amounts
 		t, ok := tally[split.Tally().Asset]
@@ -575,20 +2100,50 @@ func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTra
 		ret[split.Tally().Asset][qualifier] = append(ret[split.Tally().Asset][qualifier], split)
 	}
 
-	// If there is a null-amount split, use tally to determine its implied amount.
-	if noDelta != nil {
-		for asset, t := range tally {
-			if t.Sign() != 0 {
-				amt := NewAmount(asset, *(new(big.Rat).Neg(t)))
-				noDelta.delta = &amt
-				command.V(2).Infof("calculated amount (%s) for split (%q)", noDelta.delta, noDelta.line)
-				ret[asset][getAssetQualifier(*noDelta)] = append(ret[asset][getAssetQualifier(*noDelta)], *noDelta)
-				break // there can be only one TODO(dnc) sanity check that there only one non-zero tally
+	// If there are null-amount splits, use tally to determine their
+	// implied amounts.
+	if len(noDelta) > 0 {
+		var resolved []Split
+		resolved, err = this.resolveNullSplits(noDelta, tally)
+		if err != nil {
+			return
+		}
+		for _, split := range resolved {
+			command.V(2).Infof("calculated amount (%s) for split (%q)", split.delta, split.line)
+			asset := split.delta.Asset
+			if _, ok := ret[asset]; !ok {
+				ret[asset] = make(map[string][]Split)
+			}
+			ret[asset][this.getAssetQualifier(split)] = append(ret[asset][this.getAssetQualifier(split)], split)
+		}
+	}
+
+	// Price may be written on the base currency side (i.e. "-30000 USD
+	// @ 0.0000333 BTC"), in which case it is removed, and the price of
+	// the other asset inferred.
+	reversed := this.reversePrice(ret)
+	if reversed {
+		isTrade = false
+		for _, qualified := range ret {
+			for _, splits := range qualified {
+				for _, s := range splits {
+					isTrade = isTrade || s.price != nil || s.cost != nil
+				}
 			}
 		}
 	}
 
-	balanced = (noDelta == nil)
+	// A trade may omit price, when the only other asset is base
+	// currency (i.e. "1 BTC" bought for "-30000 USD").
+	if !isTrade {
+		isTrade = this.inferPrice(ret)
+		if reversed && !isTrade {
+			err = errors.New("price of base currency, expected one asset traded for base currency (or price in base currency, i.e. \"1 BTC @ 30000 USD\")")
+			return
+		}
+	}
+
+	balanced = (len(noDelta) == 0)
 
 	/* old way XXX
 
@@ -596,7 +2151,7 @@ func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTra
 	// transaction has trades (as opposed to moves).  Note that
 	// split.asset will be "" here.
 	if len(ret) > 0 && noDelta != nil {
-		qualifier := getAssetQualifier(*noDelta)
+		qualifier := this.getAssetQualifier(*noDelta)
 		ret[AssetUnknown] = make(map[string][]Split)
 		ret[AssetUnknown][qualifier] = make([]Split, 1)
 		ret[AssetUnknown][qualifier][0] = *noDelta
@@ -606,134 +2161,523 @@ func produceSplits(splitLines []string) (ret map[Asset]map[string][]Split, isTra
 	return
 }
 
-func consumeTrades(trades map[Asset]map[string][]Split, date time.Time) (lot []Lot, inventory []Amount, basis []Amount, comment []string, err error) {
+// reversePrice removes price or cost, in another asset, of base
+// currency splits (i.e. "-30000 USD @ 0.0000333 BTC").  Returns true
+// if any was removed.
+func (this *settings) reversePrice(splits map[Asset]map[string][]Split) bool {
+	reversed := false
+	for asset, qualified := range splits {
+		if this.isBase(asset) {
+			continue
+		}
+		for qual, ss := range qualified {
+			var keep []Split
+			for _, s := range ss {
+				if s.delta == nil || !this.isBase(s.delta.Asset) {
+					keep = append(keep, s)
+					continue
+				}
+				command.V(1).Infof("price (%q) of base currency reversed", s.line)
+				s.price, s.cost, s.rebate = nil, nil, false
+				if splits[s.delta.Asset] == nil {
+					splits[s.delta.Asset] = make(map[string][]Split)
+				}
+				q := this.getAssetQualifier(s)
+				splits[s.delta.Asset][q] = append(splits[s.delta.Asset][q], s)
+				reversed = true
+			}
+			if len(keep) == 0 {
+				delete(qualified, qual)
+			} else {
+				qualified[qual] = keep
+			}
+		}
+		if len(qualified) == 0 {
+			delete(splits, asset)
+		}
+	}
+	return reversed
+}
 
-	for _, qualified := range trades {
-		for qual, splits := range qualified {
-			for _, split := range splits {
+// inferPrice sets the price of splits of a transaction without prices,
+// when it has one asset other than base currency, all bought or all
+// sold.  The price is that of the base currency which balances it.
+// Returns true if price was inferred.
+func (this *settings) inferPrice(splits map[Asset]map[string][]Split) bool {
+	if len(splits) != 2 {
+		return false
+	}
+	var asset Asset
+	total := new(big.Rat)     // of asset
+	baseTotal := new(big.Rat) // of base currency
+	for a, qualified := range splits {
+		for _, ss := range qualified {
+			for _, s := range ss {
+				if this.isBase(a) {
+					baseTotal.Add(baseTotal, s.delta.Rat)
+				} else {
+					total.Add(total, s.delta.Rat)
+				}
+			}
+		}
+		if !this.isBase(a) {
+			asset = a
+		}
+	}
+	if asset == "" || total.Sign() == 0 || baseTotal.Sign() != -total.Sign() {
+		return false
+	}
+	for _, ss := range splits[asset] {
+		for _, s := range ss {
+			if s.delta.Sign() != total.Sign() {
+				return false // some moved, some traded
+			}
+		}
+	}
 
-				if split.delta == nil {
-					// should not longer be reached
-					log.Panic("unexpected null amount in consumeTrades()")
+	price := new(big.Rat).Quo(baseTotal, total)
+	price.Abs(price)
+	for _, ss := range splits[asset] {
+		for i := range ss {
+			p := this.NewAmount(this.base, *price)
+			ss[i].price = &p
+			command.V(1).Infof("inferred price %s of split (%q), from %s", p, ss[i].line, this.NewAmount(this.base, *baseTotal))
+		}
+	}
+	return true
+}
 
-					// without an amount, ledger-cli will compute it
-					// TODO(dnc): error here if other split cost is not in base asset
-					continue
+// resolveNullSplits calculates the amount of each null-amount split,
+// from the tally of unbalanced assets.  A single null-amount split
+// balances every asset (as ledger-cli does, producing one split per
+// asset).  When there are several, each asset is balanced by the split
+// whose account names the asset (i.e. "Assets:Crypto:BTC"), or by the
+// only split which remains.  Ambiguity is an error, rather than a
+// guess.
+func (this *settings) resolveNullSplits(noDelta []Split, tally map[Asset]*big.Rat) ([]Split, error) {
+	var unbalanced []Asset
+	for asset, t := range tally {
+		if t.Sign() != 0 {
+			unbalanced = append(unbalanced, asset)
+		}
+	}
+	sort.Slice(unbalanced, func(i, j int) bool { return unbalanced[i] < unbalanced[j] })
+
+	balance := func(split Split, asset Asset) Split {
+		amt := this.NewAmount(asset, *new(big.Rat).Neg(tally[asset]))
+		split.delta = &amt
+		return split
+	}
+
+	var ret []Split
+	if len(noDelta) == 1 {
+		for _, asset := range unbalanced {
+			ret = append(ret, balance(noDelta[0], asset))
+		}
+		return ret, nil
+	}
+
+	used := make(map[int]bool)
+	var remaining []Asset
+	for _, asset := range unbalanced {
+		match := -1
+		for i, split := range noDelta {
+			if !used[i] && containsString(strings.Split(split.account, ":"), string(asset)) {
+				match = i
+				break
+			}
+		}
+		if match == -1 {
+			remaining = append(remaining, asset)
+			continue
+		}
+		used[match] = true
+		ret = append(ret, balance(noDelta[match], asset))
+	}
+	if len(remaining) > 0 {
+		if len(remaining) > 1 || len(noDelta)-len(used) != 1 {
+			return nil, fmt.Errorf("cannot determine which null-amount split balances %q (%d null-amount splits)", remaining, len(noDelta))
+		}
+		for i, split := range noDelta {
+			if !used[i] {
+				ret = append(ret, balance(split, remaining[0]))
+			}
+		}
+	}
+	return ret, nil
+}
+
+func sortedAssets(splits map[Asset]map[string][]Split) []Asset {
+	var ret []Asset
+	for asset := range splits {
+		ret = append(ret, asset)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+func sortedQualifiers(qualified map[string][]Split) []string {
+	var ret []string
+	for qual := range qualified {
+		ret = append(ret, qual)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// qualifiers returns the distinct qualifiers of splits, in sorted order.
+func qualifiers(splits map[Asset]map[string][]Split) []string {
+	var ret []string
+	for _, qualified := range splits {
+		for qual := range qualified {
+			if !containsString(ret, qual) {
+				ret = append(ret, qual)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// unpricedLegs separates, from a trade, assets which are neither
+// priced nor the price of another split.  In a trade of more than two
+// assets, such an asset (i.e. a fee paid in a third asset) is moved
+// rather than bought or sold.
+func (this *settings) unpricedLegs(trades map[Asset]map[string][]Split) map[Asset]map[string][]Split {
+	priced := make(map[Asset]bool)
+	for asset, qualified := range trades {
+		for _, splits := range qualified {
+			for _, split := range splits {
+				if split.price != nil || split.cost != nil {
+					priced[asset] = true
+					priced[split.Cost().Asset] = true
 				}
+			}
+		}
+	}
+	ret := make(map[Asset]map[string][]Split)
+	for asset, qualified := range trades {
+		if !priced[asset] && !this.isBase(asset) {
+			ret[asset] = qualified
+		}
+	}
+	return ret
+}
 
-				if split.delta.Asset == base {
-					// sending base currency has no effect on lots
-					// but we don't want to see prices in non-base currencies here.
-					if split.price != nil || split.cost != nil {
-						err = fmt.Errorf("Trade has price in non-base currency: %q", split.line)
-					}
+// deferredPart is a lot bought by a trade, when one trade buys many
+// (see -defer-date=split).
+type deferredPart struct {
+	date  time.Time
+	delta Amount
+	basis Amount
+	name  string // if empty, named for delta and basis
+}
+
+// Besides the changes of consumeMoves, returns the trace of each (the
+// txid or ref metadata of the split consumed, see Split.trace).
+func (this *lotter) consumeTrades(trades map[Asset]map[string][]Split, date time.Time) (lot []Lot, inventory []Amount, basis []Amount, comment []string, trace []string, err error) {
+	// Assets without price, in a trade involving other assets, are
+	// moved (from one qualifier to another) rather than traded.
+	legs := this.unpricedLegs(trades)
+	if len(legs) > 0 {
+		lot, inventory, basis, comment, err = this.consumeMoves(produceMoves(legs))
+		if err != nil {
+			err = fmt.Errorf("failed to move unpriced asset of trade: %w", err)
+			return
+		}
+		trace = make([]string, len(lot)) // moves are not traced to a split
+	}
+
+	// Options exercised are consumed first.  Their basis (premium
+	// paid) rolls into the lot of the underlying asset bought, if any.
+	// Otherwise it reduces proceeds of the underlying asset sold.
+	premium := new(big.Rat)
+	for _, asset := range sortedAssets(trades) {
+		for _, qual := range sortedQualifiers(trades[asset]) {
+			for _, split := range trades[asset][qual] {
+				if split.optionEvent() != "EXERCISE" || split.delta.Sign() >= 0 {
 					continue
 				}
+				l, i, b, e := this.sell(qual, *split.delta)
+				if e != nil {
+					err = fmt.Errorf("failed to consume option exercised (%q): %w", split.line, e)
+					return
+				}
+				for j := range l {
+					lot = append(lot, l[j])
+					inventory = append(inventory, i[j].Clone())
+					basis = append(basis, b[j].Clone())
+					comment = append(comment, ":SELL:EXERCISE:")
+					trace = append(trace, split.trace())
+					premium.Sub(premium, this.tallied(b[j]))
+				}
+			}
+		}
+	}
 
-				if split.delta.Sign() == -1 { // negative delta
-
-					// the sell side of a transaction can omit price, because
-					// the buy side should have it.  Unless selling for base currency.
-					if split.price == nil && split.cost == nil {
-						continue
-					} else if split.Cost().Asset != base {
-						err = fmt.Errorf("sell-side priced in non-base currency: %q", split.line)
+	// Sells are consumed before buys, so that a transaction which both
+	// sells and buys an asset (i.e. rebalancing) consumes only
+	// inventory held before the transaction.  Within each pass, splits
+	// are consumed in order of the asset they tally in (i.e. base
+	// currency, of priced splits), qualifier, then file order.
+	for _, selling := range []bool{true, false} {
+		for _, asset := range sortedAssets(trades) {
+			for _, qual := range sortedQualifiers(trades[asset]) {
+				for _, split := range trades[asset][qual] {
+
+					if split.optionEvent() == "EXERCISE" && split.delta != nil && split.delta.Sign() < 0 {
+						continue // consumed above
 					}
 
-					// this split is the sell side of transaction, consume inventory
-					l, i, b, e := sell(qual, *split.delta)
-					if e != nil {
-						err = fmt.Errorf("failed to consume sell side of trade (%q): %w", split.line, e)
+					if split.delta == nil {
+						// should no longer be reached, produceSplits calculates null amounts
+						err = fmt.Errorf("unexpected null amount (%q)", split.line)
 						return
 					}
 
-					for j, _ := range l {
-						lot = append(lot, l[j])
-						inventory = append(inventory, i[j].Clone())
-						basis = append(basis, b[j].Clone())
-						comment = append(comment, ":SELL:")
+					if (split.delta.Sign() == -1) != selling {
+						continue // consumed in other pass
 					}
 
-					// end if split.delta.Negative
-				} else {
-					// buy side of transaction, create a new lot
-
-					// TODO(dnc): allow a filter for only "Assets:..." accounts
+					if _, ok := legs[asset]; ok {
+						continue // moved above
+					}
 
-					// new lots require a cost basis
-					if split.price == nil && split.cost == nil {
-						err = fmt.Errorf("apparent trade has no price/cost: %q", split.line)
-						return
+					if this.trackEquivalent && this.baseEquivalent[split.delta.Asset] && split.price == nil && split.cost == nil {
+						// when tracking base equivalents, they are bought
+						// and sold at the same value as base currency
+						one := this.NewAmount(this.base, *big.NewRat(1, 1))
+						split.price = &one
 					}
 
-					command.V(1).Infof("creating lot of %s with cost basis %s", split.delta.String(), split.Price().String())
+					if this.isBase(split.delta.Asset) {
+						// sending base currency has no effect on lots
+						// but we don't want to see prices in non-base currencies here.
+						if (split.price != nil || split.cost != nil) && this.toBase(*split.Cost()).Asset != this.base {
+							err = fmt.Errorf("Trade has price in non-base currency: %q", split.line)
+						}
+						continue
+					}
 
-					// lot name convention; TODO(dnc): ledger allows single space in account name
-					lotName := lotShortName(*split.delta, *split.Price())
-					lotDate := date
-					lotBasis := *split.Cost()
-					lotComment := ":BUY:"
+					if split.delta.Sign() == -1 { // negative delta
 
-					if lotBasis.Asset != base {
-						// deferred gain
-						// me must consume existing inventory, to buy the new lot.
-						// basis is the total basis of inventory consumed.
+						// the sell side of a transaction can omit price, because
+						// the buy side should have it.  Unless selling for base currency.
+						if split.price == nil && split.cost == nil {
+							continue
+						} else if this.toBase(*split.Cost()).Asset != this.base {
+							err = fmt.Errorf("sell-side priced in non-base currency: %q", split.line)
+						}
 
-						l, i, b, e := sell(qual, split.Cost().NegClone())
+						// this split is the sell side of transaction, consume inventory
+						l, i, b, e := this.sell(qual, *split.delta)
 						if e != nil {
-							err = e
+							err = fmt.Errorf("failed to consume sell side of trade (%q): %w", split.line, e)
 							return
 						}
 
-						// sanity
-						if len(l) != len(i) || len(l) != len(b) {
-							log.Panic("deferred sell sanity check failed")
+						sellComment := ":SELL:"
+						if split.optionEvent() == "EXPIRE" {
+							sellComment = ":SELL:EXPIRE:"
 						}
-
-						lotBasis = b[0].ZeroClone() // prepare to tally basis
-
 						for j, _ := range l {
-							// prepare for output
 							lot = append(lot, l[j])
 							inventory = append(inventory, i[j].Clone())
 							basis = append(basis, b[j].Clone())
-							comment = append(comment, ":SELL:DEFER:")
+							comment = append(comment, sellComment)
+							trace = append(trace, split.trace())
+						}
+
+						// end if split.delta.Negative
+					} else {
+						// buy side of transaction, create a new lot
 
-							// To avoid rounding errors, tally basis as rendeded to strings.
-							roundedBasis, ok := new(big.Rat).SetString(b[j].FloatString())
-							if !ok {
-								log.Panicf("bad amount: %s", b[j])
+						// TODO(dnc): allow a filter for only "Assets:..." accounts
+
+						// new lots require a cost basis
+						if split.price == nil && split.cost == nil {
+							err = fmt.Errorf("apparent trade has no price/cost: %q", split.line)
+							return
+						}
+
+						command.V(1).Infof("creating lot of %s with cost basis %s", split.delta.String(), split.Price().String())
+
+						// lot name convention; TODO(dnc): ledger allows single space in account name
+						lotName := lotShortName(*split.delta, *split.Price())
+						lotDate := date
+						lotBasis := this.toBase(*split.Cost())
+						lotComment := ":BUY:"
+						var part []deferredPart // of lot bought, see -defer-date=split
+
+						if split.rebate {
+							// Paid to acquire (i.e. exchange rebate).  The lot has
+							// zero basis, and the rebate is income.
+							if lotBasis.Asset != this.base {
+								err = fmt.Errorf("rebate priced in non-base currency: %q", split.line)
+								return
+							}
+							lotBasis = lotBasis.ZeroClone()
+							lotComment = ":BUY:REBATE:"
+						} else if lotBasis.Asset != this.base {
+							// deferred gain
+							// me must consume existing inventory, to buy the new lot.
+							// basis is the total basis of inventory consumed.
+
+							l, i, b, e := this.sell(qual, split.Cost().NegClone())
+							if e != nil {
+								err = e
+								return
+							}
+
+							// sanity
+							if len(l) != len(i) || len(l) != len(b) || len(l) == 0 {
+								err = fmt.Errorf("deferred sale (%q) consumed no inventory", split.line)
+								return
+							}
+
+							lotBasis = b[0].ZeroClone() // prepare to tally basis
+							consumed := new(big.Rat)    // inventory consumed, of all lots
+
+							for j, _ := range l {
+								// prepare for output
+								lot = append(lot, l[j])
+								inventory = append(inventory, i[j].Clone())
+								basis = append(basis, b[j].Clone())
+								comment = append(comment, ":SELL:DEFER:")
+								trace = append(trace, split.trace())
+
+								// With -round-tally, tally basis as rendered.
+								tallyBasis := this.tallied(b[j])
+
+								lotBasis.Sub(lotBasis.Rat, tallyBasis) // tally basis (subtract a negative)
+								consumed.Add(consumed, i[j].Rat)
+
+								// for purposes of long-term vs short term, the
+								// date of consumed inventory (see -defer-date)
+								switch this.deferDate {
+								case "original":
+									lotDate = l[j].date // of the lot consumed last
+								case "earliest":
+									if j == 0 || l[j].date.Before(lotDate) {
+										lotDate = l[j].date
+									}
+								case "latest":
+									if j == 0 || l[j].date.After(lotDate) {
+										lotDate = l[j].date
+									}
+								}
 							}
 
-							lotBasis.Sub(lotBasis.Rat, roundedBasis) // tally basis (subtract a negative)
+							// With -defer-date=split, one lot is bought per lot
+							// consumed, each with its date and basis, and
+							// inventory in proportion to that consumed.
+							if this.deferDate == "split" && len(l) > 1 {
+								remain := split.delta.Clone()
+								for j := range l {
+									delta := split.delta.ZeroClone()
+									if j == len(l)-1 {
+										delta = remain
+									} else {
+										delta.Mul(split.delta.Rat, new(big.Rat).Quo(i[j].Rat, consumed))
+										remain.Sub(remain.Rat, delta.Rat)
+									}
+									partBasis := this.NewAmount(b[j].Asset, *new(big.Rat).Neg(this.tallied(b[j])))
+									part = append(part, deferredPart{date: l[j].date, delta: delta, basis: partBasis})
+								}
+							}
 
-							// for purposes of long-term vs short term, use the
-							// latest date of the consumed inventory.
-							lotDate = l[j].date
-							// TODO(dnc): should deferred gains show date of this transaction, or date of earlier consumed lot?
+							// lot name indicates deferred basis
+							lotName = fmt.Sprintf("%s@%s", lotName, strings.ReplaceAll(lotBasis.String(), " ", ""))
+							lotComment = ":BUY:DEFER:"
+						} // end deferred
+
+						if premium.Sign() != 0 && lotComment == ":BUY:" {
+							// underlying asset of option exercised
+							lotBasis.Add(lotBasis.Rat, premium)
+							premium.SetInt64(0)
+							lotName = fmt.Sprintf("%s@%s", lotName, strings.ReplaceAll(lotBasis.String(), " ", ""))
+							lotComment = ":BUY:EXERCISE:"
 						}
 
-						// lot name indicates deferred basis
-						lotName = fmt.Sprintf("%s@%s", lotName, strings.ReplaceAll(lotBasis.String(), " ", ""))
-						lotComment = ":BUY:DEFER:"
-					} // end deferred
+						// new lot(s) from trade
+						if len(part) == 0 {
+							part = []deferredPart{{date: lotDate, delta: *split.delta, basis: lotBasis, name: lotName}}
+						}
+						for _, p := range part {
+							if p.name == "" {
+								p.name = fmt.Sprintf("%s@%s", lotShortName(p.delta, *split.Price()), strings.ReplaceAll(p.basis.String(), " ", ""))
+							}
 
-					// new lot from trade
+							// lot account naming convention
+							name := fmt.Sprintf("Lot:%s:%s:%s", qual, p.date.Format("2006/01/02"), p.name)
+							name = this.lotID(qual, this.uniqueLotName(name), p.date, p.delta, p.basis)
+							l, e := this.newLot(name, p.date, p.delta, p.basis)
+							if e == nil {
+								e = this.buy(*l, qual)
+							}
+							if e != nil {
+								err = e
+								return
+							}
 
-					// lot account naming convention
-					name := fmt.Sprintf("Lot:%s:%s:%s", qual, lotDate.Format("2006/01/02"), lotName)
-					l := NewLot(name, lotDate, *split.delta, lotBasis)
-					buy(*l, qual)
+							lot = append(lot, *l)
+							inventory = append(inventory, p.delta.NegClone())
+							basis = append(basis, p.basis.Clone())
+							comment = append(comment, lotComment)
+							trace = append(trace, split.trace())
+						}
+					}
+				} // end splits loop
+			} // end qualifier loop
+		} // end trades loop
+	} // end pass loop
+	return
+}
 
-					lot = append(lot, *l)
-					inventory = append(inventory, split.Inventory().Clone())
-					basis = append(basis, lotBasis.Clone())
-					comment = append(comment, lotComment)
+// incomeSplits finds splits tagged as income.  Each is given a price
+// (fair market value) if it has none.  Returns the total value of
+// income, in base currency.
+func (this *lotter) incomeSplits(splits map[Asset]map[string][]Split, date time.Time, prices PriceHistory) (*big.Rat, error) {
+	total := new(big.Rat)
+	for _, qualified := range splits {
+		for qual := range qualified {
+			for i := range qualified[qual] {
+				s := &qualified[qual][i]
+				if !strings.Contains(s.comment, ":INCOME:") || s.delta == nil || s.delta.Sign() < 1 || this.isBase(s.delta.Asset) {
+					continue
 				}
-			} // end splits loop
-		} // end qualifier loop
-	} // end trades loop
-	return
+				if s.price == nil && s.cost == nil {
+					fmv, ok := prices.Lookup(date, s.delta.Asset)
+					if !ok {
+						return nil, fmt.Errorf("missing price of %s on %s", s.delta.Asset, date.Format("2006/01/02"))
+					}
+					price := this.NewAmount(this.base, *fmv)
+					s.price = &price
+				}
+				total.Add(total, new(big.Rat).Abs(this.tallied(this.toBase(*s.Cost()))))
+			}
+		}
+	}
+	return total, nil
+}
+
+// tallied returns the value of an amount, for purposes of tallying
+// basis and gains.  Exact, unless -round-tally, in which case the
+// value is rounded as it will be rendered.
+func (this *lotter) tallied(amount Amount) *big.Rat {
+	if this.roundTally {
+		return amount.Round()
+	}
+	return amount.Rat
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
 }
 
 func check(err error) {
@@ -742,11 +2686,153 @@ func check(err error) {
 	}
 }
 
+// lotDetail describes a lot consumed by a sale on date, i.e. "0.02
+// USD/ABC acquired 2016/01/01 held 380d".
+func (this *settings) lotDetail(l Lot, date time.Time) string {
+	return fmt.Sprintf("%s/%s acquired %s held %dd", this.NewAmount(l.startCost.Asset, *l.price).Brief(), l.inventory.Asset, l.date.Format("2006/01/02"), heldDays(l.date, date))
+}
+
+// heldDays is the holding period, in days, of an asset acquired and
+// sold on the dates given.
+func heldDays(acquired, sold time.Time) int {
+	return int(sold.Sub(acquired).Hours() / 24)
+}
+
+// holdingPeriod is the range of dates on which lots sold were
+// acquired.
+type holdingPeriod struct {
+	first, last time.Time
+}
+
+func (this *holdingPeriod) add(acquired time.Time) {
+	if this.first.IsZero() || acquired.Before(this.first) {
+		this.first = acquired
+	}
+	if acquired.After(this.last) {
+		this.last = acquired
+	}
+}
+
+// metadata of a gain split, i.e. "acquired: 2016/01/01", "sold:
+// 2017/01/01" and "held: 366" (days).  When lots were acquired on
+// different dates, acquired is "various" and held is a range (i.e.
+// "200-366").
+func (this holdingPeriod) metadata(sold time.Time) []string {
+	acquired := this.first.Format("2006/01/02")
+	held := fmt.Sprint(heldDays(this.first, sold))
+	if !this.first.Equal(this.last) {
+		acquired = "various"
+		held = fmt.Sprintf("%d-%d", heldDays(this.last, sold), heldDays(this.first, sold))
+	}
+	return []string{
+		"acquired: " + acquired,
+		"sold: " + sold.Format("2006/01/02"),
+		"held: " + held,
+	}
+}
+
 // i.e. "100BTC@123.45USD"
 func lotShortName(inventory Amount, price Amount) string {
 	return fmt.Sprintf("%s@%s",
-		strings.ReplaceAll(inventory.String(), " ", ""),
-		strings.ReplaceAll(price.String(), " ", ""),
+		strings.ReplaceAll(inventory.Brief(), " ", ""),
+		strings.ReplaceAll(price.Brief(), " ", ""),
 	)
 }
 
+// lotMetadata converts generated postings to metadata (i.e. "; lot:
+// ...") of the original splits.  Metadata of a lot follows the split
+// of the same asset and qualifier; other metadata (i.e. gains) follows
+// the last split.  Returns the lines of the transaction, and postings
+// which remain (errors).
+func (this *settings) lotMetadata(txLines TxLines, payeeIndex int, generated []Posting, lot []Lot, inventory []Amount) ([]string, []Posting) {
+	// index of original split, of each lot
+	split := make(map[string]int)
+	for i := range lot {
+		for j, line := range txLines.Line[payeeIndex+1:] {
+			s, ok := this.parseSplit(line)
+			if !ok || s.delta == nil || s.delta.Asset != inventory[i].Asset || this.getAssetQualifier(s) != lot[i].qualifier {
+				continue
+			}
+			// prefer the split acquiring (or disposing of) the lot
+			if _, found := split[lot[i].name]; !found || s.delta.Sign() != inventory[i].Sign() {
+				split[lot[i].name] = payeeIndex + 1 + j
+			}
+		}
+	}
+
+	// index of last split
+	last := len(txLines.Line) - 1
+	for last > payeeIndex && !isSplitLine(txLines.Line[last]) {
+		last--
+	}
+
+	metadata := make(map[int][]string)
+	var remain []Posting
+	for _, p := range generated {
+		if p.Err != nil {
+			remain = append(remain, p)
+			continue
+		}
+		if p.Disabled {
+			continue
+		}
+		var line string
+		if p.Account == "" {
+			line = fmt.Sprintf("    ; %s", p.Comment)
+		} else {
+			line = fmt.Sprintf("    ; lot: %s  %s", p.Account, p.Amount)
+			if p.Comment != "" {
+				line = fmt.Sprintf("%s  %s", line, p.Comment)
+			}
+		}
+		i, ok := split[p.Account]
+		if !ok {
+			i = last
+		}
+		metadata[i] = append(metadata[i], line)
+		for _, m := range p.Metadata {
+			metadata[i] = append(metadata[i], fmt.Sprintf("    ; %s", m))
+		}
+	}
+
+	var ret []string
+	for i, line := range txLines.Line {
+		ret = append(ret, line)
+		ret = append(ret, metadata[i]...)
+	}
+	return ret, remain
+}
+
+// isSplitLine returns true if line is a split (not a comment).
+func isSplitLine(line string) bool {
+	_, ok := splitStructure(line)
+	return ok
+}
+
+// gainAccount is the template of an account of gains (see lot
+// -short-gain and -long-gain), i.e. "Income:CapGains:{{.Asset}}:Long".
+type gainAccount struct{ *template.Template }
+
+func parseGainAccount(name, text string) (gainAccount, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return gainAccount{}, fmt.Errorf("bad -%s (%q): %w", name, text, err)
+	}
+	this := gainAccount{t}
+	var b strings.Builder
+	if err := this.Execute(&b, gainAccountData{Asset: "ABC"}); err != nil {
+		return gainAccount{}, fmt.Errorf("bad -%s (%q): %w", name, text, err)
+	}
+	return this, checkAccountFlag(name, b.String())
+}
+
+type gainAccountData struct {
+	Asset Asset
+}
+
+// account returns the name of the account of gains of asset.
+func (this gainAccount) account(asset Asset) string {
+	var b strings.Builder
+	this.Execute(&b, gainAccountData{Asset: asset}) // checked by parseGainAccount
+	return b.String()
+}
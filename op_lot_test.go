@@ -0,0 +1,296 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMoveLotNames moves two lots, bought the same day at the same
+// price, to one account, in one transaction or on two days.  Each
+// moved lot must have its own name, and its own ID (see -lot-names).
+func TestMoveLotNames(t *testing.T) {
+	const buys = `2021/01/01 Buy
+    Assets:Hot          1 BTC @ 100 USD
+    Assets:Cash
+
+2021/01/01 Buy again
+    Assets:Hot          1 BTC @ 100 USD
+    Assets:Cash
+`
+	journals := map[string]string{
+		"one transaction": buys + `
+2021/02/01 Move
+    Assets:Hot          -2 BTC
+    Assets:Cold          2 BTC
+`,
+		"two days": buys + `
+2021/02/01 Move
+    Assets:Hot          -1 BTC
+    Assets:Cold          1 BTC
+
+2021/02/02 Move
+    Assets:Hot          -1 BTC
+    Assets:Cold          1 BTC
+`,
+	}
+	moved := regexp.MustCompile(`\[(Lot:[^\]]+)\] +-1 BTC +; :MOVE: move 1 BTC to`)
+	for name, journal := range journals {
+		for _, naming := range []string{"detail", "hash"} {
+			settings := newSettings()
+			settings.prune = -1
+			var out bytes.Buffer
+			err := runOperation(&out, settings, newProblemTally(-1), []byte(journal), "lot", "-lot-names="+naming)
+			if err != nil {
+				t.Fatalf("%s, -lot-names=%s: %v", name, naming, err)
+			}
+			match := moved.FindAllStringSubmatch(out.String(), -1)
+			if len(match) != 2 {
+				t.Fatalf("%s, -lot-names=%s: %d lots moved, expected 2:\n%s", name, naming, len(match), out.String())
+			}
+			if match[0][1] == match[1][1] {
+				t.Errorf("%s, -lot-names=%s: both lots moved to %q", name, naming, match[0][1])
+			}
+		}
+	}
+}
+
+// FuzzLot lots arbitrary input.  Malformed input, or inventory which
+// runs out, is a problem logged or an error returned, never a panic.
+// Run with `go test -fuzz FuzzLot`.
+// TestSellsBeforeBuys rebalances, buying ABC before selling it in one
+// transaction.  With lifo, the sale consumes the lot held before, not
+// the lot bought.
+func TestSellsBeforeBuys(t *testing.T) {
+	journal := `2021/01/01 Buy
+    Assets:Broker          1 ABC @ 10 USD
+    Assets:Broker          1 XYZ @ 5 USD
+    Assets:Cash
+
+2021/02/01 Rebalance
+    Assets:Broker          1 ABC @ 30 USD
+    Assets:Broker          -1 XYZ @ 7 USD
+    Assets:Broker          -1 ABC @ 30 USD
+    Assets:Cash
+`
+	_, rebalance, _ := strings.Cut(string(lotJournal(t, journal, "-order=lifo")), "2021/02/01 Rebalance")
+	got := generatedLines(rebalance)
+	expect := []string{
+		// sells first, in file order
+		"[Lot::2021/01/01:1XYZ@5USD] 1 XYZ ; :SELL: 5 USD/XYZ acquired 2021/01/01 held 31d (inventory consumed)",
+		"[Lot::2021/01/01:1XYZ@5USD] -5 USD ; :SELL: (basis consumed)",
+		"[Lot::2021/01/01:1ABC@10USD] 1 ABC ; :SELL: 10 USD/ABC acquired 2021/01/01 held 31d (inventory consumed)",
+		"[Lot::2021/01/01:1ABC@10USD] -10 USD ; :SELL: (basis consumed)",
+		"[Lot::2021/02/01:1ABC@30USD] -1 ABC ; :BUY: (inventory)",
+		"[Lot::2021/02/01:1ABC@30USD] 30 USD ; :BUY: (basis)",
+		"[Lot:Income:short term gain] -2 USD ; :GAIN:SHORTTERM:",
+		"[Lot:Income:short term gain] -20 USD ; :GAIN:SHORTTERM:",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("rebalance lotted:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+}
+
+// TestCheckMoves fails moves of two assets, where one asset's move
+// would consume more than held, or add more than consumed.  Lots of
+// both stay where they were.
+func TestCheckMoves(t *testing.T) {
+	journal := `2021/01/01 Buy
+    Assets:Exchange        1 BTC @ 30000 USD
+    Assets:Exchange        2 ETH @ 1000 USD
+    Assets:Bank
+
+2021/02/01 Withdraw
+    Assets:Wallet          1 BTC
+    Assets:Exchange       -1 BTC
+    Assets:Wallet          3 ETH
+    Assets:Exchange       -3 ETH
+
+2021/03/01 Withdraw
+    Assets:Wallet          1 BTC
+    Assets:Exchange       -1 BTC
+    Assets:Wallet          2 ETH
+    Assets:Exchange       -1 ETH
+`
+	settings := newSettings()
+	settings.prune = -1
+	var out bytes.Buffer
+	err := runOperation(&out, settings, newProblemTally(0), []byte(journal), "lot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, reportLines(out.String()),
+		`FIXME:lotter: lot: line 6: failed to process move transaction ("2021/02/01 Withdraw"): failed to move 3 ETH from "Assets:Exchange", which holds 2 ETH`,
+		`FIXME:lotter: lot: line 12: failed to process move transaction ("2021/03/01 Withdraw"): failed to move 2 ETH, as only 1 ETH is moved from inventory (unpriced trade?)`,
+	)
+
+	out.Reset()
+	problems := newProblemTally(0)
+	err = runOperation(&out, settings, problems, []byte(journal), "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["failed move"] != 2 {
+		t.Errorf("%d failed moves, expected 2", problems.count["failed move"])
+	}
+	expect := []string{
+		"BTC Assets:Exchange, fifo: 1 BTC, basis 30000 USD",
+		"1 2021/01/01 1 BTC 30000 USD Lot:Assets:Exchange:2021/01/01:1BTC@30000USD",
+		"",
+		"ETH Assets:Exchange, fifo: 2 ETH, basis 2000 USD",
+		"1 2021/01/01 2 ETH 2000 USD Lot:Assets:Exchange:2021/01/01:2ETH@1000USD",
+	}
+	if got := reportLines(out.String()); strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("lots after failed moves:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+}
+
+// TestInferPrice prices a trade without prices from the base currency
+// balancing it, but not a transaction which also moves the asset.
+func TestInferPrice(t *testing.T) {
+	settings := newSettings()
+	for _, test := range []struct {
+		split []string
+		price string // of each split of the asset, if a trade
+	}{
+		{[]string{"    Assets:Crypto  1 BTC", "    Assets:Bank  -30000 USD"}, "30000 USD"},
+		{[]string{"    Assets:Crypto  -2 BTC", "    Assets:Bank"}, ""}, // nothing balancing it
+		{[]string{"    Assets:Crypto  -2 BTC", "    Assets:Bank  60000 USD"}, "30000 USD"},
+		{[]string{"    Assets:Wallet  0.5 BTC", "    Assets:Exchange  0.5 BTC", "    Assets:Bank  -20000 USD"}, "20000 USD"},
+		{[]string{"    Assets:Wallet  1 BTC", "    Assets:Exchange  -0.5 BTC", "    Assets:Bank  -15000 USD"}, ""}, // some moved
+		{[]string{"    Assets:Crypto  1 BTC", "    Assets:Bank  30000 USD", "    Income:Misc"}, ""},                // base not paid
+		{[]string{"    Assets:Crypto  1 BTC", "    Assets:Crypto  -10 ETH"}, ""},                                   // no base
+	} {
+		splits, isTrade, _, err := settings.produceSplits(test.split)
+		if err != nil {
+			t.Errorf("%q: %v", test.split, err)
+			continue
+		}
+		if isTrade != (test.price != "") {
+			t.Errorf("%q is trade %t, expected %t", test.split, isTrade, !isTrade)
+			continue
+		}
+		for _, qualified := range splits["BTC"] {
+			for _, s := range qualified {
+				if test.price != "" && (s.price == nil || s.price.String() != test.price) {
+					t.Errorf("%q priced %v, expected %s", s.line, s.price, test.price)
+				}
+			}
+		}
+	}
+}
+
+// TestWritePrices writes a directive for each price commented out,
+// per unit even of total cost, which relot replaces.
+func TestWritePrices(t *testing.T) {
+	journal := `2021/01/01 Buy
+    Assets:Broker          4 ABC @@ 10 USD
+    Assets:Cash
+
+2021/01/02 Trade
+    Assets:Broker          -2 ABC @ 3 USD
+    Assets:Broker          1 XYZ @@ 6 USD
+    Assets:Cash
+`
+	lotted := lotJournal(t, journal, "-write-prices")
+	var prices []string
+	for _, line := range strings.Split(string(lotted), "\n") {
+		if strings.HasPrefix(line, "P ") {
+			prices = append(prices, line)
+		}
+	}
+	expect := []string{
+		"P 2021/01/01 ABC 2.5 USD",
+		"P 2021/01/02 ABC 3 USD",
+		"P 2021/01/02 XYZ 6 USD",
+	}
+	if strings.Join(prices, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("prices written:\n%s\nexpected:\n%s", strings.Join(prices, "\n"), strings.Join(expect, "\n"))
+	}
+	if !bytes.Contains(lotted, []byte("; prices of trades, written by lotter\nP 2021/01/01 ABC 2.5 USD\n\n2021/01/01 Buy\n")) {
+		t.Errorf("prices do not precede transaction:\n%s", lotted)
+	}
+
+	var relotted bytes.Buffer
+	err := runOperation(&relotted, newSettings(), newProblemTally(-1), lotted, "relot", "-write-prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relotted.String() != string(lotted) {
+		t.Errorf("relotted:\n%s\nexpected:\n%s", relotted.String(), lotted)
+	}
+	relotted.Reset()
+	err = runOperation(&relotted, newSettings(), newProblemTally(-1), lotted, "relot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(relotted.String(), "P 2021") || strings.Contains(relotted.String(), "prices of trades") {
+		t.Errorf("relot without -write-prices kept prices:\n%s", relotted.String())
+	}
+}
+
+func FuzzLot(f *testing.F) {
+	for _, name := range testdataLedgers(f) {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("2021/01/01 zero\n    Assets:Crypto  0 ABC @@ 5 USD\n    Assets:Cash\n"))
+	f.Add([]byte("2021/01/01 oversold\n    Assets:Crypto  -1 ABC @ 5 USD\n    Assets:Cash\n"))
+	f.Add([]byte("2021/01/01 move\n    Assets:Wallet  1 ABC\n    Assets:Crypto  -2 ABC\n"))
+
+	log.SetOutput(ioutil.Discard) // problems are expected
+	defer log.SetOutput(os.Stderr)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		runOperation(ioutil.Discard, newSettings(), newProblemTally(-1), data, "lot", "-ignore-after=none")
+	})
+}
+
+// BenchmarkLot lots generated journals, end to end.
+func BenchmarkLot(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, count := range benchmarkCounts {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			journal := genJournal(b, count)
+			b.SetBytes(int64(len(journal)))
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				// generated dates run past today, which lot would otherwise pass through
+				problems := newProblemTally(-1)
+				err := runOperation(ioutil.Discard, newSettings(), problems, journal, "lot", "-ignore-after=none")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if problems.total > 0 {
+					b.Fatalf("%d problem(s) lotting generated journal", problems.total)
+				}
+			}
+			reportRate(b, count, time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation netting
+//
+// Usage:
+//
+//     lotter -f <lotted.ledger> netting [-limit <amount>] [-short-carryover <amount>] [-long-carryover <amount>]
+//
+// The `netting` operation reports, per year, gains and losses
+// realized in a lotted file, netted as in the U.S.A.  Short term
+// losses are netted against short term gains, long term against long
+// term, then one net against the other.  A net loss is deducted (from
+// other income) up to `-limit` (by default 3000, in base currency),
+// and the remainder carried over to the next year, keeping its term.
+// For example,
+//
+//     lotter -f journal.ledger lot > lotted.ledger
+//     lotter -f lotted.ledger netting
+//
+//     2018  short term gain       500 USD
+//           short term loss       -7000 USD
+//           short term carryover  0 USD
+//           net short term        -6500 USD
+//           long term gain        1000 USD
+//           long term loss        0 USD
+//           long term carryover   0 USD
+//           net long term         1000 USD
+//           net                   -5500 USD
+//           deducted              3000 USD
+//           carried over          2500 USD short term, 0 USD long term
+//
+// Every year from the first gain to the last is reported (a year
+// without gains may deduct loss carried over).  Use
+// `-short-carryover` and `-long-carryover` for losses carried over to
+// the first year (shown as positive, as on the IRS worksheet).
+//
+// Alternatively, record carryover in the journal, with a comment
+// (which ledger-cli ignores) naming the year carried over to, term and
+// loss.  For example,
+//
+//     ; carryover: 2018 short term 2500 USD
+//     ; carryover: 2018 long term 0 USD
+//
+// Carryover recorded this way (i.e. as filed) replaces what `netting`
+// calculates for that year, so the report of later years starts from
+// the correct position, even when the journal lacks the trades of
+// earlier years.
+//
+// Gains are those recorded by `lot` as short or long term.  Margin
+// gains are counted short term.  The deduction is not limited by
+// taxable income, as the worksheet limits it; when taxable income is
+// less than the deduction, carryover is more than reported here.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		nettingMain,
+		"netting",
+		"netting [-limit=<amount>] [-short-carryover=<amount>] [-long-carryover=<amount>]",
+		"Net short and long term gains and losses per year, with loss deducted and carried over.",
+	)
+}
+
+// termTally is gains and losses of one year, short and long term.
+type termTally struct {
+	shortGain, shortLoss *big.Rat
+	longGain, longLoss   *big.Rat
+
+	// loss carried over to the year, if recorded in the journal
+	shortCarry, longCarry *big.Rat
+}
+
+// i.e. "; carryover: 2018 short term 2500 USD"
+var carryoverPattern = regexp.MustCompile(`^;\s*carryover:\s+(\d{4})\s+(short|long) term\s+(.*)$`)
+
+func nettingMain(env *environment) error {
+	// define flags
+	limitFlag := flag.String("limit", "3000", "net loss deducted per year (in base currency), i.e. 1500 when married filing separately")
+	shortFlag := flag.String("short-carryover", "0", "short term loss carried over to the first year")
+	longFlag := flag.String("long-carryover", "0", "long term loss carried over to the first year")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	nonNegative := func(name, str string) (*big.Rat, error) {
+		r, ok := new(big.Rat).SetString(str)
+		if !ok || r.Sign() < 0 {
+			return nil, fmt.Errorf("bad -%s (%q), expected a non-negative number", name, str)
+		}
+		return r, nil
+	}
+	limit, err := nonNegative("limit", *limitFlag)
+	if err != nil {
+		return err
+	}
+	shortCarry, err := nonNegative("short-carryover", *shortFlag)
+	if err != nil {
+		return err
+	}
+	longCarry, err := nonNegative("long-carryover", *longFlag)
+	if err != nil {
+		return err
+	}
+
+	tally, first, last, err := tallyTerms(env)
+	if err != nil {
+		return statusError(exitInput, err)
+	}
+	if len(tally) == 0 {
+		command.V(1).Info("no gains found")
+		return nil
+	}
+
+	amount := func(r *big.Rat) Amount { return env.NewAmount(env.base, *r) }
+	w := newReportWriter(env.output)
+	for year := first; year <= last; year++ {
+		t := tally[year]
+		if t == nil {
+			t = newTermTally()
+		}
+		if t.shortCarry != nil {
+			command.V(1).Infof("%d short term carryover recorded %s (calculated %s)", year, amount(t.shortCarry), amount(shortCarry))
+			shortCarry = t.shortCarry
+		}
+		if t.longCarry != nil {
+			command.V(1).Infof("%d long term carryover recorded %s (calculated %s)", year, amount(t.longCarry), amount(longCarry))
+			longCarry = t.longCarry
+		}
+
+		// net of each term, with loss carried over (losses negative)
+		netShort := new(big.Rat).Add(t.shortGain, t.shortLoss)
+		netShort.Sub(netShort, shortCarry)
+		netLong := new(big.Rat).Add(t.longGain, t.longLoss)
+		netLong.Sub(netLong, longCarry)
+		net := new(big.Rat).Add(netShort, netLong)
+
+		deducted := new(big.Rat)
+		if net.Sign() < 0 {
+			deducted.Neg(net)
+			if deducted.Cmp(limit) > 0 {
+				deducted.Set(limit)
+			}
+		}
+		nextShort, nextLong := carryover(netShort, netLong, deducted)
+
+		fmt.Fprintf(w, "%d\tshort term gain\t%s\n", year, amount(t.shortGain))
+		fmt.Fprintf(w, "\tshort term loss\t%s\n", amount(t.shortLoss))
+		fmt.Fprintf(w, "\tshort term carryover\t%s\n", amount(shortCarry))
+		fmt.Fprintf(w, "\tnet short term\t%s\n", amount(netShort))
+		fmt.Fprintf(w, "\tlong term gain\t%s\n", amount(t.longGain))
+		fmt.Fprintf(w, "\tlong term loss\t%s\n", amount(t.longLoss))
+		fmt.Fprintf(w, "\tlong term carryover\t%s\n", amount(longCarry))
+		fmt.Fprintf(w, "\tnet long term\t%s\n", amount(netLong))
+		fmt.Fprintf(w, "\tnet\t%s\n", amount(net))
+		fmt.Fprintf(w, "\tdeducted\t%s\n", amount(deducted))
+		fmt.Fprintf(w, "\tcarried over\t%s short term, %s long term\n", amount(nextShort), amount(nextLong))
+
+		shortCarry, longCarry = nextShort, nextLong
+	}
+	return w.Flush()
+}
+
+// carryover returns the loss of each term carried over to the next
+// year, as the IRS worksheet calculates it.  Net loss of one term is
+// first reduced by net gain of the other, then by the deduction, which
+// is applied to short term loss before long term.
+func carryover(netShort, netLong, deducted *big.Rat) (short, long *big.Rat) {
+	positive := func(r *big.Rat) *big.Rat {
+		if r.Sign() < 0 {
+			return new(big.Rat)
+		}
+		return new(big.Rat).Set(r)
+	}
+	shortLoss, longLoss := positive(new(big.Rat).Neg(netShort)), positive(new(big.Rat).Neg(netLong))
+	shortGain, longGain := positive(netShort), positive(netLong)
+
+	// short term loss, beyond long term gain, is deducted first
+	shortRemain := positive(new(big.Rat).Sub(shortLoss, longGain))
+	shortDeducted := new(big.Rat).Set(deducted)
+	if shortDeducted.Cmp(shortRemain) > 0 {
+		shortDeducted.Set(shortRemain)
+	}
+	short = shortRemain.Sub(shortRemain, shortDeducted)
+
+	longRemain := positive(new(big.Rat).Sub(longLoss, shortGain))
+	long = positive(longRemain.Sub(longRemain, new(big.Rat).Sub(deducted, shortDeducted)))
+	return short, long
+}
+
+func newTermTally() *termTally {
+	return &termTally{
+		shortGain: new(big.Rat), shortLoss: new(big.Rat),
+		longGain: new(big.Rat), longLoss: new(big.Rat),
+	}
+}
+
+// tallyTerms sums the gain splits generated by lot, per year and term,
+// and reads carryover recorded in comments.  Gains are positive,
+// losses negative.  First and last are the earliest and latest years
+// of gain or carryover.
+func tallyTerms(env *environment) (tally map[int]*termTally, first, last int, err error) {
+	tally = make(map[int]*termTally)
+	get := func(year int) *termTally {
+		t := tally[year]
+		if t == nil {
+			t = newTermTally()
+			tally[year] = t
+			if first == 0 || year < first {
+				first = year
+			}
+			if year > last {
+				last = year
+			}
+		}
+		return t
+	}
+	s := env.scanner
+	for s.Scan() {
+		txLines := s.Lines()
+		_, payeeIndex := txLines.Payee()
+
+		// carryover comments, outside of transactions
+		comment := txLines.Line
+		if payeeIndex != PayeeNotFound {
+			comment = txLines.Line[:payeeIndex]
+		}
+		for i, line := range comment {
+			m := carryoverPattern.FindStringSubmatch(strings.TrimSpace(line))
+			if m == nil {
+				continue
+			}
+			loss, err := env.parseAmount(m[3])
+			if err == nil && (!env.isBase(loss.Asset) || loss.Sign() < 0) {
+				err = fmt.Errorf("expected a non-negative amount of %s (%q)", env.base, m[3])
+			}
+			if err != nil {
+				env.problems.add("bad carryover", lineErrorf(txLines.Start+i, "%w", err))
+				continue
+			}
+			year, _ := strconv.Atoi(m[1])
+			if m[2] == "long" {
+				get(year).longCarry = loss.Rat
+			} else {
+				get(year).shortCarry = loss.Rat
+			}
+		}
+
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		for _, line := range txLines.Line[payeeIndex+1:] {
+			if !generatedSplitPattern.MatchString(line) {
+				continue
+			}
+			split, ok := env.parseSplit(line)
+			if !ok || split.delta == nil || !env.isBase(split.delta.Asset) || !strings.Contains(split.comment, ":GAIN:") {
+				continue
+			}
+			t := get(txLines.Date.Year())
+			gain := new(big.Rat).Neg(split.delta.Rat) // gain splits are credits
+			long := strings.Contains(split.comment, ":GAIN:LONGTERM:")
+			switch {
+			case long && gain.Sign() > 0:
+				t.longGain.Add(t.longGain, gain)
+			case long:
+				t.longLoss.Add(t.longLoss, gain)
+			case gain.Sign() > 0:
+				t.shortGain.Add(t.shortGain, gain)
+			default:
+				t.shortLoss.Add(t.shortLoss, gain)
+			}
+		}
+	}
+	return tally, first, last, s.Err()
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// TestCarryover checks carryover against cases of the IRS worksheet.
+func TestCarryover(t *testing.T) {
+	for _, c := range []struct {
+		netShort, netLong, deducted int64
+		short, long                 int64 // carried over
+	}{
+		{-6500, 1000, 3000, 2500, 0},  // short loss, reduced by long gain
+		{1000, -6500, 3000, 0, 2500},  // long loss, reduced by short gain
+		{-2000, -4000, 3000, 0, 3000}, // short loss deducted before long
+		{-5000, -4000, 3000, 2000, 4000},
+		{-1000, -500, 1500, 0, 0}, // all deducted
+		{500, 100, 0, 0, 0},       // gains
+	} {
+		short, long := carryover(big.NewRat(c.netShort, 1), big.NewRat(c.netLong, 1), big.NewRat(c.deducted, 1))
+		if short.Cmp(big.NewRat(c.short, 1)) != 0 || long.Cmp(big.NewRat(c.long, 1)) != 0 {
+			t.Errorf("carryover(%d, %d, %d) is %s short, %s long; expected %d short, %d long", c.netShort, c.netLong, c.deducted, short.RatString(), long.RatString(), c.short, c.long)
+		}
+	}
+}
+
+// nettingJournal has a short term loss of 6500 USD in 2018, and short
+// term gain of 1000 USD in 2019.
+const nettingJournal = `2018/01/01 Buy
+    Assets:Crypto          100 ABC @ 100 USD
+    Assets:Bank
+
+2018/06/01 Sell
+    Assets:Crypto         -100 ABC @ 35 USD
+    Assets:Bank
+
+2019/03/01 Buy
+    Assets:Crypto           10 XYZ @ 10 USD
+    Assets:Bank
+
+2019/04/01 Sell
+    Assets:Crypto          -10 XYZ @ 110 USD
+    Assets:Bank
+`
+
+// netting runs the netting operation over input, and returns lines of
+// its report (see reportLines).
+func netting(t *testing.T, input []byte, arg ...string) []string {
+	t.Helper()
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), newProblemTally(-1), input, "netting", arg...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reportLines(out.String())
+}
+
+// expectLines reports lines not found in report.
+func expectLines(t *testing.T, report []string, expect ...string) {
+	t.Helper()
+	all := strings.Join(report, "\n")
+	for _, e := range expect {
+		if !strings.Contains("\n"+all+"\n", "\n"+e+"\n") {
+			t.Errorf("report lacks %q:\n%s", e, all)
+		}
+	}
+}
+
+// TestNetting deducts 3000 USD of the loss of 2018, carrying 3500 USD
+// over to 2019, which deducts the remainder.
+func TestNetting(t *testing.T) {
+	report := netting(t, lotJournal(t, nettingJournal))
+	expectLines(t, report,
+		"2018 short term gain 0 USD",
+		"short term loss -6500 USD",
+		"net -6500 USD",
+		"deducted 3000 USD",
+		"carried over 3500 USD short term, 0 USD long term",
+		"2019 short term gain 1000 USD",
+		"short term carryover 3500 USD",
+		"net -2500 USD",
+		"deducted 2500 USD",
+		"carried over 0 USD short term, 0 USD long term",
+	)
+
+	// limit, and carryover to the first year
+	report = netting(t, lotJournal(t, nettingJournal), "-limit=1500", "-long-carryover=100")
+	expectLines(t, report,
+		"long term carryover 100 USD",
+		"net -6600 USD",
+		"deducted 1500 USD",
+		"carried over 5000 USD short term, 100 USD long term",
+		"2019 short term gain 1000 USD",
+		"net -4100 USD",
+		"carried over 2500 USD short term, 100 USD long term",
+	)
+}
+
+// TestNettingRecorded reads carryover recorded in the journal, which
+// replaces that calculated.
+func TestNettingRecorded(t *testing.T) {
+	input := lotJournal(t, nettingJournal)
+	input = append(input, `
+; carryover: 2019 short term 1000 USD
+; carryover: 2020 long term 700 USD
+; carryover: 2020 short term -5 USD
+`...)
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err := runOperation(&out, newSettings(), problems, input, "netting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["bad carryover"] != 1 {
+		t.Errorf("%d bad carryover, expected 1 (of negative loss)", problems.count["bad carryover"])
+	}
+	expectLines(t, reportLines(out.String()),
+		"carried over 3500 USD short term, 0 USD long term", // calculated, of 2018
+		"2019 short term gain 1000 USD",
+		"short term carryover 1000 USD", // recorded
+		"net 0 USD",
+		"carried over 0 USD short term, 0 USD long term",
+		"2020 short term gain 0 USD", // a year of carryover only
+		"long term carryover 700 USD",
+		"deducted 700 USD",
+	)
+}
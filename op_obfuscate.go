@@ -26,17 +26,17 @@ import (
 )
 
 func init() {
-	command.RegisterOperation(
+	registerOperation(
 		obfuscateMain,
 		"obfuscate",
-		"obfuscate [-prune=<int>] [-salt=<string>]",
+		"obfuscate [-clear=<int>] [-salt=<string>]",
 		"Convert account names, concealing potentially sensitive data.",
 	)
 }
 
-func obfuscateMain() error {
+func obfuscateMain(env *environment) error {
 	// define flags
-	pruneFlag := flag.Int("prune", 1, "name depth where obfuscation begins")
+	clearFlag := flag.Int("clear", 1, "name depth where obfuscation begins, parts before are left in cleartext")
 	saltFlag := flag.String("salt", "", "make obfuscation hashes unique and reproducable only when salt is known")
 
 	err := command.Parse()
@@ -44,18 +44,39 @@ func obfuscateMain() error {
 		return err
 	}
 
-	for scanner.Scan() {
-		txLines := scanner.Lines()
+	// validate flags
+	if *clearFlag < 0 {
+		return fmt.Errorf("bad -clear (%d), expected a name depth", *clearFlag)
+	}
+
+	for env.scanner.Scan() {
+		txLines := env.scanner.Lines()
+
+		// indented lines of a directive block are not splits
+		directive := txLines.directives()
+
+		// malformed splits are not obfuscated
+		for i, line := range txLines.Line {
+			if directive[i] {
+				continue
+			}
+			if err := env.splitError(line); err != nil {
+				env.problems.add("unparsed transaction", lineErrorf(txLines.Start+i, "%w", err))
+			}
+		}
 
 		line, index := txLines.Payee()
 		if index != PayeeNotFound {
 			// obfuscate the transaction name
 			commentPart := strings.SplitN(line, ";", 2)
-			spacePart := strings.SplitN(commentPart[0], " ", 2)
+			spacePart := append(strings.SplitN(commentPart[0], " ", 2), "") // description may be empty
 			h := sha256.Sum256([]byte(spacePart[1] + *saltFlag))
 			spacePart[1] = hex.EncodeToString(h[:8])
 			// put original line in a comment above the obfuscated line
-			txLines.Line[index] = fmt.Sprintf("; %s\n%s %s \t; %s", line, spacePart[0], spacePart[1], "")
+			txLines.Line[index] = fmt.Sprintf("%s %s \t; %s", spacePart[0], spacePart[1], "")
+			txLines.Line = append(txLines.Line[:index], append([]string{fmt.Sprintf("; %s", line)}, txLines.Line[index:]...)...)
+			txLines.payee = newInt(index + 1)
+			directive = append(directive[:index], append([]bool{false}, directive[index:]...)...)
 		}
 
 		for index, line := range txLines.Line {
@@ -63,8 +84,8 @@ func obfuscateMain() error {
 			// TODO(dnc): may need to remove or obfuscate comments,
 			// especially trailing comments which ledger exports to CSV.
 
-			split, ok := parseSplit(line)
-			if !ok {
+			split, ok := env.parseSplit(line)
+			if !ok || directive[index] {
 				continue
 			}
 
@@ -73,13 +94,13 @@ func obfuscateMain() error {
 			// original should always map to the same obfuscated name.  This
 			// allows the `lot` operation to be run after `obfuscate`.
 
-			// "Pruned" parts at the start of the name are not obfuscated.
+			// Cleartext parts at the start of the name are not obfuscated.
 			// This allows human readable "Assets" vs "Expenses", common
 			// ledger-cli conventions.
 
 			cleartext := strings.Trim(split.account, "[]")
 			parts := strings.Split(cleartext, ":")
-			for n := len(parts); n > *pruneFlag; n-- {
+			for n := len(parts); n > *clearFlag; n-- {
 				h := sha256.Sum256([]byte(parts[n-1] + *saltFlag))
 				parts[n-1] = hex.EncodeToString(h[:3]) // TODO(dnc): make length configurable
 			}
@@ -87,8 +108,11 @@ func obfuscateMain() error {
 
 			txLines.Line[index] = strings.Replace(line, cleartext, obfuscated, 1)
 		}
-		writeLines(txLines.Line)
-		fmt.Println("") // blank line between transactions
+		if index == PayeeNotFound {
+			env.output.Lines(txLines.Line)
+		} else {
+			env.output.Tx(txLines, nil)
+		}
 	} // end scan loop
 	return nil
 } // end obfuscateMain
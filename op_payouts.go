@@ -0,0 +1,213 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation payouts
+//
+// Usage:
+//
+//     lotter [-base <currency>] -f <payouts.csv> payouts [-prices <filename>]
+//
+// The `payouts` operation imports mining pool or staking provider
+// payouts, from CSV.  Payouts are often many, and tiny.  This
+// operation collapses all payouts of an asset on the same day into a
+// single income transaction, priced at fair market value, ready for
+// the `lot` operation.  For example,
+//
+//     2021/01/01 ETH payouts (24)
+//         Assets:Mining                             0.0123 ETH @@ 9.02 USD
+//         Income:Mining
+//
+// Columns are recognized by common names (i.e. "date", "amount",
+// "currency").  Use flags to name the columns found in other data.
+// Fair market value is taken from a price column if present,
+// otherwise from price directives (i.e. "P 2021/01/01 ETH 733.38
+// USD") in the file named by `-prices`.
+//
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		payoutsMain,
+		"payouts",
+		"payouts [-account=<account>] [-income=<account>] [-asset=<asset>] [-prices=<filename>]",
+		"Import mining or staking payouts (CSV), as daily income transactions.",
+	)
+}
+
+func payoutsMain(env *environment) error {
+	// define flags
+	accountFlag := flag.String("account", "Assets:Mining", "account receiving payouts")
+	incomeFlag := flag.String("income", "Income:Mining", "account payouts are income from")
+	payeeFlag := flag.String("payee", "payouts", "description of imported transactions (following asset)")
+	assetFlag := flag.String("asset", "", "asset paid, when not found in CSV")
+	pricesFlag := flag.String("prices", "", "ledger-cli file with price directives")
+	dateColumn := flag.String("date-column", "", "name of date column")
+	amountColumn := flag.String("amount-column", "", "name of amount column")
+	assetColumn := flag.String("asset-column", "", "name of asset column")
+	priceColumn := flag.String("price-column", "", "name of price (per unit, in base currency) column")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	for _, a := range [][2]string{{"account", *accountFlag}, {"income", *incomeFlag}} {
+		if err := checkAccountFlag(a[0], a[1]); err != nil {
+			return err
+		}
+	}
+
+	priceHistory := newPriceHistory(env.settings)
+	if *pricesFlag != "" {
+		f, err := os.Open(*pricesFlag)
+		if err != nil {
+			return fmt.Errorf("failed to open prices (%q): %w", *pricesFlag, err)
+		}
+		err = priceHistory.Read(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	reader := csv.NewReader(env.input)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	column := csvColumns(header, map[string][]string{
+		"date":   columnNames(*dateColumn, "date", "time", "timestamp", "datetime", "created_at", "paid_at"),
+		"amount": columnNames(*amountColumn, "amount", "reward", "value", "quantity", "payout"),
+		"asset":  columnNames(*assetColumn, "currency", "asset", "coin", "symbol", "ticker"),
+		"price":  columnNames(*priceColumn, "price", "fmv", "price_usd", "usd_price", "rate"),
+	})
+	for _, key := range []string{"date", "amount"} {
+		if _, ok := column[key]; !ok {
+			return fmt.Errorf("CSV has no %s column (header %q), use -%s-column", key, header, key)
+		}
+	}
+	if _, ok := column["asset"]; !ok && *assetFlag == "" {
+		return fmt.Errorf("CSV has no asset column (header %q), use -asset-column or -asset", header)
+	}
+
+	// collapse payouts by day and asset
+	type daily struct {
+		date   time.Time
+		asset  Asset
+		count  int
+		amount *big.Rat
+		value  *big.Rat // fair market value, in base currency
+		err    []error
+	}
+	payout := make(map[string]*daily)
+
+	for row := 2; ; row++ { // row 1 is header
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		t, err := parseTimestamp(record[column["date"]])
+		if err != nil {
+			return statusError(exitInput, fmt.Errorf("row %d: %w", row, err))
+		}
+		date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+		asset := Asset(*assetFlag)
+		if i, ok := column["asset"]; ok && record[i] != "" {
+			asset = Asset(record[i])
+		}
+		amount, err := env.parseAmount(fmt.Sprintf("%s %s", record[column["amount"]], asset))
+		if err != nil {
+			return statusError(exitInput, fmt.Errorf("row %d: %w", row, err))
+		}
+
+		key := historyKey(date, asset)
+		d, ok := payout[key]
+		if !ok {
+			d = &daily{date: date, asset: asset, amount: new(big.Rat), value: new(big.Rat)}
+			payout[key] = d
+		}
+		d.count++
+		d.amount.Add(d.amount, amount.Rat)
+
+		var price *big.Rat
+		if i, ok := column["price"]; ok && record[i] != "" {
+			p, err := env.parseAmount(fmt.Sprintf("%s %s", record[i], env.base))
+			if err != nil {
+				return statusError(exitInput, fmt.Errorf("row %d: %w", row, err))
+			}
+			price = p.Rat
+		} else {
+			price, ok = priceHistory.Lookup(date, asset)
+			if !ok {
+				d.err = append(d.err, fmt.Errorf("row %d: missing price of %s on %s", row, asset, date.Format("2006/01/02")))
+				continue
+			}
+		}
+		d.value.Add(d.value, new(big.Rat).Mul(price, amount.Rat))
+	}
+
+	// write transactions in order of date, then asset
+	var key []string
+	for k := range payout {
+		key = append(key, k)
+	}
+	sort.Strings(key)
+
+	for _, k := range key {
+		d := payout[k]
+		amount := env.NewAmount(d.asset, *d.amount)
+		value := env.NewAmount(env.base, *d.value)
+		tx := importTx(d.date, fmt.Sprintf("%s %s (%d)", d.asset, *payeeFlag, d.count),
+			importSplit(*accountFlag, fmt.Sprintf("%s @@ %s", amount, value)),
+			importSplit(*incomeFlag, ""),
+		)
+		var fixme []Posting
+		stop := false
+		for _, err := range d.err {
+			stop = env.problems.add("missing price", err) || stop
+			fixme = append(fixme, Posting{Err: fmt.Errorf("payouts: %w", err)})
+		}
+		env.output.Tx(tx, fixme)
+		if stop {
+			break
+		}
+	}
+
+	return nil
+}
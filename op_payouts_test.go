@@ -0,0 +1,101 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPayouts(t *testing.T) {
+	prices := filepath.Join(t.TempDir(), "prices.ledger")
+	err := os.WriteFile(prices, []byte("P 2021/01/01 ETH 700 USD\nP 2021/01/02 ETH 800 USD\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		csv     string
+		arg     []string
+		expect  []string
+		missing int // prices
+	}{
+		{
+			// payouts of a day and asset collapse into one, valued at the price of that day
+			csv: "Time,Reward,Coin\n" +
+				"2021-01-01T01:00:00Z,0.01,ETH\n" +
+				"2021-01-01T23:00:00Z,0.02,ETH\n" +
+				"2021-01-02T01:00:00Z,0.005,ETH\n" +
+				"2021-01-01T02:00:00Z,0.5,XYZ\n",
+			arg: []string{"-prices=" + prices},
+			expect: []string{
+				"2021/01/01 ETH payouts (2)",
+				"Assets:Mining 0.03 ETH @@ 21 USD",
+				"Income:Mining",
+				"",
+				"2021/01/01 XYZ payouts (1)",
+				"Assets:Mining 0.5 XYZ @@ 0 USD",
+				"Income:Mining",
+				"FIXME:lotter: payouts: row 5: missing price of XYZ on 2021/01/01",
+				"",
+				"2021/01/02 ETH payouts (1)",
+				"Assets:Mining 0.005 ETH @@ 4 USD",
+				"Income:Mining",
+			},
+			missing: 1,
+		},
+		{
+			// price column, where present, rather than price directives
+			csv: "date,amount,fmv\n" +
+				"2021/01/01,1,\n" +
+				"2021/01/01,2,750\n",
+			arg: []string{"-prices=" + prices, "-asset=ETH", "-account=Assets:Staking", "-income=Income:Staking", "-payee=rewards"},
+			expect: []string{
+				"2021/01/01 ETH rewards (2)",
+				"Assets:Staking 3 ETH @@ 2200 USD",
+				"Income:Staking",
+			},
+		},
+	} {
+		var out bytes.Buffer
+		problems := newProblemTally(0)
+		err := runOperation(&out, newSettings(), problems, []byte(test.csv), "payouts", test.arg...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reportLines(out.String())
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("payouts %v imported:\n%s\nexpected:\n%s", test.arg, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+		if problems.count["missing price"] != test.missing {
+			t.Errorf("%d missing prices, expected %d", problems.count["missing price"], test.missing)
+		}
+	}
+
+	for csv, expect := range map[string]string{
+		"date,coin\n2021/01/01,ETH\n":    "CSV has no amount column",
+		"date,amount\n2021/01/01,1\n":    "CSV has no asset column",
+		"date,amount,coin\nsoon,1,ETH\n": "row 2: ",
+	} {
+		err := runOperation(&bytes.Buffer{}, newSettings(), newProblemTally(0), []byte(csv), "payouts")
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("error of %q is %v, expected %s", csv, err, expect)
+		}
+	}
+}
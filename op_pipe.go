@@ -0,0 +1,64 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation pipe
+//
+// Usage:
+//
+//     lotter -f <filename> pipe <operation> [<flag> ...] [+ <operation> [<flag> ...] ...]
+//
+// The `pipe` operation runs operations in sequence, each on the
+// output of the one before, as a shell pipeline would.  For example,
+//
+//     lotter -f data.ledger pipe base -b=2020/01/01 + lot -order=hifo + obfuscate
+//
+// is like
+//
+//     lotter -f data.ledger base -b=2020/01/01 | lotter -f - lot -order=hifo | lotter -f - obfuscate
+//
+// except that transactions pass from one operation to the next
+// without being written and parsed again, and line numbers in
+// messages refer to the original data.  Flags which precede `pipe`
+// (i.e. `-base`, `-prune`) apply to every operation, while `-format`
+// and `-validate` apply to the output of the last.  An operation
+// which reads other data (i.e. `gnucash`) must be first.
+//
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func init() {
+	registerOperation(
+		pipeMain,
+		"pipe",
+		"pipe <operation> [<flag> ...] [+ <operation> [<flag> ...] ...]",
+		"Run operations in sequence, each on the output of the one before.",
+	)
+}
+
+func pipeMain(env *environment) error {
+	// flags following operations are theirs, so not parsed here
+	if len(os.Args) < 2 {
+		return errors.New("expected operation, i.e. \"pipe base + lot\"")
+	}
+	pipeline, err := ParsePipeline(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	return pipeline.Run(env)
+}
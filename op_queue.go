@@ -0,0 +1,162 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation queue
+//
+// Usage:
+//
+//     lotter [-base <currency>] -f <filename> queue [-asof <date>]
+//
+// The `queue` operation replays transactions, as the `lot` operation
+// does, and then prints the lots remaining in each lot queue.  Lots
+// are listed in the order they would be consumed by the next sale.
+// This answers questions like "what would FIFO sell next?"
+//
+// Use `-asof` to replay only transactions on or before a date, i.e.
+// `-asof 2022/12/31` for the state of lot queues at the end of 2022.
+// Transactions are replayed by the same code as `lot`, which accepts
+// the flags of `lot` deciding how transactions are lotted (i.e.
+// `-order`, `-margin`, `-classes`, `-hook`, `-reorder-day`).  Use the
+// same flags (and `-prune`) as when running `lot`, so that lot queues
+// are the same.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		queueMain,
+		"queue",
+		"queue [-asof=<date>] [-order=<fifo|lifo|hifo>] [<lot flags>]",
+		"Show lot queues, in order of consumption, as of a given date.",
+	)
+}
+
+func queueMain(env *environment) error {
+	// define flags
+	asofFlag := flag.String("asof", "", "show lot queues as of this date (i.e. 2022/12/31)")
+	lotting := defineLotFlags()
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	var asof time.Time
+	if *asofFlag != "" {
+		asof, err = parseDate(*asofFlag)
+		if err != nil {
+			return fmt.Errorf("bad -asof date (%q): %w", *asofFlag, err)
+		}
+	}
+
+	lotted, err := replayLots(env, lotting, asof, nil)
+	if err != nil {
+		return err
+	}
+
+	// show lot queues, ordered by asset then qualifier
+	var asset []Asset
+	for a := range lotted.lotQueue {
+		asset = append(asset, a)
+	}
+	sort.Slice(asset, func(i, j int) bool { return asset[i] < asset[j] })
+
+	w := newReportWriter(env.output)
+	for _, a := range asset {
+		var qualifier []string
+		for q := range lotted.lotQueue[a] {
+			qualifier = append(qualifier, q)
+		}
+		sort.Strings(qualifier)
+
+		for _, q := range qualifier {
+			queue := lotted.lotQueue[a][q]
+			if queue.Len() == 0 {
+				continue
+			}
+			inventory := env.NewAmount(a, *new(big.Rat))
+			basis := env.NewAmount(env.base, *new(big.Rat))
+			// lots are consumed from the end of the queue
+			var line []string
+			for i := queue.Len() - 1; i >= 0; i-- {
+				l := queue.lot[i]
+				b := new(big.Rat).Mul(l.price, l.inventory.Rat)
+				inventory.Add(inventory.Rat, l.inventory.Rat)
+				basis.Add(basis.Rat, b)
+				line = append(line, fmt.Sprintf("    %d\t%s\t%s\t%s\t%s", queue.Len()-i, l.date.Format("2006/01/02"), l.inventory, env.NewAmount(env.base, *b), l.name))
+			}
+
+			qual := q
+			if qual == "" {
+				qual = "(all accounts)"
+			}
+			fmt.Fprintf(w, "%s %s, %s: %s, basis %s\n", a, qual, queue.order, inventory, basis)
+			for _, l := range line {
+				fmt.Fprintln(w, l)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	return w.Flush()
+}
+
+// replayLots lots transactions of env, as the lot operation does
+// (see defineLotFlags), but writes nothing, leaving lot queues as of
+// the last transaction lotted (on or before asof, if not zero).  Price
+// directives are observed in prices, if not nil.  Returns the lotter,
+// whose queues are the lots replayed.
+func replayLots(env *environment, flags *lotFlags, asof time.Time, prices *PriceHistory) (*lotter, error) {
+	l, err := newLotter(env, flags)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close() // if replay stops early
+	l.output = nullOutput{}
+	if prices != nil {
+		l.priceHistory = *prices
+	}
+	if !asof.IsZero() && (l.ignoreAfter.IsZero() || asof.Before(l.ignoreAfter)) {
+		l.ignoreAfter = asof
+	}
+
+	err = l.run()
+	if err != nil {
+		return nil, err
+	}
+	err = l.Close()
+	if err != nil {
+		return nil, err
+	}
+	if l.problems.stopped() {
+		// transactions after the problem were not replayed
+		return nil, statusError(exitError, errors.New("lots not reported, as replay stopped early"))
+	}
+	return l, env.scanner.Err()
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	journal := simulateJournal + `
+2021/04/01 Sell
+    Assets:Broker          -1.5 ABC @ 1000 USD
+    Assets:Cash
+
+2021/05/01 Move
+    Assets:Wallet          0.5 ABC
+    Assets:Broker         -0.5 ABC
+`
+	for _, test := range []struct {
+		prune  int
+		arg    []string
+		expect []string
+	}{
+		{
+			arg: []string{"-asof=2021/01/01"},
+			expect: []string{
+				"ABC (all accounts), fifo: 3 ABC, basis 600 USD",
+				"1 2019/01/01 1 ABC 100 USD Lot::2019/01/01:1ABC@100USD",
+				"2 2020/06/01 1 ABC 300 USD Lot::2020/06/01:1ABC@300USD",
+				"3 2020/09/01 1 ABC 200 USD Lot::2020/09/01:1ABC@200USD",
+			},
+		},
+		{
+			// lot at 900 USD consumed, and half the lot at 200 USD
+			arg: []string{"-order=lifo"},
+			expect: []string{
+				"ABC (all accounts), lifo: 2.5 ABC, basis 500 USD",
+				"1 2020/09/01 0.5 ABC 100 USD Lot::2020/09/01:1ABC@200USD",
+				"2 2020/06/01 1 ABC 300 USD Lot::2020/06/01:1ABC@300USD",
+				"3 2019/01/01 1 ABC 100 USD Lot::2019/01/01:1ABC@100USD",
+			},
+		},
+		{
+			// lot at 900 USD consumed, and half the lot at 300 USD
+			arg: []string{"-order=hifo", "-asof=2021/04/01"},
+			expect: []string{
+				"ABC (all accounts), hifo: 2.5 ABC, basis 450 USD",
+				"1 2020/06/01 0.5 ABC 150 USD Lot::2020/06/01:1ABC@300USD",
+				"2 2020/09/01 1 ABC 200 USD Lot::2020/09/01:1ABC@200USD",
+				"3 2019/01/01 1 ABC 100 USD Lot::2019/01/01:1ABC@100USD",
+			},
+		},
+		{
+			// a queue per account
+			prune: -1,
+			arg:   []string{"-order=lifo"},
+			expect: []string{
+				"ABC Assets:Broker, lifo: 2 ABC, basis 400 USD",
+				"1 2020/06/01 1 ABC 300 USD Lot:Assets:Broker:2020/06/01:1ABC@300USD",
+				"2 2019/01/01 1 ABC 100 USD Lot:Assets:Broker:2019/01/01:1ABC@100USD",
+				"",
+				"ABC Assets:Wallet, lifo: 0.5 ABC, basis 100 USD",
+				"1 2020/09/01 0.5 ABC 100 USD Lot:Assets:Wallet:2020/09/01:0.5ABC@200USD",
+			},
+		},
+	} {
+		settings := newSettings()
+		settings.prune = test.prune
+		var out bytes.Buffer
+		err := runOperation(&out, settings, newProblemTally(-1), []byte(journal), "queue", test.arg...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reportLines(out.String())
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("queue %v (prune %d):\n%s\nexpected:\n%s", test.arg, test.prune, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation relot
+//
+// Usage:
+//
+//     lotter -f <lotted.ledger> relot [-freeze-before=<date>] [<lot flags> ...]
+//
+// The `relot` operation removes content generated by an earlier run
+// of `lotter lot` (lot, basis and gain splits, metadata, and FIXME
+// lines), restores prices commented out by that run, then adds fresh
+// lot splits as `lot` does.  It accepts the same flags as `lot`.  Use
+// it to regenerate lots after editing a file that was already
+// lotted, i.e.
+//
+//     lotter -f lotted.ledger relot > relotted.ledger
+//
+// To protect tax years already filed, use `-freeze-before` (a flag
+// of relot only, as lot has no earlier splits to compare).  Relot
+// then fails if the lot, basis or gain splits of any transaction
+// dated before the freeze date would differ from those found in the
+// input, i.e.
+//
+//     lotter -f lotted.ledger relot -freeze-before 2022/01/01 > relotted.ledger
+//
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerOperation(
+		relotMain,
+		"relot",
+		"relot [-freeze-before=<date>] [<lot flags> ...]",
+		"Remove splits generated by an earlier lot, and add fresh lot splits.",
+	)
+}
+
+func relotMain(env *environment) error {
+	return lotOperate(env, true)
+}
+
+var (
+	// i.e. "    [Lot::2016/01/01:100ABC@0.02USD]  -100 ABC  ; :BUY: (inventory)"
+	generatedSplitPattern = regexp.MustCompile(`^    ;?\[[^\]]*\]\s+[^;]*;\s*:[A-Z]+:`)
+
+	// i.e. "    ; :PROCEEDS:TERM: ..." or "    ; lot: ..."
+	generatedCommentPattern = regexp.MustCompile(`^    ; (:PROCEEDS:TERM: |:DISPOSAL:[A-Z]+: |lot: )`)
+
+	// i.e. "    ; held: 366", following a generated split
+	generatedMetadataPattern = regexp.MustCompile(`^    ; [a-z]+: `)
+)
+
+// unlotLines removes lines generated by the lot operation, and
+// restores prices it commented out (i.e. "-1 ABC ; @ 1 USD").  Lines
+// removed are returned as well.
+func unlotLines(line []string) (ret, removed []string) {
+	generated := false // previous line
+	for _, l := range line {
+		if generatedSplitPattern.MatchString(l) || generatedCommentPattern.MatchString(l) || strings.HasPrefix(l, "    FIXME:lotter:") || (generated && generatedMetadataPattern.MatchString(l)) {
+			removed = append(removed, l)
+			generated = true
+			continue
+		}
+		generated = false
+		ret = append(ret, l)
+	}
+	if len(removed) == 0 {
+		return ret, nil
+	}
+	for i, l := range ret {
+		if _, ok := splitStructure(l); ok {
+			ret[i] = strings.Replace(l, " ; @", " @", 1)
+		}
+	}
+	return ret, removed
+}
+
+// frozenChange returns an error if the splits generated for a
+// transaction differ from those generated by an earlier lot (see
+// -freeze-before).  Splits are compared by account and amount, so
+// that a change of comment or alignment alone is not an error.
+func (this *lotter) frozenChange(txLines TxLines, generated []Posting) error {
+	figures := func(line []string) []string {
+		var ret []string
+		for _, l := range line {
+			if m := lotMetadataPattern.FindStringSubmatch(l); m != nil {
+				l = "    " + m[1] // i.e. "; lot: Lot:...  -100 ABC"
+			} else if !generatedSplitPattern.MatchString(l) {
+				continue
+			}
+			split, ok := this.parseSplit(l)
+			if !ok || split.delta == nil {
+				continue // disabled, or not a split
+			}
+			ret = append(ret, fmt.Sprintf("%s  %s", strings.Trim(split.account, "[]"), split.delta))
+		}
+		return ret
+	}
+	before := figures(txLines.Generated)
+
+	var after []string
+	for _, p := range generated {
+		if p.Err != nil || p.Disabled || p.Account == "" {
+			continue
+		}
+		after = append(after, fmt.Sprintf("%s  %s", p.Account, p.Amount))
+	}
+
+	sort.Strings(before)
+	sort.Strings(after)
+	if strings.Join(before, "\n") == strings.Join(after, "\n") {
+		return nil
+	}
+	return fmt.Errorf("lot, basis or gain splits would change (was %q, now %q)", before, after)
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRelotProceeds relots the output of lot, which must then be
+// unchanged.  The comment dividing proceeds by term is removed and
+// written again, not duplicated, while the splits of -proceeds are
+// tagged apart from it.
+func TestRelotProceeds(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join("testdata", "rebalance.ledger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lotted, relotted bytes.Buffer
+	err = runOperation(&lotted, newSettings(), newProblemTally(-1), input, "lot", "-proceeds=Lot:Proceeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runOperation(&relotted, newSettings(), newProblemTally(-1), lotted.Bytes(), "relot", "-proceeds=Lot:Proceeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relotted.String() != lotted.String() {
+		t.Errorf("relot changed output of lot:\n%s\nexpected:\n%s", relotted.String(), lotted.String())
+	}
+
+	out := relotted.String()
+	if n := strings.Count(out, "; :PROCEEDS:TERM: short term 50 ABC for 150 USD, long term 100 ABC for 300 USD"); n != 1 {
+		t.Errorf("%d comments dividing proceeds by term, expected 1", n)
+	}
+	if n := strings.Count(out, "; :PROCEEDS:\n"); n != 4 {
+		t.Errorf("%d splits of proceeds, expected 4", n)
+	}
+}
+
+// TestRelotFreeze relots edits of a lotted file, before and after
+// -freeze-before.  Only a change of the splits of a transaction before
+// it is a problem, not a change of alignment or comment.
+func TestRelotFreeze(t *testing.T) {
+	lotted := string(lotJournal(t, nettingJournal))
+	relot := func(input string) (string, int) {
+		t.Helper()
+		var out bytes.Buffer
+		problems := newProblemTally(0)
+		err := runOperation(&out, newSettings(), problems, []byte(input), "relot", "-freeze-before=2019/01/01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.String(), problems.count["frozen period changed"]
+	}
+	edit := func(old, new string) string {
+		t.Helper()
+		if !strings.Contains(lotted, old) {
+			t.Fatalf("lotted file lacks %q", old)
+		}
+		return strings.Replace(lotted, old, new, 1)
+	}
+
+	if _, n := relot(lotted); n != 0 {
+		t.Errorf("%d frozen changes of lotted file unchanged, expected 0", n)
+	}
+	if _, n := relot(edit("[Lot::2018/01/01:100ABC@100USD]  -10000 USD  ; :SELL: (basis consumed)", "[Lot::2018/01/01:100ABC@100USD]      -10000 USD ; :SELL:")); n != 0 {
+		t.Errorf("%d frozen changes of split realigned, expected 0", n)
+	}
+	if _, n := relot(edit("-100 ABC ; @ 35 USD", "-100 ABC ; @ 40 USD")); n != 1 {
+		t.Errorf("%d frozen changes of sale of 2018 edited, expected 1", n)
+	}
+	out, n := relot(edit("-10 XYZ ; @ 110 USD", "-10 XYZ ; @ 120 USD"))
+	if n != 0 || !strings.Contains(out, "[Lot:Income:short term gain]   -1100 USD") {
+		t.Errorf("%d frozen changes of sale of 2019 edited, expected 0 and gain of 1100 USD:\n%s", n, out)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation report
+//
+// Usage:
+//
+//     lotter -f <filename> report [-asof <date>] [-all]
+//
+// The `report` operation reads lots and gains recorded as metadata
+// (i.e. "; lot: ..."), by `lot -metadata`, and reports the balance of
+// each.  Open lots are listed with inventory and basis remaining,
+// followed by gains and other accounts.  For example,
+//
+//     Lot::2016/01/01:100ABC@0.02USD   79 ABC    1.58 USD
+//     Lot::2018/02/02:1000XYZ@0.01USD  1000 XYZ  10 USD
+//     Lot:Income:long term gain        10.78 USD
+//
+// Inventory, basis and gains are shown as positive (unlike the
+// double-entry amounts of the metadata).
+//
+// Use `-asof` to report only transactions on or before a date.  Lots
+// fully consumed are omitted, unless `-all`.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		reportMain,
+		"report",
+		"report [-asof=<date>] [-all]",
+		"Report lots and gains recorded as metadata (by lot -metadata).",
+	)
+}
+
+// i.e. "    ; lot: Lot::2016/01/01:100ABC@0.02USD  -100 ABC  :BUY: (inventory)"
+var lotMetadataPattern = regexp.MustCompile(`^\s+;\s*lot:\s*(.*)$`)
+
+func reportMain(env *environment) error {
+	// define flags
+	asofFlag := flag.String("asof", "", "report as of this date (i.e. 2022/12/31)")
+	allFlag := flag.Bool("all", false, "report lots fully consumed, and zero balances")
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	var asof time.Time
+	if *asofFlag != "" {
+		asof, err = parseDate(*asofFlag)
+		if err != nil {
+			return fmt.Errorf("bad -asof date (%q): %w", *asofFlag, err)
+		}
+	}
+
+	// tally balance of each account, per asset
+	balance := make(map[string]map[Asset]*big.Rat)
+	for env.scanner.Scan() {
+		txLines := env.scanner.Lines()
+		_, payeeIndex := txLines.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		if !asof.IsZero() && txLines.Date.After(asof) {
+			continue
+		}
+		for i, line := range txLines.Line[payeeIndex+1:] {
+			m := lotMetadataPattern.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			field := accountSeparator.Split(strings.TrimSpace(m[1]), 3)
+			if len(field) < 2 {
+				env.problems.add("unparsed metadata", lineErrorf(txLines.Start+payeeIndex+1+i, "expected account and amount (%q)", line))
+				continue
+			}
+			amount, err := env.parseAmount(field[1])
+			if err != nil {
+				env.problems.add("unparsed metadata", lineErrorf(txLines.Start+payeeIndex+1+i, "%w", err))
+				continue
+			}
+			account := field[0]
+			if balance[account] == nil {
+				balance[account] = make(map[Asset]*big.Rat)
+			}
+			if balance[account][amount.Asset] == nil {
+				balance[account][amount.Asset] = new(big.Rat)
+			}
+			balance[account][amount.Asset].Add(balance[account][amount.Asset], amount.Rat)
+		}
+	}
+
+	var account []string
+	for a := range balance {
+		account = append(account, a)
+	}
+	sort.Strings(account)
+
+	// lots (those holding inventory of an asset other than base) first
+	isLot := func(a string) bool {
+		for asset := range balance[a] {
+			if !env.isBase(asset) {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(account, func(i, j int) bool { return isLot(account[i]) && !isLot(account[j]) })
+
+	w := newReportWriter(env.output)
+	for _, a := range account {
+		var asset []Asset
+		for x, b := range balance[a] {
+			if b.Sign() != 0 || *allFlag {
+				asset = append(asset, x)
+			}
+		}
+		if isLot(a) && !*allFlag {
+			// omit lot fully consumed, even if basis did not round to zero
+			open := false
+			for _, x := range asset {
+				open = open || !env.isBase(x)
+			}
+			if !open {
+				continue
+			}
+		}
+		if len(asset) == 0 {
+			continue
+		}
+		// inventory, then basis
+		sort.Slice(asset, func(i, j int) bool {
+			if env.isBase(asset[i]) != env.isBase(asset[j]) {
+				return !env.isBase(asset[i])
+			}
+			return asset[i] < asset[j]
+		})
+
+		// metadata records inventory and gains with double-entry sign
+		// (i.e. inventory held and gains are negative), report them
+		// positive, as basis is
+		line := a
+		for _, x := range asset {
+			b := new(big.Rat).Set(balance[a][x])
+			if !isLot(a) || !env.isBase(x) {
+				b.Neg(b)
+			}
+			line += fmt.Sprintf("\t%s", env.NewAmount(x, *b))
+		}
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	lotted := string(lotJournal(t, summaryJournal, "-metadata"))
+	if strings.Contains(lotted, "[Lot") {
+		t.Errorf("-metadata generated splits:\n%s", lotted)
+	}
+	// metadata follows the split it is generated for
+	for _, expect := range []string{
+		"    Assets:Broker          -1 ABC @ 150 USD\n" +
+			"    ; lot: Lot::2019/01/01:2ABC@100USD  1 ABC  :SELL: 100 USD/ABC acquired 2019/01/01 held 151d (inventory consumed)\n" +
+			"    ; lot: Lot::2019/01/01:2ABC@100USD  -100 USD  :SELL: (basis consumed)\n" +
+			"    Assets:Cash\n" +
+			"    ; lot: Lot:Income:short term gain  -50 USD  :GAIN:SHORTTERM:\n" +
+			"    ; acquired: 2019/01/01\n" +
+			"    ; sold: 2019/06/01\n" +
+			"    ; held: 151\n",
+		"    Income:Staking\n" +
+			"    ; lot: Lot:Income:payment  -20 USD  :INCOME:\n",
+	} {
+		if !strings.Contains(lotted, expect) {
+			t.Errorf("lotted lacks:\n%s\nlotted:\n%s", expect, lotted)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	lotted := lotJournal(t, summaryJournal, "-metadata")
+	for _, test := range []struct {
+		arg    []string
+		expect []string
+	}{
+		{
+			arg: nil,
+			expect: []string{
+				"Lot::2020/03/01:1XYZ@10USD 1 XYZ 10 USD", // lots first, inventory and basis remaining
+				"Lot::2021/07/01:1XYZ@20USD 1 XYZ 20 USD",
+				"Lot:Income:long term gain 200 USD",
+				"Lot:Income:payment 20 USD",
+				"Lot:Income:short term gain 50 USD",
+			},
+		},
+		{
+			arg: []string{"-asof=2019/12/31"},
+			expect: []string{
+				"Lot::2019/01/01:2ABC@100USD 1 ABC 100 USD",
+				"Lot:Income:short term gain 50 USD",
+			},
+		},
+		{
+			arg: []string{"-all"},
+			expect: []string{
+				"Lot::2019/01/01:2ABC@100USD 0 ABC 0 USD", // consumed
+				"Lot::2020/03/01:1XYZ@10USD 1 XYZ 10 USD",
+				"Lot::2021/07/01:1XYZ@20USD 1 XYZ 20 USD",
+				"Lot:Income:long term gain 200 USD",
+				"Lot:Income:payment 20 USD",
+				"Lot:Income:short term gain 50 USD",
+			},
+		},
+	} {
+		var out bytes.Buffer
+		err := runOperation(&out, newSettings(), newProblemTally(-1), lotted, "report", test.arg...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reportLines(out.String())
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("report %v:\n%s\nexpected:\n%s", test.arg, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+	}
+
+	// metadata not parsed is counted, and the rest reported
+	bad := strings.Replace(string(lotted), "Lot:Income:payment  -20 USD", "Lot:Income:payment", 1)
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err := runOperation(&out, newSettings(), problems, []byte(bad), "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.count["unparsed metadata"] != 1 {
+		t.Errorf("%d unparsed metadata, expected 1", problems.count["unparsed metadata"])
+	}
+	if strings.Contains(out.String(), "payment") || !strings.Contains(out.String(), "short term gain") {
+		t.Errorf("report of bad metadata:\n%s", out.String())
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Operation simulate
+//
+// Usage:
+//
+//     lotter [-base <currency>] -f <filename> simulate -asset <asset> -quantity <number> -price <number> [-date <date>]
+//
+// The `simulate` operation replays transactions, as the `lot`
+// operation does, then sells a hypothetical quantity of an asset.  It
+// reports the lots that sale would consume, and resulting short and
+// long term gains, under each lot order (fifo, lifo and hifo).  This
+// allows comparing orders before actually trading.
+//
+// The price is per unit, in base currency.  The date of the sale
+// determines which transactions are replayed (those on or before the
+// date), and whether gains are short or long term.  By default, the
+// sale is today.  Use `-account` (and the same `-prune` as when
+// running `lot`) to sell from account-specific lots.  Transactions are
+// replayed by the same code as `lot`, which accepts the flags of `lot`
+// deciding how transactions are lotted (i.e. `-margin`, `-classes`,
+// `-hook`), other than `-order`.
+//
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+func init() {
+	registerOperation(
+		simulateMain,
+		"simulate",
+		"simulate -asset=<asset> -quantity=<number> -price=<number> [-date=<date>] [-account=<account>] [<lot flags>]",
+		"Compare lots consumed and gains of a hypothetical sale, under each lot order.",
+	)
+}
+
+func simulateMain(env *environment) error {
+	// define flags
+	assetFlag := flag.String("asset", "", "asset to sell")
+	quantityFlag := flag.String("quantity", "", "quantity to sell")
+	priceFlag := flag.String("price", "", "price per unit, in base currency")
+	dateFlag := flag.String("date", "", "date of sale (default today)")
+	accountFlag := flag.String("account", "", "account to sell from, when lots are per-account (see -prune)")
+	lotting := defineLotFlags() // -order is set for each order simulated
+
+	err := command.Parse()
+	if err != nil {
+		return err
+	}
+
+	// validate flags
+	if env.base == "" {
+		return errors.New("A base currency is required, i.e. `-base=USD`.")
+	}
+	if *assetFlag == "" {
+		return errors.New("Asset to sell is required, i.e. `-asset=ABC`.")
+	}
+	quantity, err := env.parseAmount(fmt.Sprintf("%s %s", *quantityFlag, *assetFlag))
+	if err != nil || quantity.Sign() < 1 {
+		return fmt.Errorf("bad -quantity (%q), expected a positive number", *quantityFlag)
+	}
+	price, err := env.parseAmount(fmt.Sprintf("%s %s", *priceFlag, env.base))
+	if err != nil || price.Sign() < 0 {
+		return fmt.Errorf("bad -price (%q), expected a number", *priceFlag)
+	}
+	date := time.Now()
+	if *dateFlag != "" {
+		date, err = parseDate(*dateFlag)
+		if err != nil {
+			return fmt.Errorf("bad -date (%q): %w", *dateFlag, err)
+		}
+	}
+	qualifier := env.getAssetQualifier(Split{account: *accountFlag})
+
+	// input is replayed once per order
+	data, err := ioutil.ReadAll(env.input)
+	if err != nil {
+		return err
+	}
+
+	proceeds := new(big.Rat).Mul(quantity.Rat, price.Rat)
+	w := newReportWriter(env.output)
+	fmt.Fprintf(w, "sell %s @ %s on %s, proceeds %s\n\n", quantity, price, date.Format("2006/01/02"), env.NewAmount(env.base, *proceeds))
+	for _, o := range lotOrder {
+		*lotting.order = string(o)
+		replay := *env
+		replay.scanner = NewTxScanner(bytes.NewReader(data))
+		lotted, err := replayLots(&replay, lotting, date, nil)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s:\n", o)
+		lot, inventory, basis, err := lotted.sell(qualifier, quantity.NegClone())
+		if err != nil {
+			fmt.Fprintf(w, "    %s\n\n", err)
+			continue
+		}
+
+		shortGain, longGain := new(big.Rat), new(big.Rat)
+		for i := range lot {
+			value := new(big.Rat).Mul(inventory[i].Rat, price.Rat)
+			gain := new(big.Rat).Add(value, basis[i].Rat) // basis is negative
+			term := "short term"
+			_, years, _, _, _, _, _, _ := Elapsed(lot[i].date, date)
+			if years > 0 {
+				term = "long term"
+				longGain.Add(longGain, gain)
+			} else {
+				shortGain.Add(shortGain, gain)
+			}
+			fmt.Fprintf(w, "    %s\t%s\t%s\tbasis %s\t%s gain %s\n", lot[i].date.Format("2006/01/02"), lot[i].name, inventory[i], basis[i].NegClone(), term, env.NewAmount(env.base, *gain))
+		}
+		fmt.Fprintf(w, "    short term gain %s, long term gain %s\n\n", env.NewAmount(env.base, *shortGain), env.NewAmount(env.base, *longGain))
+	}
+	return w.Flush()
+}
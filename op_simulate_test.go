@@ -0,0 +1,93 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// simulateJournal holds lots of 1 ABC at 100, 300 and 200 USD, then a
+// lot at 900 USD bought after the simulated sale.
+const simulateJournal = `2019/01/01 Buy
+    Assets:Broker          1 ABC @ 100 USD
+    Assets:Cash
+
+2020/06/01 Buy
+    Assets:Broker          1 ABC @ 300 USD
+    Assets:Cash
+
+2020/09/01 Buy
+    Assets:Broker          1 ABC @ 200 USD
+    Assets:Cash
+
+2021/03/01 Buy
+    Assets:Broker          1 ABC @ 900 USD
+    Assets:Cash
+`
+
+func simulate(t *testing.T, arg ...string) []string {
+	t.Helper()
+	var out bytes.Buffer
+	err := runOperation(&out, newSettings(), newProblemTally(-1), []byte(simulateJournal), "simulate", arg...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reportLines(out.String())
+}
+
+func TestSimulate(t *testing.T) {
+	got := simulate(t, "-asset=ABC", "-quantity=1.5", "-price=250", "-date=2021/01/01")
+	expect := []string{
+		"sell 1.5 ABC @ 250 USD on 2021/01/01, proceeds 375 USD",
+		"",
+		"fifo:",
+		"2019/01/01 Lot::2019/01/01:1ABC@100USD 1 ABC basis 100 USD long term gain 150 USD",
+		"2020/06/01 Lot::2020/06/01:1ABC@300USD 0.5 ABC basis 150 USD short term gain -25 USD",
+		"short term gain -25 USD, long term gain 150 USD",
+		"",
+		"lifo:", // lot bought after the sale is not consumed
+		"2020/09/01 Lot::2020/09/01:1ABC@200USD 1 ABC basis 200 USD short term gain 50 USD",
+		"2020/06/01 Lot::2020/06/01:1ABC@300USD 0.5 ABC basis 150 USD short term gain -25 USD",
+		"short term gain 25 USD, long term gain 0 USD",
+		"",
+		"hifo:",
+		"2020/06/01 Lot::2020/06/01:1ABC@300USD 1 ABC basis 300 USD short term gain -50 USD",
+		"2020/09/01 Lot::2020/09/01:1ABC@200USD 0.5 ABC basis 100 USD short term gain 25 USD",
+		"short term gain -25 USD, long term gain 0 USD",
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("simulated:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+
+	// more than held is reported per order, not an error
+	expectLines(t, simulate(t, "-asset=ABC", "-quantity=9", "-price=250", "-date=2021/01/01"),
+		"fifo:",
+		"failed to sell -6 ABC (of -9 ABC), no remaining inventory",
+	)
+
+	for _, arg := range [][]string{
+		{"-asset=ABC", "-quantity=-1", "-price=250"},
+		{"-asset=ABC", "-quantity=1", "-price=cheap"},
+		{"-asset=ABC", "-quantity=1", "-price=250", "-date=soon"},
+	} {
+		err := runOperation(&bytes.Buffer{}, newSettings(), newProblemTally(-1), []byte(simulateJournal), "simulate", arg...)
+		if err == nil {
+			t.Errorf("simulate %v: no error", arg)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"src.d10.dev/command"
+)
+
+// pairOrders returns a scanner of the transactions of in, with the
+// legs of one order (transactions of the same date and "order"
+// metadata, i.e. "; order: 8812") combined into one transaction, in
+// place of the first leg.  The splits of each leg are kept, and the
+// payee line of each leg after the first is kept as a comment (i.e.
+// "; leg: 2021/01/01 Buy XYZ").
+func (this *settings) pairOrders(in *TxScanner) *TxScanner {
+	var pending []TxLines // read ahead, not yet returned
+	var done bool         // in has no more
+	next := func() (TxLines, bool) {
+		if len(pending) > 0 {
+			tx := pending[0]
+			pending = pending[1:]
+			return tx, true
+		}
+		if done || !in.Scan() {
+			done = true
+			return TxLines{}, false
+		}
+		tx := in.Lines()
+		tx.Payee() // sets date
+		return tx, true
+	}
+
+	return newTxSource(func() (TxLines, bool) {
+		first, ok := next()
+		if !ok {
+			return first, false
+		}
+		order := first.Metadata("order")
+		if order == "" {
+			return first, true
+		}
+
+		// read ahead to the end of the day
+		for !done {
+			if n := len(pending); n > 0 && pending[n-1].Date.After(first.Date) {
+				break
+			}
+			if !in.Scan() {
+				done = true
+				break
+			}
+			tx := in.Lines()
+			tx.Payee()
+			pending = append(pending, tx)
+		}
+
+		leg := []TxLines{first}
+		var rest []TxLines
+		for _, tx := range pending {
+			if tx.Date.Equal(first.Date) && tx.Metadata("order") == order {
+				leg = append(leg, tx)
+			} else {
+				rest = append(rest, tx)
+			}
+		}
+		if len(leg) == 1 {
+			command.V(1).Infof("order %q (line %d) has one leg", order, first.Start)
+			return first, true
+		}
+
+		var pair TxLines
+		for i, tx := range leg {
+			tx, err := this.explicitSplits(tx)
+			if err != nil {
+				// not paired, lot will report the problem
+				command.V(1).Infof("not pairing legs of order %q (line %d): %s", order, first.Start, err)
+				return first, true
+			}
+			if i == 0 {
+				pair = tx
+			} else {
+				pair = appendLeg(pair, tx, "leg")
+			}
+		}
+		pending = rest
+		command.V(1).Infof("paired %d legs of order %q (line %d)", len(leg), order, first.Start)
+		return pair, true
+	})
+}
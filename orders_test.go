@@ -0,0 +1,90 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestPairOrders pairs the legs of an order, but neither a leg of the
+// same order on another day, nor an order of one leg.
+func TestPairOrders(t *testing.T) {
+	journal := `2021/01/01 Sell ABC
+    ; order: 1
+    Assets:Exchange           -10 ABC
+    Equity:Transfer
+
+2021/01/01 Deposit
+    Assets:Exchange           100 USD
+    Assets:Bank
+
+2021/01/01 Buy XYZ
+    ; order: 2
+    Assets:Exchange             1 XYZ @ 1 USD
+    Assets:Exchange
+
+2021/01/01 Buy XYZ
+    ; order: 1
+    Assets:Exchange             5 XYZ @@ 10 ABC
+    Equity:Transfer
+
+2021/01/02 Buy XYZ
+    ; order: 1
+    Assets:Exchange             5 XYZ @@ 10 ABC
+    Equity:Transfer
+`
+	s := newSettings().pairOrders(NewTxScanner(strings.NewReader(journal)))
+	var payee []string
+	var paired TxLines
+	for s.Scan() {
+		tx := s.Lines()
+		p, payeeIndex := tx.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		payee = append(payee, p)
+		if len(payee) == 1 {
+			paired = tx
+			paired.Line = append([]string(nil), tx.Line...)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "2021/01/01 Sell ABC, 2021/01/01 Deposit, 2021/01/01 Buy XYZ, 2021/01/02 Buy XYZ"
+	if got := strings.Join(payee, ", "); got != expect {
+		t.Errorf("transactions %s, expected %s", got, expect)
+	}
+
+	// the legs of order 1, each with its null amount written
+	var split []string
+	for _, line := range paired.Line[1:] {
+		split = append(split, strings.Join(strings.Fields(line), " "))
+	}
+	want := []string{
+		"; order: 1",
+		"Assets:Exchange -10 ABC",
+		"Equity:Transfer 10 ABC",
+		"; leg: 2021/01/01 Buy XYZ",
+		"; order: 1",
+		"Assets:Exchange 5 XYZ @@ 10 ABC",
+		"Equity:Transfer -10 ABC",
+	}
+	if strings.Join(split, "\n") != strings.Join(want, "\n") {
+		t.Errorf("paired legs:\n%s\nexpected:\n%s", strings.Join(split, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,599 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Posting is a split generated by an operation (as opposed to the
+// splits found in source data, which are written as-is).  A posting
+// without account is written as a comment only.
+type Posting struct {
+	Account string
+	Amount  Amount
+	Comment string
+
+	// if true, the posting is written but commented out (i.e. zero basis)
+	Disabled bool
+
+	// if non-nil, the error is written in place of a posting, so that
+	// ledger-cli will refuse the output until the problem is fixed
+	Err error
+
+	// metadata of the posting, each "key: value" (i.e. "held: 366")
+	Metadata []string
+}
+
+// Output is implemented by each supported output format.  Operations
+// write through the output of their environment, so that a new format
+// need only be implemented here, not once per operation.
+type Output interface {
+	// Lines writes data which is not a transaction (i.e. comments,
+	// directives, prices).
+	Lines(lines []string)
+
+	// Tx writes a transaction, its original (possibly modified) lines
+	// followed by generated postings.
+	Tx(tx TxLines, generated []Posting)
+
+	// Report writes the rows of a report (i.e. of holdings), each a
+	// list of cells.  Text formats align cells in columns; JSON and CSV
+	// write a record per row.
+	Report(rows [][]string)
+
+	// Flush writes any buffered output.
+	Flush() error
+}
+
+var outputFormat = [...]string{
+	"ledger",
+	"json",
+	"csv",
+	"beancount",
+}
+
+// NewOutput returns an output of the format.  Structured formats write
+// amounts of source data according to settings (see structure).
+func NewOutput(format string, w io.Writer, settings *settings) (Output, error) {
+	switch format {
+	case "ledger":
+		return &ledgerOutput{w: bufio.NewWriter(w)}, nil
+	case "json":
+		return &jsonOutput{w: bufio.NewWriter(w), settings: settings}, nil
+	case "csv":
+		return &csvOutput{w: csv.NewWriter(w), settings: settings}, nil
+	case "beancount":
+		return &beancountOutput{w: bufio.NewWriter(w), settings: settings}, nil
+	}
+	return nil, fmt.Errorf("unknown output format (%q), expected one of %s", format, strings.Join(outputFormat[:], ", "))
+}
+
+// ledgerOutput writes ledger-cli data, the default format.
+type ledgerOutput struct {
+	w *bufio.Writer
+}
+
+func (this *ledgerOutput) Lines(lines []string) {
+	for _, line := range lines {
+		fmt.Fprintln(this.w, line)
+	}
+	fmt.Fprintln(this.w, "") // blank line between blocks
+	this.w.Flush()
+}
+
+func (this *ledgerOutput) Tx(tx TxLines, generated []Posting) {
+	for _, line := range tx.Line {
+		fmt.Fprintln(this.w, line)
+	}
+	for _, line := range postingLines(tx, generated) {
+		fmt.Fprintln(this.w, line)
+	}
+	if !tx.joined {
+		fmt.Fprintln(this.w, "") // blank line between transactions
+	}
+	this.w.Flush()
+}
+
+// postingLines returns lines of ledger-cli data, which follow the lines
+// of tx, for generated postings.
+func postingLines(tx TxLines, generated []Posting) []string {
+	// Align generated postings with one another.  We pad with spaces,
+	// not tabs, so that columns line up regardless of tab width.
+	accountWidth, amountWidth := 0, 0
+	amount := make([]string, len(generated)) // formatted once
+	for i, p := range generated {
+		if p.Err != nil || p.Account == "" {
+			continue
+		}
+		amount[i] = p.Amount.String()
+		if n := utf8.RuneCountInString(p.Account) + 2; n > accountWidth {
+			accountWidth = n // with brackets
+		}
+		if n := utf8.RuneCountInString(amount[i]); n > amountWidth {
+			amountWidth = n // i.e. "€" is one rune, more than one byte
+		}
+	}
+
+	// When there is room, align generated amounts with the amounts of
+	// the original splits.
+	if column := amountColumn(tx); column > 0 {
+		if width := column - len("    ") - len("  ") - amountWidth; width > accountWidth {
+			accountWidth = width
+		}
+	}
+
+	var ret []string
+	for i, p := range generated {
+		if p.Err != nil {
+			ret = append(ret, fmt.Sprint("    FIXME:lotter:   ", p.Err))
+			continue
+		}
+		if p.Account == "" {
+			ret = append(ret, fmt.Sprintf("    ; %s", p.Comment))
+			continue
+		}
+		prefix := "    "
+		if p.Disabled {
+			prefix = "    ;"
+		}
+		line := fmt.Sprintf("%s%-*s  %*s", prefix, accountWidth, "["+p.Account+"]", amountWidth, amount[i])
+		if p.Comment != "" {
+			line = fmt.Sprintf("%s  ; %s", line, p.Comment)
+		}
+		ret = append(ret, line)
+		for _, m := range p.Metadata {
+			ret = append(ret, fmt.Sprintf("    ; %s", m))
+		}
+	}
+	return ret
+}
+
+func (this *ledgerOutput) Report(rows [][]string) {
+	writeReport(this.w, rows)
+	this.w.Flush()
+}
+
+func (this *ledgerOutput) Flush() error { return this.w.Flush() }
+
+// writeReport writes rows with cells aligned in columns, two spaces
+// apart.  As with text/tabwriter, the last cell of a row does not
+// widen its column.
+func writeReport(w io.Writer, rows [][]string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+// emptyRow is true of a row separating sections of a report.
+func emptyRow(row []string) bool {
+	return len(row) == 0 || len(row) == 1 && strings.TrimSpace(row[0]) == ""
+}
+
+// amountColumn measures the column at which amounts of a
+// transaction's splits end (that is, the width of each split up to
+// its price, cost or comment).  As ledger-cli aligns amounts on the
+// right, the widest is returned.  Splits indented or separated with
+// tabs are not measured, as tab width is unknown.  Returns 0 when no
+// split has an amount.
+func amountColumn(tx TxLines) int {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return 0
+	}
+	column := 0
+	for _, line := range tx.Line[payeeIndex+1:] {
+		if strings.ContainsRune(line, '\t') {
+			continue
+		}
+		line = strings.SplitN(line, ";", 2)[0]
+		line = strings.SplitN(line, "@", 2)[0]
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if i, _ := separatorIndex(strings.TrimSpace(line)); i == -1 {
+			continue // no amount
+		}
+		if width := utf8.RuneCountInString(line); width > column {
+			column = width
+		}
+	}
+	return column
+}
+
+// outputPosting is a split, either original or generated, in the form
+// written by structured (non-ledger) output formats.
+type outputPosting struct {
+	Account   string `json:"account"`
+	Amount    string `json:"amount,omitempty"` // empty when ledger-cli is to calculate the amount
+	Asset     Asset  `json:"asset,omitempty"`
+	Price     string `json:"price,omitempty"` // i.e. "@ 0.02 USD" or "@@ 2 USD"
+	Comment   string `json:"comment,omitempty"`
+	Generated bool   `json:"generated,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type outputTx struct {
+	Date     string          `json:"date"`
+	State    string          `json:"state,omitempty"`
+	Payee    string          `json:"payee"`
+	Comment  []string        `json:"comment,omitempty"`
+	Postings []outputPosting `json:"postings"`
+}
+
+// structure converts transaction lines and generated postings into a
+// form suitable for structured output.
+func (this *settings) structure(tx TxLines, generated []Posting) outputTx {
+	payee, payeeIndex := tx.Payee()
+	_, state, description, _ := payeeFields(payee)
+	ret := outputTx{
+		Date:  tx.Date.Format("2006-01-02"),
+		State: state,
+		Payee: description,
+	}
+	for _, line := range tx.Line[payeeIndex+1:] {
+		split, ok := this.parseSplit(line)
+		if !ok {
+			comment := strings.TrimLeft(strings.TrimSpace(line), "; ")
+			if comment != "" {
+				ret.Comment = append(ret.Comment, comment)
+			}
+			continue
+		}
+		p := outputPosting{
+			Account: split.account,
+			Comment: strings.TrimSpace(split.comment),
+		}
+		if split.delta != nil {
+			p.Amount = split.delta.Number()
+			p.Asset = split.delta.Asset
+		}
+		if split.cost != nil {
+			p.Price = fmt.Sprintf("@@ %s", split.cost)
+		} else if split.price != nil {
+			p.Price = fmt.Sprintf("@ %s", split.price)
+		}
+		ret.Postings = append(ret.Postings, p)
+	}
+	for _, g := range generated {
+		if g.Account == "" && g.Err == nil {
+			ret.Comment = append(ret.Comment, g.Comment)
+			continue
+		}
+		p := outputPosting{
+			Account:   g.Account,
+			Comment:   g.Comment,
+			Generated: true,
+			Disabled:  g.Disabled,
+		}
+		if g.Err != nil {
+			p.Error = g.Err.Error()
+		} else {
+			p.Amount = g.Amount.Number()
+			p.Asset = g.Amount.Asset
+		}
+		for _, m := range g.Metadata {
+			pair := strings.SplitN(m, ": ", 2)
+			if p.Metadata == nil {
+				p.Metadata = make(map[string]string)
+			}
+			p.Metadata[pair[0]] = pair[len(pair)-1]
+		}
+		ret.Postings = append(ret.Postings, p)
+	}
+	return ret
+}
+
+// jsonOutput writes one JSON object per transaction.  Data other than
+// transactions is omitted.
+type jsonOutput struct {
+	w        *bufio.Writer
+	settings *settings
+}
+
+func (this *jsonOutput) Lines(lines []string) {}
+
+func (this *jsonOutput) Tx(tx TxLines, generated []Posting) {
+	b, err := json.Marshal(this.settings.structure(tx, generated))
+	if err != nil {
+		panic(err) // should never be reached, all fields are marshalable
+	}
+	this.w.Write(b)
+	this.w.WriteByte('\n')
+	this.w.Flush()
+}
+
+// Report writes each row as an array of strings.
+func (this *jsonOutput) Report(rows [][]string) {
+	for _, row := range rows {
+		if emptyRow(row) {
+			continue
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			panic(err) // should never be reached, strings are marshalable
+		}
+		this.w.Write(b)
+		this.w.WriteByte('\n')
+	}
+	this.w.Flush()
+}
+
+func (this *jsonOutput) Flush() error { return this.w.Flush() }
+
+// csvOutput writes one row per split.  Data other than transactions
+// is omitted.
+type csvOutput struct {
+	w        *csv.Writer
+	settings *settings
+	header   bool
+}
+
+func (this *csvOutput) Lines(lines []string) {}
+
+func (this *csvOutput) Tx(tx TxLines, generated []Posting) {
+	if !this.header {
+		this.w.Write([]string{"date", "state", "payee", "account", "amount", "asset", "price", "comment", "generated", "error"})
+		this.header = true
+	}
+	s := this.settings.structure(tx, generated)
+	for _, p := range s.Postings {
+		comment := p.Comment
+		for _, key := range sortedKeys(p.Metadata) {
+			comment = fmt.Sprintf("%s %s: %s", comment, key, p.Metadata[key])
+		}
+		this.w.Write([]string{s.Date, s.State, s.Payee, p.Account, p.Amount, string(p.Asset), p.Price, strings.TrimSpace(comment), fmt.Sprint(p.Generated), p.Error})
+	}
+	this.w.Flush()
+}
+
+func (this *csvOutput) Report(rows [][]string) {
+	for _, row := range rows {
+		if !emptyRow(row) {
+			this.w.Write(row)
+		}
+	}
+	this.w.Flush()
+}
+
+func (this *csvOutput) Flush() error {
+	this.w.Flush()
+	return this.w.Error()
+}
+
+// beancountOutput writes Beancount (https://beancount.github.io/)
+// data.  Account and commodity names are converted to satisfy
+// Beancount's stricter naming rules.
+type beancountOutput struct {
+	w        *bufio.Writer
+	settings *settings
+}
+
+func (this *beancountOutput) Lines(lines []string) {
+	for _, line := range lines {
+		field := strings.Fields(strings.SplitN(line, ";", 2)[0])
+		if len(field) >= 4 && field[0] == "P" {
+			// i.e. "P 2004/06/21 02:17:58 TWCUX 27.76 USD", time is optional
+			if len(field) == 5 {
+				field = append(field[:2+1], field[2:]...)
+			}
+			date, err := parseDate(field[1])
+			if err == nil && len(field) >= 6 {
+				fmt.Fprintf(this.w, "%s price %s %s %s\n", date.Format("2006-01-02"), beancountCommodity(Asset(field[3])), field[4], beancountCommodity(Asset(field[5])))
+				continue
+			}
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, ";") {
+			fmt.Fprintln(this.w, line)
+		} else {
+			fmt.Fprintf(this.w, "; %s\n", line) // other directives are not translated
+		}
+	}
+	fmt.Fprintln(this.w, "")
+	this.w.Flush()
+}
+
+func (this *beancountOutput) Tx(tx TxLines, generated []Posting) {
+	s := this.settings.structure(tx, generated)
+	mark := "*"
+	if s.State == "!" {
+		mark = "!"
+	}
+	fmt.Fprintf(this.w, "%s %s %q\n", s.Date, mark, s.Payee)
+	for _, c := range s.Comment {
+		fmt.Fprintf(this.w, "  ; %s\n", c)
+	}
+	for _, p := range s.Postings {
+		if p.Error != "" {
+			fmt.Fprintf(this.w, "  FIXME ; %s\n", p.Error) // beancount refuses this, like ledger-cli would
+			continue
+		}
+		line := "  " + beancountAccount(p.Account)
+		if p.Disabled {
+			line = "  ; " + line
+		}
+		if p.Amount != "" {
+			line = fmt.Sprintf("%s  %s %s", line, p.Amount, beancountCommodity(p.Asset))
+			if p.Price != "" {
+				price := strings.Fields(p.Price) // i.e. "@", "0.02", "USD"
+				line = fmt.Sprintf("%s %s %s %s", line, price[0], price[1], beancountCommodity(Asset(price[2])))
+			}
+		}
+		if p.Comment != "" && !p.Disabled {
+			line = fmt.Sprintf("%s ; %s", line, p.Comment)
+		}
+		fmt.Fprintln(this.w, line)
+		for _, key := range sortedKeys(p.Metadata) {
+			fmt.Fprintf(this.w, "    %s: %q\n", key, p.Metadata[key])
+		}
+	}
+	fmt.Fprintln(this.w, "")
+	this.w.Flush()
+}
+
+func (this *beancountOutput) Report(rows [][]string) {
+	writeReport(this.w, rows)
+	this.w.Flush()
+}
+
+func (this *beancountOutput) Flush() error { return this.w.Flush() }
+
+var beancountRoot = map[string]bool{
+	"Assets":      true,
+	"Liabilities": true,
+	"Equity":      true,
+	"Income":      true,
+	"Expenses":    true,
+}
+
+// beancountAccount converts a ledger-cli account name, i.e.
+// "[Lot::2016/01/01:100ABC@0.02USD]" to a valid Beancount name,
+// i.e. "Equity:Lot:2016-01-01-100ABC-0-02USD".
+func beancountAccount(account string) string {
+	var part []string
+	for _, p := range strings.Split(strings.Trim(account, "[]()"), ":") {
+		p = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' {
+				return r
+			}
+			return '-'
+		}, strings.TrimSpace(p))
+		p = strings.Trim(p, "-")
+		if p == "" {
+			continue
+		}
+		r := []rune(p)
+		r[0] = unicode.ToUpper(r[0])
+		part = append(part, string(r))
+	}
+	if len(part) == 0 || !beancountRoot[part[0]] {
+		part = append([]string{"Equity"}, part...)
+	}
+	return strings.Join(part, ":")
+}
+
+// beancountCommodity converts an asset name to Beancount's
+// requirements (upper case, starting with a letter).
+func beancountCommodity(asset Asset) string {
+	c := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' || r == '\'' {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, string(asset))
+	if c == "" || !unicode.IsLetter([]rune(c)[0]) {
+		c = "C" + c
+	}
+	return c
+}
+
+// sortedKeys returns the keys of metadata, in order.
+func sortedKeys(metadata map[string]string) []string {
+	var key []string
+	for k := range metadata {
+		key = append(key, k)
+	}
+	sort.Strings(key)
+	return key
+}
+
+// nullOutput writes nothing, i.e. when transactions are lotted only for
+// the lots they leave (see replayLots).
+type nullOutput struct{}
+
+func (this nullOutput) Lines(lines []string)               {}
+func (this nullOutput) Tx(tx TxLines, generated []Posting) {}
+func (this nullOutput) Report(rows [][]string)             {}
+func (this nullOutput) Flush() error                       { return nil }
+
+// reportWriter collects a report written as to text/tabwriter (cells
+// ending in tab, rows in newline), and writes it to output when
+// flushed, so that reports are written in the format of -format.
+type reportWriter struct {
+	output Output
+	buf    bytes.Buffer
+}
+
+func newReportWriter(output Output) *reportWriter {
+	return &reportWriter{output: output}
+}
+
+func (this *reportWriter) Write(p []byte) (int, error) { return this.buf.Write(p) }
+
+func (this *reportWriter) Flush() error {
+	if this.buf.Len() == 0 {
+		return nil
+	}
+	var rows [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(this.buf.String(), "\n"), "\n") {
+		rows = append(rows, strings.Split(line, "\t"))
+	}
+	this.buf.Reset()
+	this.output.Report(rows)
+	return nil
+}
+
+// lotsOutput writes generated postings to a separate ledger file (see
+// lot -lots-out), and transactions to output unchanged, apart from
+// problems (FIXME).
+type lotsOutput struct {
+	Output        // transactions
+	lots   Output // generated postings
+}
+
+func (this lotsOutput) Tx(tx TxLines, generated []Posting) {
+	var fixme, lots []Posting
+	for _, p := range generated {
+		if p.Err != nil {
+			fixme = append(fixme, p)
+		} else {
+			lots = append(lots, p)
+		}
+	}
+	this.Output.Tx(tx, fixme)
+	if len(lots) == 0 {
+		return
+	}
+	// i.e. "2016/01/01 Bought ABC", followed only by generated postings
+	// (and seq, which orders lots when loaded by lot -append)
+	payee, _ := tx.Payee()
+	line := []string{payee}
+	if seq := tx.Metadata("seq"); seq != "" {
+		line = append(line, "    ; seq: "+seq)
+	}
+	this.lots.Tx(TxLines{Date: tx.Date, Start: tx.Start, Line: line}, lots)
+}
+
+func (this lotsOutput) Flush() error {
+	err := this.Output.Flush()
+	if e := this.lots.Flush(); err == nil {
+		err = e
+	}
+	return err
+}
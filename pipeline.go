@@ -0,0 +1,168 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Stage is an operation of a Pipeline, with its flags (i.e. "lot",
+// "-order=hifo").
+type Stage struct {
+	Operation string
+	Arg       []string
+}
+
+// Pipeline runs operations in sequence.  Each stage reads the
+// transactions written by the stage before it (as TxLines, not text),
+// and the last stage writes to output.  The transactions written by a
+// stage are held in memory, until the next stage reads them.
+type Pipeline []Stage
+
+// pipelineSeparator separates stages, i.e. "base + lot".
+const pipelineSeparator = "+"
+
+// ParsePipeline splits arguments into stages, i.e. "base -b=2020/01/01
+// + lot -order=hifo" into base and lot.
+func ParsePipeline(arg []string) (Pipeline, error) {
+	var this Pipeline
+	stage := []string{}
+	for i := 0; i <= len(arg); i++ {
+		if i < len(arg) && arg[i] != pipelineSeparator {
+			stage = append(stage, arg[i])
+			continue
+		}
+		if len(stage) == 0 {
+			return nil, errors.New("expected operation, before and after each \"+\"")
+		}
+		if _, ok := pipelineHandler(stage[0]); !ok {
+			return nil, fmt.Errorf("unknown operation (%q)", stage[0])
+		}
+		this = append(this, Stage{Operation: stage[0], Arg: stage[1:]})
+		stage = []string{}
+	}
+	return this, nil
+}
+
+// pipelineHandler returns the handler of an operation which may be a
+// stage (any but pipe itself).
+func pipelineHandler(name string) (func(*environment) error, bool) {
+	if name == "pipe" {
+		return nil, false
+	}
+	for _, op := range operations {
+		if op.name == name {
+			return op.handler, true
+		}
+	}
+	return nil, false
+}
+
+// Run reads transactions from the scanner of env, and writes the
+// output of the last stage to its output.  The operation of each
+// stage parses its flags from package-level flag and os, as when run
+// alone; these are restored when Run returns.
+func (this Pipeline) Run(env *environment) error {
+	global := flag.CommandLine
+	defer func(arg []string, prefix string) {
+		os.Args, flag.CommandLine = arg, global
+		log.SetPrefix(prefix)
+	}(os.Args, log.Prefix())
+
+	scanner := env.scanner
+	for i, stage := range this {
+		handler, ok := pipelineHandler(stage.Operation)
+		if !ok {
+			return fmt.Errorf("unknown operation (%q)", stage.Operation)
+		}
+
+		var buffer *txBuffer
+		stageEnv := *env // sharing problems found, see -max-errors
+		stageEnv.scanner = scanner
+		if i+1 < len(this) {
+			buffer = &txBuffer{report: env.output}
+			stageEnv.output = buffer
+		}
+
+		// the operation defines and parses its flags, as when run alone
+		flagset := flag.NewFlagSet(stage.Operation, flag.ContinueOnError)
+		global.VisitAll(func(f *flag.Flag) {
+			flagset.Var(f.Value, f.Name, f.Usage)
+		})
+		flag.CommandLine = flagset
+		os.Args = append([]string{stage.Operation}, stage.Arg...)
+		log.SetPrefix(fmt.Sprintf("lotter %s: ", stage.Operation))
+
+		err := handler(&stageEnv)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stage.Operation, err)
+		}
+		err = scanner.Err()
+		if err != nil {
+			return statusError(exitInput, err)
+		}
+
+		if buffer != nil {
+			scanner = buffer.scanner()
+		}
+	}
+	return nil
+}
+
+// txBuffer holds the output of a stage, for the next (see Pipeline).
+// A report is not transactions, so it is written to the output of the
+// pipeline.
+type txBuffer struct {
+	tx     []TxLines
+	report Output
+}
+
+func (this *txBuffer) Lines(lines []string) {
+	this.tx = append(this.tx, TxLines{Line: append([]string(nil), lines...)})
+}
+
+func (this *txBuffer) Tx(tx TxLines, generated []Posting) {
+	// The transaction is passed as parsed (payee and date found), with
+	// generated postings as lines, as the next stage reads splits from
+	// lines.  Lines are copied, as the caller may reuse them.
+	line := make([]string, 0, len(tx.Line)+len(generated))
+	line = append(line, tx.Line...)
+	line = append(line, postingLines(tx, generated)...)
+	tx.Line, tx.Generated = line, nil
+	this.tx = append(this.tx, tx)
+}
+
+func (this *txBuffer) Report(rows [][]string) { this.report.Report(rows) }
+
+func (this *txBuffer) Flush() error { return nil }
+
+// scanner returns a scanner of the transactions held.
+func (this *txBuffer) scanner() *TxScanner {
+	next := 0
+	return newTxSource(func() (TxLines, bool) {
+		if next >= len(this.tx) {
+			return TxLines{}, false
+		}
+		tx := this.tx[next]
+		this.tx[next] = TxLines{} // no longer needed
+		next++
+		return tx, true
+	})
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"src.d10.dev/command"
+)
+
+// PriceHistory holds prices, in base currency, observed in ledger-cli
+// price directives.  Keys are formed by historyKey(), and for
+// directives with a time, also by timedKey().
+type PriceHistory struct {
+	settings *settings // of base currency
+	price    map[string]*big.Rat
+}
+
+func newPriceHistory(settings *settings) PriceHistory {
+	return PriceHistory{settings: settings, price: make(map[string]*big.Rat)}
+}
+
+func historyKey(date time.Time, asset Asset) string {
+	return fmt.Sprintf("%s %s", date.Format("2006/01/02"), asset)
+}
+
+func timedKey(when time.Time, asset Asset) string {
+	return fmt.Sprintf("%s %s", when.Format("2006/01/02 15:04:05"), asset)
+}
+
+// Observe parses a price directive, i.e. "P 2004/06/21 02:17:58 TWCUX
+// 27.76 USD", and remembers the price if it is expressed in (or is
+// the price of) base currency.  Returns false if line is not a price
+// directive.
+//
+// https://www.ledger-cli.org/3.0/doc/ledger3.html#Commodity-price-histories
+func (this PriceHistory) Observe(line string) (bool, error) {
+	if !strings.HasPrefix(line, "P ") {
+		return false, nil
+	}
+	command.V(2).Info("\t", line) // debug
+	seg := strings.SplitN(line, ";", 2)
+	field := this.settings.priceFields(seg[0])
+
+	// support "P 2004/06/21 TWCUX 27.76 USD" by inserting a time
+	timed := len(field) == 6
+	if len(field) == 5 {
+		field = append(field[:2+1], field[2:]...)
+		field[2] = "00:00:00"
+	}
+	if len(field) != 6 {
+		return true, fmt.Errorf("failed to parse historical price (%q)", line)
+	}
+
+	counterIdx, invert := -1, false
+	if field[5] == string(this.settings.base) {
+		counterIdx, invert = 3, false
+	} else if field[3] == string(this.settings.base) {
+		counterIdx, invert = 5, true
+	} else {
+		command.V(1).Infof("ignoring non-base price (%q)", line)
+		return true, nil
+	}
+
+	date, err := parseDate(field[1])
+	if err != nil {
+		return true, fmt.Errorf("failed to parse historical price (%q): %w", line, err)
+	}
+
+	price, ok := new(big.Rat).SetString(field[4])
+	if !ok {
+		return true, fmt.Errorf("failed to parse historical price (%q)", line)
+	}
+	if invert {
+		price.Inv(price)
+	}
+
+	key := historyKey(date, Asset(field[counterIdx]))
+	old, ok := this.price[key]
+	if ok {
+		// TODO(dnc): round strings to proper precision
+		command.V(1).Infof("updating price history (was %s, now %s)\n\t%s", old.FloatString(6), price.FloatString(6), line)
+	}
+	this.price[key] = price
+
+	if timed {
+		clock, err := parseClock(field[2])
+		if err != nil {
+			return true, fmt.Errorf("failed to parse historical price (%q): %w", line, err)
+		}
+		this.price[timedKey(date.Add(clock), Asset(field[counterIdx]))] = price
+	}
+	return true, nil
+}
+
+// parseClock parses a time of day, i.e. "02:17:58" or "02:17", as a
+// duration since midnight.
+func parseClock(str string) (time.Duration, error) {
+	for _, f := range []string{"15:04:05", "15:04"} {
+		t, err := time.Parse(f, str)
+		if err == nil {
+			return t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())), nil
+		}
+	}
+	return 0, fmt.Errorf("failed to parse time (%q)", str)
+}
+
+// priceFields splits a price directive into fields, the price as
+// number followed by asset (even when written i.e. "€40000").
+func (this *settings) priceFields(directive string) []string {
+	field := strings.Fields(directive)
+	if len(field) > 0 {
+		if symbol, number, ok := splitSymbol(field[len(field)-1]); ok && Asset(symbol) == this.base {
+			field = append(field[:len(field)-1], number, symbol)
+		}
+	}
+	return field
+}
+
+// normalizePrice rewrites a price directive in a consistent form,
+// i.e. "P 2004-6-21 TWCUX 27.760 USD" becomes "P 2004/06/21 TWCUX
+// 27.76 USD".  The time and comment, if any, are preserved.
+func (this *settings) normalizePrice(line string) (string, error) {
+	seg := strings.SplitN(line, ";", 2)
+	field := this.priceFields(seg[0])
+	if len(field) != 5 && len(field) != 6 {
+		return line, fmt.Errorf("failed to parse historical price (%q)", line)
+	}
+	date, err := parseDate(field[1])
+	if err != nil {
+		return line, fmt.Errorf("failed to parse historical price (%q): %w", line, err)
+	}
+	n := len(field)
+	price, err := this.parseAmount(fmt.Sprintf("%s %s", field[n-2], field[n-1]))
+	if err != nil {
+		return line, fmt.Errorf("failed to parse historical price (%q): %w", line, err)
+	}
+
+	ret := append([]string{"P", date.Format("2006/01/02")}, field[2:n-2]...) // time (if any) and asset
+	ret = append(ret, price.String())
+	if len(seg) > 1 {
+		ret = append(ret, ";"+seg[1])
+	}
+	return strings.Join(ret, " "), nil
+}
+
+// Lookup returns the price of asset, in base currency, on date.
+func (this PriceHistory) Lookup(date time.Time, asset Asset) (*big.Rat, bool) {
+	price, ok := this.price[historyKey(date, asset)]
+	return price, ok
+}
+
+// LookupTime returns the price of asset, in base currency, from the
+// price directive nearest in time to when, on the same day.  When no
+// directive of that day has a time, the price is that of Lookup().
+func (this PriceHistory) LookupTime(when time.Time, asset Asset) (*big.Rat, bool) {
+	day := when.Format("2006/01/02") + " "
+	suffix := " " + string(asset)
+	var nearest string
+	var distance time.Duration
+	for key := range this.price {
+		if !strings.HasPrefix(key, day) || !strings.HasSuffix(key, suffix) || len(key) != len(timedKey(when, asset)) {
+			continue
+		}
+		t, err := time.Parse("2006/01/02 15:04:05", strings.TrimSuffix(key, suffix))
+		if err != nil {
+			continue
+		}
+		d := t.Sub(when)
+		if d < 0 {
+			d = -d
+		}
+		if nearest == "" || d < distance || (d == distance && key < nearest) {
+			nearest, distance = key, d
+		}
+	}
+	if nearest == "" {
+		return this.Lookup(when, asset)
+	}
+	return this.price[nearest], true
+}
+
+// Latest returns the most recent price of asset, in base currency, on
+// or before date, and the date of that price.
+func (this PriceHistory) Latest(date time.Time, asset Asset) (*big.Rat, time.Time, bool) {
+	limit := historyKey(date, asset)
+	var latest string
+	for key := range this.price {
+		if key <= limit && key > latest && strings.HasSuffix(key, " "+string(asset)) && len(key) == len(limit) {
+			latest = key
+		}
+	}
+	if latest == "" {
+		return nil, time.Time{}, false
+	}
+	when, _ := parseDate(strings.Fields(latest)[0])
+	return this.price[latest], when, true
+}
+
+// Check returns an error for each split of a transaction whose price,
+// in base currency, differs by more than pct percent from the price
+// directive of the same day (if any).  Such a split is likely a typo,
+// i.e. "@" where "@@" was meant.
+func (this PriceHistory) Check(tx TxLines, pct float64) (errs []error) {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return nil
+	}
+	limit := new(big.Rat).SetFloat64(pct / 100)
+	for i, line := range tx.Line[payeeIndex+1:] {
+		split, ok := this.settings.parseSplit(line)
+		if !ok || split.delta == nil || split.delta.Sign() == 0 || (split.price == nil && split.cost == nil) {
+			continue
+		}
+		isCost := split.cost != nil // "@@", before Cost() is calculated
+		if !this.settings.isBase(split.Cost().Asset) || this.settings.isBase(split.delta.Asset) {
+			continue
+		}
+		directive, ok := this.Lookup(tx.Date, split.delta.Asset)
+		if !ok || directive.Sign() == 0 {
+			continue
+		}
+
+		// differs returns true if unit price differs beyond limit
+		differs := func(unit *big.Rat) bool {
+			diff := new(big.Rat).Sub(unit, directive)
+			diff.Abs(diff).Quo(diff, directive)
+			return diff.Cmp(limit) > 0
+		}
+
+		quantity := new(big.Rat).Abs(split.delta.Rat)
+		unit := new(big.Rat).Abs(split.Cost().Rat)
+		unit.Quo(unit, quantity)
+		if !differs(unit) {
+			continue
+		}
+
+		hint := ""
+		if !isCost && !differs(new(big.Rat).Quo(new(big.Rat).Abs(split.price.Rat), quantity)) {
+			hint = ", did you mean \"@@\"?"
+		} else if isCost && !differs(new(big.Rat).Abs(split.cost.Rat)) {
+			hint = ", did you mean \"@\"?"
+		}
+		errs = append(errs, lineErrorf(tx.Start+payeeIndex+1+i, "price of %s (%s) differs from price directive (%s) by more than %v%%%s",
+			split.delta.Asset, this.settings.NewAmount(this.settings.base, *unit), this.settings.NewAmount(this.settings.base, *directive), pct, hint))
+	}
+	return errs
+}
+
+// Read observes all price directives in ledger-cli data.  Other
+// data is ignored.
+func (this PriceHistory) Read(in io.Reader) error {
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		_, err := this.Observe(s.Text())
+		if err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// tradePricesComment begins the price directives written by lot
+// -write-prices, so that relot recognizes them.
+const tradePricesComment = "; prices of trades, written by lotter"
+
+// appendTradePrice appends the price directive (i.e. "P 2017/01/01
+// ABC 1 USD") implied by the price or cost of a split, unless
+// directive has it already.
+func (this *settings) appendTradePrice(directive []string, date time.Time, line string) []string {
+	split, ok := this.parseSplit(line)
+	if !ok || split.delta == nil || split.delta.Sign() == 0 || split.rebate || (split.price == nil && split.cost == nil) {
+		return directive
+	}
+	price := split.Price().AbsClone()
+	if price.Asset == split.delta.Asset {
+		return directive
+	}
+	p := fmt.Sprintf("P %s %s %s", date.Format("2006/01/02"), split.delta.Asset, price)
+	for _, d := range directive {
+		if d == p {
+			return directive
+		}
+	}
+	return append(directive, p)
+}
+
+// isTradePrices returns true if tx is the price directives written by
+// lot -write-prices.
+func isTradePrices(tx TxLines) bool {
+	return len(tx.Line) > 0 && tx.Line[0] == tradePricesComment
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/pprof"
+
+	"src.d10.dev/command"
+)
+
+// Exit status of lotter.  Statuses 1 and 2 are those of the command
+// package.
+const (
+	exitOK        = 0
+	exitError     = 1 // processing error
+	exitUsage     = 2 // incorrect flags or arguments
+	exitInput     = 3 // failed to parse input
+	exitInventory = 4 // inconsistent inventory of lots
+)
+
+// problemStatus is the exit status for problems of a kind, if other
+// than exitError.
+var problemStatus = map[string]int{
+	"unparsed transaction": exitInput,
+	"failed trade":         exitInventory,
+	"failed move":          exitInventory,
+	"failed margin":        exitInventory,
+}
+
+// problemTally tallies errors by kind, so that a summary can be shown
+// rather than each error alone.  Operations of one run share a tally
+// (see environment), so that stages of a pipe stop at the limit
+// together.
+type problemTally struct {
+	// limit is the number of problems after which an operation stops
+	// processing (see -max-errors).  Zero means no limit, negative
+	// means the operation's default.
+	limit int
+
+	total  int
+	status int      // exit status, of first problem
+	kind   []string // in order first seen
+	count  map[string]int
+	first  map[string]int // line number of first occurrence
+}
+
+func newProblemTally(limit int) *problemTally {
+	return &problemTally{
+		limit: limit,
+		count: make(map[string]int),
+		first: make(map[string]int),
+	}
+}
+
+// defaultLimit sets the limit on problems, unless set by the
+// `-max-errors` flag.
+func (this *problemTally) defaultLimit(limit int) {
+	if this.limit < 0 {
+		this.limit = limit
+	}
+}
+
+// stopped returns true when the limit on problems has been reached.
+func (this *problemTally) stopped() bool {
+	return this.limit > 0 && this.total >= this.limit
+}
+
+// LineError is an error found on a line of input.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (this LineError) Error() string { return fmt.Sprintf("line %d: %s", this.Line, this.Err) }
+func (this LineError) Unwrap() error { return this.Err }
+
+// lineErrorf returns a LineError, formatted like fmt.Errorf.
+func lineErrorf(line int, format string, arg ...interface{}) error {
+	return LineError{Line: line, Err: fmt.Errorf(format, arg...)}
+}
+
+// add logs an error, and tallies it by kind (i.e. "missing price").
+// Returns true when processing should stop, because the limit on
+// problems has been reached.
+func (this *problemTally) add(kind string, err error) (stop bool) {
+	command.Error(err)
+
+	this.total++
+	if this.status == exitOK {
+		this.status = exitError
+		if status, ok := problemStatus[kind]; ok {
+			this.status = status
+		}
+	}
+	if this.count[kind] == 0 {
+		this.kind = append(this.kind, kind)
+		var lineErr LineError
+		if errors.As(err, &lineErr) {
+			this.first[kind] = lineErr.Line
+		}
+	}
+	this.count[kind]++
+	return this.stopped()
+}
+
+// summary logs the count of problems of each kind.
+func (this *problemTally) summary() {
+	if this.total == 0 {
+		return
+	}
+	log.Printf("%d error(s):", this.total)
+	for _, kind := range this.kind {
+		where := ""
+		if this.first[kind] > 0 {
+			where = fmt.Sprintf(" (first on line %d)", this.first[kind])
+		}
+		log.Printf("\t%d %s%s", this.count[kind], kind, where)
+	}
+	if this.stopped() {
+		log.Printf("stopped after %d error(s), see -max-errors", this.total)
+	}
+}
+
+// StatusError ends an operation, with exit status other than that of
+// a usage error (i.e. exitInput).  Operations return it, rather than
+// exit, so that deferred cleanup runs and main decides how to exit.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (this StatusError) Error() string { return this.Err.Error() }
+func (this StatusError) Unwrap() error { return this.Err }
+
+// statusError returns a StatusError.
+func statusError(status int, err error) error {
+	return StatusError{Status: status, Err: err}
+}
+
+// operationError logs a StatusError, and records its status for main.
+// Other errors (i.e. bad flags) are returned, as usage errors.
+func (this *environment) operationError(err error) error {
+	var statusErr StatusError
+	if errors.As(err, &statusErr) {
+		command.Error(statusErr.Err)
+		this.status = statusErr.Status
+		return nil
+	}
+	return err
+}
+
+// fatal logs an error and exits with status.
+func (this *problemTally) fatal(status int, err error) {
+	command.Error(err)
+	this.exit(status)
+}
+
+// exit terminates lotter, with status (if greater than exitError) or
+// the status of problems found (if any).
+func (this *problemTally) exit(status int) {
+	if this.status > status {
+		status = this.status
+	}
+	if status > exitError {
+		// command.Exit() exits only with status 1 or 2
+		pprof.StopCPUProfile()
+		os.Exit(status)
+	}
+	command.Exit()
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// qualifierRule names the lot queue of accounts matching a pattern.
+type qualifierRule struct {
+	pattern *regexp.Regexp
+	name    string
+}
+
+// readQualifiers reads rules, one per line, of an account pattern
+// (regular expression) and qualifier, separated by two or more spaces
+// (or tab).  For example,
+//
+//     ^Assets:Crypto:Kraken(Margin)?(:|$)    Kraken
+//     ^Assets:Crypto:Cold                    Cold
+//
+// Blank lines and comments (beginning with ";" or "#") are ignored.
+func (this *settings) readQualifiers(in io.Reader) error {
+	s := bufio.NewScanner(in)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := accountSeparator.Split(text, 2)
+		if len(field) != 2 || strings.TrimSpace(field[1]) == "" {
+			return lineErrorf(line, "expected account pattern and qualifier (%q)", text)
+		}
+		pattern, err := regexp.Compile(field[0])
+		if err != nil {
+			return lineErrorf(line, "bad account pattern (%q): %w", field[0], err)
+		}
+		this.qualifierRules = append(this.qualifierRules, qualifierRule{pattern: pattern, name: strings.TrimSpace(field[1])})
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to read qualifiers: %w", err)
+	}
+	return nil
+}
+
+// qualifier returns the name by which lots of an account are
+// queued.  That is the qualifier of the first rule matching the
+// account (if any), otherwise the account name pruned to depth.
+func (this *settings) qualifier(account string) string {
+	for _, rule := range this.qualifierRules {
+		if rule.pattern.MatchString(account) {
+			return rule.name
+		}
+	}
+	if this.prune < 0 {
+		return account
+	}
+	// Pruning at 2 treats "Assets:BTC:hot" and "Assets:BTC:cold" as
+	// the same lot queue.  Pruning at 3 (or more) treats them as
+	// separate lot queues.  Pruning at 0 treats all BTC in the same
+	// lot queue.
+	seg := strings.Split(account, ":")
+	if len(seg) > this.prune {
+		return strings.Join(seg[:this.prune], ":")
+	}
+	return account
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// dayScanner reads transactions a day at a time, and returns those of
+// each day with acquisitions first, so that a sale is not attempted
+// before the purchase of the same day (as in exports not ordered
+// within a day).  Output written while a day is processed is
+// buffered, then written in the original order of the data.
+type dayScanner struct {
+	scanner  *TxScanner
+	output   Output    // where buffered output is written
+	settings *settings // which assets are base currency
+
+	day     []TxLines // current day, in order processed
+	index   []int     // original position of each
+	next    int
+	pending *TxLines // first transaction of the following day
+
+	recorded [][]func(Output) // output of each, by original position
+	current  int
+}
+
+func newDayScanner(scanner *TxScanner, output Output, settings *settings) *dayScanner {
+	return &dayScanner{scanner: scanner, output: output, settings: settings}
+}
+
+func (this *dayScanner) Scan() bool {
+	if this.next >= len(this.day) {
+		this.Flush()
+		if !this.read() {
+			return false
+		}
+	}
+	this.current = this.index[this.next]
+	this.next++
+	return true
+}
+
+func (this *dayScanner) Lines() TxLines { return this.day[this.next-1] }
+
+// read the transactions of one day (and data which is not a
+// transaction, among them).
+func (this *dayScanner) read() bool {
+	this.day, this.index, this.next = nil, nil, 0
+	var date time.Time
+	if this.pending != nil {
+		this.day = append(this.day, *this.pending)
+		date = this.pending.Date
+		this.pending = nil
+	}
+	for this.scanner.Scan() {
+		tx := this.scanner.Lines()
+		_, payeeIndex := tx.Payee()
+		if payeeIndex != PayeeNotFound {
+			if !date.IsZero() && !tx.Date.Equal(date) {
+				this.pending = &tx
+				break
+			}
+			date = tx.Date
+		}
+		this.day = append(this.day, tx)
+	}
+
+	for i := range this.day {
+		this.index = append(this.index, i)
+	}
+	sort.SliceStable(this.index, func(i, j int) bool {
+		return !this.settings.disposes(this.day[this.index[i]]) && this.settings.disposes(this.day[this.index[j]])
+	})
+	sorted := make([]TxLines, len(this.day))
+	for i, j := range this.index {
+		sorted[i] = this.day[j]
+	}
+	this.day = sorted
+	this.recorded = make([][]func(Output), len(this.day))
+	return len(this.day) > 0
+}
+
+// Flush writes output buffered for the current day.
+func (this *dayScanner) Flush() {
+	for _, recorded := range this.recorded {
+		for _, f := range recorded {
+			f(this.output)
+		}
+	}
+	this.recorded = nil
+}
+
+// disposes returns true if a transaction sends an asset other than
+// base currency (i.e. sells or moves it).
+func (this *settings) disposes(tx TxLines) bool {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return false
+	}
+	for _, line := range tx.Line[payeeIndex+1:] {
+		split, ok := this.parseSplit(line)
+		if ok && split.delta != nil && split.delta.Sign() < 0 && !this.isBase(split.delta.Asset) && !split.isLoan() {
+			return true
+		}
+	}
+	return false
+}
+
+// dayOutput buffers output, see dayScanner.
+type dayOutput struct{ scanner *dayScanner }
+
+func (this dayOutput) record(f func(Output)) {
+	s := this.scanner
+	if s.current >= len(s.recorded) {
+		f(s.output) // after the last day, nothing is buffered
+		return
+	}
+	s.recorded[s.current] = append(s.recorded[s.current], f)
+}
+
+func (this dayOutput) Lines(lines []string) {
+	this.record(func(out Output) { out.Lines(lines) })
+}
+
+func (this dayOutput) Tx(tx TxLines, generated []Posting) {
+	tx.Line = append([]string(nil), tx.Line...) // caller may reuse
+	this.record(func(out Output) { out.Tx(tx, generated) })
+}
+
+func (this dayOutput) Report(rows [][]string) {
+	this.record(func(out Output) { out.Report(rows) })
+}
+
+func (this dayOutput) Flush() error {
+	this.scanner.Flush()
+	return this.scanner.output.Flush()
+}
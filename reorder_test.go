@@ -0,0 +1,69 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestReorderDay lots a sale written before the purchase of the same
+// day.  With -reorder-day, the purchase is lotted first, while output
+// keeps the order of the journal.
+func TestReorderDay(t *testing.T) {
+	journal := `2021/01/01 Buy
+    Assets:Crypto            1 ABC @ 10 USD
+    Assets:Bank
+
+2021/01/02 Sell
+    Assets:Crypto           -2 ABC @ 30 USD
+    Assets:Bank
+
+2021/01/02 Buy
+    Assets:Crypto            1 ABC @ 20 USD
+    Assets:Bank
+`
+	var out bytes.Buffer
+	problems := newProblemTally(0)
+	err := runOperation(&out, newSettings(), problems, []byte(journal), "lot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.total != 1 {
+		t.Errorf("%d problems without -reorder-day, expected 1 (sale before purchase)", problems.total)
+	}
+
+	out.Reset()
+	problems = newProblemTally(0)
+	err = runOperation(&out, newSettings(), problems, []byte(journal), "lot", "-reorder-day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems.total != 0 {
+		t.Errorf("%d problems with -reorder-day, expected 0", problems.total)
+	}
+	var payee []string
+	for _, tx := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n\n") {
+		payee = append(payee, strings.SplitN(tx, "\n", 2)[0])
+	}
+	if got := strings.Join(payee, ", "); got != "2021/01/01 Buy, 2021/01/02 Sell, 2021/01/02 Buy" {
+		t.Errorf("order of output with -reorder-day is %s", got)
+	}
+	if sell := txBlock(out.String(), "Sell"); !strings.Contains(sell, "-30 USD  ; :GAIN:SHORTTERM:") {
+		t.Errorf("sale consumed other than lots of 10 and 20 USD:\n%s", sell)
+	}
+}
@@ -17,7 +17,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -29,8 +31,17 @@ const PayeeNotFound int = -1
 // when lines contain a transaction with a payee line.
 type TxLines struct {
 	Line  []string
+	Start int       // line number (in source data) of Line[0]
 	payee *int      // index
 	Date  time.Time // based on date in payee line
+
+	// lines generated by an earlier run of lotter, removed when
+	// scanning with unlot (see relot)
+	Generated []string
+
+	// if true, the next block (a directive) follows without a blank
+	// line
+	joined bool
 }
 
 // Inspect transaction lines and find the "payee" line.  The payee
@@ -69,8 +80,28 @@ func parseDate(str string) (t time.Time, e error) {
 	return
 }
 
+// payeeFields splits a payee line, i.e. "2016-01-01 * Bought ABC ;
+// comment", into date, state ("*", "!" or empty), description and
+// comment.
+func payeeFields(line string) (date, state, description, comment string) {
+	commentSplit := strings.SplitN(line, ";", 2)
+	if len(commentSplit) > 1 {
+		comment = strings.TrimSpace(commentSplit[1])
+	}
+	spaceSplit := strings.SplitN(strings.TrimSpace(commentSplit[0]), " ", 2)
+	date = spaceSplit[0]
+	if len(spaceSplit) > 1 {
+		description = strings.TrimSpace(spaceSplit[1])
+		if strings.HasPrefix(description, "*") || strings.HasPrefix(description, "!") {
+			state, description = description[:1], strings.TrimSpace(description[1:])
+		}
+	}
+	return
+}
+
 // returns offset of payee line, or -1 if not a transaction.
 func (this *TxLines) findPayee() int {
+	this.payee = newInt(-1) // unless found
 	isTx := false
 	for i := len(this.Line) - 1; i >= 0; i-- {
 		splitComment := strings.Split(this.Line[i], ";")
@@ -108,43 +139,295 @@ func (this *TxLines) findPayee() int {
 
 func (this *TxLines) Len() int { return len(this.Line) }
 
+// ledger-cli metadata, i.e. "; txid: 0xabc"
+var metadataPattern = regexp.MustCompile(`(?:^|\s)([A-Za-z][A-Za-z0-9_-]*):\s+(\S+)`)
+
+// Metadata returns the value of a transaction's metadata tag (i.e.
+// "txid"), found in the payee line comment or in comment lines
+// preceding the first split.  Returns "" if not found.
+func (this *TxLines) Metadata(key string) string {
+	_, payeeIndex := this.Payee()
+	if payeeIndex == PayeeNotFound {
+		return ""
+	}
+	for i, line := range this.Line[payeeIndex:] {
+		commentSplit := strings.SplitN(line, ";", 2)
+		if i > 0 && strings.TrimSpace(commentSplit[0]) != "" {
+			break // reached first split
+		}
+		if len(commentSplit) < 2 {
+			continue
+		}
+		for _, m := range metadataPattern.FindAllStringSubmatch(commentSplit[1], -1) {
+			if strings.EqualFold(m[1], key) {
+				return m[2]
+			}
+		}
+	}
+	return ""
+}
+
+// Time returns the date and time of a transaction, when its "time"
+// metadata (i.e. "; time: 14:05:00") is present.  Otherwise, returns
+// the date and false.
+func (this *TxLines) Time() (time.Time, bool) {
+	value := this.Metadata("time")
+	if value == "" {
+		return this.Date, false
+	}
+	clock, err := parseClock(value)
+	if err != nil {
+		return this.Date, false
+	}
+	return this.Date.Add(clock), true
+}
+
+// Cleared returns true if a transaction is marked cleared, i.e.
+// "2021/01/01 * Bought ABC".  A transaction marked pending ("!"), or
+// not marked, is not cleared.
+func (this *TxLines) Cleared() bool {
+	payee, payeeIndex := this.Payee()
+	if payeeIndex == PayeeNotFound {
+		return false
+	}
+	field := strings.Fields(payee)
+	return len(field) > 1 && strings.HasPrefix(field[1], "*")
+}
+
 type TxScanner struct {
 	scanner *bufio.Scanner
 	lines   TxLines
+	line    int // count of lines scanned
+
+	// accounts declared, i.e. "account Assets:Crypto"
+	account map[string]bool
+
+	// default account, i.e. "bucket Assets:Checking", which balances
+	// transactions of one posting
+	bucket string
+
+	// if set, content generated by an earlier run of lotter is
+	// removed from each transaction (see relot)
+	unlot bool
+
+	// if set, transactions are taken from source rather than parsed
+	// (see Pipeline)
+	source func() (TxLines, bool)
+
+	// scanners of the files merged into source, if any (see
+	// mergeScanners)
+	merged []*TxScanner
+
+	// content of the transaction being scanned, and the end of each
+	// line within it
+	buf []byte
+	end []int
+
+	// directive line which ended the previous transaction
+	held []byte
 }
 
+// maxLineLength limits the length of a line of input.  Data is
+// scanned one transaction at a time, so memory use is not otherwise
+// limited by size of input.
+const maxLineLength = 1024 * 1024
+
 func NewTxScanner(in io.Reader) *TxScanner {
 	this := &TxScanner{
 		scanner: bufio.NewScanner(in),
+		account: make(map[string]bool),
 	}
+	this.scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
 	return this
 }
 
+// newTxSource returns a scanner of transactions taken from source,
+// rather than parsed.
+func newTxSource(source func() (TxLines, bool)) *TxScanner {
+	return &TxScanner{
+		account: make(map[string]bool),
+		source:  source,
+	}
+}
+
 func (this *TxScanner) Scan() bool {
+	if this.source != nil {
+		return this.scanSource()
+	}
+
+	// Lines of a transaction are copied into one buffer (reused from
+	// one transaction to the next), then into one string, rather than
+	// allocating a string per line.
 	nonEmpty := false
-	this.lines = TxLines{Line: make([]string, 0)}
+	inTx := false // payee line scanned
+	joined := false
+	this.buf, this.end = this.buf[:0], this.end[:0]
+	start := this.line + 1
+	add := func(line []byte) {
+		this.buf = append(this.buf, line...)
+		this.end = append(this.end, len(this.buf))
+
+		if i := bytes.IndexByte(line, ';'); i != -1 {
+			line = line[:i]
+		}
+		if len(bytes.TrimSpace(line)) != 0 {
+			// non empty, non comment
+			nonEmpty = true
+		}
+		if len(line) > 0 && !isSpace(line[0]) {
+			if _, err := parseDate(string(bytes.SplitN(line, []byte(" "), 2)[0])); err == nil {
+				inTx = true
+			}
+		}
+	}
+	if this.held != nil {
+		// directive which followed the previous transaction
+		start = this.line
+		add(this.held)
+		this.held = nil
+	}
 	for this.scanner.Scan() {
-		line := this.scanner.Text()
+		line := this.scanner.Bytes()
+		this.line++
 
-		if strings.TrimSpace(line) == "" {
+		if bytes.HasPrefix(line, []byte("account ")) || bytes.HasPrefix(line, []byte("bucket ")) || bytes.HasPrefix(line, []byte("A ")) {
+			this.declare(string(line))
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
 			if nonEmpty {
 				// we've reached the end of a tx
 				break
 			}
 		}
 
-		this.lines.Line = append(this.lines.Line, line)
-
-		split := strings.Split(line, ";")
-		if strings.TrimSpace(split[0]) != "" {
-			// non empty, non comment
-			nonEmpty = true
+		if inTx && isDirective(line) {
+			// A directive block follows the transaction, without a
+			// blank line.  Its indented lines are not splits, so it
+			// begins the next block.
+			this.held = append([]byte(nil), line...)
+			joined = true
+			break
 		}
 
+		add(line)
+	}
+	text := string(this.buf)
+	this.lines = TxLines{Line: make([]string, len(this.end)), Start: start, joined: joined}
+	begin := 0
+	for i, end := range this.end {
+		this.lines.Line[i] = text[begin:end]
+		begin = end
+	}
+	if this.unlot {
+		this.lines.Line, this.lines.Generated = unlotLines(this.lines.Line)
+	}
+	if this.bucket != "" {
+		this.lines.Line = bucketPosting(this.lines, this.bucket)
 	}
 	return this.lines.Len() > 0
 }
 
+// blockDirectives may be followed by indented lines (i.e. "account
+// Assets:Crypto" followed by "    note ..."), which are not splits.
+var blockDirectives = []string{"account", "commodity", "payee", "tag"}
+
+// isDirective returns true if line begins a directive block.
+func isDirective(line []byte) bool {
+	for _, d := range blockDirectives {
+		if bytes.HasPrefix(line, []byte(d)) && (len(line) == len(d) || isSpace(line[len(d)])) {
+			return true
+		}
+	}
+	return false
+}
+
+// directives returns true for each line of a block which is part of
+// a directive block (i.e. "commodity USD" and its indented lines).
+func (this *TxLines) directives() []bool {
+	ret := make([]bool, len(this.Line))
+	in := false
+	for i, line := range this.Line {
+		if line != "" && !isSpace(line[0]) {
+			in = isDirective([]byte(line))
+		}
+		ret[i] = in
+	}
+	return ret
+}
+
+// declare records an account declared, if line is an account
+// directive, or the default account, if a bucket directive.
+func (this *TxScanner) declare(line string) {
+	// https://www.ledger-cli.org/3.0/doc/ledger3.html#Command-Directives
+	for _, directive := range []string{"account ", "bucket ", "A "} {
+		if !strings.HasPrefix(line, directive) {
+			continue
+		}
+		name := strings.TrimSpace(strings.SplitN(line[len(directive):], ";", 2)[0])
+		if directive == "account " {
+			this.account[name] = true
+		} else {
+			this.bucket = name
+		}
+	}
+}
+
+// bucketPosting returns the lines of a transaction, with a posting to
+// the bucket account added, if the transaction has only one posting
+// (as ledger-cli balances it).  The posting has no amount, so it
+// balances whatever the other posting holds.
+func bucketPosting(tx TxLines, bucket string) []string {
+	_, payeeIndex := tx.Payee()
+	if payeeIndex == PayeeNotFound {
+		return tx.Line
+	}
+	posting, last := 0, payeeIndex
+	for i, line := range tx.Line[payeeIndex+1:] {
+		if strings.TrimSpace(strings.SplitN(line, ";", 2)[0]) != "" {
+			posting++
+			last = payeeIndex + 1 + i
+		}
+	}
+	if posting != 1 {
+		return tx.Line
+	}
+	if split, ok := splitStructure(tx.Line[last]); !ok || split.delta == nil {
+		return tx.Line // no amount to balance
+	}
+	line := append([]string(nil), tx.Line[:last+1]...)
+	line = append(line, "    "+bucket)
+	return append(line, tx.Line[last+1:]...)
+}
+
+// scanSource takes the next transaction from source, as Scan would
+// parse it.
+func (this *TxScanner) scanSource() bool {
+	tx, ok := this.source()
+	if !ok {
+		return false
+	}
+	for _, line := range tx.Line {
+		this.declare(line)
+	}
+	if this.unlot {
+		tx.Line, tx.Generated = unlotLines(tx.Line)
+		tx.payee = nil // lines have changed
+	}
+	this.lines = tx
+	return true
+}
+
 func (this *TxScanner) Lines() TxLines { return this.lines }
 
-func (this *TxScanner) Err() error { return this.scanner.Err() }
+func (this *TxScanner) Err() error {
+	for _, s := range this.merged {
+		if err := s.Err(); err != nil {
+			return err
+		}
+	}
+	if this.scanner == nil {
+		return nil // source, see Pipeline
+	}
+	return this.scanner.Err()
+}
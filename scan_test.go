@@ -0,0 +1,223 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FuzzTxScanner parses arbitrary input into transactions and splits.
+// Malformed input is an error of the split or the scanner, never a
+// panic.  Run with `go test -fuzz FuzzTxScanner`.
+func FuzzTxScanner(f *testing.F) {
+	for _, name := range testdataLedgers(f) {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("2021/01/01 bad cost\n    Assets:Crypto  1 ABC @@ \n    Assets:Cash\n"))
+	f.Add([]byte("2021/01/01 bad price\n    Assets:Crypto  1 ABC @ 1/0 USD\n    Assets:Cash\n"))
+	f.Add([]byte("2021/13/45 bad date\n    Assets:Crypto  1 ABC\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		settings := newSettings()
+		scanner := NewTxScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			tx := scanner.Lines()
+			_, payeeIndex := tx.Payee()
+			if payeeIndex == PayeeNotFound {
+				continue
+			}
+			tx.Time()
+			tx.Cleared()
+			for _, line := range tx.Line[payeeIndex+1:] {
+				split, ok, err := settings.parseSplitError(line)
+				if err != nil || !ok || split.delta == nil {
+					continue
+				}
+				split.Inventory()
+				split.Tally()
+			}
+		}
+		scanner.Err()
+	})
+}
+
+// TestBucket adds a posting to the bucket account to transactions of
+// one posting with an amount, after the bucket directive.
+func TestBucket(t *testing.T) {
+	journal := `2021/01/01 Before bucket
+    Assets:Crypto    1 ABC @ 2 USD
+
+bucket Assets:Bank ; default
+
+2021/01/02 One posting
+    Assets:Crypto    1 ABC @ 2 USD
+    ; memo
+
+2021/01/03 Two postings
+    Assets:Crypto    -1 ABC @ 3 USD
+    Income:Misc
+
+2021/01/04 No amount
+    Assets:Crypto
+
+A Assets:Savings
+
+2021/01/05 Another bucket
+    Assets:Crypto    -1 ABC @ 3 USD
+`
+	expect := map[string][]string{
+		"2021/01/01 Before bucket":  {"Assets:Crypto 1 ABC @ 2 USD"},
+		"2021/01/02 One posting":    {"Assets:Crypto 1 ABC @ 2 USD", "Assets:Bank", "; memo"},
+		"2021/01/03 Two postings":   {"Assets:Crypto -1 ABC @ 3 USD", "Income:Misc"},
+		"2021/01/04 No amount":      {"Assets:Crypto"},
+		"2021/01/05 Another bucket": {"Assets:Crypto -1 ABC @ 3 USD", "Assets:Savings"},
+	}
+	scanner := NewTxScanner(strings.NewReader(journal))
+	for scanner.Scan() {
+		tx := scanner.Lines()
+		payee, payeeIndex := tx.Payee()
+		if payeeIndex == PayeeNotFound {
+			continue
+		}
+		var got []string
+		for _, line := range tx.Line[payeeIndex+1:] {
+			if line = strings.Join(strings.Fields(line), " "); line != "" {
+				got = append(got, line)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(expect[payee], "\n") {
+			t.Errorf("%s:\n%s\nexpected:\n%s", payee, strings.Join(got, "\n"), strings.Join(expect[payee], "\n"))
+		}
+		delete(expect, payee)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(expect) > 0 {
+		t.Errorf("not scanned: %v", expect)
+	}
+}
+
+// TestDirectiveBlocks ends a transaction at a directive which follows
+// it without a blank line, so the directive's indented lines are not
+// taken as splits.  Such a transaction is marked joined, so no blank
+// line is written after it.
+func TestDirectiveBlocks(t *testing.T) {
+	journal := `2016/01/01 Bought ABC
+    Assets:Crypto    100 ABC @ 0.02 USD
+    Equity:Cash
+account Assets:Exchange
+    note  trading   10 ABC
+2017/01/01 Sell
+    Assets:Crypto    -1 ABC @ 1 USD
+    Assets:Exchange
+commodity ABC
+    note  5 ABC
+`
+	expect := []struct {
+		start int
+		line  []string
+	}{
+		{1, []string{"2016/01/01 Bought ABC", "Assets:Crypto 100 ABC @ 0.02 USD", "Equity:Cash"}},
+		{4, []string{"account Assets:Exchange", "note trading 10 ABC", "2017/01/01 Sell", "Assets:Crypto -1 ABC @ 1 USD", "Assets:Exchange"}},
+		{9, []string{"commodity ABC", "note 5 ABC"}},
+	}
+	scanner := NewTxScanner(strings.NewReader(journal))
+	i := 0
+	for scanner.Scan() {
+		tx := scanner.Lines()
+		var got []string
+		for _, line := range tx.Line {
+			if line = strings.Join(strings.Fields(line), " "); line != "" {
+				got = append(got, line)
+			}
+		}
+		if len(got) == 0 {
+			continue
+		}
+		if i >= len(expect) {
+			t.Fatalf("unexpected block: %q", got)
+		}
+		if tx.Start != expect[i].start || strings.Join(got, "\n") != strings.Join(expect[i].line, "\n") {
+			t.Errorf("block %d at line %d:\n%s\nexpected at line %d:\n%s", i, tx.Start, strings.Join(got, "\n"), expect[i].start, strings.Join(expect[i].line, "\n"))
+		}
+		if joined := i < len(expect)-1; tx.joined != joined {
+			t.Errorf("block %d joined %t, expected %t", i, tx.joined, joined)
+		}
+		i++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(expect) {
+		t.Errorf("scanned %d blocks, expected %d", i, len(expect))
+	}
+
+	// The directive's lines pass through lot unchanged, and are not
+	// followed or preceded by an added blank line.
+	lotted := string(lotJournal(t, journal))
+	for _, directive := range []string{
+		"    Equity:Cash\n",
+		"account Assets:Exchange\n    note  trading   10 ABC\n2017/01/01 Sell\n",
+		"commodity ABC\n    note  5 ABC\n",
+	} {
+		if !strings.Contains(lotted, directive) {
+			t.Errorf("expected %q in:\n%s", directive, lotted)
+		}
+	}
+	if strings.Contains(lotted, "10 ABC  ;") || strings.Contains(lotted, "5 ABC  ;") {
+		t.Errorf("directive lotted as a split:\n%s", lotted)
+	}
+}
+
+// BenchmarkTxScanner scans generated journals, and parses each split.
+func BenchmarkTxScanner(b *testing.B) {
+	for _, count := range benchmarkCounts {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			journal := genJournal(b, count)
+			settings := newSettings()
+			b.SetBytes(int64(len(journal)))
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				scanner := NewTxScanner(bytes.NewReader(journal))
+				for scanner.Scan() {
+					tx := scanner.Lines()
+					_, payeeIndex := tx.Payee()
+					if payeeIndex == PayeeNotFound {
+						continue
+					}
+					for _, line := range tx.Line[payeeIndex+1:] {
+						settings.parseSplit(line)
+					}
+				}
+				if err := scanner.Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportRate(b, count, time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// yearSummary is what lot generated in one year, and the lots open at
+// the end of it.
+type yearSummary struct {
+	shortGain, longGain, income *big.Rat
+
+	lots      int // open at end of year
+	inventory map[Asset]*big.Rat
+	basis     *big.Rat
+}
+
+// lotSummary tallies, per year, the splits generated by lot (see lot
+// -summary).
+type lotSummary struct {
+	year      map[int]*yearSummary
+	current   int  // year of latest transaction
+	termSplit bool // if false, all gains are short term (see lot -term-split)
+
+	lotter *lotter // whose lots are counted, and words translated
+}
+
+func newLotSummary(lotter *lotter) *lotSummary {
+	return &lotSummary{year: make(map[int]*yearSummary), termSplit: true, lotter: lotter}
+}
+
+func (this *lotSummary) get(year int) *yearSummary {
+	y := this.year[year]
+	if y == nil {
+		y = &yearSummary{
+			shortGain: new(big.Rat), longGain: new(big.Rat), income: new(big.Rat),
+			inventory: make(map[Asset]*big.Rat),
+			basis:     new(big.Rat),
+		}
+		this.year[year] = y
+	}
+	return y
+}
+
+// observe is called before each transaction is lotted.  When the year
+// changes, lots open (at the end of the year before) are counted.
+func (this *lotSummary) observe(year int) {
+	if this.current != 0 && year > this.current {
+		this.openLots()
+	}
+	if year > this.current {
+		this.current = year
+	}
+	this.get(year)
+}
+
+// openLots counts lots open now, as of the end of the current year.
+func (this *lotSummary) openLots() {
+	y := this.get(this.current)
+	y.lots = 0
+	y.inventory = make(map[Asset]*big.Rat)
+	y.basis = new(big.Rat)
+	for asset, queues := range this.lotter.lotQueue {
+		for _, queue := range queues {
+			for _, l := range queue.lot {
+				if y.inventory[asset] == nil {
+					y.inventory[asset] = new(big.Rat)
+				}
+				y.lots++
+				y.inventory[asset].Add(y.inventory[asset], l.inventory.Rat)
+				y.basis.Add(y.basis, new(big.Rat).Mul(l.price, l.inventory.Rat))
+			}
+		}
+	}
+}
+
+// add tallies gain and income splits generated for a transaction.
+func (this *lotSummary) add(year int, generated []Posting) {
+	y := this.get(year)
+	for _, p := range generated {
+		if p.Account == "" || p.Err != nil || p.Disabled || !this.lotter.isBase(p.Amount.Asset) {
+			continue
+		}
+		value := new(big.Rat).Neg(p.Amount.Rat) // income splits are credits
+		switch {
+		case strings.Contains(p.Comment, ":GAIN:LONGTERM:"):
+			y.longGain.Add(y.longGain, value)
+		case strings.Contains(p.Comment, ":GAIN:"): // including margin
+			y.shortGain.Add(y.shortGain, value)
+		case strings.Contains(p.Comment, ":INCOME:"), strings.Contains(p.Comment, ":REBATE:"):
+			y.income.Add(y.income, value)
+		}
+	}
+}
+
+// Lines returns the summary as ledger comments, one block per year.
+func (this *lotSummary) Lines() []string {
+	if this.current != 0 {
+		this.openLots()
+	}
+
+	var year []int
+	for y := range this.year {
+		year = append(year, y)
+	}
+	sort.Ints(year)
+
+	amount := func(r *big.Rat) Amount { return this.lotter.NewAmount(this.lotter.base, *r) }
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	for _, y := range year {
+		s := this.year[y]
+		var held []string
+		for _, asset := range sortedAssetKeys(s.inventory) {
+			held = append(held, this.lotter.NewAmount(asset, *s.inventory[asset]).String())
+		}
+		if this.termSplit {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", y, this.lotter.translation.text("short term gain"), amount(s.shortGain))
+			fmt.Fprintf(w, "\t%s\t%s\n", this.lotter.translation.text("long term gain"), amount(s.longGain))
+		} else {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", y, this.lotter.translation.text("gain"), amount(s.shortGain))
+		}
+		fmt.Fprintf(w, "\t%s\t%s\n", this.lotter.translation.text("income"), amount(s.income))
+		fmt.Fprintf(w, "\t%s\t%d\t%s\n", this.lotter.translation.text("open lots"), s.lots, strings.Join(held, ", "))
+		fmt.Fprintf(w, "\t%s\t%s\n", this.lotter.translation.text("basis of open lots"), amount(s.basis))
+	}
+	w.Flush()
+
+	lines := []string{"; " + this.lotter.translation.text("summary generated by lotter, per year (lots open at end of year)")}
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		lines = append(lines, strings.TrimRight("; "+line, " "))
+	}
+
+	// adjustments of basis which failed (see lot -basis-adjust)
+	for _, adj := range this.lotter.adjustFailed {
+		lines = append(lines, fmt.Sprintf("; %s: row %d, %s %s acquired %s", this.lotter.translation.text("basis adjustment not applied"), adj.row, amount(adj.amount), adj.asset, adj.acquired.Format("2006/01/02")))
+	}
+	return lines
+}
+
+func sortedAssetKeys(m map[Asset]*big.Rat) []Asset {
+	var asset []Asset
+	for a := range m {
+		asset = append(asset, a)
+	}
+	sort.Slice(asset, func(i, j int) bool { return asset[i] < asset[j] })
+	return asset
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// summaryJournal holds a short term gain of 50 USD (2019), nothing
+// lotted in 2020 but a buy, and a long term gain of 200 USD and income
+// of 20 USD (2021).
+const summaryJournal = `2019/01/01 Buy
+    Assets:Broker          2 ABC @ 100 USD
+    Assets:Cash
+
+2019/06/01 Sell
+    Assets:Broker          -1 ABC @ 150 USD
+    Assets:Cash
+
+2020/03/01 Buy
+    Assets:Broker          1 XYZ @ 10 USD
+    Assets:Cash
+
+2021/06/01 Sell
+    Assets:Broker          -1 ABC @ 300 USD
+    Assets:Cash
+
+2021/07/01 Staking
+    Assets:Broker          1 XYZ @ 20 USD ; :INCOME:
+    Income:Staking
+`
+
+// summaryLines returns the lines of the summary lotted, without the
+// comment leader.
+func summaryLines(t *testing.T, lotted []byte) []string {
+	t.Helper()
+	_, summary, found := strings.Cut(string(lotted), "; summary generated by lotter, per year (lots open at end of year)\n")
+	if !found {
+		t.Fatalf("no summary:\n%s", lotted)
+	}
+	return reportLines(strings.ReplaceAll(summary, ";", ""))
+}
+
+func TestSummary(t *testing.T) {
+	for _, test := range []struct {
+		arg    []string
+		expect []string
+	}{
+		{
+			arg: []string{"-summary"},
+			expect: []string{
+				"2019 short term gain 50 USD",
+				"long term gain 0 USD",
+				"income 0 USD",
+				"open lots 1 1 ABC",
+				"basis of open lots 100 USD",
+				"2020 short term gain 0 USD", // lots still open at end of a year without sales
+				"long term gain 0 USD",
+				"income 0 USD",
+				"open lots 2 1 ABC, 1 XYZ",
+				"basis of open lots 110 USD",
+				"2021 short term gain 0 USD",
+				"long term gain 200 USD",
+				"income 20 USD",
+				"open lots 2 2 XYZ",
+				"basis of open lots 30 USD",
+			},
+		},
+		{
+			arg: []string{"-summary", "-term-split=false"},
+			expect: []string{
+				"2019 gain 50 USD",
+				"income 0 USD",
+				"open lots 1 1 ABC",
+				"basis of open lots 100 USD",
+				"2020 gain 0 USD",
+				"income 0 USD",
+				"open lots 2 1 ABC, 1 XYZ",
+				"basis of open lots 110 USD",
+				"2021 gain 200 USD",
+				"income 20 USD",
+				"open lots 2 2 XYZ",
+				"basis of open lots 30 USD",
+			},
+		},
+	} {
+		got := summaryLines(t, lotJournal(t, summaryJournal, test.arg...))
+		if strings.Join(got, "\n") != strings.Join(test.expect, "\n") {
+			t.Errorf("lot %v summarized:\n%s\nexpected:\n%s", test.arg, strings.Join(got, "\n"), strings.Join(test.expect, "\n"))
+		}
+	}
+
+	if strings.Contains(string(lotJournal(t, summaryJournal)), "; summary generated by lotter") {
+		t.Error("summary without -summary")
+	}
+}
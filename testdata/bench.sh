@@ -0,0 +1,66 @@
+#!/usr/bin/env bash
+#
+# Benchmark lotter on synthetic input, streamed from a pipe, against
+# the performance target (see README.md).
+#
+# Usage:
+#
+#     testdata/bench.sh [<transactions>] [<open lots>]
+#
+# Generates a buy for each transaction, and sells so that no more than
+# <open lots> remain open.  With defaults, input is roughly 70MB.
+# Exits non-zero if throughput is below MIN_RATE (transactions per
+# second, default 5000) or, when /usr/bin/time is installed, maximum
+# resident set size is above MAX_RSS (MB, default 600).  Memory grows
+# with lots created, as lot names are kept so that each is unique, so
+# compare with the target at the default size.  The Go benchmarks (`go
+# test -bench .`) compare speed of parts, before and after a change.
+# Dates of generated transactions run far past today, so lot is run
+# with -ignore-after=none.
+
+set -e
+
+count=${1:-1000000}
+open=${2:-1000}
+lotter=${LOTTER:-lotter}
+min_rate=${MIN_RATE:-5000}
+max_rss=${MAX_RSS:-600}
+
+generate() {
+awk -v count="$count" -v open="$open" 'BEGIN {
+	for (i = 0; i < count; i++) {
+		d = i % 28 + 1; m = int(i / 28) % 12 + 1; y = 2000 + int(i / 336)
+		date = sprintf("%04d/%02d/%02d", y, m, d)
+		if (i >= open && i % 2 == 1) {
+			printf "%s sell\n    Assets:Crypto    -1 ABC @ %d.%02d USD\n    Assets:Cash\n\n", date, i % 7 + 1, i % 100
+		} else {
+			printf "%s buy\n    Assets:Crypto    1 ABC @ %d.%02d USD\n    Assets:Cash\n\n", date, i % 5 + 1, i % 100
+		}
+	}
+}'
+}
+
+start=$(date +%s.%N)
+if [ -x /usr/bin/time ]; then
+	rss=$(generate | /usr/bin/time -f "%M" "$lotter" -base USD -f - lot -ignore-after=none 2>&1 >/dev/null | tail -n 1)
+	rss=$((rss / 1024))
+else
+	generate | "$lotter" -base USD -f - lot -ignore-after=none >/dev/null
+fi
+end=$(date +%s.%N)
+
+rate=$(awk -v count="$count" -v start="$start" -v end="$end" 'BEGIN { printf "%d", count / (end - start) }')
+status=0
+echo "throughput: $rate tx/s (target at least $min_rate)"
+if [ "$rate" -lt "$min_rate" ]; then
+	status=1
+fi
+if [ -n "$rss" ]; then
+	echo "memory: $rss MB maximum resident (target at most $max_rss)"
+	if [ "$rss" -gt "$max_rss" ]; then
+		status=1
+	fi
+else
+	echo "memory: not measured, /usr/bin/time is not installed"
+fi
+exit $status
@@ -0,0 +1,137 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// translation of words generated by lot, read from the file named by
+// `lot -translate`.  A nil translation translates nothing.
+type translation struct {
+	word       map[string]string
+	translator *strings.Replacer
+}
+
+// i.e. ":GAIN:SHORTTERM:", which lotter reads back, so not translated
+var tagPattern = regexp.MustCompile(`:[A-Z]+(:[A-Z]+)*:`)
+
+// readTranslation reads translations, one per line, of English text
+// and its translation, separated by two or more spaces (or tab).  For
+// example,
+//
+//     short term gain      kurzfristiger Gewinn
+//     long term gain       langfristiger Gewinn
+//     Income               Ertrag
+//     inventory consumed   Bestand verbraucht
+//
+// Blank lines and comments (beginning with ";" or "#") are ignored.
+func readTranslation(in io.Reader) (*translation, error) {
+	this := &translation{word: make(map[string]string)}
+	s := bufio.NewScanner(in)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := accountSeparator.Split(text, 2)
+		if len(field) != 2 || strings.TrimSpace(field[1]) == "" {
+			return nil, lineErrorf(line, "expected text and translation (%q)", text)
+		}
+		from, to := strings.TrimSpace(field[0]), strings.TrimSpace(field[1])
+		if tagPattern.MatchString(from) || strings.ContainsAny(from+to, ";[]()") {
+			return nil, lineErrorf(line, "bad translation (%q), tags and punctuation of splits are not translated", text)
+		}
+		if _, ok := this.word[from]; ok {
+			return nil, lineErrorf(line, "duplicate translation of %q", from)
+		}
+		this.word[from] = to
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read translation: %w", err)
+	}
+
+	// longest text first, so that i.e. "inventory consumed" is
+	// translated rather than "inventory"
+	var from []string
+	for f := range this.word {
+		from = append(from, f)
+	}
+	sort.Slice(from, func(i, j int) bool {
+		if len(from[i]) != len(from[j]) {
+			return len(from[i]) > len(from[j])
+		}
+		return from[i] < from[j]
+	})
+	var pair []string
+	for _, f := range from {
+		pair = append(pair, f, this.word[f])
+	}
+	this.translator = strings.NewReplacer(pair...)
+	return this, nil
+}
+
+// account translates each part of an account name which is
+// translated entirely (i.e. "Lot:Income:short term gain" becomes
+// "Lot:Ertrag:kurzfristiger Gewinn").  The prefix "Lot", which lotter
+// reads back, is not translated.
+func (this *translation) account(account string) string {
+	if this == nil {
+		return account
+	}
+	part := strings.Split(account, ":")
+	for i := range part {
+		if i == 0 && part[i] == "Lot" {
+			continue
+		}
+		if to, ok := this.word[part[i]]; ok {
+			part[i] = to
+		}
+	}
+	return strings.Join(part, ":")
+}
+
+// text translates text, except tags.
+func (this *translation) text(text string) string {
+	if this == nil {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, tag := range tagPattern.FindAllStringIndex(text, -1) {
+		b.WriteString(this.translator.Replace(text[last:tag[0]]))
+		b.WriteString(text[tag[0]:tag[1]])
+		last = tag[1]
+	}
+	b.WriteString(this.translator.Replace(text[last:]))
+	return b.String()
+}
+
+// postings translates the account and comment of generated splits.
+func (this *translation) postings(generated []Posting) {
+	for i := range generated {
+		if generated[i].Err != nil {
+			continue
+		}
+		generated[i].Account = this.account(generated[i].Account)
+		generated[i].Comment = this.text(generated[i].Comment)
+	}
+}
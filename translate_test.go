@@ -0,0 +1,70 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranslation(t *testing.T) {
+	tr, err := readTranslation(strings.NewReader(`; German
+short term gain      kurzfristiger Gewinn
+Income               Ertrag
+inventory            Bestand
+inventory consumed	Bestand verbraucht
+Lot                  Posten
+SELL                 VERKAUF
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for account, expect := range map[string]string{
+		"Lot:Income:short term gain":        "Lot:Ertrag:kurzfristiger Gewinn", // but for the prefix lotter reads
+		"Lot:Income:short term gain:Crypto": "Lot:Ertrag:kurzfristiger Gewinn:Crypto",
+		"Lot:Income:Staking Income":         "Lot:Ertrag:Staking Income", // parts translated entirely
+		"Assets:Lot":                        "Assets:Posten",
+	} {
+		if got := tr.account(account); got != expect {
+			t.Errorf("account %q translated %q, expected %q", account, got, expect)
+		}
+	}
+	for text, expect := range map[string]string{
+		":SELL: (inventory consumed)": ":SELL: (Bestand verbraucht)", // longest first, tags not translated
+		":BUY: (inventory)":           ":BUY: (Bestand)",
+	} {
+		if got := tr.text(text); got != expect {
+			t.Errorf("text %q translated %q, expected %q", text, got, expect)
+		}
+	}
+
+	var none *translation
+	if got := none.text("short term gain") + none.account("Lot:Income"); got != "short term gainLot:Income" {
+		t.Errorf("nil translation translated %q", got)
+	}
+
+	for file, expect := range map[string]string{
+		"gain  Gewinn\ngain  Ertrag\n": `line 2: duplicate translation of "gain"`,
+		":GAIN:  :GEWINN:\n":           `line 1: bad translation (":GAIN:  :GEWINN:")`,
+		"(basis)  (Basis)\n":           `line 1: bad translation ("(basis)  (Basis)")`,
+		"gain\n":                       `line 1: expected text and translation ("gain")`,
+	} {
+		_, err := readTranslation(strings.NewReader(file))
+		if err == nil || !strings.HasPrefix(err.Error(), expect) {
+			t.Errorf("error of %q is %v, expected %s", file, err, expect)
+		}
+	}
+}
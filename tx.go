@@ -16,9 +16,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"regexp"
 	"strings"
+	"unicode"
 )
 
 type Split struct {
@@ -31,6 +33,10 @@ type Split struct {
 	// if true, the delta has been calculated
 	nullAmount bool
 
+	// if true, price or cost of an acquisition is negative (i.e. an
+	// exchange rebate, where the buyer is paid to acquire)
+	rebate bool
+
 	comment string // needed???
 }
 
@@ -38,57 +44,183 @@ type Split struct {
 // and amount.  Typically two (or more) spaces, or a single tab.
 var accountSeparator = regexp.MustCompile(`\s{2,}|\t+`)
 
-func parseSplit(line string) (Split, bool) {
+// checkAccountFlag returns an error if account, the value of flag
+// -name, is not usable as the account of a split.
+func checkAccountFlag(name, account string) error {
+	if strings.TrimSpace(account) == "" || accountSeparator.MatchString(account) || strings.ContainsAny(account, ";()[]") {
+		return fmt.Errorf("bad -%s (%q), expected an account name", name, account)
+	}
+	return nil
+}
+
+// separatorIndex returns the start and end of the first match of
+// accountSeparator in str, or -1, -1 if there is none.  It is
+// equivalent to the regexp, but avoids its cost when parsing every
+// split of large journals.
+func separatorIndex(str string) (int, int) {
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\t' || (isSpace(str[i]) && i+1 < len(str) && isSpace(str[i+1])) {
+			j := i + 1
+			for j < len(str) && isSpace(str[j]) {
+				j++
+			}
+			return i, j
+		}
+	}
+	return -1, -1
+}
+
+// isSpace matches the characters of `\s` in a regexp.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// parseSplit returns false if line is not a split (i.e. a comment), or
+// if the split is malformed (see splitError()).
+func (this *settings) parseSplit(line string) (Split, bool) {
+	split, ok, err := this.parseSplitError(line)
+	return split, ok && err == nil
+}
+
+// splitStructure parses a split without settings, when only its
+// structure matters (i.e. whether it has an amount).  Decimal places
+// of its amounts are not observed.
+func splitStructure(line string) (Split, bool) {
+	return (*settings)(nil).parseSplit(line)
+}
+
+// splitError returns an error if line is a malformed split, otherwise
+// nil (including when line is not a split).
+func (this *settings) splitError(line string) error {
+	_, _, err := this.parseSplitError(line)
+	return err
+}
+
+func (this *settings) parseSplitError(line string) (Split, bool, error) {
 	// bad variable names ahead... "...Split" refers to result of
 	// strings.Split() as opposed to ledger-cli "splits"
 
-	this := Split{line: line}
+	split := Split{line: line}
 
 	commentSplit := strings.SplitN(line, ";", 2)
 	if len(commentSplit) > 1 {
-		this.comment = commentSplit[1]
+		split.comment = commentSplit[1]
 	}
 
 	trimmed := strings.TrimSpace(commentSplit[0])
 	if trimmed == commentSplit[0] || trimmed == "" {
 		// doesn't start with a space, or is only a comment
-		return this, false
+		return split, false, nil
 	}
 
-	accountSplit := accountSeparator.Split(trimmed, 2)
-	this.account = strings.TrimSpace(accountSplit[0])
-
-	if len(accountSplit) > 1 {
-		priceSplit := strings.SplitN(accountSplit[1], "@@", 2) // actually cost, not price
+	if i, j := separatorIndex(trimmed); i == -1 {
+		split.account = trimmed
+		split.nullAmount = true
+	} else {
+		split.account = trimmed[:i]
+		rest := trimmed[j:]
+		priceSplit := strings.SplitN(rest, "@@", 2) // actually cost, not price
 		if len(priceSplit) == 2 {
-			tmp, err := parseAmount(priceSplit[1])
+			tmp, err := this.parseAmount(priceSplit[1])
 			if err != nil {
-				log.Panic(err)
+				return split, true, fmt.Errorf("bad cost of split (%q): %w", line, err)
 			}
-			this.cost = &tmp
+			split.cost = &tmp
+			split.rebate = tmp.Sign() < 0
 		} else {
-			priceSplit = strings.SplitN(accountSplit[1], "@", 2)
+			priceSplit = strings.SplitN(rest, "@", 2)
 			if len(priceSplit) == 2 {
-				tmp, err := parseAmount(priceSplit[1])
+				tmp, err := this.parseAmount(priceSplit[1])
 				if err != nil {
-					log.Panic(err)
+					return split, true, fmt.Errorf("bad price of split (%q): %w", line, err)
 				}
-				this.price = &tmp
+				split.price = &tmp
+				split.rebate = tmp.Sign() < 0
 			}
 		}
 
-		tmp, err := parseAmount(priceSplit[0])
+		tmp, err := this.parseAmount(priceSplit[0])
 		if err != nil {
-			log.Panic(err)
+			return split, true, fmt.Errorf("bad amount of split (%q): %w", line, err)
+		}
+		split.delta = &tmp
+		if (split.cost != nil || split.price != nil) && split.delta.Sign() == 0 {
+			// neither a purchase nor a sale, and price would be cost divided by zero
+			return split, true, fmt.Errorf("bad amount of split (%q), zero with price or cost", line)
+		}
+		if split.delta.Sign() < 0 {
+			// Price or cost of a disposal is its magnitude, whichever
+			// sign is written (i.e. "-1 BTC @@ -40000 USD").  Only an
+			// acquisition is a rebate.
+			for _, p := range []*Amount{split.price, split.cost} {
+				if p != nil && p.Sign() < 0 {
+					p.Neg(p.Rat)
+				}
+			}
+			split.rebate = false
+		}
+	}
+
+	return split, true, nil
+}
+
+// amountIndex returns the start and end of the amount in a split line,
+// i.e. "-10 ETH" in "    Assets:Crypto  -10 ETH ; memo".  Returns
+// false if the split has no amount.
+func amountIndex(line string) (int, int, bool) {
+	end := len(line)
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		end = i
+	}
+	indent := len(line[:end]) - len(strings.TrimLeft(line[:end], " \t"))
+	_, sep := separatorIndex(line[indent:end])
+	if sep == -1 {
+		return 0, 0, false
+	}
+	start := indent + sep
+	end = start + len(strings.TrimRightFunc(line[start:end], unicode.IsSpace))
+	return start, end, start < end
+}
+
+// isLoan returns true if the split is tagged as borrowing or repaying
+// a loan.
+func (this *Split) isLoan() bool {
+	return strings.Contains(this.comment, ":BORROW:") || strings.Contains(this.comment, ":REPAY:")
+}
+
+// optionEvent returns "EXPIRE", "EXERCISE" or "ASSIGN", when the split
+// is tagged as such an event of an option contract.  Otherwise "".
+func (this *Split) optionEvent() string {
+	for _, event := range []string{"EXPIRE", "EXERCISE", "ASSIGN"} {
+		if strings.Contains(this.comment, ":"+event+":") {
+			return event
 		}
-		this.delta = &tmp
-	} else {
-		this.nullAmount = true
 	}
+	return ""
+}
+
+// metadata keys which trace generated splits back to source data
+var traceKeys = []string{"txid", "ref"}
 
-	return this, true
+// trace returns the split's own txid or ref metadata, i.e. "ref:
+// order-9" of "-1 BTC @ 300 USD ; ref: order-9".  Returns "" if none.
+func (this *Split) trace() string {
+	var found []string
+	for _, key := range traceKeys {
+		for _, m := range metadataPattern.FindAllStringSubmatch(this.comment, -1) {
+			if strings.EqualFold(m[1], key) {
+				found = append(found, fmt.Sprintf("%s: %s", key, m[2]))
+				break
+			}
+		}
+	}
+	return strings.Join(found, " ")
 }
 
+// Price returns the unit price of the split, calculated from cost
+// when "@@" was written.  Callers check that the split has a price or
+// cost (i.e. "price != nil || cost != nil") before calling, so a panic
+// here is a mistake of lotter, not of the data.
 func (this *Split) Price() *Amount {
 	if this.price == nil {
 		if this.cost == nil {
@@ -102,6 +234,8 @@ func (this *Split) Price() *Amount {
 	return this.price
 }
 
+// Cost returns the total cost of the split, calculated from price
+// when "@" was written.  Like Price, it requires a price or cost.
 func (this *Split) Cost() *Amount {
 	if this.cost == nil {
 		if this.price == nil {
@@ -116,11 +250,12 @@ func (this *Split) Cost() *Amount {
 
 // Tally returns the balance change implied by a split.  If the split
 // has a cost/price, the amount returned is the cost.  Otherwise the
-// amount returned is the delta.
+// amount returned is the delta.  The cost has the sign of the delta,
+// unless the split is a rebate.
 func (this *Split) Tally() *Amount {
 	if this.cost != nil || this.price != nil {
 		cost := this.Cost()
-		if cost.Sign() != this.delta.Sign() {
+		if (cost.Sign() != this.delta.Sign()) != this.rebate {
 			tmp := cost.NegClone()
 			cost = &tmp
 		}
@@ -0,0 +1,68 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSplitSigns takes the price or cost of a disposal as positive,
+// and only an acquisition at negative price as a rebate.
+func TestSplitSigns(t *testing.T) {
+	settings := newSettings()
+	for _, test := range []struct {
+		line           string
+		written, tally string // price or cost written, and tally
+		rebate         bool
+	}{
+		{"    Assets:Crypto  -2 BTC @@ 40000 USD", "40000 USD", "-40000 USD", false},
+		{"    Assets:Crypto  -2 BTC @@ -40000 USD", "40000 USD", "-40000 USD", false},
+		{"    Assets:Crypto  -2 BTC @ -20000 USD", "20000 USD", "-40000 USD", false},
+		{"    Assets:Crypto  10 ABC @ 0.1 USD", "0.1 USD", "1 USD", false},
+		{"    Assets:Crypto  10 ABC @ -0.1 USD", "-0.1 USD", "-1 USD", true}, // paid to acquire
+		{"    Assets:Crypto  10 ABC @@ -1 USD", "-1 USD", "-1 USD", true},
+	} {
+		split, ok, err := settings.parseSplitError(test.line)
+		if !ok || err != nil {
+			t.Errorf("failed to parse %q: %v", test.line, err)
+			continue
+		}
+		written := split.price
+		if split.cost != nil {
+			written = split.cost
+		}
+		tally := split.Tally().String()
+		if written.String() != test.written || tally != test.tally || split.rebate != test.rebate {
+			t.Errorf("%q written %s, tallied %s (rebate %t), expected %s, %s (rebate %t)", test.line, written, tally, split.rebate, test.written, test.tally, test.rebate)
+		}
+	}
+
+	// a sale lots the same, whichever sign its cost is written with
+	journal := `2021/01/01 Buy
+    Assets:Crypto          2 BTC @ 10000 USD
+    Assets:Bank
+
+2021/02/01 Sell
+    Assets:Crypto         -2 BTC @@ 40000 USD
+    Assets:Bank
+`
+	expect := generatedLines(string(lotJournal(t, journal)))
+	got := generatedLines(string(lotJournal(t, strings.Replace(journal, "@@ 40000", "@@ -40000", 1))))
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("sale at negative cost lotted:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+}
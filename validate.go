@@ -0,0 +1,131 @@
+// Copyright (C) 2019-2020  David N. Cohen
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var validateMethod = [...]string{
+	"none",
+	"syntax",
+	"ledger",
+}
+
+// generated splits, i.e. "    [Lot::2016/01/01:100ABC@0.02USD]  -100 ABC  ; :BUY:"
+var generatedPattern = regexp.MustCompile(`^    ;?\[([^\]]*)\]\s+([^;]*?)\s*(;.*)?$`)
+
+// syntaxValidator checks the splits generated by lotter, in ledger-cli
+// data, as it is written.  Only the line being written is held, so
+// that output streams (see TxScanner) with -validate=syntax as without.
+type syntaxValidator struct {
+	line    int    // count of lines checked
+	partial []byte // of a line not yet ended
+	errs    []error
+}
+
+func (this *syntaxValidator) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			if len(this.partial)+len(p) <= maxLineLength {
+				this.partial = append(this.partial, p...)
+			}
+			break
+		}
+		this.partial = append(this.partial, p[:i]...)
+		this.check(string(this.partial))
+		this.partial, p = this.partial[:0], p[i+1:]
+	}
+	return n, nil
+}
+
+// Close checks the last line, if not ended, and returns an error for
+// each line ledger-cli would reject.
+func (this *syntaxValidator) Close() []error {
+	if len(this.partial) > 0 {
+		this.check(string(this.partial))
+		this.partial = nil
+	}
+	return this.errs
+}
+
+func (this *syntaxValidator) check(text string) {
+	this.line++
+	if strings.HasPrefix(text, "    FIXME") {
+		this.errs = append(this.errs, fmt.Errorf("output line %d: unresolved problem (%q)", this.line, strings.TrimSpace(text)))
+		return
+	}
+	m := generatedPattern.FindStringSubmatch(text)
+	if m == nil {
+		return // not generated by lotter
+	}
+	account, amount := m[1], m[2]
+	if account == "" || strings.Contains(account, "  ") || strings.ContainsAny(account, "\t;") {
+		this.errs = append(this.errs, fmt.Errorf("output line %d: bad account name (%q)", this.line, account))
+	}
+	var syntax *settings // places of output are not observed
+	if _, err := syntax.parseAmount(amount); err != nil {
+		this.errs = append(this.errs, fmt.Errorf("output line %d: %w", this.line, err))
+	}
+}
+
+// ledgerValidator keeps a copy of output in a temporary file, rather
+// than in memory, for ledger-cli to parse when output is complete.
+type ledgerValidator struct {
+	*os.File
+}
+
+func newLedgerValidator() (*ledgerValidator, error) {
+	tmp, err := ioutil.TempFile("", "lotter-*.ledger")
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerValidator{File: tmp}, nil
+}
+
+// Validate runs ledger-cli (if found) to parse the copy of output.
+// Returns an error if ledger-cli rejects it.  The copy is removed.
+func (this *ledgerValidator) Validate() error {
+	defer this.Remove()
+	err := this.File.Close()
+	if err != nil {
+		return err
+	}
+	path, err := exec.LookPath("ledger")
+	if err != nil {
+		return fmt.Errorf("cannot validate output, ledger-cli not found: %w", err)
+	}
+	out, err := exec.Command(path, "-f", this.Name(), "balance").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ledger-cli rejected output: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Remove removes the copy of output, i.e. when lotter stops before
+// output is complete.
+func (this *ledgerValidator) Remove() {
+	this.File.Close()
+	os.Remove(this.Name())
+}